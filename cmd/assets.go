@@ -0,0 +1,128 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jiuchen1986/cks/pkg/assets"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/plan"
+)
+
+var (
+	assetsCmdFlagBinDir        string
+	assetsExtractCmdFlagOutput string
+)
+
+// assetsCmd represents the assets command
+var assetsCmd = &cobra.Command{
+	Use:   "assets",
+	Short: "Manage component binaries bundled in cks.",
+}
+
+// assetsListCmd represents the assets list command
+var assetsListCmd = &cobra.Command{
+	Use:          "list",
+	Short:        "List files bundled in cks.",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bundle, err := assets.Bundle()
+		if err != nil {
+			return err
+		}
+		m, _, err := assets.ReadManifest(bundle)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("version: %s\n", m.Version)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		defer w.Flush()
+		fmt.Fprintln(w, "NAME\tSHA256")
+		for _, f := range m.Files {
+			fmt.Fprintf(w, "%s\t%s\n", f.Name, f.SHA256)
+		}
+		return nil
+	},
+}
+
+// assetsExtractCmd represents the assets extract command
+var assetsExtractCmd = &cobra.Command{
+	Use:          "extract",
+	Short:        "Extract files bundled in cks to the versioned bin directory.",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	Annotations:  map[string]string{annotationDryRun: ""},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger := lgr.GetGlobalLogger()
+		defer logger.Sync()
+
+		if err := checkOutput(assetsExtractCmdFlagOutput); err != nil {
+			return err
+		}
+		if rootCmdFlagDryRun {
+			bundle, err := assets.Bundle()
+			if err != nil {
+				return err
+			}
+			pl := plan.New("assets extract", rootCmdFlagNodeName)
+			if _, err := assets.Plan(bundle, assetsBinDir(), pl); err != nil {
+				return err
+			}
+			return printPlan(pl, assetsExtractCmdFlagOutput)
+		}
+
+		dir, err := extractAssets()
+		if err != nil {
+			return err
+		}
+		logger.Infof("assets available in %s", dir)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(assetsCmd)
+	assetsCmd.AddCommand(assetsListCmd, assetsExtractCmd)
+
+	assetsExtractCmd.Flags().StringVar(&assetsCmdFlagBinDir, "bin-dir", "",
+		"directory to extract files to (default to the bin directory in the data directory)")
+	addPlanOutputFlag(assetsExtractCmd, &assetsExtractCmdFlagOutput)
+}
+
+// extractAssets extracts the bundled files and returns the versioned bin directory
+func extractAssets() (string, error) {
+	bundle, err := assets.Bundle()
+	if err != nil {
+		return "", err
+	}
+
+	return assets.Extract(bundle, assetsBinDir())
+}
+
+// assetsBinDir returns the directory to extract the bundled files to
+func assetsBinDir() string {
+	if assetsCmdFlagBinDir != "" {
+		return assetsCmdFlagBinDir
+	}
+	return assets.Dir(clusterConfig.DataDir)
+}
@@ -0,0 +1,211 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jiuchen1986/cks/pkg/backup"
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/etcd"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/plan"
+	"github.com/jiuchen1986/cks/pkg/state"
+)
+
+var (
+	backupCmdFlagFile    string
+	backupCmdFlagOutput  string
+	restoreCmdFlagForce  bool
+	restoreCmdFlagOutput string
+)
+
+// backupCmd represents the backup command
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Save an etcd snapshot, the PKI and the cluster config into one bundle.",
+	Long: `Save an etcd snapshot, the PKI and the cluster config into one bundle.
+
+The bundle is a tarball with a manifest holding checksums of all the files,
+which is private as it contains private keys.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	Annotations:  map[string]string{annotationDryRun: ""},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger := lgr.GetGlobalLogger()
+		defer logger.Sync()
+
+		if err := checkOutput(backupCmdFlagOutput); err != nil {
+			return err
+		}
+		opts, err := backupOptions()
+		if err != nil {
+			return err
+		}
+
+		dst := backupCmdFlagFile
+		if dst == "" {
+			dst = filepath.Join(clusterConfig.BackupDir(), backup.FileName(time.Now()))
+		}
+		if rootCmdFlagDryRun {
+			pl := plan.New("backup", rootCmdFlagNodeName)
+			pl.Add(plan.WriteFile, dst, "bundle of an etcd snapshot, the PKI and the cluster config")
+			return printPlan(pl, backupCmdFlagOutput)
+		}
+
+		m, err := backup.Save(signalContext(), dst, opts)
+		if err != nil {
+			return err
+		}
+		logger.Infof("backup with %d files saved to %s", len(m.Files), dst)
+		return nil
+	},
+}
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore <file>",
+	Short: "Restore a single controller cluster from a backup bundle.",
+	Long: `Restore a single controller cluster from a backup bundle.
+
+The bundle is verified against its manifest, then the PKI, the cluster config
+and etcd are restored into the data directory in the bundled cluster config,
+which is refused if it differs from the one in use unless --force is given.
+The controller should be stopped and started again with the restored config.`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	Annotations:  map[string]string{annotationDryRun: ""},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger := lgr.GetGlobalLogger()
+		defer logger.Sync()
+
+		if err := checkOutput(restoreCmdFlagOutput); err != nil {
+			return err
+		}
+		if rootCmdFlagDryRun {
+			return planRestore(args[0])
+		}
+
+		binDir, err := prepareBinDir()
+		if err != nil {
+			return err
+		}
+
+		// the operation locks the data directory in the backup, which is known once verified
+		var op *operation
+		defer func() {
+			if op != nil {
+				op.end()
+			}
+		}()
+		cfg, cfgPath, err := backup.Restore(args[0], &backup.RestoreOptions{
+			NodeName: rootCmdFlagNodeName,
+			DataDir:  clusterConfig.DataDir,
+			Force:    restoreCmdFlagForce,
+			Begin: func(cfg *conf.ClusterConfig) error {
+				var err error
+				op, err = beginOperationWith("restore", cfg)
+				return err
+			},
+			RestoreSnapshot: func(snapshot string, cfg *conf.ClusterConfig, node *conf.Node) error {
+				return etcd.RestoreSnapshot(binDir, snapshot, cfg, node)
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if err := op.succeed(cfg); err != nil {
+			return err
+		}
+		logger.Infof("restored, start the controller with: cks controller --config %s", cfgPath)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(backupCmd)
+	rootCmd.AddCommand(restoreCmd)
+
+	backupCmd.Flags().StringVarP(&backupCmdFlagFile, "file", "f", "",
+		"path of the bundle, defaults to a timestamped file in the backup directory")
+	addPlanOutputFlag(backupCmd, &backupCmdFlagOutput)
+	restoreCmd.Flags().BoolVar(&restoreCmdFlagForce, "force", false,
+		"overwrite the existing etcd data, and restore into the data directory in the backup other than the one in use")
+	addPlanOutputFlag(restoreCmd, &restoreCmdFlagOutput)
+}
+
+// planRestore prints the actions restoreCmd would take with the bundle
+func planRestore(src string) error {
+	pl := plan.New("restore", rootCmdFlagNodeName)
+	if _, err := planBinDir(pl); err != nil {
+		return err
+	}
+	cfg, err := backup.PlanRestore(src, &backup.RestoreOptions{
+		NodeName: rootCmdFlagNodeName,
+		DataDir:  clusterConfig.DataDir,
+		Force:    restoreCmdFlagForce,
+	}, pl)
+	if err != nil {
+		return err
+	}
+	pl.Add(plan.WriteFile, state.Path(cfg.DataDir), "state of the restored controller")
+	return printPlan(pl, restoreCmdFlagOutput)
+}
+
+// backupOptions returns the options to back up this node
+func backupOptions() (*backup.Options, error) {
+	c, err := etcdClient()
+	if err != nil {
+		return nil, err
+	}
+	return &backup.Options{
+		ClusterConfig: clusterConfig,
+		NodeName:      rootCmdFlagNodeName,
+		Snapshot: func(ctx context.Context, w io.Writer) error {
+			_, err := c.Snapshot(ctx, w)
+			return err
+		},
+	}, nil
+}
+
+// startBackupScheduler takes backups in background if configured
+func startBackupScheduler(ctx context.Context) error {
+	if clusterConfig.Backup.Interval == "" {
+		return nil
+	}
+	interval, err := time.ParseDuration(clusterConfig.Backup.Interval)
+	if err != nil {
+		return err
+	}
+	opts, err := backupOptions()
+	if err != nil {
+		return err
+	}
+
+	s := &backup.Scheduler{
+		Interval:  interval,
+		Retention: clusterConfig.Backup.Retention,
+		Dir:       clusterConfig.BackupDir(),
+		Options:   opts,
+	}
+	go s.Run(ctx)
+	return nil
+}
@@ -0,0 +1,224 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/jiuchen1986/cks/pkg/kubeconfig"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/pki"
+	"github.com/jiuchen1986/cks/pkg/plan"
+	"github.com/jiuchen1986/cks/pkg/state"
+)
+
+var (
+	certsCheckExpirationCmdFlagThreshold time.Duration
+	certsRenewCmdFlagOutput              string
+)
+
+// certsCmd represents the certs command
+var certsCmd = &cobra.Command{
+	Use:   "certs",
+	Short: "Inspect and renew certificates of this node.",
+}
+
+// certsListCmd represents the certs list command
+var certsListCmd = &cobra.Command{
+	Use:          "list",
+	Short:        "List certificates on the disk, including the ones in kubeconfigs, with their subjects, SANs and expiry.",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		infos, err := inspectCerts()
+		if err != nil {
+			return err
+		}
+		printCertInfos(infos)
+		return nil
+	},
+}
+
+// certsCheckExpirationCmd represents the certs check-expiration command
+var certsCheckExpirationCmd = &cobra.Command{
+	Use:          "check-expiration",
+	Short:        "Check whether any certificate on the disk expires within the threshold.",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger := lgr.GetGlobalLogger()
+		defer logger.Sync()
+
+		infos, err := inspectCerts()
+		if err != nil {
+			return err
+		}
+		printCertInfos(infos)
+
+		expiring := []string{}
+		for _, ci := range infos {
+			if ci.ExpiresWithin(certsCheckExpirationCmdFlagThreshold) {
+				expiring = append(expiring, ci.Name)
+			}
+		}
+		if len(expiring) > 0 {
+			return errors.Errorf("%d certificate(s) expire within %s: %s",
+				len(expiring), certsCheckExpirationCmdFlagThreshold, strings.Join(expiring, ", "))
+		}
+
+		logger.Infof("no certificate expires within %s", certsCheckExpirationCmdFlagThreshold)
+		return nil
+	},
+}
+
+// certsRenewCmd represents the certs renew command
+var certsRenewCmd = &cobra.Command{
+	Use:   "renew [component]",
+	Short: "Re-issue the leaf certificate of the component, or all leaf certificates, from the existing CA.",
+	Long: `Re-issue the leaf certificate of the component, or all leaf certificates, from the existing CA.
+
+The client certificates embedded in kubeconfigs are named kubeconfig/<name> as listed by
+"cks certs list", e.g. kubeconfig/admin, and are renewed together with the ones in the
+PKI directory when no component is given.
+
+Running components don't reload renewed certificates, restart "cks controller" and
+"cks worker" on this node afterwards to take them into use.`,
+	Args:         cobra.MaximumNArgs(1),
+	SilenceUsage: true,
+	Annotations:  map[string]string{annotationDryRun: ""},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := checkOutput(certsRenewCmdFlagOutput); err != nil {
+			return err
+		}
+		p, err := pki.New(clusterConfig, rootCmdFlagNodeName)
+		if err != nil {
+			return err
+		}
+		names, err := renewNames(p, args)
+		if err != nil {
+			return err
+		}
+
+		if rootCmdFlagDryRun {
+			pl := plan.New("certs renew", rootCmdFlagNodeName)
+			for _, name := range names {
+				if kcName, ok := kubeconfig.ParseCertName(name); ok {
+					err = kubeconfig.PlanRenew(clusterConfig, rootCmdFlagNodeName, kcName, pl)
+				} else {
+					err = p.PlanRenew(name, pl)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			pl.Add(plan.WriteFile, state.Path(clusterConfig.DataDir), "state with the renewed certificates")
+			return printPlan(pl, certsRenewCmdFlagOutput)
+		}
+
+		op, err := beginOperation("certs renew")
+		if err != nil {
+			return err
+		}
+		defer op.end()
+
+		for _, name := range names {
+			if kcName, ok := kubeconfig.ParseCertName(name); ok {
+				err = kubeconfig.Renew(clusterConfig, rootCmdFlagNodeName, kcName)
+			} else {
+				err = p.Renew(name)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err := op.succeed(clusterConfig); err != nil {
+			return err
+		}
+
+		lgr.GetGlobalLogger().Warnf("running components don't reload renewed certificates, " +
+			"restart cks controller and cks worker on this node to take them into use")
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(certsCmd)
+	certsCmd.AddCommand(certsListCmd, certsCheckExpirationCmd, certsRenewCmd)
+
+	certsCheckExpirationCmd.Flags().DurationVar(&certsCheckExpirationCmdFlagThreshold, "threshold",
+		30*24*time.Hour, "exit with error if any certificate expires within this duration")
+	addPlanOutputFlag(certsRenewCmd, &certsRenewCmdFlagOutput)
+}
+
+// renewNames returns the certificates given by args to renew, or all the leaf certificates
+// and the ones embedded in kubeconfigs if none is given
+func renewNames(p *pki.PKI, args []string) ([]string, error) {
+	if len(args) > 0 {
+		return args, nil
+	}
+
+	names := []string{}
+	for _, spec := range p.Leafs() {
+		names = append(names, spec.Name)
+	}
+	opts, err := kubeconfig.ComponentOptions(clusterConfig, rootCmdFlagNodeName)
+	if err != nil {
+		return nil, err
+	}
+	kcNames := []string{}
+	for name := range opts {
+		kcNames = append(kcNames, kubeconfig.CertName(name))
+	}
+	sort.Strings(kcNames)
+	return append(names, kcNames...), nil
+}
+
+// inspectCerts reads the certificates in the PKI directory and the ones embedded in kubeconfigs
+func inspectCerts() ([]pki.CertInfo, error) {
+	infos, err := pki.Inspect(pki.Dir(clusterConfig.DataDir))
+	if err != nil {
+		return nil, err
+	}
+	kcInfos, err := kubeconfig.Inspect(clusterConfig.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	return append(infos, kcInfos...), nil
+}
+
+func printCertInfos(infos []pki.CertInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "NAME\tSUBJECT\tSANS\tEXPIRES\tRESIDUAL\tCA")
+	for _, ci := range infos {
+		residual := time.Until(ci.NotAfter)
+		residualStr := "expired"
+		if residual > 0 {
+			residualStr = fmt.Sprintf("%dd", int(residual.Hours()/24))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%t\n", ci.Name, ci.Subject, strings.Join(ci.SANs, ","),
+			ci.NotAfter.Format(time.RFC3339), residualStr, ci.IsCA)
+	}
+}
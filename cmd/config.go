@@ -0,0 +1,170 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/plan"
+)
+
+var (
+	configViewCmdFlagRaw        bool
+	configMigrateCmdFlagInPlace bool
+	configMigrateCmdFlagOutput  string
+)
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Manage the cluster config.",
+}
+
+// configDefaultCmd represents the config default command
+var configDefaultCmd = &cobra.Command{
+	Use:          "default",
+	Short:        "Print a fully defaulted example of the cluster config.",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	Annotations:  map[string]string{annotationSkipClusterConfig: "", annotationOutputOnStdout: ""},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return printYAML(conf.NewDefault())
+	},
+}
+
+// configValidateCmd represents the config validate command
+var configValidateCmd = &cobra.Command{
+	Use:          "validate [file]",
+	Short:        "Validate the cluster config given by the file or --config, and list all errors found.",
+	Args:         cobra.MaximumNArgs(1),
+	SilenceUsage: true,
+	Annotations:  map[string]string{annotationSkipClusterConfig: "", annotationOutputOnStdout: ""},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger := lgr.GetGlobalLogger()
+		defer logger.Sync()
+
+		p := configFileArg(args)
+		if _, err := conf.LoadFile(p); err != nil {
+			return err
+		}
+
+		logger.Infof("cluster config %s is valid", p)
+		return nil
+	},
+}
+
+// configViewCmd represents the config view command
+var configViewCmd = &cobra.Command{
+	Use:          "view",
+	Short:        "Print the effective cluster config merged from the config file, env and flags.",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	Annotations:  map[string]string{annotationOutputOnStdout: ""},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if configViewCmdFlagRaw {
+			return printYAML(viper.AllSettings())
+		}
+		return printYAML(clusterConfig)
+	},
+}
+
+// configMigrateCmd represents the config migrate command
+var configMigrateCmd = &cobra.Command{
+	Use:          "migrate [file]",
+	Short:        "Migrate the cluster config given by the file or --config to the current apiVersion.",
+	Args:         cobra.MaximumNArgs(1),
+	SilenceUsage: true,
+	Annotations:  map[string]string{annotationSkipClusterConfig: "", annotationOutputOnStdout: "", annotationDryRun: ""},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger := lgr.GetGlobalLogger()
+		defer logger.Sync()
+
+		if err := checkOutput(configMigrateCmdFlagOutput); err != nil {
+			return err
+		}
+		p := configFileArg(args)
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read cluster config %s", p)
+		}
+
+		out, from, err := conf.Migrate(data)
+		if err != nil {
+			return err
+		}
+		logger.Infof("cluster config %s migrated from %q to %q", p, from, conf.APIVersion)
+
+		if rootCmdFlagDryRun {
+			// nothing is written without --in-place
+			pl := plan.New("config migrate", rootCmdFlagNodeName)
+			if configMigrateCmdFlagInPlace {
+				pl.Add(plan.WriteFile, p+".bak", "original cluster config")
+				pl.Add(plan.WriteFile, p, "cluster config migrated to "+conf.APIVersion)
+			}
+			return printPlan(pl, configMigrateCmdFlagOutput)
+		}
+		if !configMigrateCmdFlagInPlace {
+			fmt.Print(string(out))
+			return nil
+		}
+
+		// keep the original file as a backup
+		if err := ioutil.WriteFile(p+".bak", data, 0600); err != nil {
+			return errors.Wrapf(err, "failed to back up cluster config %s", p)
+		}
+		if err := ioutil.WriteFile(p, out, 0600); err != nil {
+			return errors.Wrapf(err, "failed to write cluster config %s", p)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configDefaultCmd, configValidateCmd, configViewCmd, configMigrateCmd)
+
+	configViewCmd.Flags().BoolVar(&configViewCmdFlagRaw, "raw", false,
+		"print all settings as viper sees them without defaulting and validation")
+	configMigrateCmd.Flags().BoolVarP(&configMigrateCmdFlagInPlace, "in-place", "i", false,
+		"overwrite the file with the migrated config and keep the original one with suffix .bak")
+	addPlanOutputFlag(configMigrateCmd, &configMigrateCmdFlagOutput)
+}
+
+// configFileArg returns the config file given by args if any,
+// otherwise the one given by --config
+func configFileArg(args []string) string {
+	if len(args) > 0 {
+		return args[0]
+	}
+	return rootCmdFlagCfgFile
+}
+
+func printYAML(v interface{}) error {
+	out, err := yaml.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal to yaml")
+	}
+	fmt.Print(string(out))
+	return nil
+}
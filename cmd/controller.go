@@ -0,0 +1,287 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jiuchen1986/cks/pkg/addons"
+	"github.com/jiuchen1986/cks/pkg/assets"
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/controller"
+	"github.com/jiuchen1986/cks/pkg/etcd"
+	"github.com/jiuchen1986/cks/pkg/join"
+	"github.com/jiuchen1986/cks/pkg/kubeconfig"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/pki"
+	"github.com/jiuchen1986/cks/pkg/plan"
+	"github.com/jiuchen1986/cks/pkg/preflight"
+	"github.com/jiuchen1986/cks/pkg/state"
+	"github.com/jiuchen1986/cks/pkg/token"
+)
+
+var (
+	controllerCmdFlagToken           string
+	controllerCmdFlagIgnorePreflight []string
+	controllerCmdFlagOutput          string
+)
+
+// controllerCmd represents the controller command
+var controllerCmd = &cobra.Command{
+	Use:   "controller",
+	Short: "Run the control plane on this node until SIGINT or SIGTERM.",
+	Long: `Run the control plane on this node until SIGINT or SIGTERM.
+
+A controller joins a running cluster with --token created by "cks token create --role controller"
+on another controller, which hands out the CAs, the etcd certificates of this node and adds
+its etcd member as a learner. Without a token, the CAs are generated unless they exist.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	Annotations:  map[string]string{annotationDryRun: ""},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger := lgr.GetGlobalLogger()
+		defer logger.Sync()
+
+		if err := checkOutput(controllerCmdFlagOutput); err != nil {
+			return err
+		}
+		var tk *token.Token
+		if controllerCmdFlagToken != "" {
+			t, err := token.Parse(controllerCmdFlagToken)
+			if err != nil {
+				return err
+			}
+			tk = t
+		}
+		if rootCmdFlagDryRun {
+			return planController(tk)
+		}
+
+		ctx := signalContext()
+
+		env := preflight.NewEnv(clusterConfig.DataDir)
+		if tk != nil {
+			env.ReferenceTime = preflight.HTTPDate(tk.Server)
+		}
+		if err := runPreflight(env, []conf.Role{conf.RoleController}, controllerCmdFlagIgnorePreflight); err != nil {
+			return err
+		}
+
+		unlock, err := lockRole(conf.RoleController)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		// the lock of the data directory is only held during provisioning,
+		// so that others, e.g. cks certs renew, are able to run meanwhile
+		op, err := beginOperation("controller")
+		if err != nil {
+			return err
+		}
+		defer op.end()
+
+		// the socket is only taken over with the role locked
+		startAdmin(ctx, conf.RoleController)
+
+		binDir, err := prepareBinDir()
+		if err != nil {
+			return err
+		}
+
+		c, err := controller.New(clusterConfig, rootCmdFlagNodeName, binDir)
+		if err != nil {
+			return err
+		}
+		switch {
+		case c.IsJoined():
+			if tk != nil {
+				logger.Infof("node %s already has the cluster CA, ignore the token", rootCmdFlagNodeName)
+			}
+		case tk != nil:
+			if err := c.Join(&join.Client{
+				Server: tk.Server,
+				Token:  controllerCmdFlagToken,
+				CAHash: tk.CAHash,
+			}); err != nil {
+				return err
+			}
+			logger.Infof("node %s joined as a controller", rootCmdFlagNodeName)
+		}
+		if err := c.Prepare(); err != nil {
+			return err
+		}
+
+		logger.Infof("start control plane on node %s", rootCmdFlagNodeName)
+		if err := c.Start(ctx); err != nil {
+			c.Stop()
+			return err
+		}
+		logger.Info("control plane started")
+
+		if err := startJoinServer(ctx); err != nil {
+			c.Stop()
+			return err
+		}
+		if err := startBackupScheduler(ctx); err != nil {
+			c.Stop()
+			return err
+		}
+		if err := startAddons(ctx); err != nil {
+			c.Stop()
+			return err
+		}
+		if err := op.succeed(clusterConfig); err != nil {
+			c.Stop()
+			return err
+		}
+		op.end()
+
+		<-ctx.Done()
+		logger.Info("stop control plane")
+		c.Stop()
+		logger.Info("control plane stopped")
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(controllerCmd)
+
+	controllerCmd.Flags().StringVar(&controllerCmdFlagToken, "token", "",
+		"token to join a running cluster, created by cks token create --role controller")
+	controllerCmd.Flags().StringSliceVar(&controllerCmdFlagIgnorePreflight, "ignore-preflight", nil,
+		fmt.Sprintf("preflight checks whose failures are ignored, %s to ignore all", preflight.IgnoreAll))
+	controllerCmd.Flags().StringVar(&controllerCmdFlagOutput, "output", outputText,
+		fmt.Sprintf("output format of the plan with --dry-run, %s or %s", outputText, outputJSON))
+}
+
+// planController prints the actions the controller would take on this node
+func planController(tk *token.Token) error {
+	pl := plan.New("controller", rootCmdFlagNodeName)
+
+	binDir, err := planBinDir(pl)
+	if err != nil {
+		return err
+	}
+	c, err := controller.New(clusterConfig, rootCmdFlagNodeName, binDir)
+	if err != nil {
+		return err
+	}
+	if !c.IsJoined() && tk != nil {
+		// what the join server hands out is unknown without joining
+		pl.Add(plan.Request, tk.Server, "join as a controller and write the CAs and etcd certificates")
+		pl.Add(plan.WriteFile, state.Path(clusterConfig.DataDir), "state of the controller")
+		return printPlan(pl, controllerCmdFlagOutput)
+	}
+	if err := c.Plan(pl); err != nil {
+		return err
+	}
+	if err := addons.NewReconciler(clusterConfig, nil).Plan(pl); err != nil {
+		return err
+	}
+
+	records, err := tokenManager().List()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		pl.Add(plan.WriteFile, token.Dir(clusterConfig.DataDir), "bootstrap token to join workers")
+	}
+	pl.Add(plan.WriteFile, state.Path(clusterConfig.DataDir), "state of the controller")
+	return printPlan(pl, controllerCmdFlagOutput)
+}
+
+// prepareBinDir extracts the bundled assets if any and returns the bin directory,
+// otherwise the binaries are expected in the current bin directory or PATH
+func prepareBinDir() (string, error) {
+	logger := lgr.GetGlobalLogger()
+
+	if _, err := assets.Bundle(); err != nil {
+		logger.Warnf("%v, look up binaries in bin directory and PATH instead", err)
+		return assets.CurrentDir(assets.Dir(clusterConfig.DataDir)), nil
+	}
+	return extractAssets()
+}
+
+// startJoinServer serves join requests of workers and controllers in background,
+// and logs the command to join a worker
+func startJoinServer(ctx context.Context) error {
+	logger := lgr.GetGlobalLogger()
+
+	p, err := pki.New(clusterConfig, rootCmdFlagNodeName)
+	if err != nil {
+		return err
+	}
+	ca, err := p.LoadKeyPair(pki.CAName)
+	if err != nil {
+		return err
+	}
+	serving, err := p.LoadKeyPair(pki.APIServerName)
+	if err != nil {
+		return err
+	}
+
+	tc, err := etcd.ClientTLSConfig(p)
+	if err != nil {
+		return err
+	}
+
+	srv := join.NewServer(clusterConfig, ca, tokenManager().Validator(),
+		join.NewRegistry(join.RegistryPath(clusterConfig.DataDir)))
+	srv.EnableControllers(p, etcd.NewClient(etcd.PeerEndpoints(clusterConfig, ""), tc))
+	go func() {
+		if err := srv.ListenAndServe(ctx, net.JoinHostPort("", strconv.Itoa(join.Port)), serving.TLSCertificate()); err != nil {
+			logger.Errorf("join server stopped: %v", err)
+		}
+	}()
+
+	// hand out a token on the first start, later ones are created by cks token create
+	records, err := tokenManager().List()
+	if err != nil {
+		return err
+	}
+	if len(records) > 0 {
+		logger.Info("create a token to join nodes with: cks token create [--role controller]")
+		return nil
+	}
+	tk, _, err := createToken(conf.RoleWorker, token.DefaultTTL, "created on the first start", "")
+	if err != nil {
+		return err
+	}
+	logger.Infof("join workers within %s with: cks worker --token %s", token.DefaultTTL, tk.String())
+	return nil
+}
+
+// startAddons applies the addons and the manifests of users in background
+// with the admin credentials
+func startAddons(ctx context.Context) error {
+	kc, err := kubeconfig.Load(kubeconfig.Path(clusterConfig.DataDir, kubeconfig.AdminName))
+	if err != nil {
+		return err
+	}
+	c, err := addons.NewRESTClient(kc)
+	if err != nil {
+		return err
+	}
+	go addons.NewReconciler(clusterConfig, c).Run(ctx)
+	return nil
+}
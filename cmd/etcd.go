@@ -0,0 +1,194 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/etcd"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/pki"
+	"github.com/jiuchen1986/cks/pkg/plan"
+	"github.com/jiuchen1986/cks/pkg/state"
+)
+
+var (
+	etcdMemberListCmdFlagOutput string
+	etcdLeaveCmdFlagOutput      string
+)
+
+// etcdCmd represents the etcd command
+var etcdCmd = &cobra.Command{
+	Use:   "etcd",
+	Short: "Manage membership of the etcd cluster.",
+}
+
+// etcdMemberListCmd represents the etcd member-list command
+var etcdMemberListCmd = &cobra.Command{
+	Use:          "member-list",
+	Short:        "List members of the etcd cluster.",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := checkOutput(etcdMemberListCmdFlagOutput); err != nil {
+			return err
+		}
+
+		c, err := etcdClient()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		members, err := c.MemberList(ctx)
+		if err != nil {
+			return err
+		}
+
+		if etcdMemberListCmdFlagOutput == outputJSON {
+			out, err := json.MarshalIndent(members, "", "  ")
+			if err != nil {
+				return errors.Wrap(err, "failed to marshal etcd members")
+			}
+			fmt.Println(string(out))
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		defer w.Flush()
+		fmt.Fprintln(w, "ID\tNAME\tSTATUS\tLEARNER\tPEER URLS\tCLIENT URLS")
+		for _, m := range members {
+			status := "started"
+			if !m.IsStarted() {
+				status = "unstarted"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\t%s\n", m.ID, m.Name, status, m.IsLearner,
+				strings.Join(m.PeerURLs, ","), strings.Join(m.ClientURLs, ","))
+		}
+		return nil
+	},
+}
+
+// etcdLeaveCmd represents the etcd leave command
+var etcdLeaveCmd = &cobra.Command{
+	Use:   "leave",
+	Short: "Remove the etcd member of this node from the cluster and delete its data.",
+	Long: `Remove the etcd member of this node from the cluster and delete its data.
+
+It's refused while the controller of this node is running, which would restart etcd
+failing without its data. The last member is refused to leave as well.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	Annotations:  map[string]string{annotationDryRun: ""},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger := lgr.GetGlobalLogger()
+		defer logger.Sync()
+
+		if err := checkOutput(etcdLeaveCmdFlagOutput); err != nil {
+			return err
+		}
+		if rootCmdFlagDryRun {
+			return planEtcdLeave()
+		}
+
+		// holding the lock of the controller keeps it from starting during leave
+		unlock, err := lockRole(conf.RoleController)
+		if err != nil {
+			return errors.Wrap(err, "stop the controller of this node before leaving")
+		}
+		defer unlock()
+
+		op, err := beginOperation("etcd leave")
+		if err != nil {
+			return err
+		}
+		defer op.end()
+
+		c, err := etcdClient()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		m, err := etcd.Leave(ctx, c, rootCmdFlagNodeName)
+		if err != nil {
+			return err
+		}
+		logger.Infof("etcd member %s of node %s removed", m.ID, rootCmdFlagNodeName)
+
+		dir := etcd.DataDir(clusterConfig.DataDir)
+		if err := os.RemoveAll(dir); err != nil {
+			return errors.Wrapf(err, "failed to delete etcd data %s", dir)
+		}
+		logger.Infof("etcd data %s deleted", dir)
+		return op.succeed(clusterConfig)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(etcdCmd)
+	etcdCmd.AddCommand(etcdMemberListCmd)
+	etcdCmd.AddCommand(etcdLeaveCmd)
+
+	etcdMemberListCmd.Flags().StringVar(&etcdMemberListCmdFlagOutput, "output", outputText,
+		fmt.Sprintf("output format, %s or %s", outputText, outputJSON))
+	addPlanOutputFlag(etcdLeaveCmd, &etcdLeaveCmdFlagOutput)
+}
+
+// planEtcdLeave prints the actions etcdLeaveCmd would take on this node
+func planEtcdLeave() error {
+	c, err := etcdClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	m, err := etcd.PlanLeave(ctx, c, rootCmdFlagNodeName)
+	if err != nil {
+		return err
+	}
+
+	pl := plan.New("etcd leave", rootCmdFlagNodeName)
+	pl.Add(plan.Request, strings.Join(c.Endpoints, ","), fmt.Sprintf("remove etcd member %s", m.ID))
+	pl.Add(plan.RemoveFile, etcd.DataDir(clusterConfig.DataDir), "etcd data")
+	pl.Add(plan.WriteFile, state.Path(clusterConfig.DataDir), "state of this node")
+	return printPlan(pl, etcdLeaveCmdFlagOutput)
+}
+
+// etcdClient returns a client of the etcd cluster, where the other controllers
+// are tried before the local member so that a stopped local member is fine
+func etcdClient() (*etcd.Client, error) {
+	p, err := pki.New(clusterConfig, rootCmdFlagNodeName)
+	if err != nil {
+		return nil, err
+	}
+	tc, err := etcd.ClientTLSConfig(p)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := append(etcd.PeerEndpoints(clusterConfig, rootCmdFlagNodeName), etcd.ClientURL("127.0.0.1"))
+	return etcd.NewClient(endpoints, tc), nil
+}
@@ -0,0 +1,141 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jiuchen1986/cks/pkg/kubeconfig"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/pki"
+	"github.com/jiuchen1986/cks/pkg/plan"
+)
+
+var (
+	kubeconfigCmdFlagServer     string
+	kubeconfigCmdFlagTTL        time.Duration
+	kubeconfigCmdFlagFile       string
+	kubeconfigCmdFlagOutput     string
+	kubeconfigUserCmdFlagGroups []string
+)
+
+// kubeconfigCmd represents the kubeconfig command
+var kubeconfigCmd = &cobra.Command{
+	Use:   "kubeconfig",
+	Short: "Generate kubeconfig files signed by the cluster CA.",
+}
+
+// kubeconfigAdminCmd represents the kubeconfig admin command
+var kubeconfigAdminCmd = &cobra.Command{
+	Use:          "admin",
+	Short:        "Generate a kubeconfig with full access to the cluster.",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	Annotations:  map[string]string{annotationDryRun: ""},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return writeKubeconfig("kubernetes-admin", []string{pki.SystemMastersGroup})
+	},
+}
+
+// kubeconfigUserCmd represents the kubeconfig user command
+var kubeconfigUserCmd = &cobra.Command{
+	Use:          "user <name>",
+	Short:        "Generate a kubeconfig for the user in the groups.",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	Annotations:  map[string]string{annotationDryRun: ""},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return writeKubeconfig(args[0], kubeconfigUserCmdFlagGroups)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(kubeconfigCmd)
+	kubeconfigCmd.AddCommand(kubeconfigAdminCmd, kubeconfigUserCmd)
+
+	kubeconfigCmd.PersistentFlags().StringVar(&kubeconfigCmdFlagServer, "server", "",
+		"URL of the apiserver (default to the API address in the cluster config)")
+	kubeconfigCmd.PersistentFlags().DurationVar(&kubeconfigCmdFlagTTL, "ttl", 24*time.Hour,
+		"validity of the client certificate")
+	kubeconfigCmd.PersistentFlags().StringVarP(&kubeconfigCmdFlagFile, "file", "f", "",
+		"file to write the kubeconfig to (default to stdout)")
+	addPlanOutputFlag(kubeconfigAdminCmd, &kubeconfigCmdFlagOutput)
+	addPlanOutputFlag(kubeconfigUserCmd, &kubeconfigCmdFlagOutput)
+	kubeconfigUserCmd.Flags().StringSliceVar(&kubeconfigUserCmdFlagGroups, "groups", []string{},
+		"groups of the user, separated by comma")
+}
+
+func writeKubeconfig(user string, groups []string) error {
+	logger := lgr.GetGlobalLogger()
+	defer logger.Sync()
+
+	if err := checkOutput(kubeconfigCmdFlagOutput); err != nil {
+		return err
+	}
+
+	p, err := pki.New(clusterConfig, rootCmdFlagNodeName)
+	if err != nil {
+		return err
+	}
+	ca, err := p.LoadKeyPair(pki.CAName)
+	if err != nil {
+		return err
+	}
+
+	server := kubeconfigCmdFlagServer
+	if server == "" {
+		server = kubeconfig.ServerURL(clusterConfig.API.Address, clusterConfig.API.Port)
+	}
+
+	if rootCmdFlagDryRun {
+		pl := plan.New("kubeconfig", rootCmdFlagNodeName)
+		pl.Add(plan.IssueCert, user, fmt.Sprintf("client certificate signed by %s, expires in %s",
+			pki.CAName, kubeconfigCmdFlagTTL))
+		if kubeconfigCmdFlagFile != "" {
+			pl.Add(plan.WriteFile, kubeconfigCmdFlagFile, "kubeconfig for "+user+" on "+server)
+		}
+		return printPlan(pl, kubeconfigCmdFlagOutput)
+	}
+
+	kc, err := kubeconfig.New(ca, &kubeconfig.Options{
+		ClusterName: clusterConfig.ClusterName,
+		Server:      server,
+		User:        user,
+		Groups:      groups,
+		TTL:         kubeconfigCmdFlagTTL,
+	})
+	if err != nil {
+		return err
+	}
+
+	if kubeconfigCmdFlagFile == "" {
+		out, err := kc.Marshal()
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(out))
+		return nil
+	}
+
+	if err := kc.Write(kubeconfigCmdFlagFile); err != nil {
+		return err
+	}
+	logger.Infof("kubeconfig of user %s written to %s, expires in %s", user, kubeconfigCmdFlagFile, kubeconfigCmdFlagTTL)
+	return nil
+}
@@ -0,0 +1,201 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/jiuchen1986/cks/pkg/admin"
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+)
+
+var (
+	logLevelCmdFlagComponent string
+	logLevelCmdFlagOutput    string
+	logLevelCmdFlagRole      string
+)
+
+// logLevelCmd represents the log-level command
+var logLevelCmd = &cobra.Command{
+	Use:   "log-level",
+	Short: "Change log levels of the running controller or worker on this node.",
+	Long: `Change log levels of the running controller or worker on this node
+through the admin API on <dataDir>/admin/cks-<role>.sock, where --role is only
+required if both of them are running.
+
+Levels are changed by signals as well, where SIGUSR1 makes the global level
+more verbose by one step, SIGUSR2 less verbose, and SIGHUP restores all the levels.`,
+}
+
+// logLevelGetCmd represents the log-level get command
+var logLevelGetCmd = &cobra.Command{
+	Use:          "get",
+	Short:        "Print the global level and levels of components.",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := checkOutput(logLevelCmdFlagOutput); err != nil {
+			return err
+		}
+		c, err := adminClient()
+		if err != nil {
+			return err
+		}
+		levels, err := c.LogLevels(logLevelCmdFlagComponent)
+		if err != nil {
+			return err
+		}
+		return printLogLevels(levels)
+	},
+}
+
+// logLevelSetCmd represents the log-level set command
+var logLevelSetCmd = &cobra.Command{
+	Use:          "set <level>",
+	Short:        "Set the global level, or the level of a component with --component.",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := checkOutput(logLevelCmdFlagOutput); err != nil {
+			return err
+		}
+		c, err := adminClient()
+		if err != nil {
+			return err
+		}
+		levels, err := c.SetLogLevel(logLevelCmdFlagComponent, args[0])
+		if err != nil {
+			return err
+		}
+		return printLogLevels(levels)
+	},
+}
+
+// logLevelResetCmd represents the log-level reset command
+var logLevelResetCmd = &cobra.Command{
+	Use:          "reset",
+	Short:        "Restore the levels given at start, or the level of a component with --component.",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := checkOutput(logLevelCmdFlagOutput); err != nil {
+			return err
+		}
+		c, err := adminClient()
+		if err != nil {
+			return err
+		}
+		levels, err := c.ResetLogLevel(logLevelCmdFlagComponent)
+		if err != nil {
+			return err
+		}
+		return printLogLevels(levels)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(logLevelCmd)
+	logLevelCmd.AddCommand(logLevelGetCmd)
+	logLevelCmd.AddCommand(logLevelSetCmd)
+	logLevelCmd.AddCommand(logLevelResetCmd)
+
+	logLevelCmd.PersistentFlags().StringVar(&logLevelCmdFlagComponent, "component", "",
+		"component whose level is got or changed, e.g. etcd, the global level if empty")
+	logLevelCmd.PersistentFlags().StringVar(&logLevelCmdFlagOutput, "output", outputText,
+		fmt.Sprintf("output format, %s or %s", outputText, outputJSON))
+	logLevelCmd.PersistentFlags().StringVar(&logLevelCmdFlagRole, "role", "",
+		fmt.Sprintf("role of the running cks, %s or %s, the running one if empty", conf.RoleController, conf.RoleWorker))
+}
+
+// adminClient returns the client of the admin API of the running cks of --role,
+// or the only running one if --role isn't given
+func adminClient() (*admin.Client, error) {
+	if logLevelCmdFlagRole != "" {
+		r := conf.Role(logLevelCmdFlagRole)
+		if r != conf.RoleController && r != conf.RoleWorker {
+			return nil, errors.Errorf("unsupported role %s, only support %s and %s",
+				r, conf.RoleController, conf.RoleWorker)
+		}
+		return admin.NewClient(admin.SocketPath(clusterConfig.DataDir, r)), nil
+	}
+
+	running := []string{}
+	for _, r := range []conf.Role{conf.RoleController, conf.RoleWorker} {
+		p := admin.SocketPath(clusterConfig.DataDir, r)
+		if _, err := os.Stat(p); err == nil {
+			running = append(running, p)
+		}
+	}
+	switch len(running) {
+	case 0:
+		return nil, errors.Errorf("neither controller nor worker is running against %s", clusterConfig.DataDir)
+	case 1:
+		return admin.NewClient(running[0]), nil
+	default:
+		return nil, errors.New("both controller and worker are running, choose one by --role")
+	}
+}
+
+func printLogLevels(levels *admin.LogLevels) error {
+	if logLevelCmdFlagOutput == outputJSON {
+		out, err := json.MarshalIndent(levels, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal log levels")
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	if logLevelCmdFlagComponent != "" {
+		fmt.Println(levels.Level)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "COMPONENT\tLEVEL")
+	fmt.Fprintf(w, "%s\t%s\n", "*", levels.Level)
+	names := make([]string, 0, len(levels.Components))
+	for n := range levels.Components {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Fprintf(w, "%s\t%s\n", n, levels.Components[n])
+	}
+	return nil
+}
+
+// startAdmin serves the admin API of the role and changes log levels on signals in background
+func startAdmin(ctx context.Context, role conf.Role) {
+	logger := lgr.GetGlobalLogger()
+
+	lgr.WatchLevelSignals(ctx)
+	go func() {
+		if err := admin.NewServer().ListenAndServe(ctx, admin.SocketPath(clusterConfig.DataDir, role)); err != nil {
+			logger.Errorf("admin API stopped: %v", err)
+		}
+	}()
+}
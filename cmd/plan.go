@@ -0,0 +1,66 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/jiuchen1986/cks/pkg/assets"
+	"github.com/jiuchen1986/cks/pkg/plan"
+)
+
+// printPlan prints the actions of the plan in order in the output format
+func printPlan(pl *plan.Plan, output string) error {
+	if output == outputJSON {
+		out, err := json.MarshalIndent(pl, "", "  ")
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal plan")
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+
+	fmt.Printf("%s on node %s would take %d action(s):\n", pl.Operation, pl.Node, len(pl.Actions))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "STEP\tKIND\tTARGET\tDETAIL")
+	for i, a := range pl.Actions {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", i+1, a.Kind, a.Target, a.Detail)
+	}
+	return nil
+}
+
+// addPlanOutputFlag adds --output giving the output format of the plan with --dry-run
+func addPlanOutputFlag(cmd *cobra.Command, output *string) {
+	cmd.Flags().StringVar(output, "output", outputText,
+		fmt.Sprintf("output format of the plan with --dry-run, %s or %s", outputText, outputJSON))
+}
+
+// planBinDir returns the bin directory prepareBinDir would return,
+// adding the extraction of the bundled assets to the plan if necessary
+func planBinDir(pl *plan.Plan) (string, error) {
+	bundle, err := assets.Bundle()
+	if err != nil {
+		return assets.CurrentDir(assets.Dir(clusterConfig.DataDir)), nil
+	}
+	return assets.Plan(bundle, assets.Dir(clusterConfig.DataDir), pl)
+}
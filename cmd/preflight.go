@@ -0,0 +1,152 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/preflight"
+)
+
+const (
+	outputText string = "text"
+	outputJSON string = "json"
+)
+
+// checkOutput returns an error if the output format is unsupported
+func checkOutput(output string) error {
+	if output != outputText && output != outputJSON {
+		return errors.Errorf("unsupported output %s, should be %s or %s", output, outputText, outputJSON)
+	}
+	return nil
+}
+
+var (
+	preflightCmdFlagRoles  []string
+	preflightCmdFlagIgnore []string
+	preflightCmdFlagOutput string
+)
+
+// preflightCmd represents the preflight command
+var preflightCmd = &cobra.Command{
+	Use:   "preflight",
+	Short: "Check whether this node is ready to run the roles.",
+	Long: `Check whether this node is ready to run the roles.
+
+Each check passes, warns or fails with a hint to fix it.
+The command exits non-zero if any check fails and is not ignored.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := checkOutput(preflightCmdFlagOutput); err != nil {
+			return err
+		}
+
+		roles := []conf.Role{}
+		for _, r := range preflightCmdFlagRoles {
+			roles = append(roles, conf.Role(r))
+		}
+		if len(roles) == 0 {
+			node := clusterConfig.Node(rootCmdFlagNodeName)
+			if node == nil {
+				return errors.Errorf("node %s not found in cluster config, specify --role instead", rootCmdFlagNodeName)
+			}
+			roles = node.Roles
+		}
+
+		env := preflight.NewEnv(clusterConfig.DataDir)
+		report := preflight.Run(env, preflight.For(clusterConfig, roles), preflightCmdFlagIgnore)
+
+		if preflightCmdFlagOutput == outputJSON {
+			out, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				return errors.Wrap(err, "failed to marshal preflight report")
+			}
+			fmt.Println(string(out))
+		} else {
+			printPreflightReport(report)
+		}
+
+		if failed := report.Failed(); len(failed) > 0 {
+			return errors.Errorf("%d preflight checks failed", len(failed))
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(preflightCmd)
+
+	preflightCmd.Flags().StringSliceVar(&preflightCmdFlagRoles, "role", nil,
+		fmt.Sprintf("roles to check for, %s or %s, defaults to roles of this node in cluster config",
+			conf.RoleController, conf.RoleWorker))
+	preflightCmd.Flags().StringSliceVar(&preflightCmdFlagIgnore, "ignore", nil,
+		fmt.Sprintf("checks whose failures are ignored, %s to ignore all", preflight.IgnoreAll))
+	preflightCmd.Flags().StringVar(&preflightCmdFlagOutput, "output", outputText,
+		fmt.Sprintf("output format, %s or %s", outputText, outputJSON))
+}
+
+func printPreflightReport(report *preflight.Report) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "CHECK\tSTATUS\tMESSAGE\tHINT")
+	for _, res := range report.Results {
+		status := strings.ToUpper(string(res.Status))
+		if res.Ignored {
+			status += " (ignored)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", res.Name, status, res.Message, res.Hint)
+	}
+}
+
+// runPreflight runs the checks for the roles before starting components,
+// where results are logged and failures not ignored abort the start
+func runPreflight(env *preflight.Env, roles []conf.Role, ignore []string) error {
+	logger := lgr.GetGlobalLogger()
+	defer logger.Sync()
+
+	report := preflight.Run(env, preflight.For(clusterConfig, roles), ignore)
+	for _, res := range report.Results {
+		switch {
+		case res.Status == preflight.StatusPass:
+			logger.Debugf("preflight %s passed: %s", res.Name, res.Message)
+		case res.Status == preflight.StatusWarn || res.Ignored:
+			logger.Warnf("preflight %s %s: %s, %s", res.Name, res.Status, res.Message, res.Hint)
+		default:
+			logger.Errorf("preflight %s failed: %s, %s", res.Name, res.Message, res.Hint)
+		}
+	}
+
+	if failed := report.Failed(); len(failed) > 0 {
+		names := []string{}
+		for _, res := range failed {
+			names = append(names, res.Name)
+		}
+		return errors.Errorf("preflight checks failed: %s, fix them or skip by --ignore-preflight",
+			strings.Join(names, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/etcd"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/plan"
+	"github.com/jiuchen1986/cks/pkg/reset"
+)
+
+var (
+	resetCmdFlagForce  bool
+	resetCmdFlagOutput string
+)
+
+// resetCmd represents the reset command
+var resetCmd = &cobra.Command{
+	Use:   "reset",
+	Short: "Tear down what cks set up on this node.",
+	Long: `Tear down what cks set up on this node.
+
+The running cks and the components it supervises are stopped together with the containers
+and their shims, the etcd member leaves the cluster if other controllers remain, mounts
+in the data directory are unmounted, CNI interfaces and iptables chains are deleted, then
+the data directory is removed except the backups in it. Once a step fails, the following
+ones leaving etcd, unmounting and removing are skipped, while the others still run.
+The failures are reported together at the end, so a reset is able to be re-run.
+The data directory is never removed unless it's locked and nothing is mounted in it.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	Annotations:  map[string]string{annotationDryRun: ""},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger := lgr.GetGlobalLogger()
+		defer logger.Sync()
+
+		if err := checkOutput(resetCmdFlagOutput); err != nil {
+			return err
+		}
+
+		env := reset.NewEnv(clusterConfig.DataDir)
+		steps := resetSteps()
+
+		if rootCmdFlagDryRun {
+			pl := plan.New("reset", rootCmdFlagNodeName)
+			if err := reset.Plan(env, steps, pl); err != nil {
+				return err
+			}
+			return printPlan(pl, resetCmdFlagOutput)
+		}
+		if !resetCmdFlagForce {
+			return errors.Errorf("reset stops all the components and removes the data directory %s, "+
+				"rerun with --force to confirm or with --dry-run to review", env.DataDir)
+		}
+
+		report := reset.Run(env, steps)
+		if env.Lock != nil {
+			if err := env.Lock.Unlock(); err != nil {
+				logger.Warnf("%v", err)
+			}
+		}
+
+		if resetCmdFlagOutput == outputJSON {
+			out, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				return errors.Wrap(err, "failed to marshal reset report")
+			}
+			fmt.Println(string(out))
+		} else {
+			printResetReport(report)
+		}
+		return report.Err()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(resetCmd)
+
+	resetCmd.Flags().BoolVar(&resetCmdFlagForce, "force", false, "confirm to reset this node")
+	resetCmd.Flags().StringVar(&resetCmdFlagOutput, "output", outputText,
+		fmt.Sprintf("output format of the report or the plan with --dry-run, %s or %s", outputText, outputJSON))
+}
+
+// resetSteps returns the steps resetting this node in order,
+// where the etcd member leaves before its credentials are removed
+func resetSteps() []reset.Step {
+	steps := []reset.Step{&reset.StopComponentsStep{}}
+
+	// the last controller has no cluster to leave
+	node := clusterConfig.Node(rootCmdFlagNodeName)
+	if node != nil && node.HasRole(conf.RoleController) &&
+		len(etcd.PeerEndpoints(clusterConfig, rootCmdFlagNodeName)) > 0 {
+		steps = append(steps, &reset.EtcdLeaveStep{NodeName: rootCmdFlagNodeName, Client: etcdClient})
+	}
+
+	return append(steps,
+		&reset.UnmountStep{},
+		&reset.DeleteLinksStep{Links: reset.CNILinks},
+		&reset.DeleteChainsStep{Prefixes: reset.ChainPrefixes, Tables: reset.ChainTables},
+		&reset.RemoveDataDirStep{Keep: []string{clusterConfig.BackupDir()}},
+	)
+}
+
+func printResetReport(report *reset.Report) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintln(w, "STEP\tSTATUS\tERROR")
+	for _, res := range report.Results {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", res.Step, strings.ToUpper(string(res.Status)), res.Error)
+	}
+}
@@ -16,22 +16,57 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	conf "github.com/jiuchen1986/cks/pkg/config"
 	erh "github.com/jiuchen1986/cks/pkg/error"
 	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/utils"
 )
 
+// annotationSkipClusterConfig is set in annotations of commands
+// that should not load the cluster config before they run
+const annotationSkipClusterConfig string = "cks/skip-cluster-config"
+
+// annotationOutputOnStdout is set in annotations of commands
+// whose output on stdout is parsed, e.g. cks config default > cks.yaml,
+// so that messages and logs of them are written to stderr instead
+const annotationOutputOnStdout string = "cks/output-on-stdout"
+
+// annotationDryRun is set in annotations of commands
+// that print their plan with --dry-run, others refuse it
+const annotationDryRun string = "cks/dry-run"
+
 var (
 	// prefer this naming pattern for variables binding to flags
 	// use cmd name + "Flag" + variable name
 	// this makes more readable when those varabiles are used across multiple files
 	rootCmdFlagCfgFile           string
 	rootCmdFlagLogLevel          string
+	rootCmdFlagLogFormat         string
+	rootCmdFlagLogFileFormat     string
+	rootCmdFlagLogTimeFormat     string
+	rootCmdFlagLogLevelFormat    string
+	rootCmdFlagLogFile           string
+	rootCmdFlagLogMaxSize        int
+	rootCmdFlagLogMaxAge         int
+	rootCmdFlagLogMaxBackups     int
+	rootCmdFlagLogCompress       bool
+	rootCmdFlagLogSinks          []string
 	rootCmdFlagErrHandleWithExit string
+	rootCmdFlagNodeName          string
+	rootCmdFlagDryRun            bool
+	// clusterConfig is loaded from the config file before any subcommand runs
+	clusterConfig *conf.ClusterConfig
 	// undo is usually called when the whole program finishes
 	// this is used with zap logger
 	undo func()
@@ -49,6 +84,22 @@ xxxxxxxx`,
 	//	Run: func(cmd *cobra.Command, args []string) { },
 }
 
+// prepare reads in config file, sets up log system and error handling for the command to run,
+// and loads the cluster config unless the command skips it
+func prepare(cmd *cobra.Command, args []string) error {
+	initConfig(cmd)
+
+	// never change anything silently when a dry run is asked for
+	if _, ok := cmd.Annotations[annotationDryRun]; rootCmdFlagDryRun && !ok {
+		return errors.Errorf("--dry-run is not supported by cks %s, which has no plan to print",
+			strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" "))
+	}
+	if _, ok := cmd.Annotations[annotationSkipClusterConfig]; !ok {
+		loadClusterConfig()
+	}
+	return nil
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -67,7 +118,8 @@ func Execute() {
 }
 
 func init() {
-	cobra.OnInitialize(initConfig)
+	// rather than cobra.OnInitialize, as the command to run is only known here
+	rootCmd.PersistentPreRunE = prepare
 
 	// Here you will define your flags and configuration settings.
 	// Cobra supports persistent flags, which, if defined here,
@@ -76,19 +128,60 @@ func init() {
 	var desc string
 
 	rootCmd.PersistentFlags().StringVar(&rootCmdFlagCfgFile, "config", "/var/lib/eke.yaml", "config file")
+	hostname, _ := os.Hostname()
+	rootCmd.PersistentFlags().StringVar(&rootCmdFlagNodeName, "node-name", strings.ToLower(hostname),
+		"name of this node in the cluster config")
+	rootCmd.PersistentFlags().BoolVar(&rootCmdFlagDryRun, "dry-run", false,
+		"print the actions of commands changing this node in order without taking them")
 	desc = fmt.Sprintf("log level (support %s)", lgr.PrintAvailLogLevel())
 	rootCmd.PersistentFlags().StringVar(&rootCmdFlagLogLevel, "log-level", "info", desc)
+	desc = fmt.Sprintf("log format (support %s)", lgr.PrintAvailLogEncoding())
+	rootCmd.PersistentFlags().StringVar(&rootCmdFlagLogFormat, "log-format", lgr.EncodingConsole, desc)
+	desc = fmt.Sprintf("format of the log file, defaults to --log-format (support %s)", lgr.PrintAvailLogEncoding())
+	rootCmd.PersistentFlags().StringVar(&rootCmdFlagLogFileFormat, "log-file-format", "", desc)
+	desc = fmt.Sprintf("format of time in logs (support %s)", lgr.PrintAvailLogTimeFormat())
+	rootCmd.PersistentFlags().StringVar(&rootCmdFlagLogTimeFormat, "log-time-format", "iso8601", desc)
+	desc = fmt.Sprintf("format of levels in logs, defaults to upper in console and lower in others (support %s)",
+		lgr.PrintAvailLogLevelFormat())
+	rootCmd.PersistentFlags().StringVar(&rootCmdFlagLogLevelFormat, "log-level-format", "", desc)
+	rootCmd.PersistentFlags().StringVar(&rootCmdFlagLogFile, "log-file", "",
+		"file logs are written to in addition to stdout, or stderr for commands printing to stdout, e.g. cks config default")
+	rootCmd.PersistentFlags().IntVar(&rootCmdFlagLogMaxSize, "log-max-size", 0,
+		"size in megabytes the log file is rotated at (100 if unset while other rotation flags are set)")
+	rootCmd.PersistentFlags().IntVar(&rootCmdFlagLogMaxAge, "log-max-age", 0,
+		"days rotated log files are kept (0 means forever)")
+	rootCmd.PersistentFlags().IntVar(&rootCmdFlagLogMaxBackups, "log-max-backups", 0,
+		"number of rotated log files kept (0 means all)")
+	rootCmd.PersistentFlags().BoolVar(&rootCmdFlagLogCompress, "log-compress", false,
+		"compress rotated log files by gzip")
+	rootCmd.PersistentFlags().StringArrayVar(&rootCmdFlagLogSinks, "log-sink", nil,
+		"sink with its own level and format, e.g. path=stdout,level=warn,format=json, "+
+			"the last one takes effect for the same path (can be repeated)")
 	desc = fmt.Sprintf("how error information is given when handling error by exiting (support %s)",
 		erh.PrintAvailExitOnErr())
 	rootCmd.PersistentFlags().StringVar(&rootCmdFlagErrHandleWithExit, "err-handling", "simple", desc)
 
+	// make flags visible to viper as well
+	if err := viper.BindPFlags(rootCmd.PersistentFlags()); err != nil {
+		erh.ExitOnErr(err)
+	}
+
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	// rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
 
-// initConfig reads in config file and ENV variables if set.
-func initConfig() {
+// initConfig reads in config file and ENV variables if set,
+// which is done once the command to run is known.
+func initConfig(cmd *cobra.Command) {
+	// stdout is left for the output of commands printing to stdout
+	_, toStderr := cmd.Annotations[annotationOutputOnStdout]
+	notice := os.Stdout
+	if toStderr {
+		notice = os.Stderr
+		utils.SetOutput(os.Stderr)
+	}
+
 	if rootCmdFlagCfgFile != "" {
 		// Use config file from the flag.
 		viper.SetConfigFile(rootCmdFlagCfgFile)
@@ -99,15 +192,65 @@ func initConfig() {
 	}
 
 	viper.AutomaticEnv() // read in environment variables that match
+	bindEnvErr := conf.BindEnv(viper.GetViper())
 
 	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+	err := viper.ReadInConfig()
+	if err == nil {
+		fmt.Fprintln(notice, "Using config file:", viper.ConfigFileUsed())
 	}
 
 	// always first setup log system and then error handling
-	initLogger()
+	initLogger(toStderr)
 	initErrHandling()
+
+	if bindEnvErr != nil {
+		erh.ExitOnErr(bindEnvErr, undo)
+	}
+
+	// a config file explicitly given must be readable,
+	// otherwise the default cluster config is used
+	if err != nil && cmd.Flags().Changed("config") {
+		erh.ExitOnErr(errors.Wrapf(err, "failed to read config file %s", rootCmdFlagCfgFile), undo)
+	}
+}
+
+// loadClusterConfig unmarshals, defaults and validates the cluster config
+func loadClusterConfig() {
+	logger := lgr.GetGlobalLogger()
+
+	c, err := conf.Load(viper.GetViper())
+	if err != nil {
+		erh.ExitOnErr(err, undo)
+	}
+
+	// levels of components are only known once the cluster config is loaded
+	if err := lgr.SetComponentLevels(c.Logging.Levels); err != nil {
+		erh.ExitOnErr(err, undo)
+	}
+
+	logger.Debugf("cluster config %s loaded with %d node(s)", c.ClusterName, len(c.Nodes))
+	clusterConfig = c
+}
+
+// signalContext returns a context canceled on SIGINT or SIGTERM,
+// so that long-running commands are able to stop gracefully.
+// A second signal causes the program exit immediately
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		logger := lgr.GetGlobalLogger()
+		s := <-ch
+		logger.Infof("received signal %s, shutting down", s)
+		cancel()
+		s = <-ch
+		erh.ExitOnErr(errors.Errorf("received signal %s again, exit immediately", s), undo)
+	}()
+
+	return ctx
 }
 
 func initErrHandling() {
@@ -116,7 +259,9 @@ func initErrHandling() {
 	}
 }
 
-func initLogger() {
+// initLogger initializes the global logger, which writes to stderr
+// rather than stdout if toStderr
+func initLogger(toStderr bool) {
 	opts := []lgr.LogOption{}
 
 	// configure log level
@@ -127,6 +272,38 @@ func initLogger() {
 
 	opts = append(opts, opt)
 
+	if toStderr {
+		if opt, er = lgr.NewLogStreamOption("stderr"); er != nil {
+			erh.ExitOnErr(er)
+		}
+		opts = append(opts, opt)
+	}
+
+	// configure log format
+	fmtOpts, er := logFormatOptions()
+	if er != nil {
+		erh.ExitOnErr(er)
+	}
+	opts = append(opts, fmtOpts...)
+
+	// configure log file and its rotation
+	if rootCmdFlagLogFile != "" {
+		fileOpts, er := logFileOptions()
+		if er != nil {
+			erh.ExitOnErr(er)
+		}
+		opts = append(opts, fileOpts...)
+	}
+
+	// configure sinks individually
+	for _, spec := range rootCmdFlagLogSinks {
+		opt, er := lgr.NewLogSinkOption(spec)
+		if er != nil {
+			erh.ExitOnErr(er)
+		}
+		opts = append(opts, opt)
+	}
+
 	// initialize global logger
 	var err error
 	undo, _, err = lgr.InitLogger(opts...)
@@ -134,3 +311,71 @@ func initLogger() {
 		erh.ExitOnErr(err, undo)
 	}
 }
+
+// logFormatOptions returns options formatting logs by the format flags
+func logFormatOptions() ([]lgr.LogOption, error) {
+	opts := []lgr.LogOption{}
+
+	opt, err := lgr.NewLogEncodingOption(rootCmdFlagLogFormat)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid --log-format")
+	}
+	opts = append(opts, opt)
+
+	if opt, err = lgr.NewLogTimeFormatOption(rootCmdFlagLogTimeFormat); err != nil {
+		return nil, errors.Wrap(err, "invalid --log-time-format")
+	}
+	opts = append(opts, opt)
+
+	if rootCmdFlagLogLevelFormat != "" {
+		if opt, err = lgr.NewLogLevelFormatOption(rootCmdFlagLogLevelFormat); err != nil {
+			return nil, errors.Wrap(err, "invalid --log-level-format")
+		}
+		opts = append(opts, opt)
+	}
+
+	if rootCmdFlagLogFileFormat != "" {
+		if opt, err = lgr.NewLogFileEncodingOption(rootCmdFlagLogFileFormat); err != nil {
+			return nil, errors.Wrap(err, "invalid --log-file-format")
+		}
+		opts = append(opts, opt)
+	}
+	return opts, nil
+}
+
+// logFileOptions returns options writing logs to the file given by --log-file,
+// which is rotated if any of the rotation flags is set
+func logFileOptions() ([]lgr.LogOption, error) {
+	enable, err := lgr.NewEnableLogFileOption()
+	if err != nil {
+		return nil, err
+	}
+	path, err := lgr.NewLogFilePathOption(rootCmdFlagLogFile)
+	if err != nil {
+		return nil, err
+	}
+	opts := []lgr.LogOption{enable, path}
+
+	flags := rootCmd.PersistentFlags()
+	for _, f := range []struct {
+		name string
+		opt  func() (lgr.LogOption, error)
+	}{
+		{"log-max-size", func() (lgr.LogOption, error) { return lgr.NewLogFileMaxSizeOption(rootCmdFlagLogMaxSize) }},
+		{"log-max-age", func() (lgr.LogOption, error) { return lgr.NewLogFileMaxAgeOption(rootCmdFlagLogMaxAge) }},
+		{"log-max-backups", func() (lgr.LogOption, error) {
+			return lgr.NewLogFileMaxBackupsOption(rootCmdFlagLogMaxBackups)
+		}},
+		{"log-compress", lgr.NewLogFileCompressOption},
+	} {
+		if !flags.Changed(f.name) || (f.name == "log-compress" && !rootCmdFlagLogCompress) {
+			continue
+		}
+		opt, err := f.opt()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid --%s", f.name)
+		}
+		opts = append(opts, opt)
+	}
+	return opts, nil
+}
@@ -0,0 +1,189 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/state"
+)
+
+var (
+	stateDiffCmdFlagOutput string
+)
+
+// stateCmd represents the state command
+var stateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Inspect what has been provisioned on this node.",
+}
+
+// stateShowCmd represents the state show command
+var stateShowCmd = &cobra.Command{
+	Use:          "show",
+	Short:        "Print the state recorded in the data directory.",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		s, err := state.Load(clusterConfig.DataDir)
+		if err != nil {
+			return err
+		}
+		out, err := yaml.Marshal(s)
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal state")
+		}
+		fmt.Print(string(out))
+		return nil
+	},
+}
+
+// stateDiffCmd represents the state diff command
+var stateDiffCmd = &cobra.Command{
+	Use:          "diff",
+	Short:        "Print changes of the cluster config against the recorded state.",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := checkOutput(stateDiffCmdFlagOutput); err != nil {
+			return err
+		}
+
+		s, err := state.Load(clusterConfig.DataDir)
+		if err != nil {
+			return err
+		}
+		changes, err := state.Diff(s, clusterConfig)
+		if err != nil {
+			return err
+		}
+
+		if stateDiffCmdFlagOutput == outputJSON {
+			out, err := json.MarshalIndent(changes, "", "  ")
+			if err != nil {
+				return errors.Wrap(err, "failed to marshal changes")
+			}
+			fmt.Println(string(out))
+			return nil
+		}
+		for _, c := range changes {
+			fmt.Println(c.String())
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(stateCmd)
+	stateCmd.AddCommand(stateShowCmd, stateDiffCmd)
+
+	stateDiffCmd.Flags().StringVar(&stateDiffCmdFlagOutput, "output", outputText,
+		fmt.Sprintf("output format, %s or %s", outputText, outputJSON))
+}
+
+// operation is a mutating command holding the lock of the data directory
+// until it ends, where controller and worker end it once provisioned
+type operation struct {
+	name  string
+	lock  *state.Lock
+	state *state.State
+}
+
+// beginOperation locks the data directory and diffs the cluster config against the state,
+// changes unable to apply to a provisioned node are refused
+func beginOperation(name string) (*operation, error) {
+	return beginOperationWith(name, clusterConfig)
+}
+
+// beginOperationWith begins the operation with the cluster config other than the given one,
+// e.g. the one restored from a backup
+func beginOperationWith(name string, cfg *conf.ClusterConfig) (*operation, error) {
+	logger := lgr.GetGlobalLogger()
+
+	lock, err := state.LockDataDir(cfg.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	op := &operation{name: name, lock: lock}
+
+	if op.state, err = state.Load(cfg.DataDir); err != nil {
+		op.end()
+		return nil, err
+	}
+	changes, err := state.Diff(op.state, cfg)
+	if err != nil {
+		op.end()
+		return nil, err
+	}
+
+	switch {
+	case op.state.IsEmpty():
+		logger.Infof("nothing provisioned in %s yet", cfg.DataDir)
+	case len(changes) == 0:
+		logger.Infof("cluster config unchanged since the last %s at %s",
+			op.state.LastOperation.Name, op.state.LastOperation.Time.Format(time.RFC3339))
+	default:
+		for _, c := range changes {
+			logger.Infof("cluster config %s", c)
+			if c.Path == "clusterName" {
+				op.end()
+				return nil, errors.Errorf("%s, which is unable to apply to a provisioned node, run cks reset first", c)
+			}
+		}
+	}
+	return op, nil
+}
+
+// succeed records the operation succeeded with the cluster config into its data directory
+func (op *operation) succeed(cfg *conf.ClusterConfig) error {
+	if err := op.state.Record(cfg, op.name, rootCmdFlagNodeName, time.Now()); err != nil {
+		return err
+	}
+	return state.Save(cfg.DataDir, op.state)
+}
+
+// end releases the lock of the data directory, which is a no-op once ended
+func (op *operation) end() {
+	if op.lock == nil {
+		return
+	}
+	if err := op.lock.Unlock(); err != nil {
+		lgr.GetGlobalLogger().Warnf("%v", err)
+	}
+	op.lock = nil
+}
+
+// lockRole takes the lock of the role held by controller or worker for its whole run,
+// the returned func releases it
+func lockRole(role conf.Role) (func(), error) {
+	lock, err := state.LockRole(clusterConfig.DataDir, role)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		if err := lock.Unlock(); err != nil {
+			lgr.GetGlobalLogger().Warnf("%v", err)
+		}
+	}, nil
+}
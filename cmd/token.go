@@ -0,0 +1,220 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/join"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/pki"
+	"github.com/jiuchen1986/cks/pkg/plan"
+	"github.com/jiuchen1986/cks/pkg/token"
+)
+
+var (
+	tokenCreateCmdFlagRole        string
+	tokenCreateCmdFlagExpiry      time.Duration
+	tokenCreateCmdFlagDescription string
+	tokenCreateCmdFlagNode        string
+	tokenCreateCmdFlagOutput      string
+	tokenRevokeCmdFlagOutput      string
+)
+
+// tokenCmd represents the token command
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Manage bootstrap tokens used by nodes to join the cluster.",
+}
+
+// tokenCreateCmd represents the token create command
+var tokenCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create a bootstrap token and print it.",
+	Long: `Create a bootstrap token and print it.
+
+The token embeds the endpoint serving join requests and the hash of the cluster CA,
+so it is all a node needs to join the cluster. A worker gets its kubelet credentials
+with a token of role worker, while a controller gets the CAs, its etcd certificates
+and its etcd member added as a learner with a token of role controller.
+
+A worker token joins any worker whose kubelet credentials have never been issued, while
+a token created with --node joins only the node, which also rejoins a worker, e.g. after reset.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	Annotations:  map[string]string{annotationDryRun: ""},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := checkOutput(tokenCreateCmdFlagOutput); err != nil {
+			return err
+		}
+		if rootCmdFlagDryRun {
+			return planCreateToken()
+		}
+
+		tk, _, err := createToken(conf.Role(tokenCreateCmdFlagRole), tokenCreateCmdFlagExpiry,
+			tokenCreateCmdFlagDescription, tokenCreateCmdFlagNode)
+		if err != nil {
+			return err
+		}
+		fmt.Println(tk.String())
+		return nil
+	},
+}
+
+// tokenListCmd represents the token list command
+var tokenListCmd = &cobra.Command{
+	Use:          "list",
+	Short:        "List bootstrap tokens with their roles and expiry.",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		records, err := tokenManager().List()
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		defer w.Flush()
+
+		now := time.Now()
+		fmt.Fprintln(w, "ID\tROLE\tNODE\tEXPIRES\tSTATUS\tDESCRIPTION")
+		for _, r := range records {
+			node, expires, status := "*", "never", "valid"
+			if r.NodeName != "" {
+				node = r.NodeName
+			}
+			if !r.Expires.IsZero() {
+				expires = r.Expires.Format(time.RFC3339)
+			}
+			if r.IsExpired(now) {
+				status = "expired"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.ID, r.Role, node, expires, status, r.Description)
+		}
+		return nil
+	},
+}
+
+// tokenRevokeCmd represents the token revoke command
+var tokenRevokeCmd = &cobra.Command{
+	Use:          "revoke <id|token>",
+	Short:        "Revoke a bootstrap token by its ID or the token itself.",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	Annotations:  map[string]string{annotationDryRun: ""},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger := lgr.GetGlobalLogger()
+		defer logger.Sync()
+
+		if err := checkOutput(tokenRevokeCmdFlagOutput); err != nil {
+			return err
+		}
+		if rootCmdFlagDryRun {
+			r, err := tokenManager().Get(args[0])
+			if err != nil {
+				return err
+			}
+			pl := plan.New("token revoke", rootCmdFlagNodeName)
+			pl.Add(plan.RemoveFile, token.RecordPath(token.Dir(clusterConfig.DataDir), r.ID),
+				fmt.Sprintf("token %s of role %s", r.ID, r.Role))
+			return printPlan(pl, tokenRevokeCmdFlagOutput)
+		}
+
+		id, err := tokenManager().Revoke(args[0])
+		if err != nil {
+			return err
+		}
+		logger.Infof("token %s revoked", id)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(tokenCmd)
+	tokenCmd.AddCommand(tokenCreateCmd)
+	tokenCmd.AddCommand(tokenListCmd)
+	tokenCmd.AddCommand(tokenRevokeCmd)
+
+	tokenCreateCmd.Flags().StringVar(&tokenCreateCmdFlagRole, "role", string(conf.RoleWorker),
+		fmt.Sprintf("role of nodes joining with the token, %s or %s", conf.RoleWorker, conf.RoleController))
+	tokenCreateCmd.Flags().DurationVar(&tokenCreateCmdFlagExpiry, "expiry", token.DefaultTTL,
+		"how long the token is valid, 0 means never expire")
+	tokenCreateCmd.Flags().StringVar(&tokenCreateCmdFlagDescription, "description", "", "description of the token")
+	tokenCreateCmd.Flags().StringVar(&tokenCreateCmdFlagNode, "node", "", "name of the only node joining with the token")
+	addPlanOutputFlag(tokenCreateCmd, &tokenCreateCmdFlagOutput)
+	addPlanOutputFlag(tokenRevokeCmd, &tokenRevokeCmdFlagOutput)
+}
+
+func tokenManager() *token.Manager {
+	return token.NewManager(token.NewFileStore(token.Dir(clusterConfig.DataDir)))
+}
+
+// createToken creates a token of the role embedding the join server and the hash of the cluster CA,
+// which is bound to the node if nodeName is not empty
+func createToken(role conf.Role, ttl time.Duration, description, nodeName string) (*token.Token, *token.Record, error) {
+	ca, err := pki.LoadCert(pki.CertPath(pki.Dir(clusterConfig.DataDir), pki.CAName))
+	if err != nil {
+		return nil, nil, err
+	}
+	return tokenManager().Create(&token.CreateOptions{
+		Role:        role,
+		Description: description,
+		NodeName:    nodeName,
+		TTL:         ttl,
+		Server:      joinServerURL(),
+		CAHash:      pki.CAHash(ca),
+	})
+}
+
+// planCreateToken prints the record tokenCreateCmd would write,
+// whose ID is unknown until the token is generated
+func planCreateToken() error {
+	if _, err := pki.LoadCert(pki.CertPath(pki.Dir(clusterConfig.DataDir), pki.CAName)); err != nil {
+		return err
+	}
+	opts := &token.CreateOptions{
+		Role:     conf.Role(tokenCreateCmdFlagRole),
+		NodeName: tokenCreateCmdFlagNode,
+		TTL:      tokenCreateCmdFlagExpiry,
+	}
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	detail := fmt.Sprintf("new token of role %s", opts.Role)
+	if opts.NodeName != "" {
+		detail += " bound to node " + opts.NodeName
+	}
+	if opts.TTL > 0 {
+		detail += ", expires in " + opts.TTL.String()
+	}
+	pl := plan.New("token create", rootCmdFlagNodeName)
+	pl.Add(plan.WriteFile, token.Dir(clusterConfig.DataDir), detail)
+	return printPlan(pl, tokenCreateCmdFlagOutput)
+}
+
+// joinServerURL returns the URL serving join requests on the API address
+func joinServerURL() string {
+	return "https://" + net.JoinHostPort(clusterConfig.API.Address, strconv.Itoa(join.Port))
+}
@@ -0,0 +1,216 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/join"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/plan"
+	"github.com/jiuchen1986/cks/pkg/preflight"
+	"github.com/jiuchen1986/cks/pkg/state"
+	"github.com/jiuchen1986/cks/pkg/token"
+	"github.com/jiuchen1986/cks/pkg/utils"
+	"github.com/jiuchen1986/cks/pkg/worker"
+)
+
+var (
+	workerCmdFlagToken           string
+	workerCmdFlagNodeIP          string
+	workerCmdFlagIgnorePreflight []string
+	workerCmdFlagOutput          string
+)
+
+// workerCmd represents the worker command
+var workerCmd = &cobra.Command{
+	Use:   "worker",
+	Short: "Join this node to the cluster and run kubelet and containerd until SIGINT or SIGTERM.",
+	Long: `Join this node to the cluster and run kubelet and containerd until SIGINT or SIGTERM.
+
+The CA and the kubelet kubeconfig are fetched from the join server of a controller
+embedded in the token on the first run, later runs reuse them from the data directory.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	Annotations:  map[string]string{annotationDryRun: ""},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		logger := lgr.GetGlobalStructuredLogger()
+		defer logger.Sync()
+
+		if err := checkOutput(workerCmdFlagOutput); err != nil {
+			return err
+		}
+
+		var tk *token.Token
+		if workerCmdFlagToken != "" {
+			t, err := token.Parse(workerCmdFlagToken)
+			if err != nil {
+				return err
+			}
+			tk = t
+		}
+		if rootCmdFlagDryRun {
+			return planWorker(tk)
+		}
+
+		ctx := signalContext()
+
+		env := preflight.NewEnv(clusterConfig.DataDir)
+		if tk != nil {
+			env.ReferenceTime = preflight.HTTPDate(tk.Server)
+		}
+		if err := runPreflight(env, []conf.Role{conf.RoleWorker}, workerCmdFlagIgnorePreflight); err != nil {
+			return err
+		}
+
+		nodeIP, err := workerNodeIP(tk)
+		if err != nil {
+			return err
+		}
+
+		unlock, err := lockRole(conf.RoleWorker)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		// the lock of the data directory is only held during provisioning,
+		// so that others, e.g. cks certs renew, are able to run meanwhile
+		op, err := beginOperation("worker")
+		if err != nil {
+			return err
+		}
+		defer op.end()
+
+		// the socket is only taken over with the role locked
+		startAdmin(ctx, conf.RoleWorker)
+
+		binDir, err := prepareBinDir()
+		if err != nil {
+			return err
+		}
+
+		w := worker.New(clusterConfig, rootCmdFlagNodeName, nodeIP, binDir)
+
+		if w.IsJoined() {
+			logger.Info("node already joined, reuse bootstrap material", map[string]string{"node": rootCmdFlagNodeName})
+		} else {
+			if tk == nil {
+				return errors.New("--token is required to join the cluster")
+			}
+			if err := w.Join(&join.Client{
+				Server: tk.Server,
+				Token:  workerCmdFlagToken,
+				CAHash: tk.CAHash,
+			}); err != nil {
+				return err
+			}
+			logger.Info("node joined", map[string]string{"node": rootCmdFlagNodeName, "address": nodeIP})
+		}
+
+		if err := w.Prepare(); err != nil {
+			return err
+		}
+		if err := w.StartLoadBalancer(ctx); err != nil {
+			return err
+		}
+		if err := w.Start(ctx); err != nil {
+			w.Stop()
+			return err
+		}
+		logger.Info("worker started", map[string]string{"node": rootCmdFlagNodeName})
+		if err := op.succeed(clusterConfig); err != nil {
+			w.Stop()
+			return err
+		}
+		op.end()
+
+		<-ctx.Done()
+		logger.Info("stop worker")
+		w.Stop()
+		logger.Info("worker stopped")
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(workerCmd)
+
+	workerCmd.Flags().StringVar(&workerCmdFlagToken, "token", "", "token to join the cluster, created by cks token create")
+	workerCmd.Flags().StringSliceVar(&workerCmdFlagIgnorePreflight, "ignore-preflight", nil,
+		fmt.Sprintf("preflight checks whose failures are ignored, %s to ignore all", preflight.IgnoreAll))
+	workerCmd.Flags().StringVar(&workerCmdFlagNodeIP, "node-ip", "", "IP address of this node, defaults to the address reaching the join server")
+	workerCmd.Flags().StringVar(&workerCmdFlagOutput, "output", outputText,
+		fmt.Sprintf("output format of the plan with --dry-run, %s or %s", outputText, outputJSON))
+}
+
+// planWorker prints the actions the worker would take on this node
+func planWorker(tk *token.Token) error {
+	pl := plan.New("worker", rootCmdFlagNodeName)
+
+	nodeIP, err := workerNodeIP(tk)
+	if err != nil {
+		return err
+	}
+	binDir, err := planBinDir(pl)
+	if err != nil {
+		return err
+	}
+	w := worker.New(clusterConfig, rootCmdFlagNodeName, nodeIP, binDir)
+	if !w.IsJoined() && tk == nil {
+		return errors.New("--token is required to join the cluster")
+	}
+
+	server := ""
+	if tk != nil {
+		server = tk.Server
+	}
+	if err := w.Plan(pl, server); err != nil {
+		return err
+	}
+	pl.Add(plan.WriteFile, state.Path(clusterConfig.DataDir), "state of the worker")
+	return printPlan(pl, workerCmdFlagOutput)
+}
+
+// workerNodeIP returns the node IP from the flag, the cluster config
+// or the outbound address towards the join server in order,
+// where the loopback address of the default single node config is skipped
+func workerNodeIP(tk *token.Token) (string, error) {
+	if workerCmdFlagNodeIP != "" {
+		return workerCmdFlagNodeIP, nil
+	}
+	if n := clusterConfig.Node(rootCmdFlagNodeName); n != nil && n.Address != "" && !net.ParseIP(n.Address).IsLoopback() {
+		return n.Address, nil
+	}
+	if tk == nil {
+		return "", errors.New("--node-ip is required without --token")
+	}
+	u, err := url.Parse(tk.Server)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid server %s in token", tk.Server)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "443")
+	}
+	return utils.OutboundIP(host)
+}
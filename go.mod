@@ -1,6 +1,6 @@
 module github.com/jiuchen1986/cks
 
-go 1.15
+go 1.16
 
 require (
 	github.com/pkg/errors v0.9.1
@@ -8,5 +8,8 @@ require (
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.7.1
 	github.com/stretchr/testify v1.4.0
+	go.uber.org/multierr v1.5.0
 	go.uber.org/zap v1.16.0
+	gopkg.in/natefinch/lumberjack.v2 v2.2.1
+	gopkg.in/yaml.v2 v2.2.8
 )
@@ -0,0 +1,32 @@
+#!/bin/sh
+# Copy files into pkg/assets/bundle and generate the bundle manifest,
+# then build cks with the files embedded by:
+#
+#   go build -tags assets
+#
+# Usage: hack/bundle-assets.sh <version> <file>...
+set -e
+
+if [ $# -lt 2 ]; then
+	echo "usage: $0 <version> <file>..." >&2
+	exit 1
+fi
+
+version=$1
+shift
+
+bundle=$(cd "$(dirname "$0")/.." && pwd)/pkg/assets/bundle
+find "$bundle" -mindepth 1 ! -name README.md -exec rm -rf {} +
+
+manifest=$bundle/manifest.yaml
+echo "version: $version" > "$manifest"
+echo "files:" >> "$manifest"
+for f in "$@"; do
+	name=$(basename "$f")
+	cp "$f" "$bundle/$name"
+	sum=$(sha256sum "$bundle/$name" | cut -d ' ' -f 1)
+	echo "- name: $name" >> "$manifest"
+	echo "  sha256: $sum" >> "$manifest"
+done
+
+echo "$# file(s) of version $version bundled in $bundle"
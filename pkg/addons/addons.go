@@ -0,0 +1,255 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package addons
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	"github.com/jiuchen1986/cks/pkg/components"
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/worker"
+)
+
+// manifests of the shipped addons, one file per addon named after it
+//go:embed manifests
+var manifests embed.FS
+
+// Object is a kubernetes object decoded from a manifest
+type Object map[string]interface{}
+
+// APIVersion returns the apiVersion of the object
+func (o Object) APIVersion() string {
+	s, _ := o["apiVersion"].(string)
+	return s
+}
+
+// Kind returns the kind of the object
+func (o Object) Kind() string {
+	s, _ := o["kind"].(string)
+	return s
+}
+
+// Name returns the name of the object
+func (o Object) Name() string {
+	return o.metadata("name")
+}
+
+// Namespace returns the namespace of the object, which is empty if not set
+func (o Object) Namespace() string {
+	return o.metadata("namespace")
+}
+
+// String identifies the object as kind/namespace/name
+func (o Object) String() string {
+	if ns := o.Namespace(); ns != "" {
+		return fmt.Sprintf("%s/%s/%s", o.Kind(), ns, o.Name())
+	}
+	return fmt.Sprintf("%s/%s", o.Kind(), o.Name())
+}
+
+func (o Object) metadata(key string) string {
+	m, _ := o["metadata"].(map[string]interface{})
+	s, _ := m[key].(string)
+	return s
+}
+
+// Labels returns the labels of the object, which is empty if not set
+func (o Object) Labels() map[string]string {
+	m, _ := o["metadata"].(map[string]interface{})
+	ls, _ := m["labels"].(map[string]interface{})
+	labels := make(map[string]string, len(ls))
+	for k, v := range ls {
+		if s, ok := v.(string); ok {
+			labels[k] = s
+		}
+	}
+	return labels
+}
+
+// setLabel sets the label of the object, adding metadata.labels if missing
+func (o Object) setLabel(key, value string) {
+	m, ok := o["metadata"].(map[string]interface{})
+	if !ok {
+		m = map[string]interface{}{}
+		o["metadata"] = m
+	}
+	ls, ok := m["labels"].(map[string]interface{})
+	if !ok {
+		ls = map[string]interface{}{}
+		m["labels"] = ls
+	}
+	ls[key] = value
+}
+
+// ref returns the object with only what identifies it
+func (o Object) ref() Object {
+	md := map[string]interface{}{"name": o.Name()}
+	if ns := o.Namespace(); ns != "" {
+		md["namespace"] = ns
+	}
+	return Object{"apiVersion": o.APIVersion(), "kind": o.Kind(), "metadata": md}
+}
+
+// key identifies the object also by its API group, regardless of the version
+func (o Object) key() string {
+	group := ""
+	if i := strings.LastIndex(o.APIVersion(), "/"); i >= 0 {
+		group = o.APIVersion()[:i]
+	}
+	return group + " " + o.String()
+}
+
+// Decode decodes the objects in a multi-document yaml or json manifest,
+// empty documents are skipped
+func Decode(data []byte) ([]Object, error) {
+	objs := []Object{}
+	d := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc interface{}
+		if err := d.Decode(&doc); err != nil {
+			if err == io.EOF {
+				return objs, nil
+			}
+			return nil, errors.Wrap(err, "failed to decode manifest")
+		}
+		if doc == nil {
+			continue
+		}
+
+		obj, ok := normalize(doc).(map[string]interface{})
+		if !ok {
+			return nil, errors.Errorf("document %d of manifest is not an object", len(objs))
+		}
+		o := Object(obj)
+		if o.APIVersion() == "" || o.Kind() == "" || o.Name() == "" {
+			return nil, errors.Errorf("object %s in manifest misses apiVersion, kind or metadata.name", o)
+		}
+		objs = append(objs, o)
+	}
+}
+
+// normalize converts maps decoded by yaml.v2 to ones with string keys,
+// so that objects can be encoded in json
+func normalize(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[fmt.Sprint(k)] = normalize(e)
+		}
+		return m
+	case []interface{}:
+		for i, e := range t {
+			t[i] = normalize(e)
+		}
+		return t
+	default:
+		return v
+	}
+}
+
+// Manifest is the objects from the same source,
+// which is the name of a shipped addon or a file of users
+type Manifest struct {
+	Source  string   `json:"source"`
+	Objects []Object `json:"objects"`
+}
+
+// Values are the inputs of the manifest templates of the shipped addons
+type Values struct {
+	Config *conf.ClusterConfig
+	// APIHost and APIPort are used by addons running before services are available
+	APIHost string
+	APIPort int
+	// CNIBinDir and CNIConfDir are where the CNI plugins and configs are installed on nodes
+	CNIBinDir     string
+	CNIConfDir    string
+	KubeProxyArgs []string
+}
+
+// NewValues returns the template values from the cluster config
+func NewValues(cfg *conf.ClusterConfig) (*Values, error) {
+	// the node name is filled in by the DaemonSet on each node
+	args, err := components.KubeProxy(cfg, &components.KubeProxyOptions{NodeName: "$(NODE_NAME)"})
+	if err != nil {
+		return nil, err
+	}
+	return &Values{
+		Config:        cfg,
+		APIHost:       cfg.API.Address,
+		APIPort:       cfg.API.Port,
+		CNIBinDir:     worker.CNIBinDir(cfg.DataDir),
+		CNIConfDir:    worker.CNIConfDir(cfg.DataDir),
+		KubeProxyArgs: args,
+	}, nil
+}
+
+var funcs = template.FuncMap{
+	// quote renders a string as a json string, which is also a valid yaml scalar
+	"quote": func(s string) (string, error) {
+		b, err := json.Marshal(s)
+		return string(b), err
+	},
+}
+
+// Render renders the enabled addons from the cluster config
+// in the order of conf.AddonNames
+func Render(cfg *conf.ClusterConfig) ([]Manifest, error) {
+	v, err := NewValues(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	ms := []Manifest{}
+	for _, name := range conf.AddonNames() {
+		if !cfg.Addons.IsEnabled(name) {
+			continue
+		}
+		objs, err := renderAddon(name, v)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, Manifest{Source: name, Objects: objs})
+	}
+	return ms, nil
+}
+
+func renderAddon(name string, v *Values) ([]Object, error) {
+	data, err := manifests.ReadFile("manifests/" + name + ".yaml")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read manifest of addon %s", name)
+	}
+	t, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse manifest of addon %s", name)
+	}
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, v); err != nil {
+		return nil, errors.Wrapf(err, "failed to render manifest of addon %s", name)
+	}
+
+	objs, err := Decode(buf.Bytes())
+	return objs, errors.Wrapf(err, "invalid manifest of addon %s", name)
+}
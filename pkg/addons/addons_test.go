@@ -0,0 +1,459 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package addons_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jiuchen1986/cks/pkg/addons"
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/kubeconfig"
+	"github.com/jiuchen1986/cks/pkg/pki"
+	"github.com/jiuchen1986/cks/pkg/plan"
+)
+
+func find(ms []addons.Manifest, source, id string) addons.Object {
+	for _, m := range ms {
+		for _, obj := range m.Objects {
+			if m.Source == source && obj.String() == id {
+				return obj
+			}
+		}
+	}
+	return nil
+}
+
+func sources(ms []addons.Manifest) []string {
+	s := []string{}
+	for _, m := range ms {
+		s = append(s, m.Source)
+	}
+	return s
+}
+
+func TestRender(t *testing.T) {
+	cfg := conf.NewDefault()
+	cfg.DataDir = "/var/lib/cks-test"
+	cfg.Network.PodCIDR = "10.100.0.0/16"
+	cfg.Addons.Disabled = []string{conf.AddonMetricsServer}
+
+	ms, err := addons.Render(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{conf.AddonKubeProxy, conf.AddonFlannel, conf.AddonCoreDNS, conf.AddonStorageClass},
+		sources(ms), "Enabled addons should be rendered in order.")
+
+	ds := find(ms, conf.AddonKubeProxy, "DaemonSet/kube-system/kube-proxy")
+	if assert.NotNil(t, ds) {
+		data, _ := json.Marshal(ds)
+		assert.Contains(t, string(data), `"--hostname-override=$(NODE_NAME)"`)
+		assert.Contains(t, string(data), `"--cluster-cidr=10.100.0.0/16"`)
+		assert.NotContains(t, string(data), "--kubeconfig", "kube-proxy should use the in-cluster config.")
+		assert.Contains(t, string(data), "kube-proxy:"+cfg.Versions.Kubernetes)
+	}
+
+	cm := find(ms, conf.AddonFlannel, "ConfigMap/kube-flannel/kube-flannel-cfg")
+	if assert.NotNil(t, cm) {
+		data := cm["data"].(map[string]interface{})
+		assert.Contains(t, data["net-conf.json"], `"Network": "10.100.0.0/16"`)
+	}
+	ds = find(ms, conf.AddonFlannel, "DaemonSet/kube-flannel/kube-flannel-ds")
+	if assert.NotNil(t, ds) {
+		data, _ := json.Marshal(ds)
+		assert.Contains(t, string(data), `"path":"/var/lib/cks-test/etc/cni/net.d"`, "CNI configs should be "+
+			"installed where containerd looks them up.")
+		assert.Contains(t, string(data), `"path":"/var/lib/cks-test/bin/current"`)
+	}
+
+	svc := find(ms, conf.AddonCoreDNS, "Service/kube-system/kube-dns")
+	if assert.NotNil(t, svc) {
+		assert.Equal(t, cfg.Network.ClusterDNS, svc["spec"].(map[string]interface{})["clusterIP"])
+	}
+	assert.NotNil(t, find(ms, conf.AddonStorageClass, "StorageClass/local"))
+}
+
+func TestDecode(t *testing.T) {
+	objs, err := addons.Decode([]byte(`
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+  namespace: test
+data:
+  1: one
+---
+{"apiVersion": "v1", "kind": "Namespace", "metadata": {"name": "test"}}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Equal(t, 2, len(objs), "Empty documents should be skipped.") {
+		assert.Equal(t, "ConfigMap/test/a", objs[0].String())
+		assert.Equal(t, "Namespace/test", objs[1].String())
+		_, err := json.Marshal(objs[0])
+		assert.Nil(t, err, "Decoded objects should be encodable in json.")
+	}
+
+	_, err = addons.Decode([]byte("apiVersion: v1\nkind: ConfigMap\n"))
+	assert.NotNil(t, err, "Objects without names should be invalid.")
+	_, err = addons.Decode([]byte("- a\n- b\n"))
+	assert.NotNil(t, err, "Documents other than objects should be invalid.")
+}
+
+// fakeClient records the applied and deleted objects
+type fakeClient struct {
+	applied []string
+	deleted []string
+	// fail is the object failing to apply or delete
+	fail string
+}
+
+func (c *fakeClient) Apply(ctx context.Context, obj addons.Object) error {
+	if obj.String() == c.fail {
+		return fmt.Errorf("conflict")
+	}
+	c.applied = append(c.applied, obj.String())
+	return nil
+}
+
+func (c *fakeClient) Delete(ctx context.Context, obj addons.Object) error {
+	if obj.String() == c.fail {
+		return fmt.Errorf("conflict")
+	}
+	c.deleted = append(c.deleted, obj.String())
+	return nil
+}
+
+func TestReconcile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-addons")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := conf.NewDefault()
+	cfg.DataDir = dir
+	cfg.Addons.Disabled = conf.AddonNames()[1:]
+	c := &fakeClient{}
+	r := addons.NewReconciler(cfg, c)
+	ctx := context.Background()
+
+	assert.Nil(t, r.ReconcileOnce(ctx), "No manifests directory should be fine.")
+	assert.Equal(t, []string{
+		"ServiceAccount/kube-system/kube-proxy",
+		"ClusterRoleBinding/cks:kube-proxy",
+		"DaemonSet/kube-system/kube-proxy",
+	}, c.applied, "Only the enabled addons should be applied.")
+
+	files := map[string]string{
+		"b/app.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n  namespace: app\n",
+		"a.yml":      "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: app\n",
+		"c.json":     `{"apiVersion": "v1", "kind": "Secret", "metadata": {"name": "s", "namespace": "app"}}`,
+		"d.yaml":     "kind: ConfigMap\n",
+		"README.md":  "not a manifest",
+	}
+	for name, content := range files {
+		p := filepath.Join(r.Dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.applied = nil
+	c.fail = "ClusterRoleBinding/cks:kube-proxy"
+	err = r.ReconcileOnce(ctx)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "d.yaml", "Invalid manifests should be reported.")
+		assert.Contains(t, err.Error(), "conflict", "Failures to apply should be reported.")
+	}
+	assert.Equal(t, []string{
+		"Namespace/app",
+		"ServiceAccount/kube-system/kube-proxy",
+		"DaemonSet/kube-system/kube-proxy",
+		"ConfigMap/app/app",
+		"Secret/app/s",
+	}, c.applied, "All the valid objects should be applied with namespaces first.")
+
+	applied := len(c.applied)
+	pl := plan.New("controller", "node-a")
+	assert.NotNil(t, r.Plan(pl), "Invalid manifests should fail the plan.")
+	if err := os.Remove(filepath.Join(r.Dir, "d.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	pl = plan.New("controller", "node-a")
+	if err := r.Plan(pl); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 6, len(pl.Targets(plan.ApplyManifest)))
+	assert.Equal(t, filepath.Join(r.Dir, "a.yml"), pl.Actions[0].Detail, "Actions should tell the source.")
+	assert.Equal(t, applied, len(c.applied), "Planning should apply nothing.")
+}
+
+func TestReconcilePrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-addons")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := conf.NewDefault()
+	cfg.DataDir = dir
+	cfg.Addons.Disabled = conf.AddonNames()[1:]
+	c := &fakeClient{}
+	r := addons.NewReconciler(cfg, c)
+	write := func(name, content string) {
+		if err := os.MkdirAll(r.Dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(r.Dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// reconcile once as Run does at its start
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+	run := func() {
+		c.applied, c.deleted = nil, nil
+		r.Run(done)
+	}
+
+	write("a.yaml", "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: app\n")
+	write("b.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app-x\n  namespace: app\n---\n"+
+		"apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app-z\n  namespace: app\n")
+	run()
+	assert.Equal(t, 6, len(c.applied))
+	ms, err := r.Manifests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, addons.FieldManager, ms[0].Objects[0].Labels()[addons.ManagedByLabel],
+		"Objects should be labeled as managed by cks.")
+
+	write("c.yaml", "kind: ConfigMap\n")
+	run()
+	assert.Empty(t, c.applied, "Invalid manifests should not make the valid ones applied again.")
+	assert.Empty(t, c.deleted)
+
+	write("b.yaml", "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app-x\n  namespace: app\n")
+	run()
+	assert.Equal(t, []string{"ConfigMap/app/app-x"}, c.applied, "Only the changed manifests should be applied.")
+	assert.Equal(t, []string{"ConfigMap/app/app-z"}, c.deleted, "Objects removed from manifests should be deleted.")
+
+	write("b.yaml", "kind: ConfigMap\n")
+	run()
+	assert.Empty(t, c.deleted, "Objects of invalid manifests should be kept.")
+
+	if err := os.Remove(filepath.Join(r.Dir, "a.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	c.fail = "Namespace/app"
+	run()
+	assert.Empty(t, c.deleted)
+	c.fail = ""
+	run()
+	assert.Equal(t, []string{"Namespace/app"}, c.deleted, "Objects failing to delete should be retried.")
+
+	// the applied objects are recorded across restarts
+	cfg.Addons.Disabled = conf.AddonNames()
+	r = addons.NewReconciler(cfg, c)
+	pl := plan.New("controller", "node-a")
+	assert.NotNil(t, r.Plan(pl), "Invalid manifests should fail the plan.")
+	if err := os.Remove(filepath.Join(r.Dir, "b.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(r.Dir, "c.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	pl = plan.New("controller", "node-a")
+	if err := r.Plan(pl); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"ConfigMap/app/app-x",
+		"ServiceAccount/kube-system/kube-proxy",
+		"ClusterRoleBinding/cks:kube-proxy",
+		"DaemonSet/kube-system/kube-proxy",
+	}
+	assert.Equal(t, expected, pl.Targets(plan.DeleteObject), "Disabled addons and removed manifests should be deleted.")
+	run()
+	assert.Empty(t, c.applied)
+	assert.Equal(t, expected, c.deleted)
+}
+
+// fakeAPIServer serves discovery, server-side apply, get and delete of a few resources
+type fakeAPIServer struct {
+	mu      sync.Mutex
+	applied map[string]string
+	queries map[string]string
+	deleted []string
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api/v1":
+		fmt.Fprint(w, `{"resources": [{"name": "configmaps", "namespaced": true, "kind": "ConfigMap"},
+			{"name": "namespaces", "namespaced": false, "kind": "Namespace"},
+			{"name": "namespaces/status", "namespaced": false, "kind": "Namespace"}]}`)
+	case r.Method == http.MethodGet && r.URL.Path == "/apis/rbac.authorization.k8s.io/v1":
+		fmt.Fprint(w, `{"resources": [{"name": "clusterroles", "namespaced": false, "kind": "ClusterRole"}]}`)
+	case r.Method == http.MethodPatch && r.Header.Get("Content-Type") == "application/apply-patch+yaml":
+		if strings.HasSuffix(r.URL.Path, "/invalid") {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			fmt.Fprint(w, `{"kind": "Status", "message": "spec is invalid"}`)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		s.applied[r.URL.Path] = string(body)
+		s.queries[r.URL.Path] = r.URL.RawQuery
+		w.Write(body)
+	case r.Method == http.MethodGet && s.applied[r.URL.Path] != "":
+		fmt.Fprint(w, s.applied[r.URL.Path])
+	case r.Method == http.MethodDelete && s.applied[r.URL.Path] != "":
+		delete(s.applied, r.URL.Path)
+		s.deleted = append(s.deleted, r.URL.Path+"?"+r.URL.RawQuery)
+		fmt.Fprint(w, `{"kind": "Status", "status": "Success"}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newFakeAPIServer(t *testing.T, s *fakeAPIServer) (*httptest.Server, *kubeconfig.Config) {
+	ca, err := pki.NewCA("kubernetes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serving, err := ca.Issue(&pki.CertConfig{
+		CommonName: "kube-apiserver",
+		IPs:        []net.IP{net.ParseIP("127.0.0.1")},
+		Usages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+
+	ts := httptest.NewUnstartedServer(s)
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serving.TLSCertificate()},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	ts.StartTLS()
+
+	kc, err := kubeconfig.New(ca, &kubeconfig.Options{ClusterName: "cks", Server: ts.URL, User: "kubernetes-admin"})
+	if err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+	return ts, kc
+}
+
+func TestRESTClient(t *testing.T) {
+	s := &fakeAPIServer{applied: map[string]string{}, queries: map[string]string{}}
+	ts, kc := newFakeAPIServer(t, s)
+	defer ts.Close()
+
+	c, err := addons.NewRESTClient(kc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	objs, err := addons.Decode([]byte(`
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: app
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+  namespace: app
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: app
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, obj := range objs {
+		assert.Nil(t, c.Apply(ctx, obj))
+	}
+
+	paths := []string{
+		"/api/v1/namespaces/app",
+		"/api/v1/namespaces/app/configmaps/app",
+		"/api/v1/namespaces/default/configmaps/app",
+		"/apis/rbac.authorization.k8s.io/v1/clusterroles/app",
+	}
+	for _, p := range paths {
+		assert.Contains(t, s.applied, p, "Objects should be applied to their resources.")
+		assert.Equal(t, "fieldManager=cks&force=true", s.queries[p], "Objects should be applied by cks.")
+	}
+	assert.Contains(t, s.applied[paths[0]], `"kind":"Namespace"`)
+
+	invalid := addons.Object{"apiVersion": "v1", "kind": "ConfigMap", "metadata": map[string]interface{}{"name": "invalid"}}
+	err = c.Apply(ctx, invalid)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "spec is invalid", "Errors should carry the message of the status.")
+	}
+	unknown := addons.Object{"apiVersion": "apps/v1", "kind": "Deployment", "metadata": map[string]interface{}{"name": "app"}}
+	assert.NotNil(t, c.Apply(ctx, unknown), "Objects of unknown resources should fail.")
+
+	managed := addons.Object{"apiVersion": "v1", "kind": "ConfigMap", "metadata": map[string]interface{}{
+		"name":   "managed",
+		"labels": map[string]interface{}{addons.ManagedByLabel: addons.FieldManager},
+	}}
+	assert.Nil(t, c.Apply(ctx, managed))
+	for _, obj := range []addons.Object{managed, objs[1], invalid} {
+		assert.Nil(t, c.Delete(ctx, obj))
+	}
+	assert.Equal(t, []string{"/api/v1/namespaces/default/configmaps/managed?propagationPolicy=Background"}, s.deleted,
+		"Only objects managed by cks should be deleted, and missing ones should be ignored.")
+	assert.Contains(t, s.applied, paths[1])
+}
@@ -0,0 +1,249 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package addons
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/jiuchen1986/cks/pkg/kubeconfig"
+)
+
+const (
+	// FieldManager owns the fields of the objects applied by cks
+	FieldManager string = "cks"
+
+	// ManagedByLabel is set to FieldManager on the objects applied by cks,
+	// only which are deleted by cks
+	ManagedByLabel string = "app.kubernetes.io/managed-by"
+)
+
+// Client applies objects to the cluster
+type Client interface {
+	// Apply creates or updates the object by server-side apply
+	Apply(ctx context.Context, obj Object) error
+	// Delete deletes the object if it's managed by cks,
+	// which is a no-op if the object doesn't exist
+	Delete(ctx context.Context, obj Object) error
+}
+
+// resource is a resource of a kind found by discovery
+type resource struct {
+	name       string
+	namespaced bool
+}
+
+// RESTClient applies objects through the REST API of the apiserver,
+// resources of kinds are discovered on first use and cached by group version
+type RESTClient struct {
+	Server string
+	// Timeout limits each request
+	Timeout time.Duration
+	hc      *http.Client
+
+	mu        sync.Mutex
+	resources map[string]map[string]resource
+}
+
+// NewRESTClient returns a client authenticating with the credentials in the kubeconfig
+func NewRESTClient(kc *kubeconfig.Config) (*RESTClient, error) {
+	tc, err := kc.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &RESTClient{
+		Server:    kc.Server(),
+		Timeout:   30 * time.Second,
+		hc:        &http.Client{Transport: &http.Transport{TLSClientConfig: tc}},
+		resources: map[string]map[string]resource{},
+	}, nil
+}
+
+// Apply creates or updates the object by server-side apply with FieldManager,
+// taking over conflicting fields from other managers
+func (c *RESTClient) Apply(ctx context.Context, obj Object) error {
+	path, err := c.objectPath(ctx, obj)
+	if err != nil {
+		return errors.Wrapf(err, "failed to apply %s", obj)
+	}
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode %s", obj)
+	}
+
+	q := url.Values{"fieldManager": {FieldManager}, "force": {"true"}}
+	// json is a subset of yaml, which is accepted by apply patches
+	err = c.do(ctx, http.MethodPatch, path+"?"+q.Encode(), "application/apply-patch+yaml", body, nil)
+	return errors.Wrapf(err, "failed to apply %s", obj)
+}
+
+// Delete deletes the object if it's labeled with ManagedByLabel of FieldManager,
+// objects taken over by others and ones already gone are left alone
+func (c *RESTClient) Delete(ctx context.Context, obj Object) error {
+	path, err := c.objectPath(ctx, obj)
+	if err != nil {
+		return errors.Wrapf(err, "failed to delete %s", obj)
+	}
+
+	current := Object{}
+	if err := c.do(ctx, http.MethodGet, path, "", nil, &current); err != nil {
+		if isNotFound(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "failed to get %s", obj)
+	}
+	if current.Labels()[ManagedByLabel] != FieldManager {
+		return nil
+	}
+
+	q := url.Values{"propagationPolicy": {"Background"}}
+	err = c.do(ctx, http.MethodDelete, path+"?"+q.Encode(), "", nil, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	return errors.Wrapf(err, "failed to delete %s", obj)
+}
+
+// objectPath returns the REST path of the object
+func (c *RESTClient) objectPath(ctx context.Context, obj Object) (string, error) {
+	prefix := groupVersionPath(obj.APIVersion())
+	r, err := c.resource(ctx, obj.APIVersion(), obj.Kind())
+	if err != nil {
+		return "", err
+	}
+
+	path := prefix
+	if r.namespaced {
+		ns := obj.Namespace()
+		if ns == "" {
+			ns = "default"
+		}
+		path += "/namespaces/" + url.PathEscape(ns)
+	}
+	return path + "/" + r.name + "/" + url.PathEscape(obj.Name()), nil
+}
+
+// resource finds the resource of the kind, discovering the group version if not cached
+func (c *RESTClient) resource(ctx context.Context, apiVersion, kind string) (resource, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rs, ok := c.resources[apiVersion]
+	if !ok {
+		list := &struct {
+			Resources []struct {
+				Name       string `json:"name"`
+				Namespaced bool   `json:"namespaced"`
+				Kind       string `json:"kind"`
+			} `json:"resources"`
+		}{}
+		if err := c.do(ctx, http.MethodGet, groupVersionPath(apiVersion), "", nil, list); err != nil {
+			return resource{}, errors.Wrapf(err, "failed to discover resources of %s", apiVersion)
+		}
+
+		rs = map[string]resource{}
+		for _, r := range list.Resources {
+			// skip subresources, e.g. pods/status
+			if !strings.Contains(r.Name, "/") {
+				rs[r.Kind] = resource{name: r.Name, namespaced: r.Namespaced}
+			}
+		}
+		c.resources[apiVersion] = rs
+	}
+
+	r, ok := rs[kind]
+	if !ok {
+		// the kind may be defined by a CRD later, so discover again next time
+		delete(c.resources, apiVersion)
+		return resource{}, errors.Errorf("no resource of kind %s found in %s", kind, apiVersion)
+	}
+	return r, nil
+}
+
+// groupVersionPath returns the REST path of the group version,
+// where the core group is served under /api
+func groupVersionPath(apiVersion string) string {
+	if !strings.Contains(apiVersion, "/") {
+		return "/api/" + apiVersion
+	}
+	return "/apis/" + apiVersion
+}
+
+// do sends a request and decodes the response into out if not nil,
+// a response not in 2xx is returned as an error with the message of its status
+func (c *RESTClient) do(ctx context.Context, method, path, contentType string, body []byte, out interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.Server, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to request %s %s", method, path)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to read response")
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		status := &struct {
+			Message string `json:"message"`
+		}{}
+		if json.Unmarshal(data, status) == nil && status.Message != "" {
+			return &statusError{code: resp.StatusCode, status: resp.Status, message: status.Message}
+		}
+		return &statusError{code: resp.StatusCode, status: resp.Status, message: strings.TrimSpace(string(data))}
+	}
+	if out == nil {
+		return nil
+	}
+	return errors.Wrap(json.Unmarshal(data, out), "failed to decode response")
+}
+
+// statusError is a response not in 2xx
+type statusError struct {
+	code    int
+	status  string
+	message string
+}
+
+func (e *statusError) Error() string {
+	return e.status + ": " + e.message
+}
+
+// isNotFound tells whether the error is a response of 404
+func isNotFound(err error) bool {
+	se, ok := errors.Cause(err).(*statusError)
+	return ok && se.code == http.StatusNotFound
+}
@@ -0,0 +1,433 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package addons
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/plan"
+	"github.com/jiuchen1986/cks/pkg/utils"
+)
+
+const (
+	// DefaultInterval is how often the manifests directory is checked by default
+	DefaultInterval time.Duration = 30 * time.Second
+
+	// ComponentName names the logger of the addons
+	ComponentName string = "addons"
+)
+
+// ManifestsDir returns the directory watched for manifests of users in the data directory
+func ManifestsDir(dataDir string) string {
+	return filepath.Join(dataDir, "manifests")
+}
+
+// kinds applied before the others, as objects of other kinds may depend on them
+var firstKinds = []string{"Namespace", "CustomResourceDefinition"}
+
+// AppliedPath returns the path of the record of the objects applied to the cluster in the data directory
+func AppliedPath(dataDir string) string {
+	return filepath.Join(dataDir, "addons", "applied.json")
+}
+
+// Reconciler applies the enabled addons and the manifests of users to the cluster,
+// applies them again once they change, and deletes the objects applied before
+// once their addons are disabled or they are removed from the manifests
+type Reconciler struct {
+	Config *conf.ClusterConfig
+	Client Client
+	// Dir is watched for manifests of users, i.e. *.yaml, *.yml and *.json files
+	// in it and its subdirectories, which are applied in lexical order of paths
+	Dir string
+	// Applied records the objects applied by source
+	Applied  string
+	Interval time.Duration
+
+	// digests are of the manifests applied successfully by source
+	digests map[string]string
+	// lastErr is the failure logged last time, which isn't logged again
+	lastErr string
+}
+
+// NewReconciler returns a reconciler watching the manifests directory in the data directory
+func NewReconciler(cfg *conf.ClusterConfig, c Client) *Reconciler {
+	return &Reconciler{
+		Config:   cfg,
+		Client:   c,
+		Dir:      ManifestsDir(cfg.DataDir),
+		Applied:  AppliedPath(cfg.DataDir),
+		Interval: DefaultInterval,
+		digests:  map[string]string{},
+	}
+}
+
+// Manifests returns the enabled addons followed by the manifests of users,
+// whose objects are labeled with ManagedByLabel. Invalid manifests of users
+// are skipped and returned as an error together with the valid ones
+func (r *Reconciler) Manifests() ([]Manifest, error) {
+	ms, _, err := r.load()
+	return ms, err
+}
+
+// load returns what Manifests does together with the sources of the invalid manifests
+func (r *Reconciler) load() ([]Manifest, map[string]bool, error) {
+	ms, err := Render(r.Config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	paths, err := manifestFiles(r.Dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	invalid := map[string]bool{}
+	var errs error
+	for _, p := range paths {
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			invalid[p] = true
+			errs = multierr.Append(errs, errors.Wrapf(err, "failed to read manifest %s", p))
+			continue
+		}
+		objs, err := Decode(data)
+		if err != nil {
+			invalid[p] = true
+			errs = multierr.Append(errs, errors.Wrapf(err, "invalid manifest %s", p))
+			continue
+		}
+		ms = append(ms, Manifest{Source: p, Objects: objs})
+	}
+
+	for _, m := range ms {
+		for _, obj := range m.Objects {
+			obj.setLabel(ManagedByLabel, FieldManager)
+		}
+	}
+	return ms, invalid, errs
+}
+
+// manifestFiles returns paths of the manifests in the directory in lexical order,
+// no manifest is found if the directory doesn't exist
+func manifestFiles(dir string) ([]string, error) {
+	paths := []string{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if p == dir && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		switch strings.ToLower(filepath.Ext(p)) {
+		case ".yaml", ".yml", ".json":
+			if info.Mode().IsRegular() {
+				paths = append(paths, p)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read manifests directory %s", dir)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// ReconcileOnce applies all the objects of the manifests, namespaces and CRDs first,
+// then deletes the objects applied before which are in none of the manifests.
+// Every object is applied even if an earlier one fails,
+// and all the failures are returned together
+func (r *Reconciler) ReconcileOnce(ctx context.Context) error {
+	_, err := r.reconcile(ctx, true)
+	return err
+}
+
+// reconcile applies the manifests changed since applied successfully last time or all of them,
+// and deletes the stale objects, returning how many objects are applied or deleted.
+// Objects applied from an invalid manifest are kept until it's fixed or removed
+func (r *Reconciler) reconcile(ctx context.Context, all bool) (int, error) {
+	ms, invalid, err := r.load()
+	if ms == nil {
+		return 0, err
+	}
+	applied, rerr := readApplied(r.Applied)
+	if rerr != nil {
+		return 0, multierr.Append(err, rerr)
+	}
+
+	digests := map[string]string{}
+	changed := []Manifest{}
+	n := 0
+	for _, m := range ms {
+		d, derr := digest(m)
+		if derr != nil {
+			return 0, multierr.Append(err, derr)
+		}
+		digests[m.Source] = d
+		if all || r.digests[m.Source] != d {
+			changed = append(changed, m)
+			n += len(m.Objects)
+		}
+	}
+	failed, aerr := r.apply(ctx, changed)
+	err = multierr.Append(err, aerr)
+
+	// objects of a manifest failing to apply may still be in the cluster,
+	// so the ones applied before are kept in the record as well
+	record := map[string][]Object{}
+	for _, m := range ms {
+		var objs []Object
+		if failed[m.Source] {
+			delete(digests, m.Source)
+			objs = applied[m.Source]
+		}
+		record[m.Source] = merge(objs, m.Objects)
+	}
+	for source := range invalid {
+		if objs, ok := applied[source]; ok {
+			record[source] = objs
+		}
+	}
+	r.digests = digests
+
+	for _, e := range stale(applied, record) {
+		if derr := r.Client.Delete(ctx, e.object); derr != nil {
+			err = multierr.Append(err, errors.WithMessage(derr, e.source))
+			// retried at the next interval
+			record[e.source] = merge(record[e.source], []Object{e.object})
+			continue
+		}
+		n++
+	}
+
+	if !equalRecords(applied, record) {
+		err = multierr.Append(err, writeApplied(r.Applied, record))
+	}
+	return n, err
+}
+
+// apply applies the objects of the manifests in order, returning the sources failing to apply
+func (r *Reconciler) apply(ctx context.Context, ms []Manifest) (map[string]bool, error) {
+	failed := map[string]bool{}
+	var errs error
+	for _, e := range ordered(ms) {
+		if err := r.Client.Apply(ctx, e.object); err != nil {
+			failed[e.source] = true
+			errs = multierr.Append(errs, errors.WithMessage(err, e.source))
+		}
+	}
+	return failed, errs
+}
+
+// Run reconciles every interval until ctx is done, objects are applied on the first run
+// and once their manifests change, while failures are retried
+func (r *Reconciler) Run(ctx context.Context) {
+	logger := lgr.Named(ComponentName)
+	logger.Infof("apply addons and manifests in %s every %s once changed", r.Dir, r.Interval)
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		r.reconcileIfChanged(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Reconciler) reconcileIfChanged(ctx context.Context) {
+	logger := lgr.Named(ComponentName)
+
+	n, err := r.reconcile(ctx, false)
+	if err != nil {
+		// e.g. an invalid manifest fails every interval until it's fixed
+		if err.Error() == r.lastErr {
+			logger.Debugf("failed to reconcile addons and manifests: %v", err)
+		} else {
+			logger.Errorf("failed to reconcile addons and manifests: %v", err)
+		}
+		r.lastErr = err.Error()
+		return
+	}
+	r.lastErr = ""
+	if n > 0 {
+		logger.Infof("addons and manifests reconciled, %d object(s) applied or deleted", n)
+	}
+}
+
+// Plan adds applying the objects of the manifests and deleting the stale objects to the plan
+func (r *Reconciler) Plan(pl *plan.Plan) error {
+	ms, err := r.Manifests()
+	if err != nil {
+		return err
+	}
+	applied, err := readApplied(r.Applied)
+	if err != nil {
+		return err
+	}
+
+	record := map[string][]Object{}
+	for _, e := range ordered(ms) {
+		pl.Add(plan.ApplyManifest, e.object.String(), e.source)
+		record[e.source] = append(record[e.source], e.object)
+	}
+	for _, e := range stale(applied, record) {
+		pl.Add(plan.DeleteObject, e.object.String(), e.source)
+	}
+	return nil
+}
+
+// entry is an object with the source of its manifest
+type entry struct {
+	source string
+	object Object
+}
+
+// ordered returns the objects of the manifests with namespaces and CRDs moved
+// to the front, keeping the order of the others
+func ordered(ms []Manifest) []entry {
+	es := []entry{}
+	for _, m := range ms {
+		for _, obj := range m.Objects {
+			es = append(es, entry{source: m.Source, object: obj})
+		}
+	}
+	rank := func(o Object) int {
+		for i, k := range firstKinds {
+			if o.Kind() == k {
+				return i
+			}
+		}
+		return len(firstKinds)
+	}
+	sort.SliceStable(es, func(i, j int) bool {
+		return rank(es[i].object) < rank(es[j].object)
+	})
+	return es
+}
+
+// stale returns the objects applied before which are in none of the sources of the record,
+// in order of their sources
+func stale(applied, record map[string][]Object) []entry {
+	keep := map[string]bool{}
+	for _, objs := range record {
+		for _, obj := range objs {
+			keep[obj.key()] = true
+		}
+	}
+
+	sources := make([]string, 0, len(applied))
+	for source := range applied {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	es := []entry{}
+	for _, source := range sources {
+		for _, obj := range applied[source] {
+			if !keep[obj.key()] {
+				es = append(es, entry{source: source, object: obj})
+			}
+		}
+	}
+	return es
+}
+
+// merge returns the references of the objects in both lists without duplicates
+func merge(a, b []Object) []Object {
+	seen := map[string]bool{}
+	refs := []Object{}
+	for _, objs := range [][]Object{a, b} {
+		for _, obj := range objs {
+			if !seen[obj.key()] {
+				seen[obj.key()] = true
+				refs = append(refs, obj.ref())
+			}
+		}
+	}
+	return refs
+}
+
+// readApplied reads the record of the objects applied by source,
+// nothing is applied if the record doesn't exist
+func readApplied(path string) (map[string][]Object, error) {
+	applied := map[string][]Object{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return applied, nil
+		}
+		return nil, errors.Wrap(err, "failed to read applied objects")
+	}
+	if err := json.Unmarshal(data, &applied); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse applied objects in %s", path)
+	}
+	return applied, nil
+}
+
+func writeApplied(path string, applied map[string][]Object) error {
+	data, err := json.MarshalIndent(applied, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal applied objects")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrap(err, "failed to create directory of applied objects")
+	}
+	return utils.WriteFileAtomic(path, data, 0600)
+}
+
+// equalRecords tells whether the records hold the same objects by source in the same order
+func equalRecords(a, b map[string][]Object) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for source, objs := range a {
+		other, ok := b[source]
+		if !ok || len(objs) != len(other) {
+			return false
+		}
+		for i := range objs {
+			if objs[i].key() != other[i].key() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// digest returns the hash of the manifest in json
+func digest(m Manifest) (string, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to encode manifest %s", m.Source)
+	}
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:]), nil
+}
@@ -0,0 +1,105 @@
+package admin_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jiuchen1986/cks/pkg/admin"
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+)
+
+func TestLogLevel(t *testing.T) {
+	opt, err := lgr.NewLogLevelOption("info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	undo, _, err := lgr.InitLogger(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer undo()
+
+	dir, err := ioutil.TempDir("", "cks-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := admin.SocketPath(dir, conf.RoleController)
+
+	// a stale socket should be replaced, and a loose socket directory restricted
+	if err := os.MkdirAll(filepath.Dir(socket), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(socket, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- admin.NewServer().ListenAndServe(ctx, socket) }()
+	defer func() {
+		cancel()
+		assert.Nil(t, <-done)
+	}()
+
+	c := admin.NewClient(socket)
+	var levels *admin.LogLevels
+	for i := 0; i < 50; i++ {
+		if levels, err = c.LogLevels(""); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, &admin.LogLevels{Level: "info"}, levels)
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "Socket should be only accessible by the owner.")
+	info, err = os.Stat(filepath.Dir(socket))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm(), "Socket directory should be only accessible by the owner.")
+
+	levels, err = c.SetLogLevel("etcd", "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, &admin.LogLevels{Level: "debug", Components: map[string]string{"etcd": "debug"}}, levels)
+
+	levels, err = c.SetLogLevel("", "warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, &admin.LogLevels{Level: "warn", Components: map[string]string{"etcd": "debug"}}, levels)
+
+	_, err = c.SetLogLevel("", "trace")
+	assert.NotNil(t, err, "Unknown level should be rejected.")
+
+	levels, err = c.ResetLogLevel("etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, &admin.LogLevels{Level: "warn"}, levels)
+
+	levels, err = c.ResetLogLevel("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "info", levels.Level, "All levels should be restored.")
+
+	_, err = admin.NewClient(filepath.Join(dir, "none.sock")).LogLevels("")
+	assert.NotNil(t, err, "Client should fail without a running server.")
+}
@@ -0,0 +1,104 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Client calls the admin API of a running cks on this node
+type Client struct {
+	Socket string
+	http   *http.Client
+}
+
+// NewClient returns a client of the admin API served on the socket
+func NewClient(socket string) *Client {
+	return &Client{
+		Socket: socket,
+		http: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// LogLevels returns the levels of the logger,
+// with the level in effect for the component if given
+func (c *Client) LogLevels(component string) (*LogLevels, error) {
+	return c.doLogLevel(http.MethodGet, component, nil)
+}
+
+// SetLogLevel sets the level of the component,
+// or the global level if component is empty
+func (c *Client) SetLogLevel(component, level string) (*LogLevels, error) {
+	return c.doLogLevel(http.MethodPut, component, &LogLevels{Level: level})
+}
+
+// ResetLogLevel restores the level of the component given at start,
+// or all the levels if component is empty
+func (c *Client) ResetLogLevel(component string) (*LogLevels, error) {
+	return c.doLogLevel(http.MethodDelete, component, nil)
+}
+
+func (c *Client) doLogLevel(method, component string, body *LogLevels) (*LogLevels, error) {
+	// the host is ignored as requests are sent to the socket
+	u := url.URL{Scheme: "http", Host: "cks", Path: logLevelPath}
+	if component != "" {
+		u.RawQuery = url.Values{"component": []string{component}}.Encode()
+	}
+
+	buf := &bytes.Buffer{}
+	if body != nil {
+		if err := json.NewEncoder(buf).Encode(body); err != nil {
+			return nil, errors.Wrap(err, "failed to marshal request")
+		}
+	}
+	req, err := http.NewRequest(method, u.String(), buf)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to call admin API on %s, make sure cks controller or worker is running", c.Socket)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.Errorf("admin API returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	levels := &LogLevels{}
+	if err := json.NewDecoder(resp.Body).Decode(levels); err != nil {
+		return nil, errors.Wrap(err, "failed to decode response")
+	}
+	return levels, nil
+}
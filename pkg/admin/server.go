@@ -0,0 +1,165 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+)
+
+const (
+	// SocketDir is the directory in the data directory holding the unix sockets,
+	// which is only accessible by the owner
+	SocketDir string = "admin"
+
+	logLevelPath string = "/v1/log/level"
+)
+
+// SocketPath returns the path of the unix socket in the data directory
+// the admin API of the controller or worker of the role is served on
+func SocketPath(dataDir string, role conf.Role) string {
+	return filepath.Join(dataDir, SocketDir, fmt.Sprintf("cks-%s.sock", role))
+}
+
+// LogLevels are the levels of the logger, where Level is the global level,
+// or the level in effect for the component if it's given in the request
+type LogLevels struct {
+	Level      string            `json:"level"`
+	Components map[string]string `json:"components,omitempty"`
+}
+
+// Server serves the admin API of a running cks
+type Server struct {
+	mux *http.ServeMux
+}
+
+// NewServer returns an admin server changing the global logger
+func NewServer() *Server {
+	s := &Server{mux: http.NewServeMux()}
+	s.mux.HandleFunc(logLevelPath, s.serveLogLevel)
+	return s
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves on the unix socket until ctx is done,
+// where the socket is only accessible by the owner
+func (s *Server) ListenAndServe(ctx context.Context, socket string) error {
+	logger := lgr.GetGlobalLogger()
+
+	// the socket is created with permissions of umask, so it's created
+	// in a directory only accessible by the owner before restricting itself
+	dir := filepath.Dir(socket)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrapf(err, "failed to create socket directory %s", dir)
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return errors.Wrapf(err, "failed to restrict access to %s", dir)
+	}
+
+	// a socket left by a previous run fails listening
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove stale socket %s", socket)
+	}
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %s", socket)
+	}
+	if err := os.Chmod(socket, 0600); err != nil {
+		ln.Close()
+		return errors.Wrapf(err, "failed to restrict access to %s", socket)
+	}
+
+	srv := &http.Server{Handler: s}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	logger.Infof("serve admin API on %s", socket)
+	if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		return errors.Wrap(err, "failed to serve admin API")
+	}
+	return nil
+}
+
+// serveLogLevel gets the levels on GET, sets the level on PUT with the level in body,
+// and restores the levels given at start on DELETE, all of which
+// apply to the component in query, or the global level if not given
+func (s *Server) serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	logger := lgr.GetGlobalLogger()
+	component := r.URL.Query().Get("component")
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		req := &LogLevels{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := lgr.SetLevel(component, req.Level); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.Warnf("log level of %s changed to %s by admin API", componentName(component), req.Level)
+	case http.MethodDelete:
+		if err := lgr.ResetLevel(component); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger.Warnf("log level of %s reset by admin API", componentName(component))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	level, err := lgr.GetLevel(component)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	comps, err := lgr.ComponentLevels()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&LogLevels{Level: level, Components: comps})
+}
+
+func componentName(component string) string {
+	if component == "" {
+		return "all components"
+	}
+	return "component " + component
+}
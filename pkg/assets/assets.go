@@ -0,0 +1,255 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package assets
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/plan"
+	"github.com/jiuchen1986/cks/pkg/utils"
+)
+
+const (
+	// ManifestName is the name of the manifest in the root of a bundle
+	ManifestName string = "manifest.yaml"
+
+	// completeName is the marker written into the versioned bin directory
+	// after all the files are extracted, holding checksum of the manifest
+	completeName string = ".complete"
+	// currentName is the symlink to the versioned bin directory last extracted
+	currentName string = "current"
+
+	defaultFileMode fs.FileMode = 0755
+)
+
+// Manifest describes files in a bundle
+type Manifest struct {
+	// Version is the version of the bundle, files are
+	// extracted into a directory named by the version
+	Version string `yaml:"version"`
+	Files   []File `yaml:"files"`
+}
+
+// File is a file in a bundle
+type File struct {
+	// Name is the slash-separated path relative to the bundle root
+	Name   string `yaml:"name"`
+	SHA256 string `yaml:"sha256"`
+	// Mode defaults to 0755
+	Mode fs.FileMode `yaml:"mode,omitempty"`
+}
+
+// Dir returns the bin directory in the data directory
+func Dir(dataDir string) string {
+	return filepath.Join(dataDir, "bin")
+}
+
+// CurrentDir returns the directory of the current version in the bin directory
+func CurrentDir(binDir string) string {
+	return filepath.Join(binDir, currentName)
+}
+
+// ReadManifest reads and checks the manifest of the bundle
+func ReadManifest(bundle fs.FS) (*Manifest, []byte, error) {
+	data, err := fs.ReadFile(bundle, ManifestName)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read bundle manifest")
+	}
+
+	m := &Manifest{}
+	if err := yaml.Unmarshal(data, m); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to parse bundle manifest")
+	}
+
+	if m.Version == "" || strings.ContainsAny(m.Version, `/\`) {
+		return nil, nil, errors.Errorf("invalid bundle version %q", m.Version)
+	}
+	for _, f := range m.Files {
+		if !fs.ValidPath(f.Name) || f.Name == ManifestName {
+			return nil, nil, errors.Errorf("invalid file name %q in bundle manifest", f.Name)
+		}
+		if len(f.SHA256) != sha256.Size*2 {
+			return nil, nil, errors.Errorf("invalid checksum of file %s in bundle manifest", f.Name)
+		}
+	}
+	return m, data, nil
+}
+
+// Extract extracts the files in the bundle to a directory named by
+// the bundle version in binDir and returns the directory.
+// Checksums of files are verified during extraction, and files already
+// extracted are skipped only if their sizes and checksums still match the manifest
+func Extract(bundle fs.FS, binDir string) (string, error) {
+	logger := lgr.GetGlobalLogger()
+	defer logger.Sync()
+
+	m, raw, err := ReadManifest(bundle)
+	if err != nil {
+		return "", err
+	}
+	sum := checksum(raw)
+
+	dir := filepath.Join(binDir, m.Version)
+	stale := staleFiles(bundle, m, dir)
+	if len(stale) == 0 && isComplete(dir, sum) {
+		logger.Debugf("assets of version %s already extracted to %s", m.Version, dir)
+		return dir, updateCurrent(binDir, m.Version)
+	}
+
+	for _, f := range stale {
+		if err := extractFile(bundle, &f, dir); err != nil {
+			return "", err
+		}
+	}
+
+	if err := utils.WriteFileAtomic(filepath.Join(dir, completeName), []byte(sum), 0644); err != nil {
+		return "", err
+	}
+	logger.Infof("%d asset(s) of version %s extracted to %s", len(stale), m.Version, dir)
+	return dir, updateCurrent(binDir, m.Version)
+}
+
+// Plan adds the extraction to the plan unless the same version
+// has already been extracted, and returns the directory Extract would return
+func Plan(bundle fs.FS, binDir string, pl *plan.Plan) (string, error) {
+	m, raw, err := ReadManifest(bundle)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(binDir, m.Version)
+	stale := staleFiles(bundle, m, dir)
+	if len(stale) > 0 || !isComplete(dir, checksum(raw)) {
+		pl.Add(plan.WriteFile, dir, fmt.Sprintf("extract %d asset(s) of version %s", len(stale), m.Version))
+	}
+	return dir, nil
+}
+
+func isComplete(dir, sum string) bool {
+	data, err := ioutil.ReadFile(filepath.Join(dir, completeName))
+	return err == nil && string(data) == sum
+}
+
+// staleFiles returns the files in the manifest which are missing in dir,
+// or differ from the bundle in size or checksum, e.g. modified after extraction
+func staleFiles(bundle fs.FS, m *Manifest, dir string) []File {
+	stale := []File{}
+	for _, f := range m.Files {
+		if !isExtracted(bundle, &f, dir) {
+			stale = append(stale, f)
+		}
+	}
+	return stale
+}
+
+func isExtracted(bundle fs.FS, f *File, dir string) bool {
+	src, err := fs.Stat(bundle, f.Name)
+	if err != nil {
+		return false
+	}
+	dst := filepath.Join(dir, filepath.FromSlash(f.Name))
+	fi, err := os.Stat(dst)
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() != src.Size() {
+		return false
+	}
+
+	file, err := os.Open(dst)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return false
+	}
+	return hex.EncodeToString(h.Sum(nil)) == strings.ToLower(f.SHA256)
+}
+
+// extractFile copies the file into dir through a temp file,
+// which is renamed only if the checksum matches
+func extractFile(bundle fs.FS, f *File, dir string) error {
+	src, err := bundle.Open(f.Name)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open asset %s", f.Name)
+	}
+	defer src.Close()
+
+	dst := filepath.Join(dir, filepath.FromSlash(f.Name))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return errors.Wrapf(err, "failed to create directory for asset %s", f.Name)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), "."+path.Base(f.Name))
+	if err != nil {
+		return errors.Wrapf(err, "failed to create temp file for asset %s", f.Name)
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to extract asset %s", f.Name)
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != strings.ToLower(f.SHA256) {
+		return errors.Errorf("checksum mismatch of asset %s: expect %s but get %s", f.Name, f.SHA256, sum)
+	}
+
+	mode := f.Mode
+	if mode == 0 {
+		mode = defaultFileMode
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return errors.Wrapf(err, "failed to change mode of asset %s", f.Name)
+	}
+	return errors.Wrapf(os.Rename(tmp.Name(), dst), "failed to extract asset %s", f.Name)
+}
+
+// updateCurrent points the current symlink to the version
+func updateCurrent(binDir, version string) error {
+	link := CurrentDir(binDir)
+	if target, err := os.Readlink(link); err == nil && target == version {
+		return nil
+	}
+
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(version, tmp); err != nil {
+		return errors.Wrapf(err, "failed to link %s to %s", link, version)
+	}
+	return errors.Wrapf(os.Rename(tmp, link), "failed to link %s to %s", link, version)
+}
+
+func checksum(data []byte) string {
+	s := sha256.Sum256(data)
+	return hex.EncodeToString(s[:])
+}
@@ -0,0 +1,129 @@
+package assets_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jiuchen1986/cks/pkg/assets"
+)
+
+func sum(data string) string {
+	s := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(s[:])
+}
+
+func newBundle(version string, files map[string]string, sums map[string]string) fstest.MapFS {
+	manifest := fmt.Sprintf("version: %s\nfiles:\n", version)
+	bundle := fstest.MapFS{}
+	for name, data := range files {
+		s, ok := sums[name]
+		if !ok {
+			s = sum(data)
+		}
+		manifest += fmt.Sprintf("- name: %s\n  sha256: %s\n", name, s)
+		bundle[name] = &fstest.MapFile{Data: []byte(data)}
+	}
+	bundle[assets.ManifestName] = &fstest.MapFile{Data: []byte(manifest)}
+	return bundle
+}
+
+func TestExtract(t *testing.T) {
+	binDir, err := ioutil.TempDir("", "cks-assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(binDir)
+
+	bundle := newBundle("v1", map[string]string{
+		"etcd":       "dummy etcd",
+		"cni/bridge": "dummy bridge",
+	}, nil)
+
+	dir, err := assets.Extract(bundle, binDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, filepath.Join(binDir, "v1"), dir)
+
+	data, err := ioutil.ReadFile(filepath.Join(assets.CurrentDir(binDir), "cni", "bridge"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "dummy bridge", string(data))
+	fi, err := os.Stat(filepath.Join(dir, "etcd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0755), fi.Mode().Perm(), "Assets should be executable by default.")
+
+	// files of an extracted version are verified, and only
+	// the missing or modified ones are extracted again
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "cni", "bridge"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "etcd")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := assets.Extract(bundle, binDir); err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadFile(filepath.Join(dir, "etcd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "dummy etcd", string(data), "Missing asset should be extracted again.")
+	fi, err = os.Stat(filepath.Join(dir, "cni", "bridge"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, fi.ModTime().Equal(old), "Intact asset should not be extracted again.")
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "etcd"), []byte("dummy ETCD"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := assets.Extract(bundle, binDir); err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadFile(filepath.Join(dir, "etcd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "dummy etcd", string(data), "Modified asset of the same size should be extracted again.")
+
+	// a new version is extracted to another directory
+	dir, err = assets.Extract(newBundle("v2", map[string]string{"etcd": "new etcd"}, nil), binDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadFile(filepath.Join(assets.CurrentDir(binDir), "etcd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "new etcd", string(data), "Current should point to the latest extracted version.")
+}
+
+func TestExtractChecksumMismatch(t *testing.T) {
+	binDir, err := ioutil.TempDir("", "cks-assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(binDir)
+
+	bundle := newBundle("v1", map[string]string{"etcd": "dummy etcd"},
+		map[string]string{"etcd": sum("tampered")})
+	_, err = assets.Extract(bundle, binDir)
+	assert.NotNil(t, err, "Checksum mismatch should fail the extraction.")
+
+	_, err = os.Stat(filepath.Join(binDir, "v1", "etcd"))
+	assert.True(t, os.IsNotExist(err), "File with mismatched checksum should not be extracted.")
+}
@@ -0,0 +1,46 @@
+//go:build assets
+// +build assets
+
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package assets
+
+import (
+	"embed"
+	"io/fs"
+
+	"github.com/pkg/errors"
+)
+
+// files in the bundle directory are embedded only when
+// built with tag assets, see hack/bundle-assets.sh.
+// The directory holds a placeholder README.md, so that
+// the pattern matches even if no assets are bundled
+//
+//go:embed bundle
+var bundle embed.FS
+
+// Bundle returns the bundle embedded in the binary
+func Bundle() (fs.FS, error) {
+	sub, err := fs.Sub(bundle, "bundle")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open embedded bundle")
+	}
+	if _, err := fs.Stat(sub, ManifestName); err != nil {
+		return nil, errors.New("no assets bundled in this binary, run hack/bundle-assets.sh before building it")
+	}
+	return sub, nil
+}
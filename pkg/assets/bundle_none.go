@@ -0,0 +1,31 @@
+//go:build !assets
+// +build !assets
+
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package assets
+
+import (
+	"io/fs"
+
+	"github.com/pkg/errors"
+)
+
+// Bundle returns an error as no bundle is embedded
+// in the binary built without tag assets
+func Bundle() (fs.FS, error) {
+	return nil, errors.New("no assets bundled in this binary, rebuild it with tag assets")
+}
@@ -0,0 +1,359 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/pki"
+)
+
+const (
+	// FormatVersion is the version of the bundle layout
+	FormatVersion int = 1
+
+	// names of entries in a bundle
+	ManifestName string = "manifest.yaml"
+	ConfigName   string = "config/cluster.yaml"
+	SnapshotName string = "etcd/snapshot.db"
+	pkiPrefix    string = "pki/"
+
+	// bundleMode keeps bundles private as they hold private keys
+	bundleMode os.FileMode = 0600
+)
+
+// Manifest describes a backup bundle
+type Manifest struct {
+	Version           int       `yaml:"version"`
+	Created           time.Time `yaml:"created"`
+	ClusterName       string    `yaml:"clusterName"`
+	NodeName          string    `yaml:"nodeName"`
+	KubernetesVersion string    `yaml:"kubernetesVersion"`
+	EtcdVersion       string    `yaml:"etcdVersion"`
+	Files             []File    `yaml:"files"`
+}
+
+// File is a file in a bundle
+type File struct {
+	// Name is the slash-separated path in the bundle
+	Name   string      `yaml:"name"`
+	SHA256 string      `yaml:"sha256"`
+	Size   int64       `yaml:"size"`
+	Mode   os.FileMode `yaml:"mode"`
+}
+
+// Options describes what to back up
+type Options struct {
+	ClusterConfig *conf.ClusterConfig
+	NodeName      string
+	// Snapshot writes an etcd snapshot to w
+	Snapshot func(ctx context.Context, w io.Writer) error
+	// Now returns the current time, defaults to time.Now
+	Now func() time.Time
+}
+
+// Save writes a bundle of the etcd snapshot, the PKI and the cluster config
+// to the path atomically, and returns its manifest
+func Save(ctx context.Context, dst string, opts *Options) (*Manifest, error) {
+	now := time.Now
+	if opts.Now != nil {
+		now = opts.Now
+	}
+	cfg := opts.ClusterConfig
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create backup directory")
+	}
+	staging, err := ioutil.TempDir(filepath.Dir(dst), ".cks-backup")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create staging directory")
+	}
+	defer os.RemoveAll(staging)
+
+	// the snapshot may be large, so it's staged on the disk rather than in memory
+	snapshotPath := filepath.Join(staging, "snapshot.db")
+	f, err := os.OpenFile(snapshotPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, bundleMode)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create snapshot file")
+	}
+	err = opts.Snapshot(ctx, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to take etcd snapshot")
+	}
+
+	configData, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal cluster config")
+	}
+
+	// sources maps names in the bundle to the files on the disk,
+	// except the cluster config which is marshaled in memory
+	sources := map[string]string{SnapshotName: snapshotPath}
+	m := &Manifest{
+		Version:           FormatVersion,
+		Created:           now().UTC(),
+		ClusterName:       cfg.ClusterName,
+		NodeName:          opts.NodeName,
+		KubernetesVersion: cfg.Versions.Kubernetes,
+		EtcdVersion:       cfg.Versions.Etcd,
+	}
+	m.Files = append(m.Files, fileOf(ConfigName, configData, 0600))
+
+	pkiDir := pki.Dir(cfg.DataDir)
+	err = filepath.Walk(pkiDir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(pkiDir, p)
+		if err != nil {
+			return err
+		}
+		name := pkiPrefix + filepath.ToSlash(rel)
+		file, err := checksumFile(name, p, fi.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		sources[name] = p
+		m.Files = append(m.Files, *file)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read PKI %s", pkiDir)
+	}
+
+	snapshotFile, err := checksumFile(SnapshotName, snapshotPath, bundleMode)
+	if err != nil {
+		return nil, err
+	}
+	m.Files = append(m.Files, *snapshotFile)
+
+	tmp := filepath.Join(staging, "bundle.tar.gz")
+	if err := writeBundle(tmp, m, configData, sources); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return nil, errors.Wrapf(err, "failed to write backup %s", dst)
+	}
+	return m, nil
+}
+
+// Verify reads the bundle and checks all the files against the manifest
+func Verify(src string) (*Manifest, error) {
+	return walk(src, func(f *File, r io.Reader) error {
+		_, err := io.Copy(ioutil.Discard, r)
+		return err
+	})
+}
+
+// Extract verifies and extracts the bundle into the directory
+func Extract(src, dir string) (*Manifest, error) {
+	return walk(src, func(f *File, r io.Reader) error {
+		p := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			return err
+		}
+		out, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, f.Mode.Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, r)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	})
+}
+
+// walk iterates files of the bundle in order with their content checked,
+// the manifest is expected as the first entry
+func walk(src string, fn func(f *File, r io.Reader) error) (*Manifest, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open backup %s", src)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid backup %s", src)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != ManifestName {
+		return nil, errors.Errorf("invalid backup %s: manifest should be the first entry", src)
+	}
+	data, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read manifest of backup %s", src)
+	}
+	m := &Manifest{}
+	if err := yaml.Unmarshal(data, m); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse manifest of backup %s", src)
+	}
+	if m.Version != FormatVersion {
+		return nil, errors.Errorf("unsupported backup format version %d, only support %d", m.Version, FormatVersion)
+	}
+
+	files := map[string]*File{}
+	for i := range m.Files {
+		if !isValidName(m.Files[i].Name) {
+			return nil, errors.Errorf("invalid file name %s in manifest of backup %s", m.Files[i].Name, src)
+		}
+		files[m.Files[i].Name] = &m.Files[i]
+	}
+
+	seen := map[string]bool{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read backup %s", src)
+		}
+		file, ok := files[hdr.Name]
+		if !ok || seen[hdr.Name] {
+			return nil, errors.Errorf("unexpected file %s in backup %s", hdr.Name, src)
+		}
+		seen[hdr.Name] = true
+
+		h := sha256.New()
+		if err := fn(file, io.TeeReader(tr, h)); err != nil {
+			return nil, errors.Wrapf(err, "failed to read %s of backup %s", hdr.Name, src)
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != file.SHA256 {
+			return nil, errors.Errorf("checksum of %s in backup %s mismatches: expect %s but get %s",
+				hdr.Name, src, file.SHA256, sum)
+		}
+	}
+	for name := range files {
+		if !seen[name] {
+			return nil, errors.Errorf("file %s missing in backup %s", name, src)
+		}
+	}
+	return m, nil
+}
+
+func writeBundle(dst string, m *Manifest, configData []byte, sources map[string]string) (err error) {
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, bundleMode)
+	if err != nil {
+		return errors.Wrap(err, "failed to create backup file")
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil && cerr != nil {
+			err = errors.Wrap(cerr, "failed to close backup file")
+		}
+	}()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	manifestData, err := yaml.Marshal(m)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal manifest")
+	}
+	if err := writeEntry(tw, ManifestName, 0644, int64(len(manifestData)), bytes.NewReader(manifestData)); err != nil {
+		return err
+	}
+	for _, file := range m.Files {
+		if file.Name == ConfigName {
+			err = writeEntry(tw, file.Name, file.Mode, file.Size, bytes.NewReader(configData))
+		} else {
+			err = copyEntry(tw, &file, sources[file.Name])
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return errors.Wrap(err, "failed to write backup")
+	}
+	if err := gz.Close(); err != nil {
+		return errors.Wrap(err, "failed to write backup")
+	}
+	return errors.Wrap(f.Sync(), "failed to sync backup")
+}
+
+func copyEntry(tw *tar.Writer, file *File, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %s", src)
+	}
+	defer f.Close()
+	return writeEntry(tw, file.Name, file.Mode, file.Size, f)
+}
+
+func writeEntry(tw *tar.Writer, name string, mode os.FileMode, size int64, r io.Reader) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(mode.Perm()),
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return errors.Wrapf(err, "failed to write %s into backup", name)
+	}
+	if _, err := io.CopyN(tw, r, size); err != nil {
+		return errors.Wrapf(err, "failed to write %s into backup", name)
+	}
+	return nil
+}
+
+func fileOf(name string, data []byte, mode os.FileMode) File {
+	sum := sha256.Sum256(data)
+	return File{Name: name, SHA256: hex.EncodeToString(sum[:]), Size: int64(len(data)), Mode: mode}
+}
+
+func checksumFile(name, p string, mode os.FileMode) (*File, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %s", p)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", p)
+	}
+	return &File{Name: name, SHA256: hex.EncodeToString(h.Sum(nil)), Size: size, Mode: mode}, nil
+}
+
+// isValidName tells whether the name stays inside the bundle
+func isValidName(name string) bool {
+	return name != "" && name != ".." && !path.IsAbs(name) && path.Clean(name) == name &&
+		!strings.HasPrefix(name, "../")
+}
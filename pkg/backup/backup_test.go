@@ -0,0 +1,236 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backup_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jiuchen1986/cks/pkg/backup"
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/etcd"
+	"github.com/jiuchen1986/cks/pkg/pki"
+	"github.com/jiuchen1986/cks/pkg/plan"
+)
+
+func newOptions(t *testing.T, dataDir string) *backup.Options {
+	cfg := &conf.ClusterConfig{
+		DataDir: dataDir,
+		Nodes:   []conf.Node{{Name: "node-a", Address: "192.168.0.10", Roles: []conf.Role{conf.RoleController}}},
+	}
+	conf.SetDefaults(cfg)
+
+	for name, data := range map[string]string{"ca.crt": "cert", "ca.key": "key", "etcd/ca.crt": "etcd cert"} {
+		p := filepath.Join(pki.Dir(dataDir), name)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &backup.Options{
+		ClusterConfig: cfg,
+		NodeName:      "node-a",
+		Snapshot: func(ctx context.Context, w io.Writer) error {
+			_, err := w.Write([]byte("snapshot"))
+			return err
+		},
+	}
+}
+
+func TestSaveAndRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dataDir := filepath.Join(dir, "data")
+
+	dst := filepath.Join(dir, "backup.tar.gz")
+	m, err := backup.Save(context.Background(), dst, newOptions(t, dataDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "node-a", m.NodeName)
+	assert.Equal(t, 5, len(m.Files), "Config, snapshot and PKI files should be backed up.")
+
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm(), "Backup holding keys should be private.")
+
+	verified, err := backup.Verify(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, m.Files, verified.Files)
+
+	if err := os.RemoveAll(pki.Dir(dataDir)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(etcd.DataDir(dataDir), "member"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, begun := "", ""
+	opts := &backup.RestoreOptions{
+		NodeName: "node-a",
+		DataDir:  filepath.Join(dir, "other"),
+		Begin: func(cfg *conf.ClusterConfig) error {
+			begun = cfg.DataDir
+			return nil
+		},
+		RestoreSnapshot: func(snapshot string, cfg *conf.ClusterConfig, node *conf.Node) error {
+			data, err := ioutil.ReadFile(snapshot)
+			restored = string(data)
+			return err
+		},
+	}
+	_, _, err = backup.Restore(dst, opts)
+	assert.NotNil(t, err, "Data directory other than the expected one should not be used without force.")
+	assert.Equal(t, "", begun)
+
+	opts.DataDir = dataDir
+	_, _, err = backup.Restore(dst, opts)
+	assert.NotNil(t, err, "Existing etcd data should not be overwritten without force.")
+	assert.Equal(t, dataDir, begun, "Data directory in the backup should be begun with.")
+
+	opts.Force = true
+	_, _, err = backup.Restore(dst, &backup.RestoreOptions{NodeName: "node-b", Force: true})
+	assert.NotNil(t, err, "Only controllers in the backup should be restored.")
+
+	pl := plan.New("restore", "node-a")
+	if _, err := backup.PlanRestore(dst, opts, pl); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{etcd.DataDir(dataDir)}, pl.Targets(plan.RemoveFile))
+	assert.Contains(t, pl.Targets(plan.WriteFile), filepath.Join(dataDir, backup.RestoredConfigName))
+	_, err = os.Stat(pki.Dir(dataDir))
+	assert.True(t, os.IsNotExist(err), "PKI should not be restored by planning.")
+
+	cfg, cfgPath, err := backup.Restore(dst, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "snapshot", restored)
+	assert.Equal(t, dataDir, cfg.DataDir)
+	assert.Equal(t, filepath.Join(dataDir, backup.RestoredConfigName), cfgPath)
+	data, err := ioutil.ReadFile(filepath.Join(pki.Dir(dataDir), "etcd", "ca.crt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "etcd cert", string(data))
+}
+
+func TestVerifyTampered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dst := filepath.Join(dir, "backup.tar.gz")
+	if _, err := backup.Save(context.Background(), dst, newOptions(t, filepath.Join(dir, "data"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// rewrite the bundle with the snapshot replaced
+	f, err := os.Open(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	buf := &bytes.Buffer{}
+	gzw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gzw)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(tr)
+		if hdr.Name == backup.SnapshotName {
+			data = []byte("tampered")
+			hdr.Size = int64(len(data))
+		}
+		tw.WriteHeader(hdr)
+		tw.Write(data)
+	}
+	f.Close()
+	tw.Close()
+	gzw.Close()
+	if err := ioutil.WriteFile(dst, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = backup.Verify(dst)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "checksum of "+backup.SnapshotName)
+	}
+
+	if err := ioutil.WriteFile(dst, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = backup.Verify(dst)
+	assert.NotNil(t, err)
+}
+
+func TestScheduler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC)
+	opts := newOptions(t, filepath.Join(dir, "data"))
+	opts.Now = func() time.Time { return now }
+	s := &backup.Scheduler{Interval: time.Hour, Retention: 2, Dir: filepath.Join(dir, "backups"), Options: opts}
+
+	for i := 0; i < 3; i++ {
+		if err := s.RunOnce(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Hour)
+	}
+
+	paths, err := backup.List(s.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{
+		filepath.Join(s.Dir, "cks-backup-20201201T010000Z.tar.gz"),
+		filepath.Join(s.Dir, "cks-backup-20201201T020000Z.tar.gz"),
+	}, paths, "Only the latest backups should be kept.")
+}
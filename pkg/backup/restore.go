@@ -0,0 +1,199 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/etcd"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/pki"
+	"github.com/jiuchen1986/cks/pkg/plan"
+	"github.com/jiuchen1986/cks/pkg/utils"
+)
+
+// RestoredConfigName is the name of the cluster config restored into the data directory
+const RestoredConfigName string = "cluster.yaml"
+
+// RestoreOptions describes how to restore a bundle
+type RestoreOptions struct {
+	// NodeName is the controller to restore as a single node cluster
+	NodeName string
+	// DataDir is the data directory expected to restore into, where restoring into another one
+	// in the bundled cluster config requires Force. Any one is fine if it's empty
+	DataDir string
+	// Force overwrites the existing etcd data, and restores into another data directory
+	Force bool
+	// Begin is called with the bundled cluster config before anything is restored,
+	// e.g. to lock its data directory
+	Begin func(cfg *conf.ClusterConfig) error
+	// RestoreSnapshot restores the etcd snapshot for the node
+	RestoreSnapshot func(snapshot string, cfg *conf.ClusterConfig, node *conf.Node) error
+}
+
+// Restore restores the PKI, the cluster config and etcd of a single node cluster
+// from the bundle, and returns the restored cluster config with its path
+func Restore(src string, opts *RestoreOptions) (*conf.ClusterConfig, string, error) {
+	logger := lgr.GetGlobalLogger()
+	defer logger.Sync()
+
+	staging, err := ioutil.TempDir("", "cks-restore")
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to create staging directory")
+	}
+	defer os.RemoveAll(staging)
+
+	m, cfg, node, err := stage(src, staging, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	if opts.Begin != nil {
+		if err := opts.Begin(cfg); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := checkEtcdData(cfg, opts); err != nil {
+		return nil, "", err
+	}
+	// etcd refuses to restore into an existing data directory
+	if err := os.RemoveAll(etcd.DataDir(cfg.DataDir)); err != nil {
+		return nil, "", errors.Wrap(err, "failed to remove etcd data")
+	}
+
+	pkiDir := pki.Dir(cfg.DataDir)
+	for _, f := range m.Files {
+		if !strings.HasPrefix(f.Name, pkiPrefix) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(staging, filepath.FromSlash(f.Name)))
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "failed to read %s", f.Name)
+		}
+		dst := restoredPKIPath(pkiDir, f.Name)
+		if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			return nil, "", errors.Wrap(err, "failed to create PKI directory")
+		}
+		if err := utils.WriteFileAtomic(dst, data, f.Mode.Perm()); err != nil {
+			return nil, "", err
+		}
+	}
+	logger.Infof("PKI restored into %s", pkiDir)
+
+	data, err := ioutil.ReadFile(filepath.Join(staging, filepath.FromSlash(ConfigName)))
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to read cluster config")
+	}
+	if err := os.MkdirAll(cfg.DataDir, 0700); err != nil {
+		return nil, "", errors.Wrap(err, "failed to create data directory")
+	}
+	restoredConfig := filepath.Join(cfg.DataDir, RestoredConfigName)
+	if err := utils.WriteFileAtomic(restoredConfig, data, 0600); err != nil {
+		return nil, "", err
+	}
+	logger.Infof("cluster config restored into %s", restoredConfig)
+
+	if err := opts.RestoreSnapshot(filepath.Join(staging, filepath.FromSlash(SnapshotName)), cfg, node); err != nil {
+		return nil, "", err
+	}
+	logger.Infof("etcd restored into %s as a single member cluster of node %s", etcd.DataDir(cfg.DataDir), node.Name)
+	return cfg, restoredConfig, nil
+}
+
+// PlanRestore adds what Restore would write to the plan, and returns the bundled cluster config.
+// The bundle is only extracted into a temporary directory to be verified
+func PlanRestore(src string, opts *RestoreOptions, pl *plan.Plan) (*conf.ClusterConfig, error) {
+	staging, err := ioutil.TempDir("", "cks-restore")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create staging directory")
+	}
+	defer os.RemoveAll(staging)
+
+	m, cfg, node, err := stage(src, staging, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkEtcdData(cfg, opts); err != nil {
+		return nil, err
+	}
+
+	if etcd.IsMember(cfg.DataDir) {
+		pl.Add(plan.RemoveFile, etcd.DataDir(cfg.DataDir), "existing etcd data")
+	}
+	for _, f := range m.Files {
+		if strings.HasPrefix(f.Name, pkiPrefix) {
+			pl.Add(plan.WriteFile, restoredPKIPath(pki.Dir(cfg.DataDir), f.Name), "restored from "+f.Name)
+		}
+	}
+	pl.Add(plan.WriteFile, filepath.Join(cfg.DataDir, RestoredConfigName), "restored cluster config")
+	pl.Add(plan.WriteFile, etcd.DataDir(cfg.DataDir),
+		"etcd snapshot restored as a single member cluster of node "+node.Name)
+	return cfg, nil
+}
+
+// stage extracts the bundle into the staging directory, and returns its manifest,
+// its cluster config and the node to restore once it's able to be restored
+func stage(src, staging string, opts *RestoreOptions) (*Manifest, *conf.ClusterConfig, *conf.Node, error) {
+	logger := lgr.GetGlobalLogger()
+
+	m, err := Extract(src, staging)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	logger.Infof("backup of cluster %s taken on node %s at %s verified", m.ClusterName, m.NodeName, m.Created)
+
+	cfg, err := conf.LoadFile(filepath.Join(staging, filepath.FromSlash(ConfigName)))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	node := cfg.Node(opts.NodeName)
+	if node == nil || !node.HasRole(conf.RoleController) {
+		return nil, nil, nil, errors.Errorf("node %s is not a %s in the backup, specify one by --node-name",
+			opts.NodeName, conf.RoleController)
+	}
+
+	if opts.DataDir != "" && cfg.DataDir != opts.DataDir {
+		if !opts.Force {
+			return nil, nil, nil, errors.Errorf("data directory %s in the backup differs from %s, "+
+				"restore with force to use it", cfg.DataDir, opts.DataDir)
+		}
+		logger.Warnf("restore into data directory %s in the backup instead of %s", cfg.DataDir, opts.DataDir)
+	}
+	return m, cfg, node, nil
+}
+
+// checkEtcdData refuses to overwrite the existing etcd data without force
+func checkEtcdData(cfg *conf.ClusterConfig, opts *RestoreOptions) error {
+	if !etcd.IsMember(cfg.DataDir) {
+		return nil
+	}
+	if !opts.Force {
+		return errors.Errorf("etcd data exists in %s, restore with force to overwrite it", etcd.DataDir(cfg.DataDir))
+	}
+	lgr.GetGlobalLogger().Warnf("remove existing etcd data %s", etcd.DataDir(cfg.DataDir))
+	return nil
+}
+
+// restoredPKIPath returns the path in the PKI directory the bundled file with the name is restored to
+func restoredPKIPath(pkiDir, name string) string {
+	return filepath.Join(pkiDir, filepath.FromSlash(strings.TrimPrefix(name, pkiPrefix)))
+}
@@ -0,0 +1,132 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package backup
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+)
+
+const (
+	filePrefix string = "cks-backup-"
+	fileSuffix string = ".tar.gz"
+	// fileTimeFormat sorts lexically in time order
+	fileTimeFormat string = "20060102T150405Z"
+)
+
+// FileName returns the file name of a backup taken at the time
+func FileName(t time.Time) string {
+	return filePrefix + t.UTC().Format(fileTimeFormat) + fileSuffix
+}
+
+// List returns paths of the backups in the directory from the oldest to the latest
+func List(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, errors.Wrapf(err, "failed to read backup directory %s", dir)
+	}
+
+	paths := []string{}
+	for _, e := range entries {
+		if e.Mode().IsRegular() && strings.HasPrefix(e.Name(), filePrefix) && strings.HasSuffix(e.Name(), fileSuffix) {
+			paths = append(paths, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Prune removes the oldest backups in the directory beyond the retention,
+// and returns paths of the removed ones
+func Prune(dir string, retention int) ([]string, error) {
+	paths, err := List(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) <= retention {
+		return []string{}, nil
+	}
+
+	removed := []string{}
+	for _, p := range paths[:len(paths)-retention] {
+		if err := os.Remove(p); err != nil {
+			return removed, errors.Wrapf(err, "failed to remove backup %s", p)
+		}
+		removed = append(removed, p)
+	}
+	return removed, nil
+}
+
+// Scheduler takes backups periodically and keeps the latest ones
+type Scheduler struct {
+	Interval  time.Duration
+	Retention int
+	Dir       string
+	Options   *Options
+}
+
+// Run takes a backup every interval until ctx is done,
+// failures are logged and retried at the next interval
+func (s *Scheduler) Run(ctx context.Context) {
+	logger := lgr.GetGlobalLogger()
+	logger.Infof("take a backup every %s into %s, keep the latest %d", s.Interval, s.Dir, s.Retention)
+
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.RunOnce(ctx); err != nil {
+				logger.Errorf("scheduled backup failed: %v", err)
+			}
+		}
+	}
+}
+
+// RunOnce takes a backup and prunes the old ones
+func (s *Scheduler) RunOnce(ctx context.Context) error {
+	logger := lgr.GetGlobalLogger()
+
+	now := time.Now
+	if s.Options.Now != nil {
+		now = s.Options.Now
+	}
+	dst := filepath.Join(s.Dir, FileName(now()))
+	if _, err := Save(ctx, dst, s.Options); err != nil {
+		return err
+	}
+	logger.Infof("backup saved to %s", dst)
+
+	removed, err := Prune(s.Dir, s.Retention)
+	for _, p := range removed {
+		logger.Infof("old backup %s removed", p)
+	}
+	return err
+}
@@ -0,0 +1,196 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package components
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/etcd"
+	"github.com/jiuchen1986/cks/pkg/kubeconfig"
+	"github.com/jiuchen1986/cks/pkg/pki"
+	"github.com/jiuchen1986/cks/pkg/supervisor"
+)
+
+// names of the kubernetes components, which are also their binary names
+const (
+	APIServerName         string = "kube-apiserver"
+	ControllerManagerName string = "kube-controller-manager"
+	SchedulerName         string = "kube-scheduler"
+	KubeletName           string = "kubelet"
+	KubeProxyName         string = "kube-proxy"
+)
+
+// MinMinor is the oldest minor version of kubernetes flags are rendered for
+const MinMinor int = 19
+
+// Minor returns the minor version of the kubernetes version in form of vX.Y.Z
+func Minor(version string) (int, error) {
+	parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	if len(parts) != 3 || parts[0] != "1" {
+		return 0, errors.Errorf("invalid kubernetes version %s", version)
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, errors.Errorf("invalid kubernetes version %s", version)
+	}
+	if minor < MinMinor {
+		return 0, errors.Errorf("kubernetes %s is not supported, should be v1.%d or later", version, MinMinor)
+	}
+	return minor, nil
+}
+
+// ConfigDir returns the directory of component configs in the data directory
+func ConfigDir(dataDir string) string {
+	return filepath.Join(dataDir, "etc")
+}
+
+// SchedulerConfigPath returns path of the scheduler config in the data directory
+func SchedulerConfigPath(dataDir string) string {
+	return filepath.Join(ConfigDir(dataDir), "kube-scheduler.yaml")
+}
+
+// APIServer returns flags of kube-apiserver on the node.
+// Defaults are:
+//   - serving on all the addresses and advertising the node address
+//   - Node and RBAC authorization with the NodeRestriction admission
+//   - talking to the local etcd member with its client certificate
+//   - service accounts signed by the service account key pair
+//   - the aggregation layer authenticated by the front proxy CA
+//   - insecure serving disabled before 1.24, where the flag is removed
+func APIServer(cfg *conf.ClusterConfig, node *conf.Node, p *pki.PKI) ([]string, error) {
+	minor, err := Minor(cfg.Versions.Kubernetes)
+	if err != nil {
+		return nil, err
+	}
+
+	args := supervisor.Args{
+		"advertise-address":                  node.Address,
+		"bind-address":                       "0.0.0.0",
+		"secure-port":                        strconv.Itoa(cfg.API.Port),
+		"allow-privileged":                   "true",
+		"authorization-mode":                 "Node,RBAC",
+		"enable-admission-plugins":           "NodeRestriction",
+		"service-cluster-ip-range":           cfg.Network.ServiceCIDR,
+		"etcd-servers":                       etcd.ClientURL("127.0.0.1"),
+		"etcd-cafile":                        p.CertPath(pki.EtcdCAName),
+		"etcd-certfile":                      p.CertPath(pki.APIServerEtcdClientName),
+		"etcd-keyfile":                       p.KeyPath(pki.APIServerEtcdClientName),
+		"client-ca-file":                     p.CertPath(pki.CAName),
+		"tls-cert-file":                      p.CertPath(pki.APIServerName),
+		"tls-private-key-file":               p.KeyPath(pki.APIServerName),
+		"kubelet-client-certificate":         p.CertPath(pki.APIServerKubeletClientName),
+		"kubelet-client-key":                 p.KeyPath(pki.APIServerKubeletClientName),
+		"kubelet-preferred-address-types":    "InternalIP,Hostname,ExternalIP",
+		"service-account-key-file":           p.ServiceAccountPubPath(),
+		"service-account-signing-key-file":   p.ServiceAccountKeyPath(),
+		"service-account-issuer":             "https://kubernetes.default.svc." + cfg.Network.ClusterDomain,
+		"requestheader-client-ca-file":       p.CertPath(pki.FrontProxyCAName),
+		"requestheader-allowed-names":        "front-proxy-client",
+		"requestheader-extra-headers-prefix": "X-Remote-Extra-",
+		"requestheader-group-headers":        "X-Remote-Group",
+		"requestheader-username-headers":     "X-Remote-User",
+		"proxy-client-cert-file":             p.CertPath(pki.FrontProxyClientName),
+		"proxy-client-key-file":              p.KeyPath(pki.FrontProxyClientName),
+	}
+	if minor < 24 {
+		args["insecure-port"] = "0"
+	}
+	return args.Merge(cfg.Components.APIServer.ExtraArgs).Render(), nil
+}
+
+// ControllerManager returns flags of kube-controller-manager.
+// Defaults are:
+//   - talking to the local apiserver with its own kubeconfig
+//   - serving on the loopback address only with leader election
+//   - allocating node CIDRs from the pod network for the CNI
+//   - signing certificates of kubelets by the cluster CA
+//   - the bootstrap token controllers enabled besides the default ones
+func ControllerManager(cfg *conf.ClusterConfig, p *pki.PKI) ([]string, error) {
+	if _, err := Minor(cfg.Versions.Kubernetes); err != nil {
+		return nil, err
+	}
+
+	kc := kubeconfig.Path(cfg.DataDir, kubeconfig.ControllerManagerName)
+	return supervisor.Args{
+		"kubeconfig":                       kc,
+		"authentication-kubeconfig":        kc,
+		"authorization-kubeconfig":         kc,
+		"bind-address":                     "127.0.0.1",
+		"leader-elect":                     "true",
+		"cluster-name":                     cfg.ClusterName,
+		"allocate-node-cidrs":              "true",
+		"cluster-cidr":                     cfg.Network.PodCIDR,
+		"service-cluster-ip-range":         cfg.Network.ServiceCIDR,
+		"cluster-signing-cert-file":        p.CertPath(pki.CAName),
+		"cluster-signing-key-file":         p.KeyPath(pki.CAName),
+		"root-ca-file":                     p.CertPath(pki.CAName),
+		"requestheader-client-ca-file":     p.CertPath(pki.FrontProxyCAName),
+		"service-account-private-key-file": p.ServiceAccountKeyPath(),
+		"use-service-account-credentials":  "true",
+		"controllers":                      "*,bootstrapsigner,tokencleaner",
+	}.Merge(cfg.Components.ControllerManager.ExtraArgs).Render(), nil
+}
+
+// Scheduler returns flags of kube-scheduler.
+// Defaults are the scheduler config written by SchedulerConfig,
+// and serving on the loopback address only
+func Scheduler(cfg *conf.ClusterConfig) ([]string, error) {
+	if _, err := Minor(cfg.Versions.Kubernetes); err != nil {
+		return nil, err
+	}
+
+	kc := kubeconfig.Path(cfg.DataDir, kubeconfig.SchedulerName)
+	return supervisor.Args{
+		"config":                    SchedulerConfigPath(cfg.DataDir),
+		"authentication-kubeconfig": kc,
+		"authorization-kubeconfig":  kc,
+		"bind-address":              "127.0.0.1",
+	}.Merge(cfg.Components.Scheduler.ExtraArgs).Render(), nil
+}
+
+// schedulerConfigTmpl is the scheduler config with leader election
+const schedulerConfigTmpl string = `apiVersion: kubescheduler.config.k8s.io/%s
+kind: KubeSchedulerConfiguration
+clientConnection:
+  kubeconfig: %s
+leaderElection:
+  leaderElect: true
+`
+
+// SchedulerConfig returns the scheduler config in the API version
+// served by the kubernetes version, which talks to the local apiserver
+func SchedulerConfig(cfg *conf.ClusterConfig) ([]byte, error) {
+	minor, err := Minor(cfg.Versions.Kubernetes)
+	if err != nil {
+		return nil, err
+	}
+
+	version := "v1"
+	switch {
+	case minor < 22:
+		version = "v1beta1"
+	case minor < 25:
+		version = "v1beta2"
+	}
+	kc := kubeconfig.Path(cfg.DataDir, kubeconfig.SchedulerName)
+	return []byte(fmt.Sprintf(schedulerConfigTmpl, version, kc)), nil
+}
@@ -0,0 +1,162 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package components_test
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jiuchen1986/cks/pkg/components"
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/pki"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+// goldenMinors are the kubernetes minor versions whose flags are locked in testdata
+var goldenMinors = []int{19, 22, 24, 27}
+
+func newConfig(t *testing.T, minor int) (*conf.ClusterConfig, *pki.PKI) {
+	cfg := &conf.ClusterConfig{
+		DataDir: "/var/lib/cks",
+		Nodes: []conf.Node{
+			{Name: "node-a", Address: "192.168.0.10", Roles: []conf.Role{conf.RoleController, conf.RoleWorker}},
+		},
+		Versions: conf.Versions{Kubernetes: fmt.Sprintf("v1.%d.0", minor)},
+	}
+	conf.SetDefaults(cfg)
+
+	p, err := pki.New(cfg, "node-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg, p
+}
+
+func render(t *testing.T, cfg *conf.ClusterConfig, p *pki.PKI) map[string][]string {
+	rendered := map[string][]string{}
+	var err error
+	if rendered[components.APIServerName], err = components.APIServer(cfg, &cfg.Nodes[0], p); err != nil {
+		t.Fatal(err)
+	}
+	if rendered[components.ControllerManagerName], err = components.ControllerManager(cfg, p); err != nil {
+		t.Fatal(err)
+	}
+	if rendered[components.SchedulerName], err = components.Scheduler(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if rendered[components.KubeletName], err = components.Kubelet(cfg, &components.KubeletOptions{
+		NodeName:        "node-a",
+		Address:         "192.168.0.10",
+		ConfigPath:      "/var/lib/cks/etc/kubelet.yaml",
+		KubeconfigPath:  "/var/lib/cks/kubeconfig/kubelet.conf",
+		RuntimeEndpoint: "unix:///var/lib/cks/run/containerd/containerd.sock",
+		RootDir:         "/var/lib/cks/kubelet",
+		CertDir:         "/var/lib/cks/kubelet/pki",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if rendered[components.KubeProxyName], err = components.KubeProxy(cfg, &components.KubeProxyOptions{
+		NodeName:       "node-a",
+		KubeconfigPath: "/var/lib/cks/kubeconfig/kube-proxy.conf",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return rendered
+}
+
+// flagNames returns names of the flags in form of --name=value
+func flagNames(args []string) []string {
+	names := []string{}
+	for _, a := range args {
+		names = append(names, strings.SplitN(strings.TrimPrefix(a, "--"), "=", 2)[0])
+	}
+	return names
+}
+
+// assertGolden compares the content with the golden file, which is rewritten with -update
+func assertGolden(t *testing.T, path string, content []byte) {
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	golden, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(golden), string(content), "%s should match, rerun with -update if intended.", path)
+}
+
+func TestGolden(t *testing.T) {
+	for _, minor := range goldenMinors {
+		cfg, p := newConfig(t, minor)
+		dir := filepath.Join("testdata", fmt.Sprintf("v1.%d", minor))
+
+		for name, args := range render(t, cfg, p) {
+			assertGolden(t, filepath.Join(dir, name+".args"), []byte(strings.Join(args, "\n")+"\n"))
+			assert.True(t, sort.StringsAreSorted(flagNames(args)), "Flags of %s should be sorted.", name)
+		}
+
+		schedulerConfig, err := components.SchedulerConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertGolden(t, filepath.Join(dir, "kube-scheduler.yaml"), schedulerConfig)
+	}
+}
+
+func TestExtraArgs(t *testing.T) {
+	cfg, p := newConfig(t, 19)
+	cfg.Components.APIServer.ExtraArgs = map[string]string{
+		"authorization-mode": "RBAC",
+		"insecure-port":      "<delete>",
+		"v":                  "2",
+	}
+
+	args, err := components.APIServer(cfg, &cfg.Nodes[0], p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, args, "--authorization-mode=RBAC", "Extra args should override defaults.")
+	assert.Contains(t, args, "--v=2", "Extra args should be added.")
+	for _, a := range args {
+		assert.False(t, strings.HasPrefix(a, "--insecure-port="), "Flags set to the sentinel should be deleted.")
+	}
+	assert.True(t, sort.StringsAreSorted(flagNames(args)))
+}
+
+func TestMinor(t *testing.T) {
+	minor, err := components.Minor("v1.19.4")
+	assert.Nil(t, err)
+	assert.Equal(t, 19, minor)
+
+	for _, v := range []string{"v1.18.0", "v2.0.0", "1.x.0", "v1.19"} {
+		_, err := components.Minor(v)
+		assert.NotNil(t, err, "%s should be rejected.", v)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package components
+
+import (
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/supervisor"
+)
+
+// KubeletOptions are the node local inputs of the kubelet flags
+type KubeletOptions struct {
+	NodeName string
+	Address  string
+	// ConfigPath is path of the KubeletConfiguration
+	ConfigPath     string
+	KubeconfigPath string
+	// RuntimeEndpoint is the CRI endpoint, e.g. unix:///run/containerd/containerd.sock
+	RuntimeEndpoint string
+	RootDir         string
+	CertDir         string
+}
+
+// Kubelet returns flags of kubelet on the node.
+// Defaults are the kubelet config and kubeconfig fetched on joining,
+// the remote container runtime, and the node name and address as registered.
+// The container runtime flag is set before 1.27, where it's removed
+func Kubelet(cfg *conf.ClusterConfig, o *KubeletOptions) ([]string, error) {
+	minor, err := Minor(cfg.Versions.Kubernetes)
+	if err != nil {
+		return nil, err
+	}
+
+	args := supervisor.Args{
+		"config":                     o.ConfigPath,
+		"kubeconfig":                 o.KubeconfigPath,
+		"container-runtime-endpoint": o.RuntimeEndpoint,
+		"hostname-override":          o.NodeName,
+		"node-ip":                    o.Address,
+		"root-dir":                   o.RootDir,
+		"cert-dir":                   o.CertDir,
+	}
+	if minor < 27 {
+		args["container-runtime"] = "remote"
+	}
+	return args.Merge(cfg.Components.Kubelet.ExtraArgs).Render(), nil
+}
+
+// KubeProxyOptions are the node local inputs of the kube-proxy flags
+type KubeProxyOptions struct {
+	NodeName string
+	// KubeconfigPath is left empty to use the in-cluster config
+	KubeconfigPath string
+}
+
+// KubeProxy returns flags of kube-proxy on the node.
+// Defaults are the iptables mode with the pod network as the cluster CIDR,
+// and serving metrics on the loopback address only
+func KubeProxy(cfg *conf.ClusterConfig, o *KubeProxyOptions) ([]string, error) {
+	if _, err := Minor(cfg.Versions.Kubernetes); err != nil {
+		return nil, err
+	}
+
+	args := supervisor.Args{
+		"hostname-override":    o.NodeName,
+		"cluster-cidr":         cfg.Network.PodCIDR,
+		"proxy-mode":           "iptables",
+		"metrics-bind-address": "127.0.0.1:10249",
+	}
+	if o.KubeconfigPath != "" {
+		args["kubeconfig"] = o.KubeconfigPath
+	}
+	return args.Merge(cfg.Components.KubeProxy.ExtraArgs).Render(), nil
+}
@@ -0,0 +1,182 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+)
+
+func writeConfig(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "cks-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "eke.yaml")
+	if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p, func() { os.RemoveAll(dir) }
+}
+
+func TestDefault(t *testing.T) {
+	c := conf.NewDefault()
+	assert.Nil(t, conf.Validate(c), "Default config should be valid.")
+	assert.Equal(t, "10.96.0.10", c.Network.ClusterDNS, "Cluster DNS should be the 10th address "+
+		"of the service network.")
+	assert.Equal(t, c.Nodes[0].Address, c.API.Address, "API address should be the address "+
+		"of the first controller.")
+
+	ip, err := c.APIServiceIP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "10.96.0.1", ip.String(), "API service IP should be the first address "+
+		"of the service network.")
+}
+
+func TestLoadFile(t *testing.T) {
+	p, clean := writeConfig(t, `
+apiVersion: cks.io/v1alpha1
+kind: ClusterConfig
+nodes:
+- name: node-a
+  address: 192.168.0.10
+  roles: [controller]
+- name: node-b
+  address: 192.168.0.11
+network:
+  serviceCIDR: 10.100.0.0/16
+components:
+  apiServer:
+    extraArgs:
+      v: "2"
+logging:
+  levels:
+    etcd: warn
+    addons: debug
+`)
+	defer clean()
+
+	c, err := conf.LoadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "192.168.0.10", c.API.Address)
+	assert.Equal(t, []conf.Role{conf.RoleWorker}, c.Nodes[1].Roles, "Node roles should be defaulted "+
+		"to worker.")
+	assert.Equal(t, "10.100.0.10", c.Network.ClusterDNS)
+	assert.Equal(t, map[string]string{"v": "2"}, c.Components.APIServer.ExtraArgs)
+	assert.Equal(t, map[string]string{"etcd": "warn", "addons": "debug"}, c.Logging.Levels)
+}
+
+func TestValidate(t *testing.T) {
+	p, clean := writeConfig(t, `
+apiVersion: cks.io/v1
+dataDir: var/lib/cks
+nodes:
+- name: node-a
+  address: 192.168.0.300
+  roles: [master]
+- name: node-a
+  address: 192.168.0.11
+network:
+  podCIDR: 10.96.0.0/16
+versions:
+  kubernetes: "1.19"
+backup:
+  interval: 10s
+addons:
+  disabled: [dashboard]
+containerRuntime:
+  registries:
+  - host: docker.io
+    mirrors: [mirror.example.com]
+  - host: docker.io
+    credentialsFile: creds.yaml
+logging:
+  levels:
+    etcd: trace
+`)
+	defer clean()
+
+	_, err := conf.LoadFile(p)
+	errs, ok := err.(conf.ErrorList)
+	if !ok {
+		t.Fatalf("Expect an ErrorList but get %v", err)
+	}
+
+	fields := []string{}
+	for _, e := range errs {
+		fields = append(fields, e.Field)
+	}
+	assert.Equal(t, []string{
+		"apiVersion",
+		"dataDir",
+		"api.address",
+		"nodes[0].address",
+		"nodes[0].roles[0]",
+		"nodes[1].name",
+		"nodes",
+		"network.serviceCIDR",
+		"versions.kubernetes",
+		"backup.interval",
+		"addons.disabled[0]",
+		"containerRuntime.registries[0].mirrors[0]",
+		"containerRuntime.registries[1].host",
+		"containerRuntime.registries[1].credentialsFile",
+		"logging.levels.etcd",
+	}, fields, "All errors should be reported with field paths.")
+}
+
+func TestMigrate(t *testing.T) {
+	p, clean := writeConfig(t, `
+clusterName: eke
+components:
+  kubelet:
+    extraArgs:
+      max-pods: "200"
+`)
+	defer clean()
+
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, from, err := conf.Migrate(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "", from)
+	assert.Equal(t, `apiVersion: cks.io/v1alpha1
+kind: ClusterConfig
+clusterName: eke
+components:
+  kubelet:
+    extraArgs:
+      max-pods: "200"
+`, string(out), "Unversioned config should be pinned to v1alpha1.")
+
+	if err := ioutil.WriteFile(p, out, 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.LoadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{"max-pods": "200"}, c.Components.Kubelet.ExtraArgs)
+
+	again, from, err := conf.Migrate(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, conf.APIVersion, from)
+	assert.Equal(t, string(out), string(again), "Config in the current apiVersion should be left as it is.")
+
+	_, _, err = conf.Migrate([]byte("apiVersion: cks.io/v0\nkind: ClusterConfig\n"))
+	assert.NotNil(t, err, "Unknown apiVersion should not be migrated.")
+}
@@ -0,0 +1,177 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package config
+
+import (
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultClusterName is the default name of the cluster
+	DefaultClusterName string = "cks"
+	// DefaultDataDir is where cks keeps all its data by default
+	DefaultDataDir string = "/var/lib/cks"
+	// DefaultAPIPort is the default secure port of the apiserver
+	DefaultAPIPort int = 6443
+	// DefaultPodCIDR is the default pod network
+	DefaultPodCIDR string = "10.244.0.0/16"
+	// DefaultServiceCIDR is the default service network
+	DefaultServiceCIDR string = "10.96.0.0/12"
+	// DefaultClusterDomain is the default cluster domain
+	DefaultClusterDomain string = "cluster.local"
+	// DefaultKubernetesVersion is the default version of kubernetes components
+	DefaultKubernetesVersion string = "v1.19.4"
+	// DefaultEtcdVersion is the default version of etcd
+	DefaultEtcdVersion string = "v3.4.13"
+	// DefaultContainerdVersion is the default version of containerd
+	DefaultContainerdVersion string = "v1.4.3"
+	// DefaultBackupRetention is how many scheduled backups are kept by default
+	DefaultBackupRetention int = 7
+	// DefaultSandboxImage is the default pause image of pods
+	DefaultSandboxImage string = "registry.k8s.io/pause:3.2"
+
+	// clusterDNSIndex is the index of the cluster dns address in the service network
+	clusterDNSIndex int = 10
+)
+
+// NewDefault returns a fully defaulted cluster config
+// with a single node playing all the roles
+func NewDefault() *ClusterConfig {
+	c := &ClusterConfig{}
+	SetDefaults(c)
+	return c
+}
+
+// SetDefaults fills the unset fields of the cluster config with default values.
+// Invalid values are left untouched and should be reported by Validate
+func SetDefaults(c *ClusterConfig) {
+	if c.APIVersion == "" {
+		c.APIVersion = APIVersion
+	}
+	if c.Kind == "" {
+		c.Kind = Kind
+	}
+	if c.ClusterName == "" {
+		c.ClusterName = DefaultClusterName
+	}
+	if c.DataDir == "" {
+		c.DataDir = DefaultDataDir
+	}
+
+	if len(c.Nodes) == 0 {
+		name, err := os.Hostname()
+		if err != nil {
+			name = "localhost"
+		}
+		// node names are lower case as --node-name defaults to the lower case hostname
+		c.Nodes = []Node{{
+			Name:    strings.ToLower(name),
+			Address: "127.0.0.1",
+			Roles:   []Role{RoleController, RoleWorker},
+		}}
+	}
+	for i := range c.Nodes {
+		if len(c.Nodes[i].Roles) == 0 {
+			c.Nodes[i].Roles = []Role{RoleWorker}
+		}
+	}
+
+	if c.API.Port == 0 {
+		c.API.Port = DefaultAPIPort
+	}
+	if c.API.Address == "" {
+		if ctrls := c.Controllers(); len(ctrls) > 0 {
+			c.API.Address = ctrls[0].Address
+		}
+	}
+
+	if c.Network.PodCIDR == "" {
+		c.Network.PodCIDR = DefaultPodCIDR
+	}
+	if c.Network.ServiceCIDR == "" {
+		c.Network.ServiceCIDR = DefaultServiceCIDR
+	}
+	if c.Network.ClusterDomain == "" {
+		c.Network.ClusterDomain = DefaultClusterDomain
+	}
+	if c.Network.ClusterDNS == "" {
+		if _, n, err := net.ParseCIDR(c.Network.ServiceCIDR); err == nil {
+			if ip, err := nthAddress(n, clusterDNSIndex); err == nil {
+				c.Network.ClusterDNS = ip.String()
+			}
+		}
+	}
+
+	if c.Versions.Kubernetes == "" {
+		c.Versions.Kubernetes = DefaultKubernetesVersion
+	}
+	if c.Versions.Etcd == "" {
+		c.Versions.Etcd = DefaultEtcdVersion
+	}
+	if c.Versions.Containerd == "" {
+		c.Versions.Containerd = DefaultContainerdVersion
+	}
+
+	if c.Backup.Retention == 0 {
+		c.Backup.Retention = DefaultBackupRetention
+	}
+
+	if c.ContainerRuntime.SandboxImage == "" {
+		c.ContainerRuntime.SandboxImage = DefaultSandboxImage
+	}
+}
+
+// BackupDir returns where scheduled backups are kept
+func (c *ClusterConfig) BackupDir() string {
+	if c.Backup.Dir != "" {
+		return c.Backup.Dir
+	}
+	return filepath.Join(c.DataDir, "backups")
+}
+
+// APIServiceIP returns the address of the kubernetes service,
+// which is the first address of the service network
+func (c *ClusterConfig) APIServiceIP() (net.IP, error) {
+	_, n, err := net.ParseCIDR(c.Network.ServiceCIDR)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse service network")
+	}
+	return nthAddress(n, 1)
+}
+
+// nthAddress returns the nth address in the network
+func nthAddress(n *net.IPNet, i int) (net.IP, error) {
+	base := big.NewInt(0).SetBytes(n.IP)
+	ip := big.NewInt(0).Add(base, big.NewInt(int64(i)))
+
+	b := ip.Bytes()
+	if len(b) > len(n.IP) {
+		return nil, errors.Errorf("network %s has no %dth address", n, i)
+	}
+	// left pad to the length of the network address
+	addr := make(net.IP, len(n.IP))
+	copy(addr[len(addr)-len(b):], b)
+	if !n.Contains(addr) {
+		return nil, errors.Errorf("network %s has no %dth address", n, i)
+	}
+	return addr, nil
+}
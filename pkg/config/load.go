@@ -0,0 +1,85 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package config
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// EnvPrefix is the prefix of environment variables overriding the cluster config,
+// e.g. CKS_NETWORK_PODCIDR overrides network.podCIDR
+const EnvPrefix string = "CKS"
+
+// Load unmarshals the cluster config from viper,
+// then defaults and validates it
+func Load(v *viper.Viper) (*ClusterConfig, error) {
+	c := &ClusterConfig{}
+	if err := v.Unmarshal(c); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal cluster config")
+	}
+
+	SetDefaults(c)
+	if err := Validate(c); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// LoadFile loads the cluster config from the file
+// without involving the global viper
+func LoadFile(path string) (*ClusterConfig, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read cluster config from %s", path)
+	}
+	return Load(v)
+}
+
+// BindEnv binds environment variables to all the scalar fields of
+// the cluster config, so that they are able to override the config file.
+// Lists and maps, e.g. nodes, are not supported
+func BindEnv(v *viper.Viper) error {
+	for _, key := range scalarKeys(reflect.TypeOf(ClusterConfig{}), "") {
+		env := EnvPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+		if err := v.BindEnv(key, env); err != nil {
+			return errors.Wrapf(err, "failed to bind env %s", env)
+		}
+	}
+	return nil
+}
+
+// scalarKeys returns keys of all scalar fields in t, which is a struct,
+// and nested keys are joined by dot
+func scalarKeys(t reflect.Type, prefix string) []string {
+	keys := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := prefix + strings.Split(f.Tag.Get("yaml"), ",")[0]
+		switch f.Type.Kind() {
+		case reflect.Struct:
+			keys = append(keys, scalarKeys(f.Type, key+".")...)
+		case reflect.String, reflect.Int, reflect.Bool:
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,116 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package config
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// migration converts a config document from one apiVersion to the next one.
+// Documents are handled as yaml.MapSlice to keep the order of keys
+type migration struct {
+	to      string
+	migrate func(yaml.MapSlice) (yaml.MapSlice, error)
+}
+
+// update this map when a new version is introduced,
+// keyed by the apiVersion to migrate from
+var migrations map[string]migration = map[string]migration{
+	// documents hand-written before the config was versioned are loaded
+	// as the current apiVersion, pin them to v1alpha1 so that they keep
+	// being read as v1alpha1 once a newer version is introduced
+	"": {to: Group + "/v1alpha1", migrate: pinV1alpha1},
+}
+
+// IsMigratable tells whether the config of apiVersion
+// can be migrated to the current apiVersion
+func IsMigratable(apiVersion string) bool {
+	_, ok := migrations[apiVersion]
+	return ok
+}
+
+// Migrate converts the config document to the current apiVersion
+// and returns the apiVersion it was migrated from.
+// The document is returned as it is if it's already in the current apiVersion
+func Migrate(data []byte) ([]byte, string, error) {
+	doc := yaml.MapSlice{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, "", errors.Wrap(err, "failed to parse config document")
+	}
+
+	v, _ := getKey(doc, "apiVersion")
+	from, _ := v.(string)
+	if from == APIVersion {
+		return data, from, nil
+	}
+
+	for cur := from; cur != APIVersion; {
+		m, ok := migrations[cur]
+		if !ok {
+			return nil, from, errors.Errorf("unable to migrate from apiVersion %s", cur)
+		}
+
+		var err error
+		if doc, err = m.migrate(doc); err != nil {
+			return nil, from, errors.Wrapf(err, "failed to migrate from %s to %s", cur, m.to)
+		}
+		doc = setKey(doc, "apiVersion", m.to)
+		cur = m.to
+	}
+
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, from, errors.Wrap(err, "failed to marshal migrated config document")
+	}
+	return out, from, nil
+}
+
+// pinV1alpha1 puts apiVersion and kind at the top of an unversioned document,
+// where apiVersion is set to v1alpha1 by Migrate afterwards
+func pinV1alpha1(doc yaml.MapSlice) (yaml.MapSlice, error) {
+	head := yaml.MapSlice{{Key: "apiVersion", Value: ""}}
+	kind, i := getKey(doc, "kind")
+	if i >= 0 {
+		doc = append(doc[:i:i], doc[i+1:]...)
+	} else {
+		kind = Kind
+	}
+	head = append(head, yaml.MapItem{Key: "kind", Value: kind})
+	return append(head, doc...), nil
+}
+
+// getKey returns the value of key and its index in doc,
+// the index is -1 if key is not found
+func getKey(doc yaml.MapSlice, key string) (interface{}, int) {
+	for i, item := range doc {
+		if fmt.Sprint(item.Key) == key {
+			return item.Value, i
+		}
+	}
+	return nil, -1
+}
+
+// setKey sets the value of key in doc, a new key is appended if not found
+func setKey(doc yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+	if _, i := getKey(doc, key); i >= 0 {
+		doc[i].Value = value
+		return doc
+	}
+	return append(doc, yaml.MapItem{Key: key, Value: value})
+}
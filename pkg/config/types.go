@@ -0,0 +1,228 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package config
+
+const (
+	// Group is the API group of the cluster configuration
+	Group string = "cks.io"
+	// Version is the current version of the cluster configuration
+	Version string = "v1alpha1"
+	// APIVersion is the current apiVersion of the cluster configuration
+	APIVersion string = Group + "/" + Version
+	// Kind is the kind of the cluster configuration
+	Kind string = "ClusterConfig"
+)
+
+// Note that field names should match the yaml tags case-insensitively,
+// as viper decodes the config with mapstructure which matches
+// keys by field name without considering the yaml tags
+
+// ClusterConfig is the typed cluster configuration
+// read from the file given by --config
+type ClusterConfig struct {
+	APIVersion       string           `yaml:"apiVersion"`
+	Kind             string           `yaml:"kind"`
+	ClusterName      string           `yaml:"clusterName"`
+	DataDir          string           `yaml:"dataDir"`
+	API              API              `yaml:"api"`
+	Nodes            []Node           `yaml:"nodes"`
+	Network          Network          `yaml:"network"`
+	Versions         Versions         `yaml:"versions"`
+	Components       Components       `yaml:"components,omitempty"`
+	Backup           Backup           `yaml:"backup,omitempty"`
+	Addons           Addons           `yaml:"addons,omitempty"`
+	ContainerRuntime ContainerRuntime `yaml:"containerRuntime,omitempty"`
+	Logging          Logging          `yaml:"logging,omitempty"`
+}
+
+// API configures how the kube-apiserver is exposed
+type API struct {
+	// Address is advertised by the apiserver and used by
+	// all the clients, defaults to the address of the first controller
+	Address string `yaml:"address"`
+	Port    int    `yaml:"port"`
+	// SANs are extra subject alternative names
+	// of the apiserver serving certificate
+	SANs []string `yaml:"sans,omitempty"`
+}
+
+// Role is the role a node plays in the cluster
+type Role string
+
+const (
+	// RoleController runs etcd and the control plane components
+	RoleController Role = "controller"
+	// RoleWorker runs kubelet and the container runtime
+	RoleWorker Role = "worker"
+)
+
+// Node is a member of the cluster
+type Node struct {
+	Name    string            `yaml:"name"`
+	Address string            `yaml:"address"`
+	Roles   []Role            `yaml:"roles"`
+	Labels  map[string]string `yaml:"labels,omitempty"`
+}
+
+// HasRole tells whether the node plays the role
+func (n *Node) HasRole(r Role) bool {
+	for _, v := range n.Roles {
+		if v == r {
+			return true
+		}
+	}
+	return false
+}
+
+// Network configures the cluster networking
+type Network struct {
+	PodCIDR       string `yaml:"podCIDR"`
+	ServiceCIDR   string `yaml:"serviceCIDR"`
+	ClusterDomain string `yaml:"clusterDomain"`
+	// ClusterDNS defaults to the tenth address of ServiceCIDR
+	ClusterDNS string `yaml:"clusterDNS"`
+}
+
+// Versions pins the versions of the components
+type Versions struct {
+	Kubernetes string `yaml:"kubernetes"`
+	Etcd       string `yaml:"etcd"`
+	Containerd string `yaml:"containerd"`
+}
+
+// Backup configures scheduled backups taken by controllers
+type Backup struct {
+	// Interval is how often a backup is taken, e.g. 6h,
+	// scheduled backups are disabled if it's empty
+	Interval string `yaml:"interval,omitempty"`
+	// Retention is how many scheduled backups are kept
+	Retention int `yaml:"retention,omitempty"`
+	// Dir is where scheduled backups are kept, defaults to <dataDir>/backups
+	Dir string `yaml:"dir,omitempty"`
+}
+
+// ContainerRuntime configures containerd on workers
+type ContainerRuntime struct {
+	// SandboxImage is the pause image of pods
+	SandboxImage string `yaml:"sandboxImage,omitempty"`
+	// Registries configures how images are pulled from each registry,
+	// which is a list as registry hosts contain dots splitting viper keys
+	Registries []Registry `yaml:"registries,omitempty"`
+}
+
+// Registry configures pulling images from a registry, where the TLS settings
+// and credentials apply to the registry and all its mirrors
+type Registry struct {
+	// Host is the registry in image names, e.g. docker.io
+	Host string `yaml:"host"`
+	// Mirrors are URLs of the endpoints tried in order before the registry itself,
+	// e.g. https://mirror.example.com
+	Mirrors []string `yaml:"mirrors,omitempty"`
+	// Insecure skips verifying TLS certificates,
+	// and allows plain http to the registry if no mirror is set
+	Insecure bool `yaml:"insecure,omitempty"`
+	// CAFile is the CA bundle on workers verifying the registry
+	CAFile string `yaml:"caFile,omitempty"`
+	// CredentialsFile is a yaml file on workers with username and password,
+	// auth or identitytoken to log in the registry
+	CredentialsFile string `yaml:"credentialsFile,omitempty"`
+}
+
+// names of the addons shipped with cks
+const (
+	AddonKubeProxy     string = "kube-proxy"
+	AddonCoreDNS       string = "coredns"
+	AddonFlannel       string = "flannel"
+	AddonMetricsServer string = "metrics-server"
+	AddonStorageClass  string = "storage-class"
+)
+
+// AddonNames returns names of all the addons shipped with cks in the order they're applied
+func AddonNames() []string {
+	return []string{AddonKubeProxy, AddonFlannel, AddonCoreDNS, AddonMetricsServer, AddonStorageClass}
+}
+
+// Addons configures the manifests controllers apply to the cluster
+type Addons struct {
+	// Disabled are names of the shipped addons not to apply,
+	// objects applied before are left in the cluster
+	Disabled []string `yaml:"disabled,omitempty"`
+}
+
+// IsEnabled tells whether the shipped addon is applied
+func (a *Addons) IsEnabled(name string) bool {
+	for _, d := range a.Disabled {
+		if d == name {
+			return false
+		}
+	}
+	return true
+}
+
+// Logging configures the logs of cks
+type Logging struct {
+	// Levels are levels of components overriding the global level given by --log-level,
+	// e.g. etcd: warn, where a component is the process cks runs, or pki, addons, etc.
+	Levels map[string]string `yaml:"levels,omitempty"`
+}
+
+// Components configures each component individually
+type Components struct {
+	Etcd              Component `yaml:"etcd,omitempty"`
+	APIServer         Component `yaml:"apiServer,omitempty"`
+	ControllerManager Component `yaml:"controllerManager,omitempty"`
+	Scheduler         Component `yaml:"scheduler,omitempty"`
+	Kubelet           Component `yaml:"kubelet,omitempty"`
+	KubeProxy         Component `yaml:"kubeProxy,omitempty"`
+}
+
+// Component configures a single component
+type Component struct {
+	// ExtraArgs are extra command line flags of the component overriding
+	// the defaults, where keys are flag names without leading dashes.
+	// A default flag is deleted if its value is "<delete>"
+	ExtraArgs map[string]string `yaml:"extraArgs,omitempty"`
+}
+
+// Controllers returns nodes with the controller role
+func (c *ClusterConfig) Controllers() []Node {
+	return c.nodesWithRole(RoleController)
+}
+
+// Workers returns nodes with the worker role
+func (c *ClusterConfig) Workers() []Node {
+	return c.nodesWithRole(RoleWorker)
+}
+
+// Node returns the node with given name, or nil if not found
+func (c *ClusterConfig) Node(name string) *Node {
+	for i := range c.Nodes {
+		if c.Nodes[i].Name == name {
+			return &c.Nodes[i]
+		}
+	}
+	return nil
+}
+
+func (c *ClusterConfig) nodesWithRole(r Role) []Node {
+	ns := []Node{}
+	for _, n := range c.Nodes {
+		if n.HasRole(r) {
+			ns = append(ns, n)
+		}
+	}
+	return ns
+}
@@ -0,0 +1,289 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+)
+
+var (
+	versionRegexp  = regexp.MustCompile(`^v\d+\.\d+\.\d+$`)
+	dns1123Regexp  = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+	flagNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][-a-zA-Z0-9_.]*$`)
+
+	// dns1123LabelRegexp matches a DNS-1123 name without dots
+	dns1123LabelRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+)
+
+// FieldError is an error found in a field of the cluster config
+type FieldError struct {
+	// Field is the path to the field, e.g. nodes[0].address
+	Field  string
+	Value  interface{}
+	Detail string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: invalid value %q: %s", e.Field, fmt.Sprint(e.Value), e.Detail)
+}
+
+// ErrorList is a list of FieldError which is also an error
+type ErrorList []*FieldError
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, 0, len(l))
+	for _, e := range l {
+		msgs = append(msgs, e.Error())
+	}
+	return fmt.Sprintf("%d error(s) found in cluster config:\n  %s", len(l), strings.Join(msgs, "\n  "))
+}
+
+// ToAggregate returns nil if no error in the list,
+// otherwise returns the list itself
+func (l ErrorList) ToAggregate() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+func (l *ErrorList) add(field string, value interface{}, format string, a ...interface{}) {
+	*l = append(*l, &FieldError{Field: field, Value: value, Detail: fmt.Sprintf(format, a...)})
+}
+
+// Validate checks the cluster config and returns all errors found,
+// the returned error is an ErrorList if not nil
+func Validate(c *ClusterConfig) error {
+	errs := ErrorList{}
+
+	if c.APIVersion != APIVersion {
+		if IsMigratable(c.APIVersion) {
+			errs.add("apiVersion", c.APIVersion, "deprecated, run \"cks config migrate\" to migrate to %s", APIVersion)
+		} else {
+			errs.add("apiVersion", c.APIVersion, "only support %s", APIVersion)
+		}
+	}
+	if c.Kind != Kind {
+		errs.add("kind", c.Kind, "only support %s", Kind)
+	}
+	if !dns1123Regexp.MatchString(c.ClusterName) {
+		errs.add("clusterName", c.ClusterName, "must be a lower case DNS-1123 name")
+	}
+	if !filepath.IsAbs(c.DataDir) {
+		errs.add("dataDir", c.DataDir, "must be an absolute path")
+	}
+
+	validateAPI(&c.API, &errs)
+	validateNodes(c.Nodes, &errs)
+	validateNetwork(&c.Network, &errs)
+	validateVersions(&c.Versions, &errs)
+	validateComponents(&c.Components, &errs)
+	validateBackup(&c.Backup, &errs)
+	validateAddons(&c.Addons, &errs)
+	validateContainerRuntime(&c.ContainerRuntime, &errs)
+	validateLogging(&c.Logging, &errs)
+
+	return errs.ToAggregate()
+}
+
+func validateAPI(a *API, errs *ErrorList) {
+	if !isAddress(a.Address) {
+		errs.add("api.address", a.Address, "must be an IP address or a DNS name")
+	}
+	if a.Port < 1 || a.Port > 65535 {
+		errs.add("api.port", a.Port, "must be between 1 and 65535")
+	}
+	for i, s := range a.SANs {
+		if !isAddress(s) {
+			errs.add(fmt.Sprintf("api.sans[%d]", i), s, "must be an IP address or a DNS name")
+		}
+	}
+}
+
+func validateNodes(nodes []Node, errs *ErrorList) {
+	if len(nodes) == 0 {
+		errs.add("nodes", "", "at least one node is required")
+		return
+	}
+
+	names := map[string]bool{}
+	controllers := 0
+	for i, n := range nodes {
+		path := fmt.Sprintf("nodes[%d]", i)
+		if !IsNodeName(n.Name) {
+			errs.add(path+".name", n.Name, "must be a lower case DNS-1123 name")
+		} else if names[n.Name] {
+			errs.add(path+".name", n.Name, "duplicated node name")
+		}
+		names[n.Name] = true
+
+		if net.ParseIP(n.Address) == nil {
+			errs.add(path+".address", n.Address, "must be an IP address")
+		}
+
+		for j, r := range n.Roles {
+			if r != RoleController && r != RoleWorker {
+				errs.add(fmt.Sprintf("%s.roles[%d]", path, j), r, "only support %s, %s", RoleController, RoleWorker)
+			}
+		}
+		if n.HasRole(RoleController) {
+			controllers++
+		}
+	}
+
+	if controllers == 0 {
+		errs.add("nodes", "", "at least one node with role %s is required", RoleController)
+	}
+}
+
+func validateNetwork(n *Network, errs *ErrorList) {
+	_, pod, err := net.ParseCIDR(n.PodCIDR)
+	if err != nil {
+		errs.add("network.podCIDR", n.PodCIDR, "must be a CIDR")
+	}
+	_, svc, err := net.ParseCIDR(n.ServiceCIDR)
+	if err != nil {
+		errs.add("network.serviceCIDR", n.ServiceCIDR, "must be a CIDR")
+	}
+	if pod != nil && svc != nil && (pod.Contains(svc.IP) || svc.Contains(pod.IP)) {
+		errs.add("network.serviceCIDR", n.ServiceCIDR, "must not overlap with network.podCIDR %s", n.PodCIDR)
+	}
+
+	if !dns1123Regexp.MatchString(n.ClusterDomain) {
+		errs.add("network.clusterDomain", n.ClusterDomain, "must be a lower case DNS-1123 name")
+	}
+
+	dns := net.ParseIP(n.ClusterDNS)
+	if dns == nil {
+		errs.add("network.clusterDNS", n.ClusterDNS, "must be an IP address")
+	} else if svc != nil && !svc.Contains(dns) {
+		errs.add("network.clusterDNS", n.ClusterDNS, "must be in network.serviceCIDR %s", n.ServiceCIDR)
+	}
+}
+
+func validateVersions(v *Versions, errs *ErrorList) {
+	// use slices rather than maps to keep errors in a stable order
+	fields := []string{"versions.kubernetes", "versions.etcd", "versions.containerd"}
+	for i, value := range []string{v.Kubernetes, v.Etcd, v.Containerd} {
+		if !versionRegexp.MatchString(value) {
+			errs.add(fields[i], value, "must be in form of vX.Y.Z")
+		}
+	}
+}
+
+func validateComponents(c *Components, errs *ErrorList) {
+	fields := []string{"etcd", "apiServer", "controllerManager", "scheduler", "kubelet", "kubeProxy"}
+	for i, comp := range []*Component{
+		&c.Etcd, &c.APIServer, &c.ControllerManager, &c.Scheduler, &c.Kubelet, &c.KubeProxy,
+	} {
+		for _, k := range sortedKeys(comp.ExtraArgs) {
+			if !flagNameRegexp.MatchString(k) {
+				errs.add("components."+fields[i]+".extraArgs."+k, k, "must be a flag name without leading dashes")
+			}
+		}
+	}
+}
+
+func validateBackup(b *Backup, errs *ErrorList) {
+	if b.Interval != "" {
+		if d, err := time.ParseDuration(b.Interval); err != nil || d < time.Minute {
+			errs.add("backup.interval", b.Interval, "must be a duration of at least 1m, e.g. 6h")
+		}
+	}
+	if b.Retention < 1 {
+		errs.add("backup.retention", b.Retention, "must be positive")
+	}
+	if b.Dir != "" && !filepath.IsAbs(b.Dir) {
+		errs.add("backup.dir", b.Dir, "must be an absolute path")
+	}
+}
+
+func validateAddons(a *Addons, errs *ErrorList) {
+	names := AddonNames()
+	for i, d := range a.Disabled {
+		known := false
+		for _, n := range names {
+			known = known || d == n
+		}
+		if !known {
+			errs.add(fmt.Sprintf("addons.disabled[%d]", i), d, "must be one of %s", strings.Join(names, ", "))
+		}
+	}
+}
+
+func validateContainerRuntime(r *ContainerRuntime, errs *ErrorList) {
+	hosts := map[string]bool{}
+	for i, reg := range r.Registries {
+		path := fmt.Sprintf("containerRuntime.registries[%d]", i)
+		if reg.Host == "" || strings.HasPrefix(reg.Host, ":") || strings.ContainsAny(reg.Host, "/ ") {
+			errs.add(path+".host", reg.Host, "must be a registry host with an optional port, e.g. docker.io")
+		} else if hosts[reg.Host] {
+			errs.add(path+".host", reg.Host, "duplicated registry")
+		}
+		hosts[reg.Host] = true
+
+		for j, m := range reg.Mirrors {
+			if u, err := url.Parse(m); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs.add(fmt.Sprintf("%s.mirrors[%d]", path, j), m, "must be a http or https URL")
+			}
+		}
+		if reg.CAFile != "" && !filepath.IsAbs(reg.CAFile) {
+			errs.add(path+".caFile", reg.CAFile, "must be an absolute path")
+		}
+		if reg.CredentialsFile != "" && !filepath.IsAbs(reg.CredentialsFile) {
+			errs.add(path+".credentialsFile", reg.CredentialsFile, "must be an absolute path")
+		}
+	}
+}
+
+func validateLogging(l *Logging, errs *ErrorList) {
+	for _, c := range sortedKeys(l.Levels) {
+		// components with dots are not supported as dots split viper keys
+		if !dns1123LabelRegexp.MatchString(c) {
+			errs.add("logging.levels."+c, c, "must be a lower case DNS-1123 label")
+		}
+		if _, err := lgr.NewLogLevelOption(l.Levels[c]); err != nil {
+			errs.add("logging.levels."+c, l.Levels[c], "only support %s", lgr.PrintAvailLogLevel())
+		}
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// IsNodeName tells whether the name is a valid node name, i.e. a lower case DNS-1123 name
+func IsNodeName(name string) bool {
+	return dns1123Regexp.MatchString(name)
+}
+
+func isAddress(s string) bool {
+	return net.ParseIP(s) != nil || dns1123Regexp.MatchString(s)
+}
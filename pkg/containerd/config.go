@@ -0,0 +1,220 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package containerd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/preflight"
+)
+
+// Options are the node local inputs of the containerd config
+type Options struct {
+	Root       string
+	State      string
+	Socket     string
+	CNIBinDir  string
+	CNIConfDir string
+	// SystemdCgroup runs containers in cgroups managed by systemd,
+	// kubelet should use the same cgroup driver
+	SystemdCgroup bool
+	// ReadFile reads the credentials files of registries, defaults to ioutil.ReadFile
+	ReadFile func(path string) ([]byte, error)
+}
+
+// Credentials is the content of a credentials file of a registry
+type Credentials struct {
+	Username      string `yaml:"username,omitempty"`
+	Password      string `yaml:"password,omitempty"`
+	Auth          string `yaml:"auth,omitempty"`
+	IdentityToken string `yaml:"identitytoken,omitempty"`
+}
+
+// hostConfig is the TLS settings and credentials of an endpoint host
+type hostConfig struct {
+	Host        string
+	Insecure    bool
+	CAFile      string
+	Credentials *Credentials
+}
+
+// mirror is the endpoints of a registry
+type mirror struct {
+	Host      string
+	Endpoints []string
+}
+
+// values are the inputs of configTmpl
+type values struct {
+	*Options
+	SandboxImage string
+	Mirrors      []mirror
+	HostConfigs  []hostConfig
+}
+
+// configTmpl is the config of containerd 1.4 and later in version 2,
+// with all the state kept in the data directory
+const configTmpl string = `version = 2
+root = {{ quote .Root }}
+state = {{ quote .State }}
+
+[grpc]
+  address = {{ quote .Socket }}
+
+[plugins."io.containerd.grpc.v1.cri"]
+  sandbox_image = {{ quote .SandboxImage }}
+
+[plugins."io.containerd.grpc.v1.cri".containerd.runtimes.runc]
+  runtime_type = "io.containerd.runc.v2"
+
+[plugins."io.containerd.grpc.v1.cri".containerd.runtimes.runc.options]
+  SystemdCgroup = {{ .SystemdCgroup }}
+
+[plugins."io.containerd.grpc.v1.cri".cni]
+  bin_dir = {{ quote .CNIBinDir }}
+  conf_dir = {{ quote .CNIConfDir }}
+{{- range .Mirrors }}
+
+[plugins."io.containerd.grpc.v1.cri".registry.mirrors.{{ quote .Host }}]
+  endpoint = [{{ range $i, $e := .Endpoints }}{{ if $i }}, {{ end }}{{ quote $e }}{{ end }}]
+{{- end }}
+{{- range $hc := .HostConfigs }}
+{{- if or .Insecure .CAFile }}
+
+[plugins."io.containerd.grpc.v1.cri".registry.configs.{{ quote .Host }}.tls]
+{{- if .Insecure }}
+  insecure_skip_verify = true
+{{- end }}
+{{- if .CAFile }}
+  ca_file = {{ quote .CAFile }}
+{{- end }}
+{{- end }}
+{{- with .Credentials }}
+
+[plugins."io.containerd.grpc.v1.cri".registry.configs.{{ quote $hc.Host }}.auth]
+{{- if .Username }}
+  username = {{ quote .Username }}
+{{- end }}
+{{- if .Password }}
+  password = {{ quote .Password }}
+{{- end }}
+{{- if .Auth }}
+  auth = {{ quote .Auth }}
+{{- end }}
+{{- if .IdentityToken }}
+  identitytoken = {{ quote .IdentityToken }}
+{{- end }}
+{{- end }}
+{{- end }}
+`
+
+var tmpl = template.Must(template.New("config.toml").Funcs(template.FuncMap{
+	// quote renders a string as a json string, which is also a valid toml basic string
+	"quote": func(s string) (string, error) {
+		b, err := json.Marshal(s)
+		return string(b), err
+	},
+}).Parse(configTmpl))
+
+// Config renders the containerd config.toml from the cluster config,
+// reading the credentials files of registries on this node
+func Config(cfg *conf.ClusterConfig, o *Options) ([]byte, error) {
+	readFile := o.ReadFile
+	if readFile == nil {
+		readFile = ioutil.ReadFile
+	}
+
+	v := &values{Options: o, SandboxImage: cfg.ContainerRuntime.SandboxImage, Mirrors: []mirror{}}
+	if v.SandboxImage == "" {
+		v.SandboxImage = conf.DefaultSandboxImage
+	}
+	for _, reg := range cfg.ContainerRuntime.Registries {
+		hc := hostConfig{Insecure: reg.Insecure, CAFile: reg.CAFile}
+		if reg.CredentialsFile != "" {
+			data, err := readFile(reg.CredentialsFile)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read credentials of registry %s", reg.Host)
+			}
+			c := &Credentials{}
+			if err := yaml.UnmarshalStrict(data, c); err != nil {
+				return nil, errors.Wrapf(err, "invalid credentials file %s of registry %s", reg.CredentialsFile, reg.Host)
+			}
+			hc.Credentials = c
+		}
+
+		m := mirror{Host: reg.Host, Endpoints: append([]string{}, reg.Mirrors...)}
+		hosts := []string{reg.Host}
+		for _, e := range reg.Mirrors {
+			u, err := url.Parse(e)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid mirror %s of registry %s", e, reg.Host)
+			}
+			hosts = append(hosts, u.Host)
+		}
+		if reg.Insecure && len(reg.Mirrors) == 0 {
+			// try https first, and fall back to plain http
+			m.Endpoints = []string{"https://" + reg.Host, "http://" + reg.Host}
+		}
+		if len(m.Endpoints) > 0 {
+			v.Mirrors = append(v.Mirrors, m)
+		}
+
+		if hc.Insecure || hc.CAFile != "" || hc.Credentials != nil {
+			for _, h := range hosts {
+				hc.Host = h
+				v.HostConfigs = mergeHostConfig(v.HostConfigs, hc)
+			}
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, v); err != nil {
+		return nil, errors.Wrap(err, "failed to render containerd config")
+	}
+	return buf.Bytes(), nil
+}
+
+// mergeHostConfig adds the host config, replacing the one of the same host
+// shared by registries, e.g. a mirror of multiple registries
+func mergeHostConfig(hcs []hostConfig, hc hostConfig) []hostConfig {
+	for i := range hcs {
+		if strings.EqualFold(hcs[i].Host, hc.Host) {
+			hcs[i] = hc
+			return hcs
+		}
+	}
+	return append(hcs, hc)
+}
+
+// SystemdCgroup tells whether containers should run in cgroups managed by systemd,
+// which is the case on hosts with cgroup v2
+func SystemdCgroup(fsys fs.FS) (bool, error) {
+	version, err := preflight.CgroupVersion(fsys)
+	if err != nil {
+		return false, err
+	}
+	return version == 2, nil
+}
@@ -0,0 +1,160 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package containerd_test
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/containerd"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+// credentials are the fake credentials files on the node
+var credentials = map[string]string{
+	"/etc/cks/registry.example.com.yaml": "username: cks\npassword: \"p@ss\\\"word\"\n",
+	"/etc/cks/ghcr.io.yaml":              "identitytoken: token\n",
+}
+
+func readFile(path string) ([]byte, error) {
+	data, ok := credentials[path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return []byte(data), nil
+}
+
+func newOptions(systemd bool) *containerd.Options {
+	return &containerd.Options{
+		Root:          "/var/lib/cks/containerd",
+		State:         "/var/lib/cks/run/containerd",
+		Socket:        "/var/lib/cks/run/containerd/containerd.sock",
+		CNIBinDir:     "/var/lib/cks/bin/current",
+		CNIConfDir:    "/var/lib/cks/etc/cni/net.d",
+		SystemdCgroup: systemd,
+		ReadFile:      readFile,
+	}
+}
+
+// goldenCases are the container runtime configs whose containerd configs are locked in testdata
+var goldenCases = map[string]struct {
+	runtime conf.ContainerRuntime
+	systemd bool
+}{
+	"default": {},
+	"sandbox-image": {
+		runtime: conf.ContainerRuntime{SandboxImage: "registry.example.com/pause:3.5"},
+	},
+	"systemd-cgroup": {
+		systemd: true,
+	},
+	"mirrors": {
+		runtime: conf.ContainerRuntime{Registries: []conf.Registry{
+			{Host: "docker.io", Mirrors: []string{"https://mirror.example.com", "https://registry-1.docker.io"}},
+			{Host: "registry.k8s.io", Mirrors: []string{"https://mirror.example.com/v2/k8s"}},
+		}},
+	},
+	"insecure": {
+		runtime: conf.ContainerRuntime{Registries: []conf.Registry{
+			{Host: "registry.local:5000", Insecure: true},
+			{Host: "docker.io", Mirrors: []string{"https://mirror.local"}, Insecure: true},
+		}},
+	},
+	"credentials": {
+		runtime: conf.ContainerRuntime{Registries: []conf.Registry{
+			{Host: "registry.example.com", CAFile: "/etc/cks/ca.pem",
+				CredentialsFile: "/etc/cks/registry.example.com.yaml"},
+			{Host: "ghcr.io", CredentialsFile: "/etc/cks/ghcr.io.yaml"},
+		}},
+	},
+	"airgapped": {
+		runtime: conf.ContainerRuntime{
+			SandboxImage: "registry.example.com/pause:3.2",
+			Registries: []conf.Registry{
+				{Host: "docker.io", Mirrors: []string{"https://registry.example.com"},
+					CAFile: "/etc/cks/ca.pem", CredentialsFile: "/etc/cks/registry.example.com.yaml"},
+				{Host: "registry.k8s.io", Mirrors: []string{"https://registry.example.com"},
+					CAFile: "/etc/cks/ca.pem", CredentialsFile: "/etc/cks/registry.example.com.yaml"},
+				{Host: "registry.local", Insecure: true},
+			},
+		},
+		systemd: true,
+	},
+}
+
+// assertGolden compares the content with the golden file, which is rewritten with -update
+func assertGolden(t *testing.T, path string, content []byte) {
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	golden, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(golden), string(content), "%s should match, rerun with -update if intended.", path)
+}
+
+func TestGolden(t *testing.T) {
+	for name, c := range goldenCases {
+		cfg := &conf.ClusterConfig{ContainerRuntime: c.runtime}
+		conf.SetDefaults(cfg)
+
+		out, err := containerd.Config(cfg, newOptions(c.systemd))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		assertGolden(t, filepath.Join("testdata", name+".toml"), out)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	cfg := conf.NewDefault()
+	cfg.ContainerRuntime.Registries = []conf.Registry{{Host: "docker.io", CredentialsFile: "/etc/cks/missing.yaml"}}
+	_, err := containerd.Config(cfg, newOptions(false))
+	assert.NotNil(t, err, "Missing credentials files should fail.")
+
+	credentials["/etc/cks/invalid.yaml"] = "user: cks\n"
+	defer delete(credentials, "/etc/cks/invalid.yaml")
+	cfg.ContainerRuntime.Registries[0].CredentialsFile = "/etc/cks/invalid.yaml"
+	_, err = containerd.Config(cfg, newOptions(false))
+	assert.NotNil(t, err, "Unknown fields in credentials files should fail.")
+}
+
+func TestSystemdCgroup(t *testing.T) {
+	systemd, err := containerd.SystemdCgroup(fstest.MapFS{"sys/fs/cgroup/cgroup.controllers": {}})
+	assert.Nil(t, err)
+	assert.True(t, systemd, "Containers should run in systemd cgroups on cgroup v2.")
+
+	systemd, err = containerd.SystemdCgroup(fstest.MapFS{"proc/cgroups": {}})
+	assert.Nil(t, err)
+	assert.False(t, systemd)
+
+	_, err = containerd.SystemdCgroup(fstest.MapFS{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,382 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/jiuchen1986/cks/pkg/components"
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/etcd"
+	"github.com/jiuchen1986/cks/pkg/join"
+	"github.com/jiuchen1986/cks/pkg/kubeconfig"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/pki"
+	"github.com/jiuchen1986/cks/pkg/plan"
+	"github.com/jiuchen1986/cks/pkg/supervisor"
+	"github.com/jiuchen1986/cks/pkg/utils"
+)
+
+// names of the control plane components, which are also their binary names
+const (
+	EtcdName              string = etcd.Name
+	APIServerName         string = components.APIServerName
+	ControllerManagerName string = components.ControllerManagerName
+	SchedulerName         string = components.SchedulerName
+)
+
+// etcdPrepareTimeout is how long to look for a running etcd cluster to join
+const etcdPrepareTimeout time.Duration = 30 * time.Second
+
+// Controller runs the control plane on a node
+type Controller struct {
+	cfg    *conf.ClusterConfig
+	node   *conf.Node
+	pki    *pki.PKI
+	binDir string
+	sup    *supervisor.Supervisor
+
+	etcdClient    *etcd.Client
+	etcdBootstrap *etcd.Bootstrap
+	etcdLearner   *etcd.Learner
+}
+
+// New returns a controller running on the node,
+// where binaries are looked up in binDir first and then PATH
+func New(cfg *conf.ClusterConfig, nodeName, binDir string) (*Controller, error) {
+	node := cfg.Node(nodeName)
+	if node == nil {
+		return nil, errors.Errorf("node %s not found in cluster config", nodeName)
+	}
+	if !node.HasRole(conf.RoleController) {
+		return nil, errors.Errorf("node %s is not a %s", nodeName, conf.RoleController)
+	}
+
+	p, err := pki.New(cfg, nodeName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Controller{
+		cfg:    cfg,
+		node:   node,
+		pki:    p,
+		binDir: binDir,
+		sup:    supervisor.New(),
+	}, nil
+}
+
+// IsJoined tells whether the node has the cluster CA,
+// i.e. it joined or bootstrapped the cluster before
+func (c *Controller) IsJoined() bool {
+	_, err := os.Stat(c.pki.CertPath(pki.CAName))
+	return err == nil
+}
+
+// Join fetches the CAs, the service account key pair, the etcd certificates and
+// the etcd member added as a learner through the client, then writes them,
+// so that the node shares the CAs with the other controllers and
+// its etcd member starts as the learner added on Prepare
+func (c *Controller) Join(jc *join.Client) error {
+	logger := lgr.GetGlobalLogger()
+	defer logger.Sync()
+
+	logger.Infof("fetch cluster CA from %s", jc.Server)
+	ca, err := jc.FetchCA()
+	if err != nil {
+		return err
+	}
+	logger.Infof("cluster CA %s verified", pki.CAHash(ca))
+
+	logger.Infof("request controller bootstrap material for node %s", c.node.Name)
+	cb, err := jc.Controller(ca, &join.ControllerRequest{NodeName: c.node.Name})
+	if err != nil {
+		return err
+	}
+
+	// the CA is checked first, as the rest is trusted through it
+	kps := map[string]*pki.KeyPair{}
+	for _, name := range append(pki.CANames(), certNames(cb.Certs)...) {
+		encoded, ok := cb.CAs[name]
+		if !ok {
+			encoded, ok = cb.Certs[name]
+		}
+		if !ok {
+			return errors.Errorf("CA %s missing in controller bootstrap material", name)
+		}
+		kp, err := encoded.Decode()
+		if err != nil {
+			return errors.Wrapf(err, "invalid %s in controller bootstrap material", name)
+		}
+		kps[name] = kp
+	}
+	if !kps[pki.CAName].Cert.Equal(ca) {
+		return errors.New("cluster CA in controller bootstrap material mismatches the verified one")
+	}
+
+	for name, kp := range kps {
+		if err := c.pki.WriteKeyPair(name, kp); err != nil {
+			return err
+		}
+	}
+	if err := c.pki.WriteServiceAccountKeyPEM([]byte(cb.ServiceAccountKey), []byte(cb.ServiceAccountPub)); err != nil {
+		return err
+	}
+	logger.Infof("CAs and etcd certificates written to %s", c.pki.Dir)
+
+	c.etcdBootstrap = &etcd.Bootstrap{
+		InitialCluster: cb.Etcd.InitialCluster,
+		State:          etcd.StateExisting,
+		LearnerID:      cb.Etcd.ID,
+	}
+	return nil
+}
+
+// certNames returns the names of the certificates sorted
+func certNames(certs map[string]join.KeyPairPEM) []string {
+	names := []string{}
+	for name := range certs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Prepare generates PKI, kubeconfigs and configs of components
+func (c *Controller) Prepare() error {
+	logger := lgr.GetGlobalLogger()
+	defer logger.Sync()
+
+	logger.Info("prepare PKI")
+	if err := c.pki.Ensure(); err != nil {
+		return errors.Wrap(err, "failed to prepare PKI")
+	}
+
+	logger.Info("prepare kubeconfigs")
+	if err := kubeconfig.EnsureComponents(c.cfg, c.node.Name); err != nil {
+		return errors.Wrap(err, "failed to prepare kubeconfigs")
+	}
+
+	logger.Info("prepare etcd member")
+	tc, err := etcd.ClientTLSConfig(c.pki)
+	if err != nil {
+		return err
+	}
+	c.etcdClient = etcd.NewClient(etcd.PeerEndpoints(c.cfg, c.node.Name), tc)
+	// a joined member starts as the learner added by the join server
+	if c.etcdBootstrap == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), etcdPrepareTimeout)
+		defer cancel()
+		if c.etcdBootstrap, err = etcd.PrepareBootstrap(ctx, c.cfg, c.node, c.etcdClient); err != nil {
+			return errors.Wrap(err, "failed to prepare etcd member")
+		}
+	}
+	c.etcdLearner = etcd.NewLearner(c.etcdBootstrap, c.etcdClient)
+
+	logger.Info("prepare component configs")
+	if err := os.MkdirAll(etcd.DataDir(c.cfg.DataDir), 0700); err != nil {
+		return errors.Wrap(err, "failed to create etcd data directory")
+	}
+	if err := os.MkdirAll(ConfigDir(c.cfg.DataDir), 0755); err != nil {
+		return errors.Wrap(err, "failed to create config directory")
+	}
+	schedulerConfig, err := components.SchedulerConfig(c.cfg)
+	if err != nil {
+		return err
+	}
+	if err := utils.WriteFileAtomic(SchedulerConfigPath(c.cfg.DataDir), schedulerConfig, 0644); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Processes returns the control plane processes to run, which should be
+// called after Prepare decides how the etcd member starts
+func (c *Controller) Processes() ([]supervisor.Process, error) {
+	if c.etcdBootstrap == nil {
+		return nil, errors.New("controller not prepared")
+	}
+
+	procs, err := c.processes(c.etcdBootstrap, c.etcdLearner)
+	if err != nil {
+		return nil, err
+	}
+	for i := range procs {
+		path, err := supervisor.LookupBinary(c.binDir, procs[i].Name)
+		if err != nil {
+			return nil, err
+		}
+		procs[i].Path = path
+	}
+	return procs, nil
+}
+
+// Plan adds what Prepare and Start would do to the plan without changing anything,
+// where how the etcd member starts is decided by only reading from the peers
+func (c *Controller) Plan(pl *plan.Plan) error {
+	if err := c.pki.Plan(pl); err != nil {
+		return err
+	}
+	if err := kubeconfig.PlanComponents(c.cfg, c.node.Name, pl); err != nil {
+		return err
+	}
+
+	// the etcd client is unavailable before the PKI exists, when the peers
+	// are unreachable with the new CA and a new cluster would be bootstrapped
+	endpoints := []string{}
+	tc, err := etcd.ClientTLSConfig(c.pki)
+	if err == nil {
+		endpoints = etcd.PeerEndpoints(c.cfg, c.node.Name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdPrepareTimeout)
+	defer cancel()
+	b, add, err := etcd.PlanBootstrap(ctx, c.cfg, c.node, etcd.NewClient(endpoints, tc))
+	if err != nil {
+		return errors.Wrap(err, "failed to plan etcd member")
+	}
+	if add {
+		pl.Add(plan.Request, etcd.Name, fmt.Sprintf("add member %s with peer URL %s as a learner",
+			c.node.Name, etcd.PeerURL(c.node.Address)))
+	}
+
+	pl.Add(plan.WriteFile, SchedulerConfigPath(c.cfg.DataDir), "scheduler config")
+	procs, err := c.processes(b, etcd.NewLearner(b, nil))
+	if err != nil {
+		return err
+	}
+	for _, p := range procs {
+		pl.Add(plan.StartProcess, p.Name, strings.Join(p.Args, " "))
+	}
+	return nil
+}
+
+// processes returns the control plane processes with the etcd bootstrap and learner,
+// whose paths are not looked up yet
+func (c *Controller) processes(b *etcd.Bootstrap, l *etcd.Learner) ([]supervisor.Process, error) {
+	apiServerArgs, err := components.APIServer(c.cfg, c.node, c.pki)
+	if err != nil {
+		return nil, err
+	}
+	controllerManagerArgs, err := components.ControllerManager(c.cfg, c.pki)
+	if err != nil {
+		return nil, err
+	}
+	schedulerArgs, err := components.Scheduler(c.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return []supervisor.Process{
+		{
+			Name:  EtcdName,
+			Args:  etcd.Args(c.cfg, c.node, c.pki, b),
+			Ready: etcd.Ready(l),
+		},
+		{
+			Name:      APIServerName,
+			Args:      apiServerArgs,
+			DependsOn: []string{EtcdName},
+			Ready:     tcpReady(c.cfg.API.Port),
+		},
+		{
+			Name:      ControllerManagerName,
+			Args:      controllerManagerArgs,
+			DependsOn: []string{APIServerName},
+		},
+		{
+			Name:      SchedulerName,
+			Args:      schedulerArgs,
+			DependsOn: []string{APIServerName},
+		},
+	}, nil
+}
+
+// ConfigDir returns the directory of component configs in the data directory
+func ConfigDir(dataDir string) string {
+	return components.ConfigDir(dataDir)
+}
+
+// SchedulerConfigPath returns path of the scheduler config in the data directory
+func SchedulerConfigPath(dataDir string) string {
+	return components.SchedulerConfigPath(dataDir)
+}
+
+// Start starts the control plane components and waits for them ready,
+// which is given up with the components stopped once ctx is done
+func (c *Controller) Start(ctx context.Context) error {
+	procs, err := c.Processes()
+	if err != nil {
+		return err
+	}
+	for _, p := range procs {
+		if err := c.sup.Add(p); err != nil {
+			return err
+		}
+	}
+
+	// a learner is promoted in background, as it may catch up
+	// with the leader after the ready timeout of etcd
+	go func() {
+		if err := c.etcdLearner.Promote(ctx); err != nil {
+			lgr.Named(etcd.Name).Warnf("%v", err)
+		}
+	}()
+
+	// waiting for readiness takes up to the ready timeout of each component
+	started := make(chan struct{})
+	defer close(started)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.sup.Stop()
+		case <-started:
+		}
+	}()
+
+	if err := c.sup.Start(); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return errors.Wrap(ctx.Err(), "control plane stopped while starting")
+	}
+	return nil
+}
+
+// Stop stops the control plane components gracefully
+func (c *Controller) Stop() {
+	c.sup.Stop()
+}
+
+// tcpReady returns a readiness check dialing the local port
+func tcpReady(port int) func() error {
+	return func() error {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), time.Second)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
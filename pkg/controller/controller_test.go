@@ -0,0 +1,272 @@
+package controller_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/controller"
+	"github.com/jiuchen1986/cks/pkg/etcd"
+	"github.com/jiuchen1986/cks/pkg/join"
+	"github.com/jiuchen1986/cks/pkg/kubeconfig"
+	"github.com/jiuchen1986/cks/pkg/pki"
+	"github.com/jiuchen1986/cks/pkg/plan"
+)
+
+func TestPrepareAndProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	binDir := filepath.Join(dir, "bin")
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		controller.EtcdName,
+		controller.APIServerName,
+		controller.ControllerManagerName,
+		controller.SchedulerName,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(binDir, name), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &conf.ClusterConfig{
+		DataDir: dir,
+		Nodes: []conf.Node{
+			{Name: "node-a", Address: "192.168.0.10", Roles: []conf.Role{conf.RoleController}},
+			{Name: "node-b", Address: "192.168.0.11", Roles: []conf.Role{conf.RoleWorker}},
+		},
+		Components: conf.Components{
+			APIServer: conf.Component{ExtraArgs: map[string]string{
+				"authorization-mode": "RBAC",
+				"v":                  "2",
+			}},
+		},
+	}
+	conf.SetDefaults(cfg)
+
+	_, err = controller.New(cfg, "node-b", binDir)
+	assert.NotNil(t, err, "Worker node should not run the control plane.")
+
+	c, err := controller.New(cfg, "node-a", binDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{
+		kubeconfig.Path(dir, kubeconfig.ControllerManagerName),
+		kubeconfig.Path(dir, kubeconfig.SchedulerName),
+		controller.SchedulerConfigPath(dir),
+	} {
+		_, err := os.Stat(p)
+		assert.Nil(t, err, "%s should be prepared.", p)
+	}
+
+	procs, err := c.Processes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, controller.APIServerName, procs[1].Name)
+	assert.Equal(t, filepath.Join(binDir, controller.APIServerName), procs[1].Path)
+	assert.Contains(t, procs[1].Args, "--authorization-mode=RBAC", "Extra args should override defaults.")
+	assert.Contains(t, procs[1].Args, "--v=2", "Extra args should be appended.")
+	assert.Contains(t, procs[0].Args, "--initial-cluster=node-a=https://192.168.0.10:2380",
+		"Only controllers should be in the etcd cluster.")
+
+	// etcd is never ready, starting should be given up once cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	done := make(chan error)
+	go func() { done <- c.Start(ctx) }()
+	select {
+	case err := <-done:
+		assert.NotNil(t, err, "Starting should fail once cancelled.")
+	case <-time.After(30 * time.Second):
+		t.Fatal("Starting should be given up once cancelled.")
+	}
+	c.Stop()
+}
+
+func TestPlan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &conf.ClusterConfig{
+		DataDir: dir,
+		Nodes: []conf.Node{
+			{Name: "node-a", Address: "192.168.0.10", Roles: []conf.Role{conf.RoleController}},
+		},
+	}
+	conf.SetDefaults(cfg)
+
+	c, err := controller.New(cfg, "node-a", filepath.Join(dir, "bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := plan.New("controller", "node-a")
+	if err := c.Plan(pl); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, pl.Targets(plan.IssueCert), pki.CAName)
+	assert.Contains(t, pl.Targets(plan.WriteFile), kubeconfig.Path(dir, kubeconfig.AdminName))
+	assert.Equal(t, []string{
+		controller.EtcdName,
+		controller.APIServerName,
+		controller.ControllerManagerName,
+		controller.SchedulerName,
+	}, pl.Targets(plan.StartProcess), "Processes should be planned in order.")
+	assert.Contains(t, pl.Actions[len(pl.Actions)-4].Detail, "--initial-cluster-state=new")
+	_, err = os.Stat(pki.Dir(dir))
+	assert.True(t, os.IsNotExist(err), "Plan should not write anything.")
+
+	if err := c.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	pl = plan.New("controller", "node-a")
+	if err := c.Plan(pl); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, pl.Targets(plan.IssueCert), "Valid certificates should not be issued again.")
+	assert.Equal(t, []string{controller.SchedulerConfigPath(dir)}, pl.Targets(plan.WriteFile))
+}
+
+// fakeMembers keeps etcd members in memory
+type fakeMembers struct {
+	members []etcd.Member
+}
+
+func (f *fakeMembers) MemberList(ctx context.Context) ([]etcd.Member, error) {
+	return append([]etcd.Member{}, f.members...), nil
+}
+
+func (f *fakeMembers) MemberAdd(ctx context.Context, peerURLs []string, learner bool) (*etcd.Member,
+	[]etcd.Member, error) {
+	m := etcd.Member{ID: etcd.ID(len(f.members) + 1), PeerURLs: peerURLs, IsLearner: learner}
+	f.members = append(f.members, m)
+	all, err := f.MemberList(ctx)
+	return &m, all, err
+}
+
+func TestJoin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	binDir := filepath.Join(dir, "bin")
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		controller.EtcdName,
+		controller.APIServerName,
+		controller.ControllerManagerName,
+		controller.SchedulerName,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(binDir, name), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// node-a runs the cluster and serves the join request of node-b
+	newConfig := func(dataDir string) *conf.ClusterConfig {
+		cfg := &conf.ClusterConfig{
+			DataDir: dataDir,
+			Nodes: []conf.Node{
+				{Name: "node-a", Address: "192.168.0.10", Roles: []conf.Role{conf.RoleController}},
+				{Name: "node-b", Address: "192.168.0.11", Roles: []conf.Role{conf.RoleController}},
+			},
+		}
+		conf.SetDefaults(cfg)
+		return cfg
+	}
+	cfgA := newConfig(filepath.Join(dir, "node-a"))
+	pkiA, err := pki.New(cfgA, "node-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pkiA.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	ca, err := pkiA.LoadKeyPair(pki.CAName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serving, err := ca.Issue(&pki.CertConfig{
+		CommonName: "join",
+		IPs:        []net.IP{net.ParseIP("127.0.0.1")},
+		Usages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := join.NewServer(cfgA, ca, join.StaticToken("secret"), join.NewRegistry(join.RegistryPath(cfgA.DataDir)))
+	srv.EnableControllers(pkiA, &fakeMembers{members: []etcd.Member{{
+		ID:       1,
+		Name:     "node-a",
+		PeerURLs: []string{etcd.PeerURL("192.168.0.10")},
+	}}})
+	ts := httptest.NewUnstartedServer(srv)
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{serving.TLSCertificate()}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	cfgB := newConfig(filepath.Join(dir, "node-b"))
+	c, err := controller.New(cfgB, "node-b", binDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, c.IsJoined())
+	if err := c.Join(&join.Client{Server: ts.URL, Token: "secret", CAHash: pki.CAHash(ca.Cert)}); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, c.IsJoined())
+
+	if err := c.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	pkiB, err := pki.New(cfgB, "node-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range pki.CANames() {
+		a, err := pkiA.LoadKeyPair(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := pkiB.LoadKeyPair(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, a.Cert.Equal(b.Cert), "CA %s should be shared by the controllers.", name)
+	}
+
+	procs, err := c.Processes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, procs[0].Args, "--initial-cluster=node-a=https://192.168.0.10:2380,"+
+		"node-b=https://192.168.0.11:2380", "Etcd member should join the running cluster.")
+	assert.Contains(t, procs[0].Args, "--initial-cluster-state=existing")
+}
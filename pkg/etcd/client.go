@@ -0,0 +1,305 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/jiuchen1986/cks/pkg/pki"
+)
+
+// ID is the ID of an etcd member, which is a string in the JSON gateway
+type ID uint64
+
+// String returns the ID in hex as etcdctl does
+func (id ID) String() string {
+	return strconv.FormatUint(uint64(id), 16)
+}
+
+// MarshalJSON encodes the ID as a decimal string
+func (id ID) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatUint(uint64(id), 10))
+}
+
+// UnmarshalJSON decodes the ID from a decimal string or number
+func (id *ID) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	v, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return errors.Wrapf(err, "invalid member ID %s", s)
+	}
+	*id = ID(v)
+	return nil
+}
+
+// ParseID parses the ID in hex as printed by String
+func ParseID(s string) (ID, error) {
+	v, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid member ID %s", s)
+	}
+	return ID(v), nil
+}
+
+// Member is a member of the etcd cluster
+type Member struct {
+	ID ID `json:"ID"`
+	// Name is empty until the member is started
+	Name       string   `json:"name,omitempty"`
+	PeerURLs   []string `json:"peerURLs,omitempty"`
+	ClientURLs []string `json:"clientURLs,omitempty"`
+	IsLearner  bool     `json:"isLearner,omitempty"`
+}
+
+// IsStarted tells whether the member has started and published its name
+func (m *Member) IsStarted() bool {
+	return m.Name != ""
+}
+
+// HasPeerURL tells whether the member advertises the peer URL
+func (m *Member) HasPeerURL(url string) bool {
+	for _, u := range m.PeerURLs {
+		if u == url {
+			return true
+		}
+	}
+	return false
+}
+
+// paths of the etcd v3 JSON gateway
+const (
+	memberListPath    string = "/v3/cluster/member/list"
+	memberAddPath     string = "/v3/cluster/member/add"
+	memberRemovePath  string = "/v3/cluster/member/remove"
+	memberPromotePath string = "/v3/cluster/member/promote"
+	snapshotPath      string = "/v3/maintenance/snapshot"
+)
+
+// Client talks to etcd through its v3 JSON gateway, which is served
+// on the client port, so no gRPC client is needed
+type Client struct {
+	// Endpoints are tried in order until one responds
+	Endpoints []string
+	// Timeout limits each call except snapshots, which are limited by the context only
+	Timeout time.Duration
+	hc      *http.Client
+}
+
+// NewClient returns a client of the endpoints with the TLS config
+func NewClient(endpoints []string, tc *tls.Config) *Client {
+	return &Client{
+		Endpoints: endpoints,
+		Timeout:   10 * time.Second,
+		hc:        &http.Client{Transport: &http.Transport{TLSClientConfig: tc}},
+	}
+}
+
+// ClientTLSConfig returns the TLS config authenticating with the etcd
+// healthcheck client certificate and trusting the etcd CA
+func ClientTLSConfig(p *pki.PKI) (*tls.Config, error) {
+	ca, err := pki.LoadCert(p.CertPath(pki.EtcdCAName))
+	if err != nil {
+		return nil, err
+	}
+	kp, err := p.LoadKeyPair(pki.EtcdHealthcheckClientName)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{kp.TLSCertificate()},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// MemberList lists all the members of the cluster
+func (c *Client) MemberList(ctx context.Context) ([]Member, error) {
+	resp := &struct {
+		Members []Member `json:"members"`
+	}{}
+	if err := c.call(ctx, memberListPath, struct{}{}, resp); err != nil {
+		return nil, errors.Wrap(err, "failed to list etcd members")
+	}
+	return resp.Members, nil
+}
+
+// MemberAdd adds a member with the peer URLs,
+// and returns the added member together with all the members
+func (c *Client) MemberAdd(ctx context.Context, peerURLs []string, learner bool) (*Member, []Member, error) {
+	req := &struct {
+		PeerURLs  []string `json:"peerURLs"`
+		IsLearner bool     `json:"isLearner,omitempty"`
+	}{PeerURLs: peerURLs, IsLearner: learner}
+	resp := &struct {
+		Member  *Member  `json:"member"`
+		Members []Member `json:"members"`
+	}{}
+	if err := c.call(ctx, memberAddPath, req, resp); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to add etcd member")
+	}
+	if resp.Member == nil {
+		return nil, nil, errors.New("failed to add etcd member: no member returned")
+	}
+	return resp.Member, resp.Members, nil
+}
+
+// MemberRemove removes the member from the cluster
+func (c *Client) MemberRemove(ctx context.Context, id ID) error {
+	req := &struct {
+		ID ID `json:"ID"`
+	}{ID: id}
+	return errors.Wrapf(c.call(ctx, memberRemovePath, req, &struct{}{}), "failed to remove etcd member %s", id)
+}
+
+// MemberPromote promotes the learner to a voting member,
+// which fails until the learner catches up with the leader
+func (c *Client) MemberPromote(ctx context.Context, id ID) error {
+	req := &struct {
+		ID ID `json:"ID"`
+	}{ID: id}
+	return errors.Wrapf(c.call(ctx, memberPromotePath, req, &struct{}{}), "failed to promote etcd member %s", id)
+}
+
+// Snapshot streams a snapshot of the etcd backend to w,
+// and returns the number of bytes written
+func (c *Client) Snapshot(ctx context.Context, w io.Writer) (int64, error) {
+	hresp, ep, err := c.post(ctx, snapshotPath, struct{}{})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to take etcd snapshot")
+	}
+	defer hresp.Body.Close()
+
+	// the gateway streams the snapshot as a JSON object per chunk
+	dec := json.NewDecoder(hresp.Body)
+	written := int64(0)
+	for {
+		chunk := &struct {
+			Result *struct {
+				RemainingBytes json.Number `json:"remaining_bytes"`
+				Blob           []byte      `json:"blob"`
+			} `json:"result"`
+			Error json.RawMessage `json:"error"`
+		}{}
+		if err := dec.Decode(chunk); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return written, errors.Wrapf(err, "%s: failed to read etcd snapshot", ep)
+		}
+		if len(chunk.Error) > 0 {
+			return written, errors.Errorf("%s: failed to take etcd snapshot: %s", ep, gatewayError(chunk.Error))
+		}
+		if chunk.Result == nil {
+			continue
+		}
+		n, err := w.Write(chunk.Result.Blob)
+		written += int64(n)
+		if err != nil {
+			return written, errors.Wrap(err, "failed to write etcd snapshot")
+		}
+		if remaining, err := chunk.Result.RemainingBytes.Int64(); err == nil && remaining == 0 {
+			return written, nil
+		}
+	}
+	return written, errors.Errorf("%s: etcd snapshot is truncated", ep)
+}
+
+// call posts the request to the endpoints and decodes the response
+func (c *Client) call(ctx context.Context, path string, req, resp interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	hresp, ep, err := c.post(ctx, path, req)
+	if err != nil {
+		return err
+	}
+	defer hresp.Body.Close()
+
+	body, err := ioutil.ReadAll(hresp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "%s: failed to read response", ep)
+	}
+	return errors.Wrapf(json.Unmarshal(body, resp), "%s: failed to parse response", ep)
+}
+
+// post posts the request to the endpoints in order until one responds,
+// errors returned by etcd are not retried on other endpoints
+func (c *Client) post(ctx context.Context, path string, req interface{}) (*http.Response, string, error) {
+	if len(c.Endpoints) == 0 {
+		return nil, "", errors.New("no etcd endpoint")
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to marshal request")
+	}
+
+	var lastErr error
+	for _, ep := range c.Endpoints {
+		hreq, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(ep, "/")+path, bytes.NewReader(data))
+		if err != nil {
+			return nil, "", errors.Wrap(err, "failed to create request")
+		}
+		hreq = hreq.WithContext(ctx)
+		hreq.Header.Set("Content-Type", "application/json")
+
+		hresp, err := c.hc.Do(hreq)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if hresp.StatusCode == http.StatusOK {
+			return hresp, ep, nil
+		}
+
+		body, _ := ioutil.ReadAll(hresp.Body)
+		hresp.Body.Close()
+		if msg := gatewayError(body); msg != "" {
+			return nil, ep, errors.Errorf("%s: %s", ep, msg)
+		}
+		return nil, ep, errors.Errorf("%s: unexpected status %s", ep, hresp.Status)
+	}
+	return nil, "", errors.Wrap(lastErr, "no etcd endpoint available")
+}
+
+// gatewayError returns the message of the error returned by the gateway if any
+func gatewayError(body []byte) string {
+	gwErr := &struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}{}
+	if err := json.Unmarshal(body, gwErr); err != nil {
+		return ""
+	}
+	if gwErr.Message != "" {
+		return gwErr.Message
+	}
+	return gwErr.Error
+}
@@ -0,0 +1,359 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package etcd
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/pki"
+	"github.com/jiuchen1986/cks/pkg/supervisor"
+)
+
+const (
+	// Name is the name of the etcd component, which is also its binary name
+	Name string = "etcd"
+	// ClientPort is the port etcd serves clients on
+	ClientPort int = 2379
+	// PeerPort is the port etcd serves peers on
+	PeerPort int = 2380
+
+	// StateNew bootstraps a new cluster with the initial members
+	StateNew string = "new"
+	// StateExisting joins an existing cluster
+	StateExisting string = "existing"
+
+	// promoteInterval is the interval retrying promotion of a learner
+	promoteInterval time.Duration = 5 * time.Second
+)
+
+// DataDir returns the etcd data directory in the data directory
+func DataDir(dataDir string) string {
+	return filepath.Join(dataDir, "etcd")
+}
+
+// ClientURL returns the client URL of etcd on the host
+func ClientURL(host string) string {
+	return "https://" + net.JoinHostPort(host, strconv.Itoa(ClientPort))
+}
+
+// PeerURL returns the peer URL of etcd on the host
+func PeerURL(host string) string {
+	return "https://" + net.JoinHostPort(host, strconv.Itoa(PeerPort))
+}
+
+// Bootstrap is how the local member starts
+type Bootstrap struct {
+	// InitialCluster is the initial members in form of name=peerURL,...
+	InitialCluster string
+	State          string
+	// LearnerID is set if the member joins as a learner to be promoted once ready
+	LearnerID ID
+}
+
+// IsMember tells whether the local member has data, i.e. joined before
+func IsMember(dataDir string) bool {
+	_, err := os.Stat(filepath.Join(DataDir(dataDir), "member"))
+	return err == nil
+}
+
+// PeerEndpoints returns client URLs of the controllers other than the node
+func PeerEndpoints(cfg *conf.ClusterConfig, nodeName string) []string {
+	endpoints := []string{}
+	for _, n := range cfg.Controllers() {
+		if n.Name != nodeName {
+			endpoints = append(endpoints, ClientURL(n.Address))
+		}
+	}
+	return endpoints
+}
+
+// PrepareBootstrap decides how the local member starts. A member with data
+// restarts as is, a member finding a running cluster on other controllers
+// is added as a learner, otherwise all the controllers bootstrap a new cluster
+func PrepareBootstrap(ctx context.Context, cfg *conf.ClusterConfig, node *conf.Node, c *Client) (*Bootstrap, error) {
+	b, _, err := decideBootstrap(ctx, cfg, node, c, false)
+	return b, err
+}
+
+// PlanBootstrap decides how the local member would start like PrepareBootstrap,
+// but never adds the member to a running cluster. It tells whether the member
+// would be added as a learner, whose ID is unknown in the returned bootstrap then
+func PlanBootstrap(ctx context.Context, cfg *conf.ClusterConfig, node *conf.Node, c *Client) (*Bootstrap, bool, error) {
+	return decideBootstrap(ctx, cfg, node, c, true)
+}
+
+func decideBootstrap(ctx context.Context, cfg *conf.ClusterConfig, node *conf.Node, c *Client,
+	dryRun bool) (*Bootstrap, bool, error) {
+	logger := lgr.Named(Name)
+	defer logger.Sync()
+
+	static := &Bootstrap{InitialCluster: staticInitialCluster(cfg), State: StateNew}
+	if IsMember(cfg.DataDir) {
+		logger.Infof("etcd member %s has data, restart as is", node.Name)
+		static.State = StateExisting
+		static.LearnerID = restartedLearner(ctx, c, PeerURL(node.Address))
+		return static, false, nil
+	}
+	if len(c.Endpoints) == 0 {
+		logger.Infof("etcd member %s bootstraps a new cluster", node.Name)
+		return static, false, nil
+	}
+
+	members, err := c.MemberList(ctx)
+	if err != nil {
+		logger.Infof("no running etcd cluster found (%v), bootstrap a new cluster with all the controllers", err)
+		return static, false, nil
+	}
+
+	if dryRun {
+		self := findMember(members, PeerURL(node.Address))
+		if self != nil {
+			return existingBootstrap(node, self, members), false, nil
+		}
+		self = &Member{PeerURLs: []string{PeerURL(node.Address)}, IsLearner: true}
+		return existingBootstrap(node, self, append(members, *self)), true, nil
+	}
+	// whether it's added only matters to planning
+	b, err := addLearner(ctx, c, node, members)
+	return b, false, err
+}
+
+// MemberAdder lists and adds members of a running cluster, which is satisfied by Client
+type MemberAdder interface {
+	MemberList(ctx context.Context) ([]Member, error)
+	MemberAdd(ctx context.Context, peerURLs []string, learner bool) (*Member, []Member, error)
+}
+
+// AddLearner adds the member of the node to the running cluster as a learner,
+// or reuses the one added before, and returns how the member of the node starts
+func AddLearner(ctx context.Context, c MemberAdder, node *conf.Node) (*Bootstrap, error) {
+	members, err := c.MemberList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return addLearner(ctx, c, node, members)
+}
+
+func addLearner(ctx context.Context, c MemberAdder, node *conf.Node, members []Member) (*Bootstrap, error) {
+	logger := lgr.Named(Name)
+
+	peerURL := PeerURL(node.Address)
+	self := findMember(members, peerURL)
+	if self != nil {
+		logger.Infof("etcd member %s with peer URL %s was added before, reuse it", self.ID, peerURL)
+		return existingBootstrap(node, self, members), nil
+	}
+
+	logger.Infof("add etcd member %s with peer URL %s as a learner", node.Name, peerURL)
+	added, all, err := c.MemberAdd(ctx, []string{peerURL}, true)
+	if err != nil {
+		return nil, err
+	}
+	return existingBootstrap(node, added, all), nil
+}
+
+func findMember(members []Member, peerURL string) *Member {
+	for i := range members {
+		if members[i].HasPeerURL(peerURL) {
+			return &members[i]
+		}
+	}
+	return nil
+}
+
+// existingBootstrap returns how the member self of the node joins the members
+func existingBootstrap(node *conf.Node, self *Member, members []Member) *Bootstrap {
+	// only started members have names, unstarted ones other than the local are left out
+	initial := []string{}
+	for _, m := range members {
+		switch {
+		case m.ID == self.ID:
+			initial = append(initial, node.Name+"="+PeerURL(node.Address))
+		case m.IsStarted():
+			for _, u := range m.PeerURLs {
+				initial = append(initial, m.Name+"="+u)
+			}
+		}
+	}
+
+	b := &Bootstrap{InitialCluster: strings.Join(initial, ","), State: StateExisting}
+	if self.IsLearner {
+		b.LearnerID = self.ID
+	}
+	return b
+}
+
+// Args returns the command line arguments of etcd on the node
+func Args(cfg *conf.ClusterConfig, node *conf.Node, p *pki.PKI, b *Bootstrap) []string {
+	return supervisor.Args{
+		"name":                        node.Name,
+		"data-dir":                    DataDir(cfg.DataDir),
+		"listen-client-urls":          ClientURL("127.0.0.1") + "," + ClientURL(node.Address),
+		"advertise-client-urls":       ClientURL(node.Address),
+		"listen-peer-urls":            PeerURL(node.Address),
+		"initial-advertise-peer-urls": PeerURL(node.Address),
+		"initial-cluster":             b.InitialCluster,
+		"initial-cluster-state":       b.State,
+		"initial-cluster-token":       cfg.ClusterName,
+		"client-cert-auth":            "true",
+		"trusted-ca-file":             p.CertPath(pki.EtcdCAName),
+		"cert-file":                   p.CertPath(pki.EtcdServerName),
+		"key-file":                    p.KeyPath(pki.EtcdServerName),
+		"peer-client-cert-auth":       "true",
+		"peer-trusted-ca-file":        p.CertPath(pki.EtcdCAName),
+		"peer-cert-file":              p.CertPath(pki.EtcdPeerName),
+		"peer-key-file":               p.KeyPath(pki.EtcdPeerName),
+	}.Merge(cfg.Components.Etcd.ExtraArgs).Render()
+}
+
+// restartedLearner returns ID of the local member if it's still a learner,
+// i.e. it was restarted before promoted, or 0 if it's unknown
+func restartedLearner(ctx context.Context, c *Client, peerURL string) ID {
+	if len(c.Endpoints) == 0 {
+		return 0
+	}
+	members, err := c.MemberList(ctx)
+	if err != nil {
+		return 0
+	}
+	for _, m := range members {
+		if m.HasPeerURL(peerURL) && m.IsLearner {
+			lgr.Named(Name).Infof("etcd member %s is still a learner, promote it once ready", m.ID)
+			return m.ID
+		}
+	}
+	return 0
+}
+
+// Learner promotes the local member once it catches up with the leader
+// if it joined as a learner
+type Learner struct {
+	ID ID
+	// Interval is the interval retrying promotion
+	Interval time.Duration
+
+	c        *Client
+	promoted chan struct{}
+}
+
+// NewLearner returns the learner of the bootstrap,
+// which is promoted already if the member didn't join as a learner
+func NewLearner(b *Bootstrap, c *Client) *Learner {
+	l := &Learner{ID: b.LearnerID, Interval: promoteInterval, c: c, promoted: make(chan struct{})}
+	if l.ID == 0 {
+		close(l.promoted)
+	}
+	return l
+}
+
+// Promote retries promoting the member until it's promoted or ctx is done,
+// which should be called only once in background as catching up takes a while
+func (l *Learner) Promote(ctx context.Context) error {
+	logger := lgr.Named(Name)
+
+	for !l.Promoted() {
+		promoteCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		err := l.c.MemberPromote(promoteCtx, l.ID)
+		cancel()
+		if err == nil {
+			logger.Infof("etcd learner %s promoted", l.ID)
+			close(l.promoted)
+			return nil
+		}
+		logger.Debugf("etcd learner %s not promoted yet: %v", l.ID, err)
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "etcd learner %s not promoted", l.ID)
+		case <-time.After(l.Interval):
+		}
+	}
+	return nil
+}
+
+// Promoted tells whether the member is promoted
+func (l *Learner) Promoted() bool {
+	select {
+	case <-l.promoted:
+		return true
+	default:
+		return false
+	}
+}
+
+// Ready returns a readiness check of the local member,
+// which is ready once it serves clients and is promoted if it's a learner
+func Ready(l *Learner) func() error {
+	return func() error {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(ClientPort)), time.Second)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+
+		if !l.Promoted() {
+			return errors.Errorf("etcd learner %s not promoted yet", l.ID)
+		}
+		return nil
+	}
+}
+
+// Leave removes the member with the name from the cluster,
+// the last member is refused to leave as the cluster would be lost
+func Leave(ctx context.Context, c *Client, name string) (*Member, error) {
+	m, err := PlanLeave(ctx, c, name)
+	if err != nil {
+		return nil, err
+	}
+	return m, c.MemberRemove(ctx, m.ID)
+}
+
+// PlanLeave returns the member with the name Leave would remove without removing it
+func PlanLeave(ctx context.Context, c *Client, name string) (*Member, error) {
+	members, err := c.MemberList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range members {
+		m := members[i]
+		if m.Name != name {
+			continue
+		}
+		if len(members) == 1 {
+			return nil, errors.Errorf("etcd member %s is the last member, which is unable to leave", name)
+		}
+		return &m, nil
+	}
+	return nil, errors.Errorf("etcd member %s not found", name)
+}
+
+func staticInitialCluster(cfg *conf.ClusterConfig) string {
+	peers := []string{}
+	for _, n := range cfg.Controllers() {
+		peers = append(peers, n.Name+"="+PeerURL(n.Address))
+	}
+	return strings.Join(peers, ",")
+}
@@ -0,0 +1,305 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package etcd_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/etcd"
+)
+
+// fakeGateway serves the member API of the etcd v3 JSON gateway in memory
+type fakeGateway struct {
+	mu      sync.Mutex
+	members []etcd.Member
+	nextID  etcd.ID
+	// promoteFailures is how many times promotion fails before the learner is in sync
+	promoteFailures int
+}
+
+func (g *fakeGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	req := &struct {
+		ID        etcd.ID  `json:"ID"`
+		PeerURLs  []string `json:"peerURLs"`
+		IsLearner bool     `json:"isLearner"`
+	}{}
+	json.NewDecoder(r.Body).Decode(req)
+
+	fail := func(msg string) {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": msg, "message": msg, "code": 2})
+	}
+
+	switch r.URL.Path {
+	case "/v3/cluster/member/list":
+		json.NewEncoder(w).Encode(map[string]interface{}{"members": g.members})
+	case "/v3/cluster/member/add":
+		g.nextID++
+		m := etcd.Member{ID: g.nextID, PeerURLs: req.PeerURLs, IsLearner: req.IsLearner}
+		g.members = append(g.members, m)
+		json.NewEncoder(w).Encode(map[string]interface{}{"member": m, "members": g.members})
+	case "/v3/cluster/member/remove":
+		for i, m := range g.members {
+			if m.ID == req.ID {
+				g.members = append(g.members[:i], g.members[i+1:]...)
+				json.NewEncoder(w).Encode(map[string]interface{}{})
+				return
+			}
+		}
+		fail("etcdserver: member not found")
+	case "/v3/cluster/member/promote":
+		if g.promoteFailures > 0 {
+			g.promoteFailures--
+			fail("etcdserver: can only promote a learner member which is in sync with leader")
+			return
+		}
+		for i := range g.members {
+			if g.members[i].ID == req.ID {
+				g.members[i].IsLearner = false
+				json.NewEncoder(w).Encode(map[string]interface{}{})
+				return
+			}
+		}
+		fail("etcdserver: member not found")
+	case "/v3/maintenance/snapshot":
+		enc := json.NewEncoder(w)
+		enc.Encode(map[string]interface{}{"result": map[string]interface{}{"remaining_bytes": "4", "blob": []byte("snap")}})
+		enc.Encode(map[string]interface{}{"result": map[string]interface{}{"remaining_bytes": "0", "blob": []byte("shot")}})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newFakeCluster(t *testing.T, g *fakeGateway) (*httptest.Server, *tls.Config) {
+	ts := httptest.NewTLSServer(g)
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	return ts, &tls.Config{RootCAs: pool}
+}
+
+func TestClient(t *testing.T) {
+	g := &fakeGateway{
+		members: []etcd.Member{{ID: 0xabc, Name: "node-a", PeerURLs: []string{"https://192.168.0.10:2380"}}},
+		nextID:  0xabc,
+
+		promoteFailures: 1,
+	}
+	ts, tc := newFakeCluster(t, g)
+	defer ts.Close()
+
+	// the unreachable endpoint is skipped
+	c := etcd.NewClient([]string{"https://127.0.0.1:1", ts.URL}, tc)
+	ctx := context.Background()
+
+	members, err := c.MemberList(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(members))
+	assert.Equal(t, "abc", members[0].ID.String())
+
+	added, all, err := c.MemberAdd(ctx, []string{"https://192.168.0.11:2380"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, added.IsLearner)
+	assert.False(t, added.IsStarted())
+	assert.Equal(t, 2, len(all))
+
+	assert.NotNil(t, c.MemberPromote(ctx, added.ID), "Learner out of sync should not be promoted.")
+	assert.Nil(t, c.MemberPromote(ctx, added.ID))
+	assert.Nil(t, c.MemberRemove(ctx, added.ID))
+
+	err = c.MemberRemove(ctx, added.ID)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "member not found", "Error of etcd should be reported.")
+	}
+
+	buf := &bytes.Buffer{}
+	n, err := c.Snapshot(ctx, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(8), n)
+	assert.Equal(t, "snapshot", buf.String())
+
+	id, err := etcd.ParseID("abc")
+	assert.Nil(t, err)
+	assert.Equal(t, etcd.ID(0xabc), id)
+}
+
+func TestPrepareBootstrap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &conf.ClusterConfig{
+		DataDir: dir,
+		Nodes: []conf.Node{
+			{Name: "node-a", Address: "192.168.0.10", Roles: []conf.Role{conf.RoleController}},
+			{Name: "node-b", Address: "192.168.0.11", Roles: []conf.Role{conf.RoleController}},
+			{Name: "node-c", Address: "192.168.0.12", Roles: []conf.Role{conf.RoleWorker}},
+		},
+	}
+	conf.SetDefaults(cfg)
+	node := cfg.Node("node-b")
+	assert.Equal(t, []string{"https://192.168.0.10:2379"}, etcd.PeerEndpoints(cfg, "node-b"))
+	ctx := context.Background()
+
+	// nobody answers, so all the controllers bootstrap a new cluster
+	b, err := etcd.PrepareBootstrap(ctx, cfg, node, etcd.NewClient([]string{"https://127.0.0.1:1"}, &tls.Config{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, &etcd.Bootstrap{
+		InitialCluster: "node-a=https://192.168.0.10:2380,node-b=https://192.168.0.11:2380",
+		State:          etcd.StateNew,
+	}, b)
+
+	// a running cluster is joined as a learner
+	g := &fakeGateway{
+		members: []etcd.Member{{ID: 1, Name: "node-a", PeerURLs: []string{"https://192.168.0.10:2380"}}},
+		nextID:  1,
+	}
+	ts, tc := newFakeCluster(t, g)
+	defer ts.Close()
+	c := etcd.NewClient([]string{ts.URL}, tc)
+
+	b, err = etcd.PrepareBootstrap(ctx, cfg, node, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, &etcd.Bootstrap{
+		InitialCluster: "node-a=https://192.168.0.10:2380,node-b=https://192.168.0.11:2380",
+		State:          etcd.StateExisting,
+		LearnerID:      2,
+	}, b)
+
+	// preparing again reuses the member added before
+	b, err = etcd.PrepareBootstrap(ctx, cfg, node, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, etcd.ID(2), b.LearnerID)
+	assert.Equal(t, 2, len(g.members))
+
+	// a member with data restarts as is, and is still promoted if restarted as a learner
+	if err := os.MkdirAll(filepath.Join(etcd.DataDir(dir), "member"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	b, err = etcd.PrepareBootstrap(ctx, cfg, node, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, etcd.StateExisting, b.State)
+	assert.Equal(t, etcd.ID(2), b.LearnerID)
+
+	g.members[1].IsLearner = false
+	b, err = etcd.PrepareBootstrap(ctx, cfg, node, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, etcd.StateExisting, b.State)
+	assert.Equal(t, etcd.ID(0), b.LearnerID)
+}
+
+func TestLearnerPromote(t *testing.T) {
+	g := &fakeGateway{
+		members: []etcd.Member{
+			{ID: 1, Name: "node-a", PeerURLs: []string{"https://192.168.0.10:2380"}},
+			{ID: 2, PeerURLs: []string{"https://192.168.0.11:2380"}, IsLearner: true},
+		},
+		nextID: 2,
+
+		promoteFailures: 3,
+	}
+	ts, tc := newFakeCluster(t, g)
+	defer ts.Close()
+	c := etcd.NewClient([]string{ts.URL}, tc)
+
+	assert.True(t, etcd.NewLearner(&etcd.Bootstrap{}, c).Promoted(), "Member not joined as "+
+		"a learner should be promoted already.")
+
+	// promotion is retried until the learner is in sync
+	l := etcd.NewLearner(&etcd.Bootstrap{LearnerID: 2}, c)
+	l.Interval = 10 * time.Millisecond
+	assert.False(t, l.Promoted())
+	assert.Nil(t, l.Promote(context.Background()))
+	assert.True(t, l.Promoted())
+	assert.False(t, g.members[1].IsLearner)
+	assert.Equal(t, 0, g.promoteFailures)
+
+	// promotion is given up once cancelled
+	g.members[1].IsLearner = true
+	g.promoteFailures = 1000
+	l = etcd.NewLearner(&etcd.Bootstrap{LearnerID: 2}, c)
+	l.Interval = 10 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.NotNil(t, l.Promote(ctx))
+	assert.False(t, l.Promoted())
+	assert.True(t, g.members[1].IsLearner)
+}
+
+func TestLeave(t *testing.T) {
+	g := &fakeGateway{
+		members: []etcd.Member{
+			{ID: 1, Name: "node-a", PeerURLs: []string{"https://192.168.0.10:2380"}},
+			{ID: 2, Name: "node-b", PeerURLs: []string{"https://192.168.0.11:2380"}},
+		},
+	}
+	ts, tc := newFakeCluster(t, g)
+	defer ts.Close()
+	c := etcd.NewClient([]string{ts.URL}, tc)
+	ctx := context.Background()
+
+	_, err := etcd.Leave(ctx, c, "node-c")
+	assert.NotNil(t, err, "Unknown member should not leave.")
+
+	planned, err := etcd.PlanLeave(ctx, c, "node-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, etcd.ID(2), planned.ID)
+	assert.Equal(t, 2, len(g.members), "Planned member should not be removed.")
+
+	m, err := etcd.Leave(ctx, c, "node-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, etcd.ID(2), m.ID)
+
+	_, err = etcd.Leave(ctx, c, "node-a")
+	assert.NotNil(t, err, "The last member should not leave.")
+}
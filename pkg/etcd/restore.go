@@ -0,0 +1,60 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package etcd
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/supervisor"
+)
+
+// restoreTools are the binaries able to restore a snapshot in order of preference,
+// etcdutl since etcd v3.5 and etcdctl before
+var restoreTools = []string{"etcdutl", "etcdctl"}
+
+// RestoreSnapshot restores the snapshot into the etcd data directory
+// as a new single member cluster of the node
+func RestoreSnapshot(binDir, snapshot string, cfg *conf.ClusterConfig, node *conf.Node) error {
+	var tool string
+	for _, name := range restoreTools {
+		if path, err := supervisor.LookupBinary(binDir, name); err == nil {
+			tool = path
+			break
+		}
+	}
+	if tool == "" {
+		return errors.Errorf("none of %s found to restore etcd snapshot", strings.Join(restoreTools, ", "))
+	}
+
+	cmd := exec.Command(tool, "snapshot", "restore", snapshot,
+		"--name", node.Name,
+		"--data-dir", DataDir(cfg.DataDir),
+		"--initial-cluster", node.Name+"="+PeerURL(node.Address),
+		"--initial-cluster-token", cfg.ClusterName,
+		"--initial-advertise-peer-urls", PeerURL(node.Address),
+	)
+	// etcdctl of v3.4 needs the v3 API explicitly
+	cmd.Env = append(os.Environ(), "ETCDCTL_API=3")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "failed to restore etcd snapshot: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
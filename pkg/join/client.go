@@ -0,0 +1,141 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package join
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/jiuchen1986/cks/pkg/pki"
+)
+
+// Client joins a node to the cluster through a controller
+type Client struct {
+	// Server is the URL of the join server, e.g. https://192.168.0.10:9443
+	Server string
+	Token  string
+	// CAHash pins the cluster CA in form of sha256:<hex>
+	CAHash  string
+	Timeout time.Duration
+}
+
+// FetchCA fetches the cluster CA from the join server
+// and verifies it against the CA hash
+func (c *Client) FetchCA() (*x509.Certificate, error) {
+	// the server certificate is unable to be verified before the CA is known,
+	// the CA hash is what makes this trustworthy
+	hc := c.httpClient(&tls.Config{InsecureSkipVerify: true})
+	resp, err := hc.Get(strings.TrimSuffix(c.Server, "/") + caPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch cluster CA")
+	}
+	defer resp.Body.Close()
+
+	body, err := readBody(resp)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch cluster CA")
+	}
+	ca, err := pki.ParseCertPEM(body)
+	if err != nil {
+		return nil, err
+	}
+
+	if hash := pki.CAHash(ca); !strings.EqualFold(hash, c.CAHash) {
+		return nil, errors.Errorf("cluster CA hash %s mismatches the expected %s", hash, c.CAHash)
+	}
+	return ca, nil
+}
+
+// Kubelet requests the kubelet bootstrap material with the token,
+// where the join server is verified by the cluster CA
+func (c *Client) Kubelet(ca *x509.Certificate, req *KubeletRequest) (*KubeletBootstrap, error) {
+	kb := &KubeletBootstrap{}
+	if err := c.post(ca, kubeletPath, req, kb); err != nil {
+		return nil, errors.Wrap(err, "failed to request kubelet bootstrap material")
+	}
+	return kb, nil
+}
+
+// Controller requests the controller bootstrap material with the token,
+// where the join server is verified by the cluster CA
+func (c *Client) Controller(ca *x509.Certificate, req *ControllerRequest) (*ControllerBootstrap, error) {
+	cb := &ControllerBootstrap{}
+	if err := c.post(ca, controllerPath, req, cb); err != nil {
+		return nil, errors.Wrap(err, "failed to request controller bootstrap material")
+	}
+	return cb, nil
+}
+
+// post sends the request in json with the token and parses the response into resp
+func (c *Client) post(ca *x509.Certificate, path string, req, resp interface{}) error {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	hc := c.httpClient(&tls.Config{RootCAs: pool})
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal request")
+	}
+	hreq, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(c.Server, "/")+path, bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	hreq.Header.Set("Authorization", "Bearer "+c.Token)
+	hreq.Header.Set("Content-Type", "application/json")
+
+	hresp, err := hc.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer hresp.Body.Close()
+
+	body, err := readBody(hresp)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(json.Unmarshal(body, resp), "failed to parse response")
+}
+
+func (c *Client) httpClient(tc *tls.Config) *http.Client {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	tc.MinVersion = tls.VersionTLS12
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: tc},
+	}
+}
+
+func readBody(resp *http.Response) ([]byte, error) {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
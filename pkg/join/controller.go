@@ -0,0 +1,218 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package join
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/etcd"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/pki"
+)
+
+// memberAddTimeout is how long adding the etcd member of a joining controller takes at most
+const memberAddTimeout time.Duration = 30 * time.Second
+
+// ControllerRequest is sent by a controller to get its bootstrap material,
+// whose address is taken from the cluster config
+type ControllerRequest struct {
+	NodeName string `json:"nodeName"`
+}
+
+// KeyPairPEM is a certificate with its private key in PEM
+type KeyPairPEM struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// EtcdMember is the etcd member added for a joining controller as a learner
+type EtcdMember struct {
+	ID etcd.ID `json:"id"`
+	// InitialCluster is the initial members in form of name=peerURL,...
+	InitialCluster string `json:"initialCluster"`
+}
+
+// ControllerBootstrap is the bootstrap material handed out to a controller
+type ControllerBootstrap struct {
+	// CAs are the cluster CAs by names, e.g. etcd/ca
+	CAs map[string]KeyPairPEM `json:"cas"`
+	// ServiceAccountKey and ServiceAccountPub are the key pair signing service account tokens
+	ServiceAccountKey string `json:"serviceAccountKey"`
+	ServiceAccountPub string `json:"serviceAccountPub"`
+	// Certs are the etcd peer, server and client certificates issued to the controller by names
+	Certs map[string]KeyPairPEM `json:"certs"`
+	Etcd  EtcdMember            `json:"etcd"`
+}
+
+// etcdCertNames are names of the etcd certificates issued to joining controllers
+var etcdCertNames = []string{
+	pki.EtcdPeerName,
+	pki.EtcdServerName,
+	pki.EtcdHealthcheckClientName,
+	pki.APIServerEtcdClientName,
+}
+
+// EnableControllers serves join requests of controllers with the CAs in the PKI,
+// where the etcd members of joining controllers are added through members
+func (s *Server) EnableControllers(p *pki.PKI, members etcd.MemberAdder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pki = p
+	s.members = members
+}
+
+func (s *Server) serveController(w http.ResponseWriter, r *http.Request) {
+	logger := lgr.GetGlobalLogger()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	bound, err := s.tokens.Validate(bearerToken(r), conf.RoleController)
+	if err != nil {
+		logger.Warnf("reject join request from %s: %v", r.RemoteAddr, err)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	req := &ControllerRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil || !conf.IsNodeName(req.NodeName) {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pki == nil {
+		http.Error(w, "controllers are not allowed to join", http.StatusNotFound)
+		return
+	}
+	node := s.cfg.Node(req.NodeName)
+	if err := admitController(node, bound, req.NodeName); err != nil {
+		logger.Warnf("reject join request of controller %s from %s: %v", req.NodeName, r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	cb, err := s.controllerBootstrap(r.Context(), node)
+	if err != nil {
+		logger.Errorf("failed to prepare bootstrap material for controller %s: %v", req.NodeName, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Infof("controller %s joined as etcd learner %s from %s", req.NodeName, cb.Etcd.ID, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cb)
+}
+
+// admitController checks the node is a controller in the cluster config
+// allowed to join with a token bound to the node with the name
+func admitController(node *conf.Node, bound, nodeName string) error {
+	if node == nil || !node.HasRole(conf.RoleController) {
+		return errors.Errorf("node %s is not a %s in the cluster config", nodeName, conf.RoleController)
+	}
+	if bound != "" && bound != nodeName {
+		return errors.Errorf("token is bound to node %s", bound)
+	}
+	return nil
+}
+
+// controllerBootstrap reads the CAs and the service account key pair, issues the etcd
+// certificates of the node and adds its etcd member as a learner, which is done last
+// so that a member is never added for a controller failing to get its material
+func (s *Server) controllerBootstrap(ctx context.Context, node *conf.Node) (*ControllerBootstrap, error) {
+	cb := &ControllerBootstrap{CAs: map[string]KeyPairPEM{}, Certs: map[string]KeyPairPEM{}}
+	for _, name := range pki.CANames() {
+		ca, err := s.pki.LoadKeyPair(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load CA %s", name)
+		}
+		if cb.CAs[name], err = encodeKeyPair(ca); err != nil {
+			return nil, err
+		}
+	}
+
+	keyPEM, pubPEM, err := s.pki.ServiceAccountKeyPEM()
+	if err != nil {
+		return nil, err
+	}
+	cb.ServiceAccountKey, cb.ServiceAccountPub = string(keyPEM), string(pubPEM)
+
+	p, err := pki.New(s.cfg, node.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range etcdCertNames {
+		spec, err := p.Leaf(name)
+		if err != nil {
+			return nil, err
+		}
+		ca, err := s.pki.LoadKeyPair(spec.CAName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load CA %s", spec.CAName)
+		}
+		kp, err := ca.Issue(&spec.Config)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to issue certificate %s", name)
+		}
+		if cb.Certs[name], err = encodeKeyPair(kp); err != nil {
+			return nil, err
+		}
+	}
+
+	addCtx, cancel := context.WithTimeout(ctx, memberAddTimeout)
+	defer cancel()
+	b, err := etcd.AddLearner(addCtx, s.members, node)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to add etcd member of controller %s", node.Name)
+	}
+	cb.Etcd = EtcdMember{ID: b.LearnerID, InitialCluster: b.InitialCluster}
+	return cb, nil
+}
+
+func encodeKeyPair(kp *pki.KeyPair) (KeyPairPEM, error) {
+	keyPEM, err := pki.EncodeKeyPEM(kp.Key)
+	if err != nil {
+		return KeyPairPEM{}, err
+	}
+	return KeyPairPEM{Cert: string(pki.EncodeCertPEM(kp.Cert)), Key: string(keyPEM)}, nil
+}
+
+// Decode parses the key pair, which is refused if the key doesn't match the certificate
+func (kp KeyPairPEM) Decode() (*pki.KeyPair, error) {
+	cert, err := pki.ParseCertPEM([]byte(kp.Cert))
+	if err != nil {
+		return nil, err
+	}
+	key, err := pki.ParseKeyPEM([]byte(kp.Key))
+	if err != nil {
+		return nil, err
+	}
+	decoded := &pki.KeyPair{Cert: cert, Key: key}
+	if !decoded.Matches() {
+		return nil, errors.New("private key doesn't match certificate")
+	}
+	return decoded, nil
+}
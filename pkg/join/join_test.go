@@ -0,0 +1,299 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package join_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/etcd"
+	"github.com/jiuchen1986/cks/pkg/join"
+	"github.com/jiuchen1986/cks/pkg/kubeconfig"
+	"github.com/jiuchen1986/cks/pkg/pki"
+	"github.com/jiuchen1986/cks/pkg/token"
+)
+
+func newTestServer(t *testing.T, tokens join.TokenValidator, dir string) (*httptest.Server, *pki.KeyPair) {
+	ca, err := pki.NewCA("test-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := conf.NewDefault()
+	cfg.API.Address = "192.168.0.10"
+	cfg.Nodes[0].Name = "node-a"
+	return startTLS(t, join.NewServer(cfg, ca, tokens, join.NewRegistry(join.RegistryPath(dir))), ca), ca
+}
+
+func startTLS(t *testing.T, srv *join.Server, ca *pki.KeyPair) *httptest.Server {
+	serving, err := ca.Issue(&pki.CertConfig{
+		CommonName: "join",
+		IPs:        []net.IP{net.ParseIP("127.0.0.1")},
+		Usages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewUnstartedServer(srv)
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{serving.TLSCertificate()}}
+	ts.StartTLS()
+	return ts
+}
+
+// fakeMembers keeps etcd members in memory
+type fakeMembers struct {
+	members []etcd.Member
+}
+
+func (f *fakeMembers) MemberList(ctx context.Context) ([]etcd.Member, error) {
+	return append([]etcd.Member{}, f.members...), nil
+}
+
+func (f *fakeMembers) MemberAdd(ctx context.Context, peerURLs []string, learner bool) (*etcd.Member,
+	[]etcd.Member, error) {
+	m := etcd.Member{ID: etcd.ID(len(f.members) + 1), PeerURLs: peerURLs, IsLearner: learner}
+	f.members = append(f.members, m)
+	all, err := f.MemberList(ctx)
+	return &m, all, err
+}
+
+func TestFetchCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-join")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts, ca := newTestServer(t, join.StaticToken("secret"), dir)
+	defer ts.Close()
+
+	c := &join.Client{Server: ts.URL, CAHash: pki.CAHash(ca.Cert)}
+	fetched, err := c.FetchCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, fetched.Equal(ca.Cert))
+
+	other, err := pki.NewCA("other-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.CAHash = pki.CAHash(other.Cert)
+	_, err = c.FetchCA()
+	assert.NotNil(t, err, "CA mismatching the hash should be rejected.")
+}
+
+func TestKubelet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-join")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts, ca := newTestServer(t, join.StaticToken("secret"), dir)
+	defer ts.Close()
+
+	req := &join.KubeletRequest{NodeName: "node-b", Address: "192.168.0.11"}
+
+	c := &join.Client{Server: ts.URL, Token: "wrong"}
+	_, err = c.Kubelet(ca.Cert, req)
+	assert.NotNil(t, err, "Invalid token should be rejected.")
+
+	c.Token = "secret"
+	kb, err := c.Kubelet(ca.Cert, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, conf.DefaultClusterDomain, kb.ClusterDomain)
+	assert.Equal(t, conf.DefaultKubernetesVersion, kb.KubernetesVersion)
+
+	kc, err := kubeconfig.Parse([]byte(kb.Kubeconfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "https://192.168.0.10:6443", kc.Server())
+	kp, err := kc.ClientKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "system:node:node-b", kp.Cert.Subject.CommonName)
+	assert.Equal(t, []string{kubeconfig.NodesGroup}, kp.Cert.Subject.Organization)
+	assert.Nil(t, kp.Cert.CheckSignatureFrom(ca.Cert))
+}
+
+func TestKubeletAdmission(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-join")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := token.NewManager(token.NewMemoryStore())
+	ts, ca := newTestServer(t, m.Validator(), dir)
+	defer ts.Close()
+
+	unbound, _, err := m.Create(&token.CreateOptions{Role: conf.RoleWorker, Server: "https://10.0.0.1:9443", CAHash: "sha256:00ff"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bound, _, err := m.Create(&token.CreateOptions{Role: conf.RoleWorker, NodeName: "node-b", Server: "https://10.0.0.1:9443",
+		CAHash: "sha256:00ff"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &join.Client{Server: ts.URL, Token: unbound.String()}
+	_, err = c.Kubelet(ca.Cert, &join.KubeletRequest{NodeName: "node-a"})
+	assert.NotNil(t, err, "Controller in the cluster config should not join with tokens.")
+	_, err = c.Kubelet(ca.Cert, &join.KubeletRequest{NodeName: "Node_B"})
+	assert.NotNil(t, err, "Invalid node name should be rejected.")
+
+	_, err = c.Kubelet(ca.Cert, &join.KubeletRequest{NodeName: "node-b"})
+	assert.Nil(t, err)
+	_, err = c.Kubelet(ca.Cert, &join.KubeletRequest{NodeName: "node-b"})
+	assert.NotNil(t, err, "Node already issued should not join with a token bound to no node.")
+
+	c.Token = bound.String()
+	_, err = c.Kubelet(ca.Cert, &join.KubeletRequest{NodeName: "node-c"})
+	assert.NotNil(t, err, "Token bound to a node should not join other nodes.")
+	_, err = c.Kubelet(ca.Cert, &join.KubeletRequest{NodeName: "node-b"})
+	assert.Nil(t, err, "Token bound to the node should join it again.")
+
+	names, err := join.NewRegistry(join.RegistryPath(dir)).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"node-b"}, names)
+}
+
+func TestController(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-join")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &conf.ClusterConfig{
+		DataDir: dir,
+		Nodes: []conf.Node{
+			{Name: "node-a", Address: "192.168.0.10", Roles: []conf.Role{conf.RoleController}},
+			{Name: "node-b", Address: "192.168.0.11", Roles: []conf.Role{conf.RoleController}},
+			{Name: "node-c", Address: "192.168.0.12", Roles: []conf.Role{conf.RoleWorker}},
+		},
+	}
+	conf.SetDefaults(cfg)
+	p, err := pki.New(cfg, "node-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	ca, err := p.LoadKeyPair(pki.CAName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := token.NewManager(token.NewMemoryStore())
+	srv := join.NewServer(cfg, ca, m.Validator(), join.NewRegistry(join.RegistryPath(dir)))
+	ts := startTLS(t, srv, ca)
+	defer ts.Close()
+
+	worker, _, err := m.Create(&token.CreateOptions{Role: conf.RoleWorker, Server: ts.URL, CAHash: pki.CAHash(ca.Cert)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller, _, err := m.Create(&token.CreateOptions{Role: conf.RoleController, Server: ts.URL,
+		CAHash: pki.CAHash(ca.Cert)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := &join.ControllerRequest{NodeName: "node-b"}
+	c := &join.Client{Server: ts.URL, Token: controller.String()}
+	_, err = c.Controller(ca.Cert, req)
+	assert.NotNil(t, err, "Controllers should not join before enabled.")
+
+	members := &fakeMembers{members: []etcd.Member{{
+		ID:       1,
+		Name:     "node-a",
+		PeerURLs: []string{etcd.PeerURL("192.168.0.10")},
+	}}}
+	srv.EnableControllers(p, members)
+
+	c.Token = worker.String()
+	_, err = c.Controller(ca.Cert, req)
+	assert.NotNil(t, err, "Token of workers should not join controllers.")
+	c.Token = controller.String()
+	_, err = c.Controller(ca.Cert, &join.ControllerRequest{NodeName: "node-c"})
+	assert.NotNil(t, err, "Node other than the controllers in the cluster config should not join.")
+
+	cb, err := c.Controller(ca.Cert, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range pki.CANames() {
+		kp, err := cb.CAs[name].Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		local, err := p.LoadKeyPair(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, kp.Cert.Equal(local.Cert), "CA %s should be shared.", name)
+	}
+	keyPEM, pubPEM, err := p.ServiceAccountKeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(keyPEM), cb.ServiceAccountKey)
+	assert.Equal(t, string(pubPEM), cb.ServiceAccountPub)
+
+	etcdCA, err := p.LoadKeyPair(pki.EtcdCAName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := cb.Certs[pki.EtcdPeerName].Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "node-b", peer.Cert.Subject.CommonName)
+	assert.Equal(t, "192.168.0.11", peer.Cert.IPAddresses[0].String())
+	assert.Nil(t, peer.Cert.CheckSignatureFrom(etcdCA.Cert))
+	_, err = cb.Certs[pki.APIServerEtcdClientName].Decode()
+	assert.Nil(t, err, "Etcd client certificate should be issued.")
+
+	assert.Equal(t, etcd.ID(2), cb.Etcd.ID, "Etcd member should be added as a learner.")
+	assert.Equal(t, "node-a=https://192.168.0.10:2380,node-b=https://192.168.0.11:2380", cb.Etcd.InitialCluster)
+
+	cb, err = c.Controller(ca.Cert, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, etcd.ID(2), cb.Etcd.ID, "Etcd member added before should be reused.")
+	assert.Equal(t, 2, len(members.members))
+}
@@ -0,0 +1,106 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package join
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	"github.com/jiuchen1986/cks/pkg/utils"
+)
+
+// RegistryPath returns the path of the registry in the data directory
+func RegistryPath(dataDir string) string {
+	return filepath.Join(dataDir, "join", "nodes.yaml")
+}
+
+// Registry records the names of nodes which kubelet credentials
+// have been issued to, kept in a yaml file
+type Registry struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewRegistry returns a registry kept in the file
+func NewRegistry(path string) *Registry {
+	return &Registry{path: path}
+}
+
+// List returns the names of the nodes issued sorted
+func (r *Registry) List() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.read()
+}
+
+// Has tells whether credentials have been issued to the node
+func (r *Registry) Has(nodeName string) (bool, error) {
+	names, err := r.List()
+	if err != nil {
+		return false, err
+	}
+	i := sort.SearchStrings(names, nodeName)
+	return i < len(names) && names[i] == nodeName, nil
+}
+
+// Add records the node, which is a no-op if it's already recorded
+func (r *Registry) Add(nodeName string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names, err := r.read()
+	if err != nil {
+		return err
+	}
+	i := sort.SearchStrings(names, nodeName)
+	if i < len(names) && names[i] == nodeName {
+		return nil
+	}
+	names = append(names, "")
+	copy(names[i+1:], names[i:])
+	names[i] = nodeName
+
+	data, err := yaml.Marshal(names)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal joined nodes")
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0700); err != nil {
+		return errors.Wrap(err, "failed to create directory of joined nodes")
+	}
+	return utils.WriteFileAtomic(r.path, data, 0600)
+}
+
+func (r *Registry) read() ([]string, error) {
+	data, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, errors.Wrap(err, "failed to read joined nodes")
+	}
+	names := []string{}
+	if err := yaml.Unmarshal(data, &names); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse joined nodes in %s", r.path)
+	}
+	sort.Strings(names)
+	return names, nil
+}
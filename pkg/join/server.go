@@ -0,0 +1,238 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package join
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/etcd"
+	"github.com/jiuchen1986/cks/pkg/kubeconfig"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/pki"
+)
+
+const (
+	// Port is the port controllers serve join requests on
+	Port int = 9443
+
+	caPath         string = "/v1/ca"
+	kubeletPath    string = "/v1/kubelet"
+	controllerPath string = "/v1/controller"
+)
+
+// TokenValidator validates tokens presented by joining nodes
+type TokenValidator interface {
+	// Validate checks the token is valid for the role and returns the name
+	// of the node the token is bound to, which is empty if any node is allowed to join
+	Validate(token string, role conf.Role) (string, error)
+}
+
+// StaticToken is a TokenValidator accepting a single token for any role bound to no node,
+// which is handy when tokens are managed out of cks
+type StaticToken string
+
+// Validate accepts the token only if it equals the static token
+func (st StaticToken) Validate(token string, role conf.Role) (string, error) {
+	if subtle.ConstantTimeCompare([]byte(st), []byte(token)) != 1 {
+		return "", errors.New("invalid token")
+	}
+	return "", nil
+}
+
+// KubeletRequest is sent by a worker to get its bootstrap material
+type KubeletRequest struct {
+	NodeName string `json:"nodeName"`
+	Address  string `json:"address"`
+}
+
+// KubeletBootstrap is the bootstrap material handed out to a worker
+type KubeletBootstrap struct {
+	// Kubeconfig is the kubelet kubeconfig in yaml
+	Kubeconfig        string `json:"kubeconfig"`
+	ClusterDNS        string `json:"clusterDNS"`
+	ClusterDomain     string `json:"clusterDomain"`
+	KubernetesVersion string `json:"kubernetesVersion"`
+}
+
+// Server hands out the CA and bootstrap material to joining workers,
+// and to joining controllers once enabled by EnableControllers
+type Server struct {
+	cfg    *conf.ClusterConfig
+	ca     *pki.KeyPair
+	tokens TokenValidator
+	nodes  *Registry
+	mux    *http.ServeMux
+	// pki and members are set only if controllers are allowed to join
+	pki     *pki.PKI
+	members etcd.MemberAdder
+	// mu serializes issuing, so that a node name is never issued twice
+	mu sync.Mutex
+}
+
+// NewServer returns a join server issuing kubelet credentials signed by the CA,
+// where nodes issued are recorded in the registry
+func NewServer(cfg *conf.ClusterConfig, ca *pki.KeyPair, tokens TokenValidator, nodes *Registry) *Server {
+	s := &Server{cfg: cfg, ca: ca, tokens: tokens, nodes: nodes, mux: http.NewServeMux()}
+	s.mux.HandleFunc(caPath, s.serveCA)
+	s.mux.HandleFunc(kubeletPath, s.serveKubelet)
+	s.mux.HandleFunc(controllerPath, s.serveController)
+	return s
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves on the address with the certificate until ctx is done
+func (s *Server) ListenAndServe(ctx context.Context, addr string, cert tls.Certificate) error {
+	logger := lgr.GetGlobalLogger()
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %s", addr)
+	}
+
+	srv := &http.Server{
+		Handler:   s,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12},
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	logger.Infof("serve join requests on %s", addr)
+	if err := srv.ServeTLS(ln, "", ""); err != nil && err != http.ErrServerClosed {
+		return errors.Wrap(err, "failed to serve join requests")
+	}
+	return nil
+}
+
+// serveCA serves the CA without authentication,
+// which is verified by the CA hash on the client side
+func (s *Server) serveCA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(pki.EncodeCertPEM(s.ca.Cert))
+}
+
+func (s *Server) serveKubelet(w http.ResponseWriter, r *http.Request) {
+	logger := lgr.GetGlobalLogger()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	bound, err := s.tokens.Validate(bearerToken(r), conf.RoleWorker)
+	if err != nil {
+		logger.Warnf("reject join request from %s: %v", r.RemoteAddr, err)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	req := &KubeletRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil || !conf.IsNodeName(req.NodeName) {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.admit(bound, req.NodeName); err != nil {
+		logger.Warnf("reject join request of node %s from %s: %v", req.NodeName, r.RemoteAddr, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	kc, err := kubeconfig.New(s.ca, &kubeconfig.Options{
+		ClusterName: s.cfg.ClusterName,
+		Server:      kubeconfig.ServerURL(s.cfg.API.Address, s.cfg.API.Port),
+		User:        kubeconfig.KubeletUser(req.NodeName),
+		Groups:      []string{kubeconfig.NodesGroup},
+	})
+	if err != nil {
+		logger.Errorf("failed to generate kubeconfig for node %s: %v", req.NodeName, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	out, err := kc.Marshal()
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	if err := s.nodes.Add(req.NodeName); err != nil {
+		logger.Errorf("failed to record node %s: %v", req.NodeName, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	logger.Infof("node %s with address %s joined from %s", req.NodeName, req.Address, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&KubeletBootstrap{
+		Kubeconfig:        string(out),
+		ClusterDNS:        s.cfg.Network.ClusterDNS,
+		ClusterDomain:     s.cfg.Network.ClusterDomain,
+		KubernetesVersion: s.cfg.Versions.Kubernetes,
+	})
+}
+
+// admit checks the node is allowed to get kubelet credentials with a token
+// bound to the node with the name, which is empty if the token is bound to no node
+func (s *Server) admit(bound, nodeName string) error {
+	if n := s.cfg.Node(nodeName); n != nil && n.HasRole(conf.RoleController) {
+		return errors.Errorf("node %s is a controller holding its own credentials", nodeName)
+	}
+	if bound != "" {
+		if bound != nodeName {
+			return errors.Errorf("token is bound to node %s", bound)
+		}
+		// a token created for the node issues its credentials again, e.g. after reset
+		return nil
+	}
+
+	issued, err := s.nodes.Has(nodeName)
+	if err != nil {
+		return err
+	}
+	if issued {
+		return errors.Errorf("credentials already issued to node %s, create a token bound to it "+
+			"by cks token create --node %s to join it again", nodeName, nodeName)
+	}
+	return nil
+}
+
+func bearerToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
@@ -0,0 +1,280 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package kubeconfig
+
+import (
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/pki"
+	"github.com/jiuchen1986/cks/pkg/plan"
+)
+
+// names of kubeconfigs of components, which are also
+// the file names in the kubeconfig directory without the .conf suffix
+const (
+	AdminName             string = "admin"
+	ControllerManagerName string = "controller-manager"
+	SchedulerName         string = "scheduler"
+	KubeletName           string = "kubelet"
+)
+
+// certPrefix prefixes names of the client certificates embedded in kubeconfigs,
+// which tells them from the ones in the PKI directory
+const certPrefix string = "kubeconfig/"
+
+// Dir returns the kubeconfig directory in the data directory
+func Dir(dataDir string) string {
+	return filepath.Join(dataDir, "kubeconfig")
+}
+
+// Path returns path of the kubeconfig with the name in the data directory
+func Path(dataDir, name string) string {
+	return filepath.Join(Dir(dataDir), name+".conf")
+}
+
+// ServerURL returns the URL of the apiserver at the host and port
+func ServerURL(host string, port int) string {
+	return "https://" + net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// KubeletUser returns the user of the kubelet on the node
+func KubeletUser(nodeName string) string {
+	return "system:node:" + nodeName
+}
+
+// NodesGroup is the group of all the kubelets
+const NodesGroup string = "system:nodes"
+
+// ComponentOptions returns options of kubeconfigs for the components
+// running on the node, where each component has its own credentials.
+// Components on controllers talk to the local apiserver
+func ComponentOptions(cfg *conf.ClusterConfig, nodeName string) (map[string]*Options, error) {
+	node := cfg.Node(nodeName)
+	if node == nil {
+		return nil, errors.Errorf("node %s not found in cluster config", nodeName)
+	}
+
+	api := ServerURL(cfg.API.Address, cfg.API.Port)
+	local := ServerURL("127.0.0.1", cfg.API.Port)
+
+	opts := map[string]*Options{}
+	if node.HasRole(conf.RoleController) {
+		opts[AdminName] = &Options{
+			Server: api,
+			User:   "kubernetes-admin",
+			Groups: []string{pki.SystemMastersGroup},
+		}
+		opts[ControllerManagerName] = &Options{Server: local, User: "system:kube-controller-manager"}
+		opts[SchedulerName] = &Options{Server: local, User: "system:kube-scheduler"}
+	}
+	if node.HasRole(conf.RoleWorker) {
+		opts[KubeletName] = &Options{
+			Server: api,
+			User:   KubeletUser(node.Name),
+			Groups: []string{NodesGroup},
+		}
+	}
+
+	for _, o := range opts {
+		o.ClusterName = cfg.ClusterName
+	}
+	return opts, nil
+}
+
+// EnsureComponents writes kubeconfigs of the components running
+// on the node into the data directory, signed by the cluster CA.
+// Existing kubeconfigs are kept if they're still valid
+func EnsureComponents(cfg *conf.ClusterConfig, nodeName string) error {
+	logger := lgr.GetGlobalLogger()
+	defer logger.Sync()
+
+	opts, err := ComponentOptions(cfg, nodeName)
+	if err != nil {
+		return err
+	}
+
+	p, err := pki.New(cfg, nodeName)
+	if err != nil {
+		return err
+	}
+	ca, err := p.LoadKeyPair(pki.CAName)
+	if err != nil {
+		return errors.Wrap(err, "failed to load cluster CA")
+	}
+
+	for name, o := range opts {
+		path := Path(cfg.DataDir, name)
+		if isValid(path, ca, o) {
+			logger.Debugf("kubeconfig %s is valid, skip it", path)
+			continue
+		}
+
+		if err := write(path, ca, o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Renew re-issues the client certificate of the kubeconfig
+// of the component with the name running on the node from the cluster CA
+func Renew(cfg *conf.ClusterConfig, nodeName, name string) error {
+	o, ca, err := renewal(cfg, nodeName, name)
+	if err != nil {
+		return err
+	}
+	return write(Path(cfg.DataDir, name), ca, o)
+}
+
+// PlanRenew adds the kubeconfig with the name Renew would write to the plan
+func PlanRenew(cfg *conf.ClusterConfig, nodeName, name string, pl *plan.Plan) error {
+	o, _, err := renewal(cfg, nodeName, name)
+	if err != nil {
+		return err
+	}
+	pl.Add(plan.WriteFile, Path(cfg.DataDir, name), "kubeconfig for "+o.User+" with a renewed client certificate")
+	return nil
+}
+
+// renewal returns the options of the kubeconfig with the name and the CA renewing it
+func renewal(cfg *conf.ClusterConfig, nodeName, name string) (*Options, *pki.KeyPair, error) {
+	opts, err := ComponentOptions(cfg, nodeName)
+	if err != nil {
+		return nil, nil, err
+	}
+	o, ok := opts[name]
+	if !ok {
+		return nil, nil, errors.Errorf("no kubeconfig %s for the components on node %s", name, nodeName)
+	}
+
+	p, err := pki.New(cfg, nodeName)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := p.LoadKeyPair(pki.CAName)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to load cluster CA")
+	}
+	return o, ca, nil
+}
+
+// CertName returns the name of the client certificate embedded in the kubeconfig with the name
+func CertName(name string) string {
+	return certPrefix + name
+}
+
+// ParseCertName returns the name of the kubeconfig embedding the client certificate
+// with the name, and false if the certificate isn't embedded in a kubeconfig
+func ParseCertName(certName string) (string, bool) {
+	if !strings.HasPrefix(certName, certPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(certName, certPrefix), true
+}
+
+// Inspect reads the client certificates embedded in the kubeconfigs
+// in the data directory sorted by name, which are named by CertName
+func Inspect(dataDir string) ([]pki.CertInfo, error) {
+	paths, err := filepath.Glob(filepath.Join(Dir(dataDir), "*.conf"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list kubeconfigs")
+	}
+
+	infos := []pki.CertInfo{}
+	for _, path := range paths {
+		kc, err := Load(path)
+		if err != nil {
+			return nil, err
+		}
+		if kc.Users[0].User.ClientCertificateData == "" {
+			continue
+		}
+		kp, err := kc.ClientKeyPair()
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid client certificate in kubeconfig %s", path)
+		}
+		name := strings.TrimSuffix(filepath.Base(path), ".conf")
+		infos = append(infos, pki.NewCertInfo(CertName(name), kp.Cert))
+	}
+	return infos, nil
+}
+
+// write writes the kubeconfig with a client certificate newly issued by the CA
+func write(path string, ca *pki.KeyPair, o *Options) error {
+	kc, err := New(ca, o)
+	if err != nil {
+		return err
+	}
+	if err := kc.Write(path); err != nil {
+		return err
+	}
+	lgr.GetGlobalLogger().Infof("kubeconfig %s written for %s", path, o.User)
+	return nil
+}
+
+// PlanComponents adds the kubeconfigs EnsureComponents would write to the plan
+func PlanComponents(cfg *conf.ClusterConfig, nodeName string, pl *plan.Plan) error {
+	opts, err := ComponentOptions(cfg, nodeName)
+	if err != nil {
+		return err
+	}
+
+	p, err := pki.New(cfg, nodeName)
+	if err != nil {
+		return err
+	}
+	// the CA may be generated in the same run, then all the kubeconfigs are written
+	ca, _ := p.LoadKeyPair(pki.CAName)
+
+	names := make([]string, 0, len(opts))
+	for name := range opts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := Path(cfg.DataDir, name)
+		if ca != nil && isValid(path, ca, opts[name]) {
+			continue
+		}
+		pl.Add(plan.WriteFile, path, "kubeconfig for "+opts[name].User)
+	}
+	return nil
+}
+
+// isValid tells whether the kubeconfig on the disk points to the server
+// and holds a client certificate of the user signed by the CA and not expired
+func isValid(path string, ca *pki.KeyPair, o *Options) bool {
+	kc, err := Load(path)
+	if err != nil || kc.Server() != o.Server {
+		return false
+	}
+	kp, err := kc.ClientKeyPair()
+	if err != nil {
+		return false
+	}
+	return kp.Cert.Subject.CommonName == o.User &&
+		kp.Cert.CheckSignatureFrom(ca.Cert) == nil &&
+		time.Now().Before(kp.Cert.NotAfter)
+}
@@ -0,0 +1,241 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package kubeconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	"github.com/jiuchen1986/cks/pkg/pki"
+	"github.com/jiuchen1986/cks/pkg/utils"
+)
+
+// Config is a minimal kubeconfig holding a single cluster,
+// user and context with all credentials embedded
+type Config struct {
+	APIVersion     string         `yaml:"apiVersion"`
+	Kind           string         `yaml:"kind"`
+	Clusters       []NamedCluster `yaml:"clusters"`
+	Users          []NamedUser    `yaml:"users"`
+	Contexts       []NamedContext `yaml:"contexts"`
+	CurrentContext string         `yaml:"current-context"`
+}
+
+// NamedCluster is a cluster entry in the kubeconfig
+type NamedCluster struct {
+	Name    string  `yaml:"name"`
+	Cluster Cluster `yaml:"cluster"`
+}
+
+// Cluster holds the endpoint and CA of the cluster,
+// where CA data is base64 encoded PEM
+type Cluster struct {
+	Server                   string `yaml:"server"`
+	CertificateAuthorityData string `yaml:"certificate-authority-data"`
+}
+
+// NamedUser is a user entry in the kubeconfig
+type NamedUser struct {
+	Name string   `yaml:"name"`
+	User AuthInfo `yaml:"user"`
+}
+
+// AuthInfo holds the client certificate and key,
+// where data is base64 encoded PEM
+type AuthInfo struct {
+	ClientCertificateData string `yaml:"client-certificate-data"`
+	ClientKeyData         string `yaml:"client-key-data"`
+}
+
+// NamedContext is a context entry in the kubeconfig
+type NamedContext struct {
+	Name    string  `yaml:"name"`
+	Context Context `yaml:"context"`
+}
+
+// Context binds a cluster and a user
+type Context struct {
+	Cluster string `yaml:"cluster"`
+	User    string `yaml:"user"`
+}
+
+// Options describes a kubeconfig to generate
+type Options struct {
+	ClusterName string
+	// Server is the URL of the apiserver, e.g. https://127.0.0.1:6443
+	Server string
+	// User is the common name of the client certificate
+	User string
+	// Groups are the organizations of the client certificate
+	Groups []string
+	// TTL is the validity of the client certificate,
+	// defaults to pki.CertValidity if not set
+	TTL time.Duration
+}
+
+// New generates a kubeconfig with a client certificate signed by the CA
+func New(ca *pki.KeyPair, opts *Options) (*Config, error) {
+	kp, err := ca.Issue(&pki.CertConfig{
+		CommonName:   opts.User,
+		Organization: opts.Groups,
+		Usages:       []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		Validity:     opts.TTL,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to issue client certificate for %s", opts.User)
+	}
+	keyPEM, err := pki.EncodeKeyPEM(kp.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := opts.User + "@" + opts.ClusterName
+	return &Config{
+		APIVersion: "v1",
+		Kind:       "Config",
+		Clusters: []NamedCluster{{
+			Name: opts.ClusterName,
+			Cluster: Cluster{
+				Server:                   opts.Server,
+				CertificateAuthorityData: encode(pki.EncodeCertPEM(ca.Cert)),
+			},
+		}},
+		Users: []NamedUser{{
+			Name: opts.User,
+			User: AuthInfo{
+				ClientCertificateData: encode(pki.EncodeCertPEM(kp.Cert)),
+				ClientKeyData:         encode(keyPEM),
+			},
+		}},
+		Contexts: []NamedContext{{
+			Name:    ctx,
+			Context: Context{Cluster: opts.ClusterName, User: opts.User},
+		}},
+		CurrentContext: ctx,
+	}, nil
+}
+
+// Load reads the kubeconfig from the file
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read kubeconfig %s", path)
+	}
+	c, err := Parse(data)
+	return c, errors.Wrapf(err, "invalid kubeconfig %s", path)
+}
+
+// Parse decodes the kubeconfig in yaml
+func Parse(data []byte) (*Config, error) {
+	c := &Config{}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return nil, errors.Wrap(err, "failed to parse kubeconfig")
+	}
+	if len(c.Clusters) == 0 || len(c.Users) == 0 {
+		return nil, errors.New("no cluster or user found in kubeconfig")
+	}
+	return c, nil
+}
+
+// Marshal encodes the kubeconfig in yaml
+func (c *Config) Marshal() ([]byte, error) {
+	out, err := yaml.Marshal(c)
+	return out, errors.Wrap(err, "failed to marshal kubeconfig")
+}
+
+// Write writes the kubeconfig to the file readable only by the owner
+func (c *Config) Write(path string) error {
+	out, err := c.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrapf(err, "failed to create directory for kubeconfig %s", path)
+	}
+	return utils.WriteFileAtomic(path, out, 0600)
+}
+
+// Server returns the URL of the apiserver
+func (c *Config) Server() string {
+	return c.Clusters[0].Cluster.Server
+}
+
+// CAPEM returns the CA of the cluster in PEM
+func (c *Config) CAPEM() ([]byte, error) {
+	return decode(c.Clusters[0].Cluster.CertificateAuthorityData)
+}
+
+// ClientKeyPair returns the client certificate and key
+func (c *Config) ClientKeyPair() (*pki.KeyPair, error) {
+	certPEM, err := decode(c.Users[0].User.ClientCertificateData)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := decode(c.Users[0].User.ClientKeyData)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := pki.ParseCertPEM(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	key, err := pki.ParseKeyPEM(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &pki.KeyPair{Cert: cert, Key: key}, nil
+}
+
+// TLSConfig returns the TLS config authenticating with the client certificate
+// and trusting the CA of the cluster
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	caPEM, err := c.CAPEM()
+	if err != nil {
+		return nil, err
+	}
+	kp, err := c.ClientKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("no CA certificate found in kubeconfig")
+	}
+	return &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{kp.TLSCertificate()},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func encode(data []byte) string {
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func decode(s string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	return data, errors.Wrap(err, "failed to decode kubeconfig data")
+}
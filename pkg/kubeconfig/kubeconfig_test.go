@@ -0,0 +1,208 @@
+package kubeconfig_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/kubeconfig"
+	"github.com/jiuchen1986/cks/pkg/pki"
+	"github.com/jiuchen1986/cks/pkg/plan"
+)
+
+func TestNew(t *testing.T) {
+	ca, err := pki.NewCA("test-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "cks-kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kc, err := kubeconfig.New(ca, &kubeconfig.Options{
+		ClusterName: "cks",
+		Server:      "https://10.0.0.1:6443",
+		User:        "alice",
+		Groups:      []string{"dev", "ops"},
+		TTL:         time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := dir + "/alice.conf"
+	if err := kc.Write(path); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm(), "Kubeconfig should only be "+
+		"accessible by the owner.")
+
+	loaded, err := kubeconfig.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "https://10.0.0.1:6443", loaded.Server())
+	assert.Equal(t, "alice@cks", loaded.CurrentContext)
+
+	kp, err := loaded.ClientKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "alice", kp.Cert.Subject.CommonName)
+	assert.Equal(t, []string{"dev", "ops"}, kp.Cert.Subject.Organization)
+	assert.True(t, kp.Cert.NotAfter.Before(time.Now().Add(time.Hour+time.Minute)), "Client "+
+		"certificate should expire after TTL.")
+	assert.Nil(t, kp.Cert.CheckSignatureFrom(ca.Cert))
+}
+
+func TestEnsureComponents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &conf.ClusterConfig{
+		DataDir: dir,
+		Nodes: []conf.Node{{
+			Name:    "node-a",
+			Address: "192.168.0.10",
+			Roles:   []conf.Role{conf.RoleController, conf.RoleWorker},
+		}},
+	}
+	conf.SetDefaults(cfg)
+
+	p, err := pki.New(cfg, "node-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	if err := kubeconfig.EnsureComponents(cfg, "node-a"); err != nil {
+		t.Fatal(err)
+	}
+
+	users := map[string]string{
+		kubeconfig.AdminName:             "kubernetes-admin",
+		kubeconfig.ControllerManagerName: "system:kube-controller-manager",
+		kubeconfig.SchedulerName:         "system:kube-scheduler",
+		kubeconfig.KubeletName:           "system:node:node-a",
+	}
+	serials := map[string]string{}
+	for name, user := range users {
+		kc, err := kubeconfig.Load(kubeconfig.Path(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		kp, err := kc.ClientKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, user, kp.Cert.Subject.CommonName, "Each component should have its own user.")
+		serials[name] = kp.Cert.SerialNumber.String()
+	}
+
+	// re-run keeps the valid kubeconfigs
+	if err := kubeconfig.EnsureComponents(cfg, "node-a"); err != nil {
+		t.Fatal(err)
+	}
+	for name := range users {
+		kc, err := kubeconfig.Load(kubeconfig.Path(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		kp, err := kc.ClientKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, serials[name], kp.Cert.SerialNumber.String(), "Valid kubeconfig should "+
+			"not be regenerated.")
+	}
+}
+
+func TestInspectAndRenew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &conf.ClusterConfig{
+		DataDir: dir,
+		Nodes: []conf.Node{{
+			Name:    "node-a",
+			Address: "192.168.0.10",
+			Roles:   []conf.Role{conf.RoleController},
+		}},
+	}
+	conf.SetDefaults(cfg)
+
+	p, err := pki.New(cfg, "node-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	if err := kubeconfig.EnsureComponents(cfg, "node-a"); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := kubeconfig.Inspect(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, ci := range infos {
+		names = append(names, ci.Name)
+	}
+	assert.Equal(t, []string{
+		kubeconfig.CertName(kubeconfig.AdminName),
+		kubeconfig.CertName(kubeconfig.ControllerManagerName),
+		kubeconfig.CertName(kubeconfig.SchedulerName),
+	}, names, "Client certificates of all kubeconfigs should be inspected.")
+	assert.Equal(t, "CN=kubernetes-admin,O=system:masters", infos[0].Subject)
+
+	name, ok := kubeconfig.ParseCertName(infos[0].Name)
+	assert.True(t, ok)
+	assert.Equal(t, kubeconfig.AdminName, name)
+	_, ok = kubeconfig.ParseCertName("apiserver")
+	assert.False(t, ok, "Certificates in the PKI directory should not be taken as embedded.")
+
+	before, err := kubeconfig.Load(kubeconfig.Path(dir, kubeconfig.AdminName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kubeconfig.Renew(cfg, "node-a", kubeconfig.AdminName); err != nil {
+		t.Fatal(err)
+	}
+	after, err := kubeconfig.Load(kubeconfig.Path(dir, kubeconfig.AdminName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, before.Users[0].User.ClientCertificateData, after.Users[0].User.ClientCertificateData,
+		"Client certificate should be re-issued.")
+	assert.Equal(t, before.Server(), after.Server())
+
+	assert.NotNil(t, kubeconfig.Renew(cfg, "node-a", kubeconfig.KubeletName), "Kubeconfigs of components "+
+		"not on the node should not be renewed.")
+
+	pl := plan.New("certs renew", "node-a")
+	if err := kubeconfig.PlanRenew(cfg, "node-a", kubeconfig.AdminName, pl); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{kubeconfig.Path(dir, kubeconfig.AdminName)}, pl.Targets(plan.WriteFile))
+	assert.NotNil(t, kubeconfig.PlanRenew(cfg, "node-a", kubeconfig.KubeletName, pl))
+}
@@ -0,0 +1,130 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/jiuchen1986/cks/pkg/kubeconfig"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+)
+
+// endpointsPath is the Endpoints object of the kubernetes service,
+// which lists the apiservers
+const endpointsPath string = "/api/v1/namespaces/default/endpoints/kubernetes"
+
+// EndpointsFunc returns the apiservers in host:port
+type EndpointsFunc func(ctx context.Context) ([]string, error)
+
+// endpoints is the subset of the Endpoints object cks reads
+type endpoints struct {
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+// KubernetesEndpoints returns the func reading the apiservers from the kubernetes
+// Endpoints object through the server with the credentials in the kubeconfig
+func KubernetesEndpoints(kc *kubeconfig.Config, server string) (EndpointsFunc, error) {
+	tc, err := kc.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	hc := &http.Client{Transport: &http.Transport{TLSClientConfig: tc}, Timeout: 10 * time.Second}
+
+	return func(ctx context.Context) ([]string, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(server, "/")+endpointsPath, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create request")
+		}
+		req.Header.Set("Accept", "application/json")
+		resp, err := hc.Do(req)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get kubernetes endpoints")
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.Errorf("failed to get kubernetes endpoints: %s", resp.Status)
+		}
+
+		eps := &endpoints{}
+		if err := json.NewDecoder(resp.Body).Decode(eps); err != nil {
+			return nil, errors.Wrap(err, "failed to decode kubernetes endpoints")
+		}
+		servers := []string{}
+		for _, ss := range eps.Subsets {
+			for _, p := range ss.Ports {
+				// the port is named https, or is the only one
+				if p.Name != "https" && len(ss.Ports) > 1 {
+					continue
+				}
+				for _, a := range ss.Addresses {
+					servers = append(servers, net.JoinHostPort(a.IP, strconv.Itoa(p.Port)))
+				}
+			}
+		}
+		sort.Strings(servers)
+		return servers, nil
+	}, nil
+}
+
+// WatchEndpoints replaces the servers with the ones from fetch every interval until ctx is done,
+// and calls onChange with the new servers if they're changed and onChange is not nil.
+// Failures and empty results are logged and leave the servers untouched
+func (lb *LoadBalancer) WatchEndpoints(ctx context.Context, fetch EndpointsFunc, interval time.Duration,
+	onChange func(servers []string)) {
+	logger := lgr.GetGlobalLogger()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		servers, err := fetch(ctx)
+		switch {
+		case err != nil:
+			if ctx.Err() == nil {
+				logger.Warnf("failed to refresh apiservers of the load balancer: %v", err)
+			}
+		case len(servers) == 0:
+			logger.Warn("no apiserver found in kubernetes endpoints, keep the current ones")
+		case lb.SetServers(servers):
+			logger.Infof("apiservers of the load balancer updated to %v", servers)
+			if onChange != nil {
+				onChange(servers)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,351 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package loadbalancer
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+)
+
+// DefaultPort is the port the load balancer listens on localhost by default,
+// next to the secure port of the apiserver
+const DefaultPort int = 6444
+
+// Policy decides which server a connection goes to
+type Policy string
+
+const (
+	// RoundRobin spreads connections over the healthy servers in turn
+	RoundRobin Policy = "round-robin"
+	// Failover sends connections to the first healthy server in order
+	Failover Policy = "failover"
+)
+
+// LoadBalancer proxies TCP connections to the healthy servers.
+// Unhealthy servers are still tried if no server is healthy
+type LoadBalancer struct {
+	// Address is listened on, e.g. 127.0.0.1:6444
+	Address        string
+	Policy         Policy
+	DialTimeout    time.Duration
+	HealthInterval time.Duration
+	// HealthCheck checks whether the server is healthy,
+	// defaults to dialing it within DialTimeout
+	HealthCheck func(ctx context.Context, server string) error
+
+	mu      sync.Mutex
+	servers []string
+	healthy map[string]bool
+	conns   map[string]map[net.Conn]bool
+	next    int
+	ln      net.Listener
+}
+
+// New returns a round-robin load balancer listening on the address
+// with the servers in host:port
+func New(address string, servers []string) *LoadBalancer {
+	lb := &LoadBalancer{
+		Address:        address,
+		Policy:         RoundRobin,
+		DialTimeout:    5 * time.Second,
+		HealthInterval: 5 * time.Second,
+		healthy:        map[string]bool{},
+		conns:          map[string]map[net.Conn]bool{},
+	}
+	lb.SetServers(servers)
+	return lb
+}
+
+// Start checks the servers once and listens on the address, then proxies connections
+// and checks the servers every HealthInterval in background until ctx is done
+func (lb *LoadBalancer) Start(ctx context.Context) error {
+	logger := lgr.GetGlobalLogger()
+
+	ln, err := net.Listen("tcp", lb.Address)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %s", lb.Address)
+	}
+	lb.mu.Lock()
+	lb.ln = ln
+	lb.mu.Unlock()
+	lb.checkServers(ctx)
+	logger.Infof("load balance %s over %v", ln.Addr(), lb.Servers())
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+		lb.mu.Lock()
+		defer lb.mu.Unlock()
+		for s := range lb.conns {
+			lb.closeConns(s)
+		}
+	}()
+	go lb.healthLoop(ctx)
+	go lb.serve(ctx, ln)
+	return nil
+}
+
+// Addr returns the address listened on, which is only known after Start
+// if the port of Address is 0
+func (lb *LoadBalancer) Addr() string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if lb.ln == nil {
+		return lb.Address
+	}
+	return lb.ln.Addr().String()
+}
+
+// Servers returns all the servers in order
+func (lb *LoadBalancer) Servers() []string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return append([]string{}, lb.servers...)
+}
+
+// Healthy returns the healthy servers in order
+func (lb *LoadBalancer) Healthy() []string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	healthy := []string{}
+	for _, s := range lb.servers {
+		if lb.healthy[s] {
+			healthy = append(healthy, s)
+		}
+	}
+	return healthy
+}
+
+// SetServers replaces the servers, new servers are taken as healthy until checked,
+// while connections to the removed ones are closed.
+// It returns whether the servers are changed
+func (lb *LoadBalancer) SetServers(servers []string) bool {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	seen := map[string]bool{}
+	updated := []string{}
+	for _, s := range servers {
+		if !seen[s] {
+			seen[s] = true
+			updated = append(updated, s)
+		}
+	}
+	if equal(updated, lb.servers) {
+		return false
+	}
+
+	for _, s := range lb.servers {
+		if !seen[s] {
+			delete(lb.healthy, s)
+			lb.closeConns(s)
+		}
+	}
+	for _, s := range updated {
+		if _, ok := lb.healthy[s]; !ok {
+			lb.healthy[s] = true
+		}
+	}
+	lb.servers = updated
+	return true
+}
+
+// candidates returns the servers to try in order for a new connection,
+// i.e. the healthy ones in the order of the policy followed by the unhealthy ones
+func (lb *LoadBalancer) candidates() []string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	healthy, unhealthy := []string{}, []string{}
+	for _, s := range lb.servers {
+		if lb.healthy[s] {
+			healthy = append(healthy, s)
+		} else {
+			unhealthy = append(unhealthy, s)
+		}
+	}
+	if lb.Policy != Failover && len(healthy) > 0 {
+		i := lb.next % len(healthy)
+		healthy = append(healthy[i:], healthy[:i]...)
+		lb.next++
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (lb *LoadBalancer) setHealthy(server string, healthy bool) {
+	logger := lgr.GetGlobalLogger()
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	was, ok := lb.healthy[server]
+	if !ok || was == healthy {
+		return
+	}
+	lb.healthy[server] = healthy
+	if healthy {
+		logger.Infof("apiserver %s is healthy", server)
+	} else {
+		logger.Warnf("apiserver %s is unhealthy", server)
+	}
+}
+
+func (lb *LoadBalancer) serve(ctx context.Context, ln net.Listener) {
+	logger := lgr.GetGlobalLogger()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Errorf("load balancer stopped: %v", err)
+			}
+			return
+		}
+		go lb.proxy(conn)
+	}
+}
+
+// proxy pipes the connection to the first candidate accepting it,
+// candidates failing to dial are taken as unhealthy
+func (lb *LoadBalancer) proxy(conn net.Conn) {
+	logger := lgr.GetGlobalLogger()
+
+	for _, s := range lb.candidates() {
+		upstream, err := net.DialTimeout("tcp", s, lb.DialTimeout)
+		if err != nil {
+			logger.Warnf("failed to connect apiserver %s: %v", s, err)
+			lb.setHealthy(s, false)
+			continue
+		}
+		if !lb.track(s, conn, upstream) {
+			// the server is removed meanwhile
+			upstream.Close()
+			continue
+		}
+		pipe(conn, upstream)
+		lb.untrack(s, conn, upstream)
+		return
+	}
+	logger.Errorf("no apiserver available for connection from %s", conn.RemoteAddr())
+	conn.Close()
+}
+
+func (lb *LoadBalancer) track(server string, conns ...net.Conn) bool {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if _, ok := lb.healthy[server]; !ok {
+		return false
+	}
+	if lb.conns[server] == nil {
+		lb.conns[server] = map[net.Conn]bool{}
+	}
+	for _, c := range conns {
+		lb.conns[server][c] = true
+	}
+	return true
+}
+
+func (lb *LoadBalancer) untrack(server string, conns ...net.Conn) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	for _, c := range conns {
+		delete(lb.conns[server], c)
+	}
+	if len(lb.conns[server]) == 0 {
+		delete(lb.conns, server)
+	}
+}
+
+// closeConns closes connections to the server, the caller should hold the lock
+func (lb *LoadBalancer) closeConns(server string) {
+	for c := range lb.conns[server] {
+		c.Close()
+	}
+	delete(lb.conns, server)
+}
+
+// pipe copies data in both directions until either side is closed
+func pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	cp := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
+
+func (lb *LoadBalancer) healthLoop(ctx context.Context) {
+	ticker := time.NewTicker(lb.HealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			lb.checkServers(ctx)
+		}
+	}
+}
+
+// checkServers checks all the servers in parallel
+func (lb *LoadBalancer) checkServers(ctx context.Context) {
+	check := lb.HealthCheck
+	if check == nil {
+		check = lb.dial
+	}
+
+	wg := sync.WaitGroup{}
+	for _, s := range lb.Servers() {
+		wg.Add(1)
+		go func(s string) {
+			defer wg.Done()
+			lb.setHealthy(s, check(ctx, s) == nil)
+		}(s)
+	}
+	wg.Wait()
+}
+
+func (lb *LoadBalancer) dial(ctx context.Context, server string) error {
+	d := &net.Dialer{Timeout: lb.DialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
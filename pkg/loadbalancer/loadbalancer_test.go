@@ -0,0 +1,315 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package loadbalancer_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jiuchen1986/cks/pkg/kubeconfig"
+	"github.com/jiuchen1986/cks/pkg/loadbalancer"
+	"github.com/jiuchen1986/cks/pkg/pki"
+)
+
+// backend greets connections with its address and echoes what it receives
+type backend struct {
+	ln net.Listener
+}
+
+func newBackend(t *testing.T) *backend {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &backend{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				fmt.Fprintln(conn, ln.Addr().String())
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return b
+}
+
+func (b *backend) addr() string {
+	return b.ln.Addr().String()
+}
+
+func startLB(t *testing.T, ctx context.Context, policy loadbalancer.Policy, servers ...string) *loadbalancer.LoadBalancer {
+	lb := loadbalancer.New("127.0.0.1:0", servers)
+	lb.Policy = policy
+	lb.DialTimeout = time.Second
+	lb.HealthInterval = 20 * time.Millisecond
+	if err := lb.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return lb
+}
+
+// connect returns the connection through the load balancer and the backend serving it
+func connect(t *testing.T, lb *loadbalancer.LoadBalancer) (net.Conn, string) {
+	conn, err := net.Dial("tcp", lb.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, ""
+	}
+	return conn, strings.TrimSpace(line)
+}
+
+func served(t *testing.T, lb *loadbalancer.LoadBalancer, n int) []string {
+	names := []string{}
+	for i := 0; i < n; i++ {
+		conn, name := connect(t, lb)
+		if conn != nil {
+			conn.Close()
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestRoundRobin(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, b, c := newBackend(t), newBackend(t), newBackend(t)
+	defer a.ln.Close()
+	defer b.ln.Close()
+	defer c.ln.Close()
+	lb := startLB(t, ctx, loadbalancer.RoundRobin, a.addr(), b.addr(), c.addr())
+
+	assert.Equal(t, []string{a.addr(), b.addr(), c.addr(), a.addr(), b.addr(), c.addr()}, served(t, lb, 6),
+		"Connections should be spread over the servers in turn.")
+
+	conn, _ := connect(t, lb)
+	defer conn.Close()
+	fmt.Fprintln(conn, "ping")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "ping\n", line, "Data should be proxied in both directions.")
+
+	b.ln.Close()
+	names := served(t, lb, 4)
+	assert.NotContains(t, names, b.addr())
+	assert.NotContains(t, names, "", "Connections should go to the healthy servers only.")
+	assert.Equal(t, []string{a.addr(), c.addr()}, lb.Healthy())
+}
+
+func TestFailover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, b := newBackend(t), newBackend(t)
+	defer b.ln.Close()
+	lb := startLB(t, ctx, loadbalancer.Failover, a.addr(), b.addr())
+
+	assert.Equal(t, []string{a.addr(), a.addr(), a.addr()}, served(t, lb, 3),
+		"Connections should go to the first server.")
+
+	a.ln.Close()
+	assert.Equal(t, []string{b.addr(), b.addr()}, served(t, lb, 2),
+		"Connections should fail over to the next server.")
+	assert.Equal(t, []string{b.addr()}, lb.Healthy())
+
+	// the server recovers on the same address
+	ln, err := net.Listen("tcp", a.addr())
+	if err != nil {
+		t.Skipf("failed to listen on %s again: %v", a.addr(), err)
+	}
+	a.ln = ln
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintln(conn, ln.Addr().String())
+			conn.Close()
+		}
+	}()
+	assert.Eventually(t, func() bool {
+		return len(lb.Healthy()) == 2
+	}, 5*time.Second, 10*time.Millisecond, "Recovered servers should be healthy again.")
+	assert.Equal(t, []string{a.addr()}, served(t, lb, 1), "Connections should go back to the first server.")
+}
+
+func TestHealthCheck(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, b := newBackend(t), newBackend(t)
+	defer a.ln.Close()
+	defer b.ln.Close()
+
+	mu := sync.Mutex{}
+	down := map[string]bool{a.addr(): true}
+	lb := loadbalancer.New("127.0.0.1:0", []string{a.addr(), b.addr()})
+	lb.HealthInterval = 10 * time.Millisecond
+	lb.HealthCheck = func(ctx context.Context, server string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if down[server] {
+			return errors.New("down")
+		}
+		return nil
+	}
+	if err := lb.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{b.addr()}, lb.Healthy(), "Servers should be checked before serving.")
+	assert.Equal(t, []string{b.addr(), b.addr()}, served(t, lb, 2))
+
+	mu.Lock()
+	down = map[string]bool{b.addr(): true}
+	mu.Unlock()
+	assert.Eventually(t, func() bool {
+		h := lb.Healthy()
+		return len(h) == 1 && h[0] == a.addr()
+	}, 5*time.Second, 10*time.Millisecond, "Servers should be checked periodically.")
+
+	mu.Lock()
+	down = map[string]bool{a.addr(): true, b.addr(): true}
+	mu.Unlock()
+	assert.Eventually(t, func() bool {
+		return len(lb.Healthy()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NotContains(t, served(t, lb, 2), "", "Unhealthy servers should still be tried if none is healthy.")
+}
+
+func TestSetServers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, b := newBackend(t), newBackend(t)
+	defer a.ln.Close()
+	defer b.ln.Close()
+	lb := startLB(t, ctx, loadbalancer.Failover, a.addr())
+
+	conn, name := connect(t, lb)
+	defer conn.Close()
+	assert.Equal(t, a.addr(), name)
+
+	assert.False(t, lb.SetServers([]string{a.addr(), a.addr()}), "Duplicated servers should be ignored.")
+	assert.True(t, lb.SetServers([]string{b.addr()}))
+	assert.Equal(t, []string{b.addr()}, lb.Servers())
+
+	_, err := conn.Read(make([]byte, 1))
+	assert.NotNil(t, err, "Connections to removed servers should be closed.")
+	assert.Equal(t, []string{b.addr()}, served(t, lb, 1))
+}
+
+func TestWatchEndpoints(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := [][]string{{"10.0.0.1:6443"}, {}, nil, {"10.0.0.1:6443", "10.0.0.2:6443"}}
+	calls := 0
+	fetch := func(ctx context.Context) ([]string, error) {
+		defer func() { calls++ }()
+		if calls >= len(results) {
+			cancel()
+			return nil, ctx.Err()
+		}
+		if results[calls] == nil {
+			return nil, errors.New("unavailable")
+		}
+		return results[calls], nil
+	}
+	changes := [][]string{}
+
+	lb := loadbalancer.New("127.0.0.1:0", []string{"192.168.0.10:6443"})
+	lb.WatchEndpoints(ctx, fetch, time.Millisecond, func(servers []string) {
+		changes = append(changes, servers)
+	})
+	assert.Equal(t, [][]string{{"10.0.0.1:6443"}, {"10.0.0.1:6443", "10.0.0.2:6443"}}, changes,
+		"Servers should be updated unless the endpoints are empty or failed to read.")
+	assert.Equal(t, []string{"10.0.0.1:6443", "10.0.0.2:6443"}, lb.Servers())
+}
+
+func TestKubernetesEndpoints(t *testing.T) {
+	ca, err := pki.NewCA("kubernetes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serving, err := ca.Issue(&pki.CertConfig{
+		CommonName: "kube-apiserver",
+		IPs:        []net.IP{net.ParseIP("127.0.0.1")},
+		Usages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/default/endpoints/kubernetes" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"subsets": [{"addresses": [{"ip": "192.168.0.11"}, {"ip": "192.168.0.10"}],
+			"ports": [{"name": "https", "port": 6443}, {"name": "other", "port": 8080}]}]}`)
+	}))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serving.TLSCertificate()},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	kc, err := kubeconfig.New(ca, &kubeconfig.Options{ClusterName: "cks", Server: ts.URL, User: "system:node:node-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetch, err := loadbalancer.KubernetesEndpoints(kc, ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, err := fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"192.168.0.10:6443", "192.168.0.11:6443"}, servers)
+}
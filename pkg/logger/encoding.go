@@ -0,0 +1,263 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/buffer"
+	"go.uber.org/zap/zapcore"
+)
+
+// supported encodings of logs
+const (
+	// EncodingConsole is the human readable encoding of zap
+	EncodingConsole string = "console"
+	// EncodingJSON writes an object per line
+	EncodingJSON string = "json"
+	// EncodingLogfmt writes key=value pairs per line
+	EncodingLogfmt string = "logfmt"
+)
+
+// mapping from string to zap time encoder,
+// update this map when new format is added
+var timeFormatMap map[string]zapcore.TimeEncoder = map[string]zapcore.TimeEncoder{
+	"iso8601":     zapcore.ISO8601TimeEncoder,
+	"rfc3339":     zapcore.RFC3339TimeEncoder,
+	"rfc3339nano": zapcore.RFC3339NanoTimeEncoder,
+	"epoch":       zapcore.EpochTimeEncoder,
+	"millis":      zapcore.EpochMillisTimeEncoder,
+	"nanos":       zapcore.EpochNanosTimeEncoder,
+}
+
+// mapping from string to zap level encoder,
+// update this map when new format is added
+var levelFormatMap map[string]zapcore.LevelEncoder = map[string]zapcore.LevelEncoder{
+	"lower":       zapcore.LowercaseLevelEncoder,
+	"upper":       zapcore.CapitalLevelEncoder,
+	"lower-color": zapcore.LowercaseColorLevelEncoder,
+	"upper-color": zapcore.CapitalColorLevelEncoder,
+}
+
+// PrintAvailLogEncoding returns a string listing all supported encodings
+// seperated by comma, e.g. "console", "json", ...
+func PrintAvailLogEncoding() string {
+	return quoteJoin([]string{EncodingConsole, EncodingJSON, EncodingLogfmt})
+}
+
+// PrintAvailLogTimeFormat returns a string listing all supported time formats
+// seperated by comma, e.g. "epoch", "iso8601", ...
+func PrintAvailLogTimeFormat() string {
+	names := []string{}
+	for k := range timeFormatMap {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return quoteJoin(names)
+}
+
+// PrintAvailLogLevelFormat returns a string listing all supported level formats
+// seperated by comma, e.g. "lower", "lower-color", ...
+func PrintAvailLogLevelFormat() string {
+	names := []string{}
+	for k := range levelFormatMap {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return quoteJoin(names)
+}
+
+func quoteJoin(names []string) string {
+	quoted := make([]string, 0, len(names))
+	for _, n := range names {
+		quoted = append(quoted, strconv.Quote(n))
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func init() {
+	if err := zap.RegisterEncoder(EncodingLogfmt, func(cfg zapcore.EncoderConfig) (zapcore.Encoder, error) {
+		return newLogfmtEncoder(cfg), nil
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// newEncoder returns the encoder of the encoding,
+// where levels are in lower case for encodings other than console
+// unless levelFormatted is true
+func newEncoder(encoding string, cfg zapcore.EncoderConfig, levelFormatted bool) (zapcore.Encoder, error) {
+	if encoding != EncodingConsole && !levelFormatted {
+		cfg.EncodeLevel = zapcore.LowercaseLevelEncoder
+	}
+	switch encoding {
+	case EncodingConsole:
+		return zapcore.NewConsoleEncoder(cfg), nil
+	case EncodingJSON:
+		return zapcore.NewJSONEncoder(cfg), nil
+	case EncodingLogfmt:
+		return newLogfmtEncoder(cfg), nil
+	}
+	return nil, errors.Errorf("unsupported log encoding: %s, only support %s", encoding, PrintAvailLogEncoding())
+}
+
+var logfmtPool = buffer.NewPool()
+
+// logfmtEncoder writes an entry as key=value pairs in a line, where fields
+// are sorted by keys and fields in namespaces are prefixed by the namespaces
+type logfmtEncoder struct {
+	*zapcore.MapObjectEncoder
+	cfg zapcore.EncoderConfig
+}
+
+func newLogfmtEncoder(cfg zapcore.EncoderConfig) *logfmtEncoder {
+	return &logfmtEncoder{MapObjectEncoder: zapcore.NewMapObjectEncoder(), cfg: cfg}
+}
+
+// Clone copies the fields added to the encoder
+func (enc *logfmtEncoder) Clone() zapcore.Encoder {
+	clone := newLogfmtEncoder(enc.cfg)
+	for k, v := range enc.Fields {
+		clone.Fields[k] = v
+	}
+	return clone
+}
+
+// EncodeEntry writes the entry with the time, level, logger name, caller and message
+// followed by the fields and the stack trace
+func (enc *logfmtEncoder) EncodeEntry(ent zapcore.Entry, fields []zapcore.Field) (*buffer.Buffer, error) {
+	buf := logfmtPool.Get()
+
+	if enc.cfg.TimeKey != "" && enc.cfg.EncodeTime != nil {
+		enc.appendPair(buf, enc.cfg.TimeKey, primitive(func(ae zapcore.PrimitiveArrayEncoder) {
+			enc.cfg.EncodeTime(ent.Time, ae)
+		}))
+	}
+	if enc.cfg.LevelKey != "" && enc.cfg.EncodeLevel != nil {
+		enc.appendPair(buf, enc.cfg.LevelKey, primitive(func(ae zapcore.PrimitiveArrayEncoder) {
+			enc.cfg.EncodeLevel(ent.Level, ae)
+		}))
+	}
+	if enc.cfg.NameKey != "" && ent.LoggerName != "" {
+		enc.appendPair(buf, enc.cfg.NameKey, ent.LoggerName)
+	}
+	if enc.cfg.CallerKey != "" && ent.Caller.Defined && enc.cfg.EncodeCaller != nil {
+		enc.appendPair(buf, enc.cfg.CallerKey, primitive(func(ae zapcore.PrimitiveArrayEncoder) {
+			enc.cfg.EncodeCaller(ent.Caller, ae)
+		}))
+	}
+	if enc.cfg.MessageKey != "" {
+		enc.appendPair(buf, enc.cfg.MessageKey, ent.Message)
+	}
+
+	m := zapcore.NewMapObjectEncoder()
+	for k, v := range enc.Fields {
+		m.Fields[k] = v
+	}
+	for _, f := range fields {
+		f.AddTo(m)
+	}
+	enc.appendFields(buf, "", m.Fields)
+
+	if enc.cfg.StacktraceKey != "" && ent.Stack != "" {
+		enc.appendPair(buf, enc.cfg.StacktraceKey, ent.Stack)
+	}
+
+	if enc.cfg.LineEnding != "" {
+		buf.AppendString(enc.cfg.LineEnding)
+	} else {
+		buf.AppendString(zapcore.DefaultLineEnding)
+	}
+	return buf, nil
+}
+
+func (enc *logfmtEncoder) appendFields(buf *buffer.Buffer, prefix string, fields map[string]interface{}) {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		// a namespace is a nested map in the fields
+		if ns, ok := fields[k].(map[string]interface{}); ok {
+			enc.appendFields(buf, prefix+k+".", ns)
+			continue
+		}
+		enc.appendPair(buf, prefix+k, fields[k])
+	}
+}
+
+func (enc *logfmtEncoder) appendPair(buf *buffer.Buffer, key string, value interface{}) {
+	if buf.Len() > 0 {
+		buf.AppendByte(' ')
+	}
+	buf.AppendString(key)
+	buf.AppendByte('=')
+	buf.AppendString(quoteLogfmt(enc.format(value)))
+}
+
+func (enc *logfmtEncoder) format(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case time.Time:
+		if enc.cfg.EncodeTime != nil {
+			return enc.format(primitive(func(ae zapcore.PrimitiveArrayEncoder) { enc.cfg.EncodeTime(v, ae) }))
+		}
+		return v.Format(time.RFC3339Nano)
+	case []interface{}, map[string]interface{}:
+		if b, err := json.Marshal(v); err == nil {
+			return string(b)
+		}
+	}
+	return fmt.Sprint(value)
+}
+
+// primitive returns the value appended by the zapcore encoding function
+func primitive(f func(zapcore.PrimitiveArrayEncoder)) interface{} {
+	m := zapcore.NewMapObjectEncoder()
+	_ = m.AddArray("v", zapcore.ArrayMarshalerFunc(func(ae zapcore.ArrayEncoder) error {
+		f(ae)
+		return nil
+	}))
+	if vs, ok := m.Fields["v"].([]interface{}); ok && len(vs) > 0 {
+		return vs[0]
+	}
+	return nil
+}
+
+// quoteLogfmt quotes the value if it's empty or has spaces, quotes,
+// equal signs or non-printable characters
+func quoteLogfmt(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if r == '"' || r == '=' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
@@ -0,0 +1,304 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package logger
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// levelRegistry keeps the global level and the levels of components
+// of the logger built by InitLogger, which are changeable at runtime.
+// A component is a logger name, where a name without its own level
+// follows its parent, e.g. etcd.client follows etcd
+type levelRegistry struct {
+	global  zap.AtomicLevel
+	initial zapcore.Level
+
+	// mu guards initialComponents and serializes changes of components,
+	// which is a copy-on-write map[string]zapcore.Level
+	mu                sync.Mutex
+	initialComponents map[string]zapcore.Level
+	components        atomic.Value
+}
+
+func newLevelRegistry(global zap.AtomicLevel, components map[string]zapcore.Level) *levelRegistry {
+	r := &levelRegistry{global: global, initial: global.Level(), initialComponents: components}
+	r.components.Store(copyLevels(components))
+	return r
+}
+
+func copyLevels(m map[string]zapcore.Level) map[string]zapcore.Level {
+	c := make(map[string]zapcore.Level, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func (r *levelRegistry) componentLevels() map[string]zapcore.Level {
+	return r.components.Load().(map[string]zapcore.Level)
+}
+
+// levelOf returns the level of the logger name, which falls back
+// to its parents and then the global level
+func (r *levelRegistry) levelOf(name string) zapcore.Level {
+	comps := r.componentLevels()
+	for name != "" {
+		if l, ok := comps[name]; ok {
+			return l
+		}
+		i := strings.LastIndex(name, ".")
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+	return r.global.Level()
+}
+
+// minEnabled tells whether the level is enabled for any component
+func (r *levelRegistry) minEnabled(l zapcore.Level) bool {
+	if r.global.Enabled(l) {
+		return true
+	}
+	for _, v := range r.componentLevels() {
+		if v.Enabled(l) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *levelRegistry) setComponent(name string, l *zapcore.Level) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	comps := copyLevels(r.componentLevels())
+	if l == nil {
+		delete(comps, name)
+	} else {
+		comps[name] = *l
+	}
+	r.components.Store(comps)
+}
+
+func (r *levelRegistry) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.global.SetLevel(r.initial)
+	r.components.Store(copyLevels(r.initialComponents))
+}
+
+func (r *levelRegistry) resetComponent(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	comps := copyLevels(r.componentLevels())
+	if l, ok := r.initialComponents[name]; ok {
+		comps[name] = l
+	} else {
+		delete(comps, name)
+	}
+	r.components.Store(comps)
+}
+
+// setInitialComponents replaces the levels of components given at start,
+// where components changed at runtime are restored as well
+func (r *levelRegistry) setInitialComponents(m map[string]zapcore.Level) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	comps := copyLevels(r.componentLevels())
+	for k := range r.initialComponents {
+		delete(comps, k)
+	}
+	for k, v := range m {
+		comps[k] = v
+	}
+	r.initialComponents = copyLevels(m)
+	r.components.Store(comps)
+}
+
+// componentCore checks entries against the levels of their components,
+// which wraps a core of a sink without its own level
+type componentCore struct {
+	zapcore.Core
+	levels *levelRegistry
+}
+
+func (c *componentCore) Enabled(l zapcore.Level) bool {
+	return c.levels.minEnabled(l)
+}
+
+func (c *componentCore) With(fields []zapcore.Field) zapcore.Core {
+	return &componentCore{Core: c.Core.With(fields), levels: c.levels}
+}
+
+func (c *componentCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.levels.levelOf(ent.LoggerName).Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+// levels of the logger built by the last InitLogger
+var (
+	levelsMu sync.RWMutex
+	levels   *levelRegistry
+)
+
+func swapLevels(r *levelRegistry) *levelRegistry {
+	levelsMu.Lock()
+	defer levelsMu.Unlock()
+	prev := levels
+	levels = r
+	return prev
+}
+
+func currentLevels() (*levelRegistry, error) {
+	levelsMu.RLock()
+	defer levelsMu.RUnlock()
+	if levels == nil {
+		return nil, errors.New("logger is not initialized by InitLogger")
+	}
+	return levels, nil
+}
+
+func parseLevel(lvl string) (zapcore.Level, error) {
+	if l, ok := logLevelMap[lvl]; ok {
+		return l, nil
+	}
+	return zapcore.InfoLevel, errors.Errorf("unsupported log level: %s, only support %s", lvl, PrintAvailLogLevel())
+}
+
+// AtomicLevel returns the global level of the logger built by InitLogger,
+// changing which changes the level of all the sinks without their own levels
+func AtomicLevel() (zap.AtomicLevel, error) {
+	r, err := currentLevels()
+	if err != nil {
+		return zap.AtomicLevel{}, err
+	}
+	return r.global, nil
+}
+
+// GetLevel returns the level in effect for the component,
+// or the global level if component is empty
+func GetLevel(component string) (string, error) {
+	r, err := currentLevels()
+	if err != nil {
+		return "", err
+	}
+	return r.levelOf(component).String(), nil
+}
+
+// SetLevel changes the level of the component at runtime,
+// or the global level if component is empty
+func SetLevel(component, lvl string) error {
+	r, err := currentLevels()
+	if err != nil {
+		return err
+	}
+	l, err := parseLevel(lvl)
+	if err != nil {
+		return err
+	}
+	if component == "" {
+		r.global.SetLevel(l)
+		return nil
+	}
+	r.setComponent(component, &l)
+	return nil
+}
+
+// ResetLevel restores the level of the component given to InitLogger,
+// or all the levels if component is empty
+func ResetLevel(component string) error {
+	r, err := currentLevels()
+	if err != nil {
+		return err
+	}
+	if component == "" {
+		r.reset()
+		return nil
+	}
+	r.resetComponent(component)
+	return nil
+}
+
+// SetComponentLevels replaces the levels of components given at start,
+// e.g. by the cluster config, which are restored by ResetLevel as well
+func SetComponentLevels(levels map[string]string) error {
+	r, err := currentLevels()
+	if err != nil {
+		return err
+	}
+	m := make(map[string]zapcore.Level, len(levels))
+	for c, lvl := range levels {
+		l, err := parseLevel(lvl)
+		if err != nil {
+			return errors.Wrapf(err, "invalid log level of component %s", c)
+		}
+		m[c] = l
+	}
+	r.setInitialComponents(m)
+	return nil
+}
+
+// ComponentLevels returns levels of the components having their own levels
+func ComponentLevels() (map[string]string, error) {
+	r, err := currentLevels()
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]string{}
+	for k, v := range r.componentLevels() {
+		m[k] = v.String()
+	}
+	return m, nil
+}
+
+// StepLevel makes the global level more verbose by one step if verbose is true,
+// otherwise less verbose, e.g. from info to debug, and returns the new level.
+// The level stays at the ends, i.e. debug and panic
+func StepLevel(verbose bool) (string, error) {
+	r, err := currentLevels()
+	if err != nil {
+		return "", err
+	}
+	steps := make([]zapcore.Level, 0, len(logLevelMap))
+	for _, l := range logLevelMap {
+		steps = append(steps, l)
+	}
+	sort.Slice(steps, func(i, j int) bool { return steps[i] < steps[j] })
+
+	cur := r.global.Level()
+	i := sort.Search(len(steps), func(i int) bool { return steps[i] >= cur })
+	switch {
+	case verbose && i > 0:
+		i--
+	case !verbose && i < len(steps)-1:
+		i++
+	}
+	if i >= len(steps) {
+		i = len(steps) - 1
+	}
+	r.global.SetLevel(steps[i])
+	return steps[i].String(), nil
+}
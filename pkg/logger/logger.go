@@ -17,6 +17,7 @@ package logger
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
@@ -42,35 +43,80 @@ func InitLogger(options ...LogOption) (func(), *zap.Config, error) {
 	// see Error function below for details
 	cfg.DisableStacktrace = true
 
+	// use keys of the production config which are expected by log shipping,
+	// keys are not printed in console encoding anyway
+	prod := zap.NewProductionEncoderConfig()
+	cfg.EncoderConfig.TimeKey = prod.TimeKey
+	cfg.EncoderConfig.LevelKey = prod.LevelKey
+	cfg.EncoderConfig.NameKey = prod.NameKey
+	cfg.EncoderConfig.CallerKey = prod.CallerKey
+	cfg.EncoderConfig.MessageKey = prod.MessageKey
+	cfg.EncoderConfig.StacktraceKey = prod.StacktraceKey
+
 	opts, bitmap := tidyOptsAndCalBitmap(options)
 
-	// apply options
-	for _, v := range opts {
-		if err := v.ConfigLogger(bitmap, &cfg); err != nil {
+	// apply options in order of their types, so that
+	// options depending on others always apply later
+	for _, t := range sortedOptTypes(opts) {
+		if err := opts[t].ConfigLogger(bitmap, &cfg); err != nil {
 			return nil, nil, errors.Wrap(err, "failed to apply options")
 		}
 	}
 
-	logger, err := cfg.Build(zap.WithCaller(true), zap.AddCallerSkip(1))
+	// each output path is a sink with its own encoding and level
+	sinks := make([]*sink, 0, len(cfg.OutputPaths))
+	for _, p := range cfg.OutputPaths {
+		sinks = append(sinks, &sink{path: p, encoding: cfg.Encoding})
+	}
+	for _, t := range sortedOptTypes(opts) {
+		if so, ok := opts[t].(sinkOption); ok {
+			var err error
+			if sinks, err = so.configSinks(bitmap, &cfg, sinks); err != nil {
+				return nil, nil, errors.Wrap(err, "failed to apply options")
+			}
+		}
+	}
+
+	levels := newLevelRegistry(cfg.Level, nil)
+	logger, err := build(&cfg, sinks, levels, bitmap&LogLevelFormatOpt != 0, zap.WithCaller(true), zap.AddCallerSkip(1))
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "failed to build global logger")
 	}
 
-	return zap.ReplaceGlobals(logger), &cfg, nil
+	// levels are kept to be changed at runtime, see SetLevel
+	prev := swapLevels(levels)
+	undo := zap.ReplaceGlobals(logger)
+	return func() {
+		undo()
+		swapLevels(prev)
+	}, &cfg, nil
 }
 
-// if same options are provided, make sure only the last one takes effect
+// if same options are provided, make sure only the last one takes effect,
+// unless the options are merged, e.g. sinks of different paths are all kept.
 // also bitmap is calculated
 func tidyOptsAndCalBitmap(opts []LogOption) (map[LogOptionType]LogOption, LogOptionType) {
 	result := map[LogOptionType]LogOption{}
 	bitmap := LogOptionType(0)
 	for _, opt := range opts {
+		if prev, ok := result[opt.OptType()].(mergeableOption); ok {
+			opt = prev.merge(opt)
+		}
 		result[opt.OptType()] = opt
 		bitmap = bitmap | opt.OptType()
 	}
 	return result, bitmap
 }
 
+func sortedOptTypes(opts map[LogOptionType]LogOption) []LogOptionType {
+	types := make([]LogOptionType, 0, len(opts))
+	for t := range opts {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
 // StructuredLogger is an interface wraps the zap logger
 type StructuredLogger interface {
 	Sync() error
@@ -90,6 +136,16 @@ func GetGlobalStructuredLogger() StructuredLogger {
 	return &wrapLogger{logger: zap.L()}
 }
 
+// NamedStructured returns a wrapped global zap logger of the component,
+// which logs with the component field and follows the level of the component
+func NamedStructured(component string) StructuredLogger {
+	return &wrapLogger{logger: named(component)}
+}
+
+func named(component string) *zap.Logger {
+	return zap.L().Named(component).With(zap.String("component", component))
+}
+
 // Sync is wrapped sync of zap logger
 func (w *wrapLogger) Sync() error {
 	return w.logger.Sync()
@@ -165,6 +221,7 @@ type SugaredLogger interface {
 	Debugf(string, ...interface{})
 	Panicf(string, ...interface{})
 	UnwrappedStackErrorf(error, string, ...interface{})
+	With(...interface{}) SugaredLogger
 }
 
 type wrapSugaredLogger struct {
@@ -176,6 +233,12 @@ func GetGlobalLogger() SugaredLogger {
 	return &wrapSugaredLogger{logger: zap.S()}
 }
 
+// Named returns a wrapped global zap sugared logger of the component,
+// which logs with the component field and follows the level of the component
+func Named(component string) SugaredLogger {
+	return &wrapSugaredLogger{logger: named(component).Sugar()}
+}
+
 // Sync wraps up the Sync of zap.SugaredLogger
 func (w *wrapSugaredLogger) Sync() error {
 	return w.logger.Sync()
@@ -223,7 +286,7 @@ func (w *wrapSugaredLogger) Errorf(template string, args ...interface{}) {
 
 // Debugf wraps up the Debugf of zap.SugaredLogger
 func (w *wrapSugaredLogger) Debugf(template string, args ...interface{}) {
-	w.logger.Infof(template, args...)
+	w.logger.Debugf(template, args...)
 }
 
 // Panicf wraps up the Panicf of zap.SugaredLogger
@@ -231,6 +294,12 @@ func (w *wrapSugaredLogger) Panicf(template string, args ...interface{}) {
 	w.logger.Panicf(template, args...)
 }
 
+// With wraps up the With of zap.SugaredLogger,
+// which returns a logger with the key-value pairs added as fields
+func (w *wrapSugaredLogger) With(args ...interface{}) SugaredLogger {
+	return &wrapSugaredLogger{logger: w.logger.With(args...)}
+}
+
 // UnwrappedStackErrorf wraps up the Errorf of zap.SugaredLogger by unwrapping
 // the input error and output the stack trace info of the unwrapped error.
 // Note that user should not use "%+v" to print out any detailed information of any errors
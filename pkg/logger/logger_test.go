@@ -1,8 +1,15 @@
 package logger_test
 
 import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
@@ -138,3 +145,419 @@ func TestMultiOutputPath(t *testing.T) {
 	assert.Equal(t, []string{"stdout", filePathB}, cfg.OutputPaths, "The file path of last option "+
 		"should be in output path.")
 }
+
+func TestLogStream(t *testing.T) {
+	enableLogFileOpt, er := lgr.NewEnableLogFileOption()
+	if er != nil {
+		t.Fatal(er)
+	}
+	logFilePathOptA, er := lgr.NewLogFilePathOption(filePathA)
+	if er != nil {
+		t.Fatal(er)
+	}
+	logStreamOpt, er := lgr.NewLogStreamOption("stderr")
+	if er != nil {
+		t.Fatal(er)
+	}
+
+	undo, cfg, er := lgr.InitLogger(logStreamOpt, enableLogFileOpt, logFilePathOptA)
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer clean(undo)
+
+	assert.Equal(t, []string{"stderr", filePathA}, cfg.OutputPaths, "Stderr should replace stdout "+
+		"in output path.")
+
+	_, er = lgr.NewLogStreamOption(filePathA)
+	assert.Error(t, er, "Only stdout and stderr should be valid log streams.")
+}
+
+func TestLogFileRotation(t *testing.T) {
+	dir, er := ioutil.TempDir("", "cks-logger")
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "eke.log")
+
+	// keep the logs written to stdout out of the test output
+	stdout := os.Stdout
+	if os.Stdout, er = os.OpenFile(os.DevNull, os.O_WRONLY, 0); er != nil {
+		t.Fatal(er)
+	}
+	defer func() { os.Stdout = stdout }()
+
+	opts := []lgr.LogOption{}
+	for _, f := range []func() (lgr.LogOption, error){
+		lgr.NewEnableLogFileOption,
+		func() (lgr.LogOption, error) { return lgr.NewLogFilePathOption(logPath) },
+		func() (lgr.LogOption, error) { return lgr.NewLogFileMaxSizeOption(1) },
+		func() (lgr.LogOption, error) { return lgr.NewLogFileMaxBackupsOption(1) },
+		lgr.NewLogFileCompressOption,
+	} {
+		opt, er := f()
+		if er != nil {
+			t.Fatal(er)
+		}
+		opts = append(opts, opt)
+	}
+
+	// rotation options are given before the file path on purpose
+	undo, cfg, er := lgr.InitLogger(append(opts[2:], opts[:2]...)...)
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer undo()
+	assert.Equal(t, []string{"stdout", "rotate://" + logPath + "?compress=true&maxbackups=1&maxsize=1"},
+		cfg.OutputPaths, "File path should be rotated with all the rotation options.")
+
+	// 3MB of logs rotate the file at least twice
+	msg := strings.Repeat("x", 1024)
+	for i := 0; i < 3*1024; i++ {
+		zap.L().Info(msg)
+	}
+
+	// rotated files are compressed and removed in background
+	var backups []string
+	for i := 0; i < 50; i++ {
+		if backups, er = filepath.Glob(filepath.Join(dir, "eke-*")); er != nil {
+			t.Fatal(er)
+		}
+		if len(backups) == 1 && strings.HasSuffix(backups[0], ".log.gz") {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Len(t, backups, 1, "Only the latest rotated file should be kept.")
+	for _, b := range backups {
+		assert.True(t, strings.HasSuffix(b, ".log.gz"), "Rotated file %s should be compressed.", b)
+	}
+
+	info, er := os.Stat(logPath)
+	if er != nil {
+		t.Fatal(er)
+	}
+	assert.True(t, info.Size() <= 1024*1024, "Log file should be rotated before exceeding max size.")
+}
+
+func TestInvalidLogFileRotation(t *testing.T) {
+	_, er := lgr.NewLogFileMaxSizeOption(0)
+	assert.NotNil(t, er, "Max size should be positive.")
+	_, er = lgr.NewLogFileMaxAgeOption(-1)
+	assert.NotNil(t, er, "Max age should not be negative.")
+	_, er = lgr.NewLogFileMaxBackupsOption(-1)
+	assert.NotNil(t, er, "Max backups should not be negative.")
+}
+
+func initLoggerWithOptions(t *testing.T, fs ...func() (lgr.LogOption, error)) func() {
+	opts := []lgr.LogOption{}
+	for _, f := range fs {
+		opt, er := f()
+		if er != nil {
+			t.Fatal(er)
+		}
+		opts = append(opts, opt)
+	}
+	undo, _, er := lgr.InitLogger(opts...)
+	if er != nil {
+		t.Fatal(er)
+	}
+	return undo
+}
+
+func TestLogEncoding(t *testing.T) {
+	dir, er := ioutil.TempDir("", "cks-logger")
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "eke.log")
+	stdoutPath := filepath.Join(dir, "stdout")
+
+	// capture logs written to stdout
+	stdout := os.Stdout
+	if os.Stdout, er = os.Create(stdoutPath); er != nil {
+		t.Fatal(er)
+	}
+	defer func() { os.Stdout = stdout }()
+
+	undo := initLoggerWithOptions(t,
+		lgr.NewEnableLogFileOption,
+		func() (lgr.LogOption, error) { return lgr.NewLogFilePathOption(logPath) },
+		func() (lgr.LogOption, error) { return lgr.NewLogEncodingOption("console") },
+		func() (lgr.LogOption, error) { return lgr.NewLogFileEncodingOption("json") },
+	)
+	lgr.GetGlobalStructuredLogger().Info("hello", map[string]string{"node": "node-a"})
+	undo()
+
+	out, er := ioutil.ReadFile(stdoutPath)
+	if er != nil {
+		t.Fatal(er)
+	}
+	assert.Contains(t, string(out), "\tINFO\t", "Stdout should be in console encoding with upper case levels.")
+	assert.Contains(t, string(out), `{"node": "node-a"}`)
+
+	data, er := ioutil.ReadFile(logPath)
+	if er != nil {
+		t.Fatal(er)
+	}
+	entry := map[string]interface{}{}
+	if er := json.Unmarshal(data, &entry); er != nil {
+		t.Fatalf("Log file should be in json encoding but get %s", data)
+	}
+	assert.Equal(t, "info", entry["level"], "Levels should be in lower case in json encoding.")
+	assert.Equal(t, "hello", entry["msg"])
+	assert.Equal(t, "node-a", entry["node"])
+	assert.Contains(t, entry, "ts")
+	assert.Contains(t, entry, "caller")
+}
+
+func TestLogfmtEncoding(t *testing.T) {
+	dir, er := ioutil.TempDir("", "cks-logger")
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "eke.log")
+
+	stdout := os.Stdout
+	if os.Stdout, er = os.OpenFile(os.DevNull, os.O_WRONLY, 0); er != nil {
+		t.Fatal(er)
+	}
+	defer func() { os.Stdout = stdout }()
+
+	undo := initLoggerWithOptions(t,
+		lgr.NewEnableLogFileOption,
+		func() (lgr.LogOption, error) { return lgr.NewLogFilePathOption(logPath) },
+		func() (lgr.LogOption, error) { return lgr.NewLogFileEncodingOption("logfmt") },
+		func() (lgr.LogOption, error) { return lgr.NewLogTimeFormatOption("rfc3339") },
+		func() (lgr.LogOption, error) { return lgr.NewLogLevelFormatOption("upper") },
+	)
+	zap.L().Warn("disk is almost full", zap.String("path", "/var/lib/cks"), zap.String("used", "95 %"),
+		zap.Namespace("disk"), zap.Int("free", 5))
+	undo()
+
+	data, er := ioutil.ReadFile(logPath)
+	if er != nil {
+		t.Fatal(er)
+	}
+	line := string(data)
+	assert.Regexp(t, `^ts=\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(Z|[+-]\d{2}:\d{2}) level=WARN caller=\S+ `, line,
+		"Time should be in rfc3339 and level in upper case.")
+	assert.True(t, strings.HasSuffix(line, ` msg="disk is almost full" disk.free=5 path=/var/lib/cks used="95 %"`+"\n"),
+		"Fields should be sorted and quoted if necessary but get %s", line)
+}
+
+func TestInvalidLogEncoding(t *testing.T) {
+	_, er := lgr.NewLogEncodingOption("xml")
+	assert.NotNil(t, er, "Unknown encoding should be rejected.")
+	_, er = lgr.NewLogFileEncodingOption("xml")
+	assert.NotNil(t, er, "Unknown encoding should be rejected.")
+	_, er = lgr.NewLogTimeFormatOption("unix")
+	assert.NotNil(t, er, "Unknown time format should be rejected.")
+	_, er = lgr.NewLogLevelFormatOption("title")
+	assert.NotNil(t, er, "Unknown level format should be rejected.")
+}
+
+func TestLogSinks(t *testing.T) {
+	dir, er := ioutil.TempDir("", "cks-logger")
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "eke.log")
+	debugPath := filepath.Join(dir, "debug.log")
+	stdoutPath := filepath.Join(dir, "stdout")
+
+	stdout := os.Stdout
+	if os.Stdout, er = os.Create(stdoutPath); er != nil {
+		t.Fatal(er)
+	}
+	defer func() { os.Stdout = stdout }()
+
+	undo := initLoggerWithOptions(t,
+		func() (lgr.LogOption, error) { return lgr.NewLogLevelOption("info") },
+		lgr.NewEnableLogFileOption,
+		func() (lgr.LogOption, error) { return lgr.NewLogFilePathOption(logPath) },
+		func() (lgr.LogOption, error) { return lgr.NewLogFileMaxSizeOption(10) },
+		func() (lgr.LogOption, error) { return lgr.NewLogSinkOption("path=" + debugPath + ",level=error") },
+		func() (lgr.LogOption, error) { return lgr.NewLogSinkOption("path=stdout,level=warn,format=json") },
+		// the log file is the same sink even if it's rotated
+		func() (lgr.LogOption, error) { return lgr.NewLogSinkOption("path=" + logPath + ",format=logfmt") },
+		// the later sink of the same path takes effect
+		func() (lgr.LogOption, error) { return lgr.NewLogSinkOption("path=" + debugPath + ",level=debug") },
+	)
+	zap.L().Debug("debug msg")
+	zap.L().Info("info msg")
+	zap.L().Warn("warn msg")
+	undo()
+
+	read := func(p string) string {
+		data, er := ioutil.ReadFile(p)
+		if er != nil {
+			t.Fatal(er)
+		}
+		return string(data)
+	}
+
+	out := read(stdoutPath)
+	assert.Equal(t, 1, strings.Count(out, " msg"), "Only warn msg should be written to stdout.")
+	assert.Contains(t, out, `"msg":"warn msg"`, "Stdout should be in json encoding.")
+
+	log := read(logPath)
+	assert.Equal(t, 2, strings.Count(log, "\n"), "Log file should be at the global level.")
+	assert.Contains(t, log, `msg="info msg"`, "Log file should be in logfmt encoding.")
+
+	debug := read(debugPath)
+	assert.Equal(t, 3, strings.Count(debug, "\n"), "Later sink of the same path should take effect.")
+	assert.Contains(t, debug, "\tDEBUG\t", "Sink without format should be in the global encoding.")
+}
+
+func TestInvalidLogSink(t *testing.T) {
+	for _, spec := range []string{
+		"level=debug",
+		"path=stdout,level=trace",
+		"path=stdout,format=xml",
+		"path=stdout,color=true",
+		"path=stdout,json",
+	} {
+		_, er := lgr.NewLogSinkOption(spec)
+		assert.NotNil(t, er, "Sink %s should be invalid.", spec)
+	}
+}
+
+func TestRuntimeLevel(t *testing.T) {
+	undo := initLoggerWithOptions(t, func() (lgr.LogOption, error) { return lgr.NewLogLevelOption("info") })
+	defer undo()
+
+	etcd := zap.L().Named("etcd")
+	assert.Nil(t, etcd.Check(zapcore.DebugLevel, "msg"), "Component should follow the global level.")
+
+	if er := lgr.SetLevel("etcd", "debug"); er != nil {
+		t.Fatal(er)
+	}
+	assert.NotNil(t, etcd.Check(zapcore.DebugLevel, "msg"), "Component level should take effect.")
+	assert.NotNil(t, etcd.Named("client").Check(zapcore.DebugLevel, "msg"), "Child should follow its parent.")
+	assert.Nil(t, zap.L().Check(zapcore.DebugLevel, "msg"), "Global level should be unchanged.")
+
+	lvl, er := lgr.StepLevel(false)
+	if er != nil {
+		t.Fatal(er)
+	}
+	assert.Equal(t, "warn", lvl)
+	assert.Nil(t, zap.L().Check(zapcore.InfoLevel, "msg"), "Global level should be less verbose.")
+
+	atomic, er := lgr.AtomicLevel()
+	if er != nil {
+		t.Fatal(er)
+	}
+	atomic.SetLevel(zapcore.ErrorLevel)
+	lvl, er = lgr.GetLevel("")
+	if er != nil {
+		t.Fatal(er)
+	}
+	assert.Equal(t, "error", lvl, "Atomic level should be the global level.")
+
+	if er := lgr.ResetLevel(""); er != nil {
+		t.Fatal(er)
+	}
+	lvl, _ = lgr.GetLevel("etcd")
+	assert.Equal(t, "info", lvl, "All levels should be restored.")
+	comps, _ := lgr.ComponentLevels()
+	assert.Empty(t, comps)
+
+	assert.NotNil(t, lgr.SetLevel("", "trace"), "Unknown level should be rejected.")
+}
+
+func TestLevelSignals(t *testing.T) {
+	undo := initLoggerWithOptions(t, func() (lgr.LogOption, error) { return lgr.NewLogLevelOption("info") })
+	defer undo()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lgr.WatchLevelSignals(ctx)
+
+	waitLevel := func(sig syscall.Signal, expected string) {
+		if er := syscall.Kill(os.Getpid(), sig); er != nil {
+			t.Fatal(er)
+		}
+		lvl := ""
+		for i := 0; i < 50 && lvl != expected; i++ {
+			time.Sleep(10 * time.Millisecond)
+			lvl, _ = lgr.GetLevel("")
+		}
+		assert.Equal(t, expected, lvl, "Level should be changed on %s.", sig)
+	}
+	waitLevel(syscall.SIGUSR1, "debug")
+	waitLevel(syscall.SIGUSR1, "debug")
+	waitLevel(syscall.SIGUSR2, "info")
+	waitLevel(syscall.SIGUSR2, "warn")
+	waitLevel(syscall.SIGHUP, "info")
+}
+
+func TestNamed(t *testing.T) {
+	dir, er := ioutil.TempDir("", "cks-logger")
+	if er != nil {
+		t.Fatal(er)
+	}
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "eke.log")
+
+	stdout := os.Stdout
+	if os.Stdout, er = os.OpenFile(os.DevNull, os.O_WRONLY, 0); er != nil {
+		t.Fatal(er)
+	}
+	defer func() { os.Stdout = stdout }()
+
+	undo := initLoggerWithOptions(t,
+		func() (lgr.LogOption, error) { return lgr.NewLogLevelOption("info") },
+		func() (lgr.LogOption, error) { return lgr.NewLogSinkOption("path=" + logPath + ",format=json") },
+	)
+	defer undo()
+
+	if er := lgr.SetComponentLevels(map[string]string{"etcd": "warn", "addons": "debug"}); er != nil {
+		t.Fatal(er)
+	}
+	lgr.Named("etcd").Info("etcd info msg")
+	lgr.Named("etcd").Warnf("etcd %s msg", "warn")
+	lgr.Named("addons").Debug("addons debug msg")
+	lgr.NamedStructured("pki").Info("pki info msg", map[string]string{"cert": "ca"})
+	lgr.NamedStructured("pki").Debug("pki debug msg")
+
+	// levels changed at runtime are restored to those given by SetComponentLevels
+	if er := lgr.SetLevel("etcd", "debug"); er != nil {
+		t.Fatal(er)
+	}
+	if er := lgr.ResetLevel("etcd"); er != nil {
+		t.Fatal(er)
+	}
+	lvl, _ := lgr.GetLevel("etcd")
+	assert.Equal(t, "warn", lvl, "Component level given at start should be restored.")
+
+	data, er := ioutil.ReadFile(logPath)
+	if er != nil {
+		t.Fatal(er)
+	}
+	entries := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		entry := map[string]interface{}{}
+		if er := json.Unmarshal([]byte(line), &entry); er != nil {
+			t.Fatal(er)
+		}
+		entries = append(entries, entry)
+	}
+
+	msgs := []string{}
+	for _, e := range entries {
+		msgs = append(msgs, e["msg"].(string))
+		assert.Equal(t, e["logger"], e["component"], "Component should be the logger name.")
+		assert.True(t, strings.HasPrefix(e["caller"].(string), "logger/logger_test.go"),
+			"Caller should be the caller of named loggers.")
+	}
+	assert.Equal(t, []string{"etcd warn msg", "addons debug msg", "pki info msg"}, msgs,
+		"Named loggers should follow the levels of components.")
+	assert.Equal(t, "ca", entries[2]["cert"])
+
+	assert.NotNil(t, lgr.SetComponentLevels(map[string]string{"etcd": "trace"}), "Unknown level should be rejected.")
+}
@@ -17,6 +17,7 @@ package logger
 
 import (
 	"fmt"
+	"strconv"
 
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
@@ -34,12 +35,53 @@ const (
 	// Local log file is enabled only if
 	// both EnableLogFileOpt and LogFilePathOpt exist.
 	// Value of EnableLogFileOpt is ignored.
-	// Note that currently no internal rotation supported
+	// Note that the file is not rotated unless
+	// any of the rotation options below exists
 	EnableLogFileOpt
 
 	// LogFilePathOpt is used to configure
 	// the path for local log file
 	LogFilePathOpt
+
+	// LogFileMaxSizeOpt is used to configure the size in megabytes
+	// the local log file is rotated at, defaults to 100
+	LogFileMaxSizeOpt
+
+	// LogFileMaxAgeOpt is used to configure the days
+	// rotated log files are kept, which are kept forever by default
+	LogFileMaxAgeOpt
+
+	// LogFileMaxBackupsOpt is used to configure how many
+	// rotated log files are kept, which are all kept by default
+	LogFileMaxBackupsOpt
+
+	// LogFileCompressOpt is used to compress rotated log files by gzip
+	LogFileCompressOpt
+
+	// LogEncodingOpt is used to configure the encoding of logs,
+	// i.e. console, json or logfmt, defaults to console
+	LogEncodingOpt
+
+	// LogFileEncodingOpt is used to configure the encoding
+	// of the local log file, defaults to the one of LogEncodingOpt
+	LogFileEncodingOpt
+
+	// LogTimeFormatOpt is used to configure
+	// how time is formatted, defaults to iso8601
+	LogTimeFormatOpt
+
+	// LogLevelFormatOpt is used to configure how levels are formatted,
+	// defaults to upper case in console and lower case in other encodings
+	LogLevelFormatOpt
+
+	// LogSinkOpt is used to configure the encoding and level of a sink,
+	// i.e. stdout, stderr or a file, which is added if not in output paths.
+	// Sinks of different paths are all kept when multiple LogSinkOpt exist
+	LogSinkOpt
+
+	// LogStreamOpt is used to configure the standard stream,
+	// i.e. stdout or stderr, logs are written to, defaults to stdout
+	LogStreamOpt
 )
 
 // LogOption is used to configure global logger behaviors
@@ -132,3 +174,254 @@ func (lfp *logFilePathOption) ConfigLogger(opts LogOptionType, cfg *zap.Config)
 	}
 	return nil
 }
+
+type logFileRotationOption struct {
+	optType LogOptionType
+	key     string
+	value   string
+}
+
+// NewLogFileMaxSizeOption returns a logFileRotationOption
+// which rotates the local log file once it reaches the size in megabytes
+func NewLogFileMaxSizeOption(megabytes int) (LogOption, error) {
+	if megabytes <= 0 {
+		return nil, errors.Errorf("invalid max size of log file: %d, must be positive", megabytes)
+	}
+	return &logFileRotationOption{optType: LogFileMaxSizeOpt, key: rotateMaxSize, value: strconv.Itoa(megabytes)}, nil
+}
+
+// NewLogFileMaxAgeOption returns a logFileRotationOption
+// which removes rotated log files older than the days
+func NewLogFileMaxAgeOption(days int) (LogOption, error) {
+	if days < 0 {
+		return nil, errors.Errorf("invalid max age of log file: %d, must not be negative", days)
+	}
+	return &logFileRotationOption{optType: LogFileMaxAgeOpt, key: rotateMaxAge, value: strconv.Itoa(days)}, nil
+}
+
+// NewLogFileMaxBackupsOption returns a logFileRotationOption
+// which keeps at most the number of rotated log files
+func NewLogFileMaxBackupsOption(n int) (LogOption, error) {
+	if n < 0 {
+		return nil, errors.Errorf("invalid max backups of log file: %d, must not be negative", n)
+	}
+	return &logFileRotationOption{optType: LogFileMaxBackupsOpt, key: rotateMaxBackups, value: strconv.Itoa(n)}, nil
+}
+
+// NewLogFileCompressOption returns a logFileRotationOption
+// which compresses rotated log files by gzip
+func NewLogFileCompressOption() (LogOption, error) {
+	return &logFileRotationOption{optType: LogFileCompressOpt, key: rotateCompress, value: "true"}, nil
+}
+
+func (lfr *logFileRotationOption) OptType() LogOptionType {
+	return lfr.optType
+}
+
+// ConfigLogger turns the local log file in output paths into a rotating file,
+// which is applied after logFilePathOption as options apply in order of types
+func (lfr *logFileRotationOption) ConfigLogger(opts LogOptionType, cfg *zap.Config) error {
+	enable := EnableLogFileOpt | LogFilePathOpt
+	if (opts & enable) != enable {
+		return nil
+	}
+	for i, p := range cfg.OutputPaths {
+		rotated, err := withRotation(p, lfr.key, lfr.value)
+		if err != nil {
+			return err
+		}
+		cfg.OutputPaths[i] = rotated
+	}
+	return nil
+}
+
+type logEncodingOption struct {
+	Encoding string
+}
+
+// NewLogEncodingOption returns a logEncodingOption
+// with specified encoding and an error if exists
+func NewLogEncodingOption(encoding string) (LogOption, error) {
+	if err := checkEncoding(encoding); err != nil {
+		return nil, err
+	}
+	return &logEncodingOption{Encoding: encoding}, nil
+}
+
+func (le *logEncodingOption) OptType() LogOptionType {
+	return LogEncodingOpt
+}
+
+func (le *logEncodingOption) ConfigLogger(opts LogOptionType, cfg *zap.Config) error {
+	cfg.Encoding = le.Encoding
+	return nil
+}
+
+type logFileEncodingOption struct {
+	Encoding string
+}
+
+// NewLogFileEncodingOption returns a logFileEncodingOption
+// which configures the encoding of the local log file only
+func NewLogFileEncodingOption(encoding string) (LogOption, error) {
+	if err := checkEncoding(encoding); err != nil {
+		return nil, err
+	}
+	return &logFileEncodingOption{Encoding: encoding}, nil
+}
+
+func (lfe *logFileEncodingOption) OptType() LogOptionType {
+	return LogFileEncodingOpt
+}
+
+func (lfe *logFileEncodingOption) ConfigLogger(opts LogOptionType, cfg *zap.Config) error {
+	// do nothing here because the zap config has only one encoding,
+	// the local log file is configured in configSinks
+	return nil
+}
+
+func (lfe *logFileEncodingOption) configSinks(opts LogOptionType, cfg *zap.Config, sinks []*sink) ([]*sink, error) {
+	enable := EnableLogFileOpt | LogFilePathOpt
+	if (opts & enable) != enable {
+		return sinks, nil
+	}
+	for _, s := range sinks {
+		if !isStdStream(s.path) {
+			s.encoding = lfe.Encoding
+		}
+	}
+	return sinks, nil
+}
+
+func checkEncoding(encoding string) error {
+	switch encoding {
+	case EncodingConsole, EncodingJSON, EncodingLogfmt:
+		return nil
+	}
+	return errors.Errorf("unsupported log encoding: %s, only support %s", encoding, PrintAvailLogEncoding())
+}
+
+type logTimeFormatOption struct {
+	EncodeTime zapcore.TimeEncoder
+}
+
+// NewLogTimeFormatOption returns a logTimeFormatOption
+// with specified time format and an error if exists
+func NewLogTimeFormatOption(format string) (LogOption, error) {
+	if e, ok := timeFormatMap[format]; ok {
+		return &logTimeFormatOption{EncodeTime: e}, nil
+	}
+	return nil, errors.Errorf("unsupported log time format: %s, only support %s", format, PrintAvailLogTimeFormat())
+}
+
+func (ltf *logTimeFormatOption) OptType() LogOptionType {
+	return LogTimeFormatOpt
+}
+
+func (ltf *logTimeFormatOption) ConfigLogger(opts LogOptionType, cfg *zap.Config) error {
+	cfg.EncoderConfig.EncodeTime = ltf.EncodeTime
+	return nil
+}
+
+type logLevelFormatOption struct {
+	EncodeLevel zapcore.LevelEncoder
+}
+
+// NewLogLevelFormatOption returns a logLevelFormatOption
+// with specified level format and an error if exists
+func NewLogLevelFormatOption(format string) (LogOption, error) {
+	if e, ok := levelFormatMap[format]; ok {
+		return &logLevelFormatOption{EncodeLevel: e}, nil
+	}
+	return nil, errors.Errorf("unsupported log level format: %s, only support %s", format, PrintAvailLogLevelFormat())
+}
+
+func (llf *logLevelFormatOption) OptType() LogOptionType {
+	return LogLevelFormatOpt
+}
+
+func (llf *logLevelFormatOption) ConfigLogger(opts LogOptionType, cfg *zap.Config) error {
+	cfg.EncoderConfig.EncodeLevel = llf.EncodeLevel
+	return nil
+}
+
+type logSinkOption struct {
+	Sinks []*sinkSpec
+}
+
+// NewLogSinkOption returns a logSinkOption with a sink given in form of
+// comma separated key=value pairs, e.g. path=/var/log/cks.log,level=debug,format=json,
+// where path is stdout, stderr, a file or a url of registered zap sinks,
+// level and format are those of the zap config if not given
+func NewLogSinkOption(spec string) (LogOption, error) {
+	s, err := parseSinkSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &logSinkOption{Sinks: []*sinkSpec{s}}, nil
+}
+
+func (ls *logSinkOption) OptType() LogOptionType {
+	return LogSinkOpt
+}
+
+func (ls *logSinkOption) ConfigLogger(opts LogOptionType, cfg *zap.Config) error {
+	// do nothing here because sinks are configured in configSinks
+	return nil
+}
+
+// merge keeps sinks of both options, where
+// the later one takes effect for the same path
+func (ls *logSinkOption) merge(opt LogOption) LogOption {
+	next, ok := opt.(*logSinkOption)
+	if !ok {
+		return opt
+	}
+	merged := &logSinkOption{}
+	for _, s := range ls.Sinks {
+		overridden := false
+		for _, n := range next.Sinks {
+			overridden = overridden || sinkKey(s.Path) == sinkKey(n.Path)
+		}
+		if !overridden {
+			merged.Sinks = append(merged.Sinks, s)
+		}
+	}
+	merged.Sinks = append(merged.Sinks, next.Sinks...)
+	return merged
+}
+
+func (ls *logSinkOption) configSinks(opts LogOptionType, cfg *zap.Config, sinks []*sink) ([]*sink, error) {
+	for _, s := range ls.Sinks {
+		sinks = s.apply(cfg, sinks)
+	}
+	return sinks, nil
+}
+
+type logStreamOption struct {
+	Stream string
+}
+
+// NewLogStreamOption returns a logStreamOption
+// with specified stream and an error if exists
+func NewLogStreamOption(stream string) (LogOption, error) {
+	if !isStdStream(stream) {
+		return nil, errors.Errorf("unsupported log stream: %s, only support \"stdout\", \"stderr\"", stream)
+	}
+	return &logStreamOption{Stream: stream}, nil
+}
+
+func (ls *logStreamOption) OptType() LogOptionType {
+	return LogStreamOpt
+}
+
+// ConfigLogger replaces the default stdout in output paths,
+// sinks given by LogSinkOpt are applied afterwards
+func (ls *logStreamOption) ConfigLogger(opts LogOptionType, cfg *zap.Config) error {
+	for i, p := range cfg.OutputPaths {
+		if isStdStream(p) {
+			cfg.OutputPaths[i] = ls.Stream
+		}
+	}
+	return nil
+}
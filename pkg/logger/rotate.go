@@ -0,0 +1,109 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package logger
+
+import (
+	"net/url"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// rotateScheme is the scheme of the zap sink writing to a rotating file,
+// e.g. rotate:///var/log/cks.log?maxsize=100&maxbackups=3
+const rotateScheme string = "rotate"
+
+// query parameters of the rotating file sink
+const (
+	rotateMaxSize    string = "maxsize"
+	rotateMaxAge     string = "maxage"
+	rotateMaxBackups string = "maxbackups"
+	rotateCompress   string = "compress"
+)
+
+func init() {
+	if err := zap.RegisterSink(rotateScheme, newRotateSink); err != nil {
+		panic(err)
+	}
+}
+
+// rotateSink is a zap sink writing to a file rotated by lumberjack
+type rotateSink struct {
+	*lumberjack.Logger
+}
+
+// Sync does nothing as lumberjack writes to the file without buffering
+func (s *rotateSink) Sync() error {
+	return nil
+}
+
+func newRotateSink(u *url.URL) (zap.Sink, error) {
+	if u.Path == "" {
+		return nil, errors.Errorf("no file path in %s", u)
+	}
+	l := &lumberjack.Logger{Filename: u.Path, LocalTime: true}
+
+	var err error
+	q := u.Query()
+	for key, v := range map[string]*int{rotateMaxSize: &l.MaxSize, rotateMaxAge: &l.MaxAge, rotateMaxBackups: &l.MaxBackups} {
+		if s := q.Get(key); s != "" {
+			if *v, err = strconv.Atoi(s); err != nil || *v < 0 {
+				return nil, errors.Errorf("invalid %s %s of log file %s", key, s, u.Path)
+			}
+		}
+	}
+	if s := q.Get(rotateCompress); s != "" {
+		if l.Compress, err = strconv.ParseBool(s); err != nil {
+			return nil, errors.Errorf("invalid %s %s of log file %s", rotateCompress, s, u.Path)
+		}
+	}
+	return &rotateSink{Logger: l}, nil
+}
+
+// withRotation returns the output path rotating the file with the query parameter set,
+// where stdout, stderr and paths of other sinks are left untouched
+func withRotation(path, key, value string) (string, error) {
+	if isStdStream(path) {
+		return path, nil
+	}
+
+	u, err := url.Parse(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid output path %s", path)
+	}
+	switch u.Scheme {
+	case rotateScheme:
+	case "file":
+		u = &url.URL{Scheme: rotateScheme, Path: u.Path}
+	case "":
+		// the whole path is a file path even if it has ? or #
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return "", errors.Wrapf(err, "invalid output path %s", path)
+		}
+		u = &url.URL{Scheme: rotateScheme, Path: abs}
+	default:
+		return path, nil
+	}
+
+	q := u.Query()
+	q.Set(key, value)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,59 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package logger
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// WatchLevelSignals changes levels on signals in background until ctx is done,
+// where SIGUSR1 makes the global level more verbose by one step,
+// SIGUSR2 less verbose, and SIGHUP restores all the levels given to InitLogger
+func WatchLevelSignals(ctx context.Context) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case s := <-ch:
+				// logged at warn so that it's seen unless the level is above warn
+				logger := GetGlobalLogger()
+				if s == syscall.SIGHUP {
+					if err := ResetLevel(""); err != nil {
+						logger.Errorf("failed to reset log levels on %s: %v", s, err)
+						continue
+					}
+					lvl, _ := GetLevel("")
+					logger.Warnf("log levels reset on %s, global level is %s", s, lvl)
+					continue
+				}
+				lvl, err := StepLevel(s == syscall.SIGUSR1)
+				if err != nil {
+					logger.Errorf("failed to change log level on %s: %v", s, err)
+					continue
+				}
+				logger.Warnf("global log level changed to %s on %s", lvl, s)
+			}
+		}
+	}()
+}
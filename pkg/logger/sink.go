@@ -0,0 +1,172 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package logger
+
+import (
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// sink is an output path with its own encoding and level,
+// where the level of the zap config is used if level is nil
+type sink struct {
+	path     string
+	encoding string
+	level    *zapcore.Level
+}
+
+// sinkOption is implemented by options configuring
+// sinks individually rather than the whole zap config
+type sinkOption interface {
+	configSinks(LogOptionType, *zap.Config, []*sink) ([]*sink, error)
+}
+
+// mergeableOption is implemented by options merged with
+// the following option of the same type rather than replaced
+type mergeableOption interface {
+	merge(LogOption) LogOption
+}
+
+func isStdStream(path string) bool {
+	return path == "stdout" || path == "stderr"
+}
+
+// sinkKey identifies the stream or file a sink writes to,
+// so that a file is the same sink whether it's rotated or not
+func sinkKey(path string) string {
+	if isStdStream(path) {
+		return path
+	}
+	if u, err := url.Parse(path); err == nil && u.Scheme != "" {
+		if u.Scheme == rotateScheme || u.Scheme == "file" {
+			return u.Path
+		}
+		return path
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// sinkSpec is a sink given in form of comma separated key=value pairs,
+// e.g. path=/var/log/cks.log,level=debug,format=json
+type sinkSpec struct {
+	Path     string
+	Encoding string
+	Level    *zapcore.Level
+}
+
+func parseSinkSpec(spec string) (*sinkSpec, error) {
+	s := &sinkSpec{}
+	for _, kv := range strings.Split(spec, ",") {
+		pair := strings.SplitN(kv, "=", 2)
+		if len(pair) != 2 {
+			return nil, errors.Errorf("invalid log sink %s: %s is not in form of key=value", spec, kv)
+		}
+		k, v := strings.TrimSpace(pair[0]), strings.TrimSpace(pair[1])
+		switch k {
+		case "path":
+			s.Path = v
+		case "level":
+			l, ok := logLevelMap[v]
+			if !ok {
+				return nil, errors.Errorf("invalid log sink %s: unsupported log level: %s, only support %s",
+					spec, v, PrintAvailLogLevel())
+			}
+			s.Level = &l
+		case "format":
+			if err := checkEncoding(v); err != nil {
+				return nil, errors.Wrapf(err, "invalid log sink %s", spec)
+			}
+			s.Encoding = v
+		default:
+			return nil, errors.Errorf("invalid log sink %s: unknown key %s, only support path, level, format", spec, k)
+		}
+	}
+	if s.Path == "" {
+		return nil, errors.Errorf("invalid log sink %s: path is required", spec)
+	}
+	return s, nil
+}
+
+// apply configures the sink writing to the same path,
+// or appends a new sink if not found
+func (s *sinkSpec) apply(cfg *zap.Config, sinks []*sink) []*sink {
+	var target *sink
+	for _, v := range sinks {
+		if sinkKey(v.path) == sinkKey(s.Path) {
+			target = v
+		}
+	}
+	if target == nil {
+		target = &sink{path: s.Path, encoding: cfg.Encoding}
+		sinks = append(sinks, target)
+	}
+	if s.Encoding != "" {
+		target.encoding = s.Encoding
+	}
+	if s.Level != nil {
+		target.level = s.Level
+	}
+	return sinks
+}
+
+// build works as cfg.Build, except that each sink is a core with its own encoder
+// and level and all the cores are teed, where sinks without their own levels
+// follow the levels of components. levelFormatted tells whether
+// the level format is given rather than the default of the encodings
+func build(cfg *zap.Config, sinks []*sink, levels *levelRegistry, levelFormatted bool,
+	opts ...zap.Option) (*zap.Logger, error) {
+	cores := make([]zapcore.Core, 0, len(sinks))
+	for _, s := range sinks {
+		enc, err := newEncoder(s.encoding, cfg.EncoderConfig, levelFormatted)
+		if err != nil {
+			return nil, err
+		}
+		ws, _, err := zap.Open(s.path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to open %s", s.path)
+		}
+		if s.level != nil {
+			cores = append(cores, zapcore.NewCore(enc, ws, *s.level))
+			continue
+		}
+		cores = append(cores, &componentCore{Core: zapcore.NewCore(enc, ws, cfg.Level), levels: levels})
+	}
+
+	errSink, _, err := zap.Open(cfg.ErrorOutputPaths...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open error output")
+	}
+	opts = append([]zap.Option{zap.ErrorOutput(errSink)}, opts...)
+	if cfg.Development {
+		opts = append(opts, zap.Development())
+	}
+	if !cfg.DisableCaller {
+		opts = append(opts, zap.AddCaller())
+	}
+	if !cfg.DisableStacktrace {
+		opts = append(opts, zap.AddStacktrace(zapcore.ErrorLevel))
+	}
+
+	return zap.New(zapcore.NewTee(cores...), opts...), nil
+}
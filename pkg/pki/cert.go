@@ -0,0 +1,325 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/jiuchen1986/cks/pkg/utils"
+)
+
+const (
+	// CAValidity is how long a generated CA is valid
+	CAValidity time.Duration = 10 * 365 * 24 * time.Hour
+	// CertValidity is how long a generated leaf certificate is valid
+	CertValidity time.Duration = 365 * 24 * time.Hour
+
+	certFileMode os.FileMode = 0644
+	keyFileMode  os.FileMode = 0600
+	dirMode      os.FileMode = 0700
+
+	certPEMType      string = "CERTIFICATE"
+	ecKeyPEMType     string = "EC PRIVATE KEY"
+	pkcs8KeyPEMType  string = "PRIVATE KEY"
+	publicKeyPEMType string = "PUBLIC KEY"
+)
+
+// KeyPair is a certificate with its private key
+type KeyPair struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// TLSCertificate returns the key pair for serving TLS
+func (kp *KeyPair) TLSCertificate() tls.Certificate {
+	return tls.Certificate{
+		Certificate: [][]byte{kp.Cert.Raw},
+		PrivateKey:  kp.Key,
+		Leaf:        kp.Cert,
+	}
+}
+
+// CertConfig describes a leaf certificate to issue
+type CertConfig struct {
+	CommonName   string
+	Organization []string
+	DNSNames     []string
+	IPs          []net.IP
+	Usages       []x509.ExtKeyUsage
+	// Validity defaults to CertValidity if not set
+	Validity time.Duration
+}
+
+// NewPrivateKey generates an ECDSA P-256 private key
+func NewPrivateKey() (crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate private key")
+	}
+	return key, nil
+}
+
+// NewCA generates a self-signed CA with the common name
+func NewCA(cn string) (*KeyPair, error) {
+	key, err := NewPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             now.Add(-5 * time.Minute).UTC(),
+		NotAfter:              now.Add(CAValidity).UTC(),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create CA %s", cn)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse CA %s", cn)
+	}
+
+	return &KeyPair{Cert: cert, Key: key}, nil
+}
+
+// Issue issues a leaf certificate with a new private key signed by the CA
+func (ca *KeyPair) Issue(cfg *CertConfig) (*KeyPair, error) {
+	key, err := NewPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := ca.Sign(cfg, key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{Cert: cert, Key: key}, nil
+}
+
+// Sign signs a leaf certificate for the public key by the CA
+func (ca *KeyPair) Sign(cfg *CertConfig, pub crypto.PublicKey) (*x509.Certificate, error) {
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	validity := cfg.Validity
+	if validity == 0 {
+		validity = CertValidity
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cfg.CommonName, Organization: cfg.Organization},
+		DNSNames:     cfg.DNSNames,
+		IPAddresses:  cfg.IPs,
+		NotBefore:    now.Add(-5 * time.Minute).UTC(),
+		NotAfter:     now.Add(validity).UTC(),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  cfg.Usages,
+	}
+	// never outlive the CA
+	if tmpl.NotAfter.After(ca.Cert.NotAfter) {
+		tmpl.NotAfter = ca.Cert.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, pub, ca.Key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to sign certificate %s", cfg.CommonName)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse certificate %s", cfg.CommonName)
+	}
+	return cert, nil
+}
+
+func newSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate serial number")
+	}
+	return serial, nil
+}
+
+// EncodeCertPEM encodes the certificate in PEM
+func EncodeCertPEM(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: certPEMType, Bytes: cert.Raw})
+}
+
+// EncodeKeyPEM encodes the private key in PEM
+func EncodeKeyPEM(key crypto.Signer) ([]byte, error) {
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal private key")
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: ecKeyPEMType, Bytes: der}), nil
+	default:
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal private key")
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: pkcs8KeyPEMType, Bytes: der}), nil
+	}
+}
+
+// EncodePublicKeyPEM encodes the public key in PEM
+func EncodePublicKeyPEM(key crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal public key")
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: publicKeyPEMType, Bytes: der}), nil
+}
+
+// ParseCertPEM parses the first certificate in PEM
+func ParseCertPEM(data []byte) (*x509.Certificate, error) {
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == certPEMType {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			return cert, errors.Wrap(err, "failed to parse certificate")
+		}
+	}
+	return nil, errors.New("no certificate found in PEM")
+}
+
+// ParseKeyPEM parses the first private key in PEM
+func ParseKeyPEM(data []byte) (crypto.Signer, error) {
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case ecKeyPEMType:
+			key, err := x509.ParseECPrivateKey(block.Bytes)
+			return key, errors.Wrap(err, "failed to parse private key")
+		case pkcs8KeyPEMType:
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to parse private key")
+			}
+			signer, ok := key.(crypto.Signer)
+			if !ok {
+				return nil, errors.Errorf("unsupported private key type %T", key)
+			}
+			return signer, nil
+		}
+	}
+	return nil, errors.New("no private key found in PEM")
+}
+
+// LoadCert reads the certificate from a PEM file
+func LoadCert(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read certificate %s", path)
+	}
+	cert, err := ParseCertPEM(data)
+	return cert, errors.Wrapf(err, "invalid certificate %s", path)
+}
+
+// LoadKeyPair reads the key pair from PEM files
+func LoadKeyPair(certPath, keyPath string) (*KeyPair, error) {
+	cert, err := LoadCert(certPath)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read private key %s", keyPath)
+	}
+	key, err := ParseKeyPEM(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid private key %s", keyPath)
+	}
+
+	kp := &KeyPair{Cert: cert, Key: key}
+	if !kp.Matches() {
+		return nil, errors.Errorf("private key %s doesn't match certificate %s", keyPath, certPath)
+	}
+	return kp, nil
+}
+
+// Matches tells whether the public key of the certificate is the one of the private key
+func (kp *KeyPair) Matches() bool {
+	pub, ok := kp.Key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	return ok && pub.Equal(kp.Cert.PublicKey)
+}
+
+// WriteKeyPair writes the key pair to PEM files with safe permissions,
+// where both of them are written before either replaces the one on the disk
+func WriteKeyPair(kp *KeyPair, certPath, keyPath string) error {
+	keyPEM, err := EncodeKeyPEM(kp.Key)
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{filepath.Dir(certPath), filepath.Dir(keyPath)} {
+		if err := os.MkdirAll(dir, dirMode); err != nil {
+			return errors.Wrapf(err, "failed to create directory %s", dir)
+		}
+	}
+	// the key is renamed first so that a certificate never exists without its key
+	return utils.WriteFilesAtomic(
+		utils.File{Path: keyPath, Data: keyPEM, Mode: keyFileMode},
+		utils.File{Path: certPath, Data: EncodeCertPEM(kp.Cert), Mode: certFileMode},
+	)
+}
+
+// writeFile atomically writes data to path and creates
+// the parent directory with safe permissions if necessary
+func writeFile(path string, data []byte, mode os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, dirMode); err != nil {
+		return errors.Wrapf(err, "failed to create directory %s", dir)
+	}
+	return utils.WriteFileAtomic(path, data, mode)
+}
+
+// CAHash returns the hash of the CA public key in form of sha256:<hex>,
+// which is used to pin the CA when joining a cluster
+func CAHash(ca *x509.Certificate) string {
+	sum := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,91 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pki
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CertInfo is the information of a certificate on the disk
+type CertInfo struct {
+	// Name is the path relative to the PKI directory without the .crt suffix,
+	// or the name given by the one embedding the certificate, e.g. kubeconfig/admin
+	Name     string
+	Subject  string
+	Issuer   string
+	SANs     []string
+	IsCA     bool
+	NotAfter time.Time
+}
+
+// ExpiresWithin tells whether the certificate expires within d from now
+func (ci *CertInfo) ExpiresWithin(d time.Duration) bool {
+	return time.Now().Add(d).After(ci.NotAfter)
+}
+
+// Inspect reads all the certificates in the PKI directory sorted by name
+func Inspect(dir string) ([]CertInfo, error) {
+	infos := []CertInfo{}
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || filepath.Ext(path) != ".crt" {
+			return nil
+		}
+
+		cert, err := LoadCert(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get relative path of %s", path)
+		}
+
+		infos = append(infos, NewCertInfo(strings.TrimSuffix(filepath.ToSlash(rel), ".crt"), cert))
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to inspect certificates in %s", dir)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+// NewCertInfo returns the information of the certificate with the name
+func NewCertInfo(name string, cert *x509.Certificate) CertInfo {
+	sans := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return CertInfo{
+		Name:     name,
+		Subject:  cert.Subject.String(),
+		Issuer:   cert.Issuer.String(),
+		SANs:     sans,
+		IsCA:     cert.IsCA,
+		NotAfter: cert.NotAfter,
+	}
+}
@@ -0,0 +1,501 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pki
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/plan"
+)
+
+// names of CAs, which are also the paths of files relative
+// to the PKI directory without the .crt and .key suffixes
+const (
+	CAName           string = "ca"
+	FrontProxyCAName string = "front-proxy-ca"
+	EtcdCAName       string = "etcd/ca"
+)
+
+// names of leaf certificates, which are also the paths of files relative
+// to the PKI directory without the .crt and .key suffixes
+const (
+	APIServerName              string = "apiserver"
+	APIServerKubeletClientName string = "apiserver-kubelet-client"
+	APIServerEtcdClientName    string = "apiserver-etcd-client"
+	FrontProxyClientName       string = "front-proxy-client"
+	KubeletName                string = "kubelet"
+	EtcdServerName             string = "etcd/server"
+	EtcdPeerName               string = "etcd/peer"
+	EtcdHealthcheckClientName  string = "etcd/healthcheck-client"
+	AdminName                  string = "admin"
+)
+
+const (
+	// ServiceAccountKeyName is the name of the key pair
+	// signing and verifying service account tokens
+	ServiceAccountKeyName string = "sa"
+
+	// SystemMastersGroup is the group with full access to the cluster
+	SystemMastersGroup string = "system:masters"
+
+	// ComponentName names the logger of the PKI
+	ComponentName string = "pki"
+)
+
+// Dir returns the PKI directory in the data directory
+func Dir(dataDir string) string {
+	return filepath.Join(dataDir, "pki")
+}
+
+// LeafSpec describes a leaf certificate managed by PKI
+type LeafSpec struct {
+	Name   string
+	CAName string
+	Config CertConfig
+}
+
+// PKI manages the CAs and certificates of a node on the disk
+type PKI struct {
+	Dir   string
+	leafs []LeafSpec
+}
+
+// New returns the PKI of the node in the cluster.
+// Certificates are derived from the cluster config
+func New(cfg *conf.ClusterConfig, nodeName string) (*PKI, error) {
+	node := cfg.Node(nodeName)
+	if node == nil {
+		return nil, errors.Errorf("node %s not found in cluster config", nodeName)
+	}
+
+	apiSANs, err := apiServerSANs(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	serverUsages := []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	clientUsages := []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	peerUsages := []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	nodeSANs := newSANs(node.Name, node.Address)
+	etcdSANs := newSANs("localhost", "127.0.0.1", node.Name, node.Address)
+
+	return &PKI{
+		Dir: Dir(cfg.DataDir),
+		leafs: []LeafSpec{
+			{APIServerName, CAName, CertConfig{
+				CommonName: "kube-apiserver",
+				DNSNames:   apiSANs.dnsNames,
+				IPs:        apiSANs.ips,
+				Usages:     serverUsages,
+			}},
+			{APIServerKubeletClientName, CAName, CertConfig{
+				CommonName:   "kube-apiserver-kubelet-client",
+				Organization: []string{SystemMastersGroup},
+				Usages:       clientUsages,
+			}},
+			{KubeletName, CAName, CertConfig{
+				CommonName: node.Name,
+				DNSNames:   nodeSANs.dnsNames,
+				IPs:        nodeSANs.ips,
+				Usages:     serverUsages,
+			}},
+			{AdminName, CAName, CertConfig{
+				CommonName:   "kubernetes-admin",
+				Organization: []string{SystemMastersGroup},
+				Usages:       clientUsages,
+			}},
+			{FrontProxyClientName, FrontProxyCAName, CertConfig{
+				CommonName: "front-proxy-client",
+				Usages:     clientUsages,
+			}},
+			{APIServerEtcdClientName, EtcdCAName, CertConfig{
+				CommonName:   "kube-apiserver-etcd-client",
+				Organization: []string{SystemMastersGroup},
+				Usages:       clientUsages,
+			}},
+			{EtcdServerName, EtcdCAName, CertConfig{
+				CommonName: node.Name,
+				DNSNames:   etcdSANs.dnsNames,
+				IPs:        etcdSANs.ips,
+				Usages:     peerUsages,
+			}},
+			{EtcdPeerName, EtcdCAName, CertConfig{
+				CommonName: node.Name,
+				DNSNames:   nodeSANs.dnsNames,
+				IPs:        nodeSANs.ips,
+				Usages:     peerUsages,
+			}},
+			{EtcdHealthcheckClientName, EtcdCAName, CertConfig{
+				CommonName:   "kube-etcd-healthcheck-client",
+				Organization: []string{SystemMastersGroup},
+				Usages:       clientUsages,
+			}},
+		},
+	}, nil
+}
+
+// CANames returns names of all the CAs
+func CANames() []string {
+	return []string{CAName, FrontProxyCAName, EtcdCAName}
+}
+
+// Leafs returns specs of all the leaf certificates
+func (p *PKI) Leafs() []LeafSpec {
+	return p.leafs
+}
+
+// Leaf returns the spec of the leaf certificate with the name
+func (p *PKI) Leaf(name string) (*LeafSpec, error) {
+	for i := range p.leafs {
+		if p.leafs[i].Name == name {
+			return &p.leafs[i], nil
+		}
+	}
+	return nil, errors.Errorf("unknown certificate %s", name)
+}
+
+// CertPath returns path of the certificate with the name
+func (p *PKI) CertPath(name string) string {
+	return CertPath(p.Dir, name)
+}
+
+// CertPath returns path of the certificate with the name in the PKI directory
+func CertPath(dir, name string) string {
+	return filepath.Join(dir, name+".crt")
+}
+
+// KeyPath returns path of the private key with the name
+func (p *PKI) KeyPath(name string) string {
+	return filepath.Join(p.Dir, name+".key")
+}
+
+// ServiceAccountKeyPath returns path of the service account private key
+func (p *PKI) ServiceAccountKeyPath() string {
+	return p.KeyPath(ServiceAccountKeyName)
+}
+
+// ServiceAccountPubPath returns path of the service account public key
+func (p *PKI) ServiceAccountPubPath() string {
+	return filepath.Join(p.Dir, ServiceAccountKeyName+".pub")
+}
+
+// LoadKeyPair reads the key pair with the name from the disk
+func (p *PKI) LoadKeyPair(name string) (*KeyPair, error) {
+	return LoadKeyPair(p.CertPath(name), p.KeyPath(name))
+}
+
+// WriteKeyPair writes the key pair with the name to the disk,
+// e.g. a CA shared by another controller
+func (p *PKI) WriteKeyPair(name string, kp *KeyPair) error {
+	return WriteKeyPair(kp, p.CertPath(name), p.KeyPath(name))
+}
+
+// ServiceAccountKeyPEM reads the service account private and public keys in PEM
+func (p *PKI) ServiceAccountKeyPEM() ([]byte, []byte, error) {
+	keyPEM, err := ioutil.ReadFile(p.ServiceAccountKeyPath())
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read service account key")
+	}
+	pubPEM, err := ioutil.ReadFile(p.ServiceAccountPubPath())
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to read service account public key")
+	}
+	return keyPEM, pubPEM, nil
+}
+
+// WriteServiceAccountKeyPEM writes the service account private and public keys in PEM,
+// which are shared by all the controllers
+func (p *PKI) WriteServiceAccountKeyPEM(keyPEM, pubPEM []byte) error {
+	if err := writeFile(p.ServiceAccountKeyPath(), keyPEM, keyFileMode); err != nil {
+		return err
+	}
+	return writeFile(p.ServiceAccountPubPath(), pubPEM, certFileMode)
+}
+
+// Ensure makes sure all the CAs, the service account key pair
+// and the leaf certificates exist and are valid on the disk.
+// Existing valid ones are kept untouched, so it's safe to re-run
+func (p *PKI) Ensure() error {
+	logger := lgr.Named(ComponentName)
+	defer logger.Sync()
+
+	if err := os.MkdirAll(p.Dir, dirMode); err != nil {
+		return errors.Wrapf(err, "failed to create PKI directory %s", p.Dir)
+	}
+
+	cas := map[string]*KeyPair{}
+	for _, name := range CANames() {
+		ca, err := p.ensureCA(name)
+		if err != nil {
+			return err
+		}
+		cas[name] = ca
+	}
+
+	if err := p.ensureServiceAccountKey(); err != nil {
+		return err
+	}
+
+	for i := range p.leafs {
+		spec := &p.leafs[i]
+		if p.isLeafValid(spec, cas[spec.CAName]) {
+			logger.Debugf("certificate %s is valid, skip it", spec.Name)
+			continue
+		}
+		if err := p.issue(spec, cas[spec.CAName]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Plan adds the CAs, the service account key pair and the leaf
+// certificates Ensure would generate to the plan without touching the disk
+func (p *PKI) Plan(pl *plan.Plan) error {
+	cas := map[string]*KeyPair{}
+	for _, name := range CANames() {
+		_, certErr := os.Stat(p.CertPath(name))
+		_, keyErr := os.Stat(p.KeyPath(name))
+		if certErr != nil && keyErr != nil {
+			pl.Add(plan.IssueCert, name, "generate CA")
+			continue
+		}
+		ca, err := p.LoadKeyPair(name)
+		if err != nil {
+			return errors.Wrapf(err, "failed to load existing CA %s", name)
+		}
+		cas[name] = ca
+	}
+
+	_, keyErr := os.Stat(p.ServiceAccountKeyPath())
+	_, pubErr := os.Stat(p.ServiceAccountPubPath())
+	if keyErr != nil || pubErr != nil {
+		pl.Add(plan.WriteFile, p.ServiceAccountKeyPath(), "generate service account key pair")
+	}
+
+	for i := range p.leafs {
+		spec := &p.leafs[i]
+		if ca, ok := cas[spec.CAName]; ok && p.isLeafValid(spec, ca) {
+			continue
+		}
+		pl.Add(plan.IssueCert, spec.Name, "signed by "+spec.CAName)
+	}
+	return nil
+}
+
+// Renew re-issues the leaf certificate with the name
+// from the existing CA, the CA itself is never changed
+func (p *PKI) Renew(name string) error {
+	spec, err := p.Leaf(name)
+	if err != nil {
+		return err
+	}
+
+	ca, err := p.LoadKeyPair(spec.CAName)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load CA %s", spec.CAName)
+	}
+	return p.issue(spec, ca)
+}
+
+// PlanRenew adds the leaf certificate with the name Renew would re-issue to the plan
+func (p *PKI) PlanRenew(name string, pl *plan.Plan) error {
+	spec, err := p.Leaf(name)
+	if err != nil {
+		return err
+	}
+	if _, err := p.LoadKeyPair(spec.CAName); err != nil {
+		return errors.Wrapf(err, "failed to load CA %s", spec.CAName)
+	}
+	pl.Add(plan.IssueCert, spec.Name, "signed by "+spec.CAName)
+	return nil
+}
+
+func (p *PKI) issue(spec *LeafSpec, ca *KeyPair) error {
+	logger := lgr.Named(ComponentName)
+
+	kp, err := ca.Issue(&spec.Config)
+	if err != nil {
+		return errors.Wrapf(err, "failed to issue certificate %s", spec.Name)
+	}
+	if err := WriteKeyPair(kp, p.CertPath(spec.Name), p.KeyPath(spec.Name)); err != nil {
+		return err
+	}
+
+	logger.Infof("certificate %s issued, expires at %s", spec.Name, kp.Cert.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+func (p *PKI) ensureCA(name string) (*KeyPair, error) {
+	logger := lgr.Named(ComponentName)
+
+	certPath, keyPath := p.CertPath(name), p.KeyPath(name)
+	_, certErr := os.Stat(certPath)
+	_, keyErr := os.Stat(keyPath)
+
+	// never overwrite an existing CA, as all the certificates are signed by it
+	if certErr == nil || keyErr == nil {
+		ca, err := LoadKeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load existing CA %s", name)
+		}
+		if !ca.Cert.IsCA {
+			return nil, errors.Errorf("certificate %s is not a CA", certPath)
+		}
+		return ca, nil
+	}
+
+	ca, err := NewCA("cks-" + strings.ReplaceAll(name, "/", "-"))
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteKeyPair(ca, certPath, keyPath); err != nil {
+		return nil, err
+	}
+
+	logger.Infof("CA %s generated", name)
+	return ca, nil
+}
+
+func (p *PKI) ensureServiceAccountKey() error {
+	logger := lgr.Named(ComponentName)
+
+	if _, err := os.Stat(p.ServiceAccountKeyPath()); err == nil {
+		if _, err := os.Stat(p.ServiceAccountPubPath()); err == nil {
+			return nil
+		}
+	}
+
+	key, err := NewPrivateKey()
+	if err != nil {
+		return err
+	}
+	keyPEM, err := EncodeKeyPEM(key)
+	if err != nil {
+		return err
+	}
+	pubPEM, err := EncodePublicKeyPEM(key.Public())
+	if err != nil {
+		return err
+	}
+
+	if err := p.WriteServiceAccountKeyPEM(keyPEM, pubPEM); err != nil {
+		return err
+	}
+
+	logger.Info("service account key pair generated")
+	return nil
+}
+
+// isLeafValid tells whether the leaf certificate on the disk matches its key,
+// is signed by the CA, not expired and has all the desired SANs
+func (p *PKI) isLeafValid(spec *LeafSpec, ca *KeyPair) bool {
+	// a key not matching the certificate fails loading
+	kp, err := p.LoadKeyPair(spec.Name)
+	if err != nil {
+		return false
+	}
+	if kp.Cert.CheckSignatureFrom(ca.Cert) != nil {
+		return false
+	}
+	if time.Now().After(kp.Cert.NotAfter) {
+		return false
+	}
+
+	has := newSANs(kp.Cert.DNSNames...)
+	for _, ip := range kp.Cert.IPAddresses {
+		has.add(ip.String())
+	}
+	for _, n := range spec.Config.DNSNames {
+		if !has.contains(n) {
+			return false
+		}
+	}
+	for _, ip := range spec.Config.IPs {
+		if !has.contains(ip.String()) {
+			return false
+		}
+	}
+	return true
+}
+
+// apiServerSANs returns SANs of the apiserver serving certificate,
+// including the in-cluster names, the kubernetes service address,
+// the API address, extra SANs and all the controllers
+func apiServerSANs(cfg *conf.ClusterConfig) (*sans, error) {
+	svcIP, err := cfg.APIServiceIP()
+	if err != nil {
+		return nil, err
+	}
+
+	s := newSANs(
+		"kubernetes",
+		"kubernetes.default",
+		"kubernetes.default.svc",
+		"kubernetes.default.svc."+cfg.Network.ClusterDomain,
+		"localhost",
+		"127.0.0.1",
+		svcIP.String(),
+		cfg.API.Address,
+	)
+	s.add(cfg.API.SANs...)
+	for _, n := range cfg.Controllers() {
+		s.add(n.Name, n.Address)
+	}
+	return s, nil
+}
+
+// sans is an ordered set of DNS names and IP addresses
+type sans struct {
+	dnsNames []string
+	ips      []net.IP
+	seen     map[string]bool
+}
+
+func newSANs(names ...string) *sans {
+	s := &sans{seen: map[string]bool{}}
+	s.add(names...)
+	return s
+}
+
+func (s *sans) add(names ...string) {
+	for _, n := range names {
+		if n == "" || s.seen[n] {
+			continue
+		}
+		s.seen[n] = true
+		if ip := net.ParseIP(n); ip != nil {
+			s.ips = append(s.ips, ip)
+		} else {
+			s.dnsNames = append(s.dnsNames, n)
+		}
+	}
+}
+
+func (s *sans) contains(name string) bool {
+	return s.seen[name]
+}
@@ -0,0 +1,245 @@
+package pki_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/pki"
+	"github.com/jiuchen1986/cks/pkg/plan"
+)
+
+func newPKI(t *testing.T) (*pki.PKI, *conf.ClusterConfig, func()) {
+	dir, err := ioutil.TempDir("", "cks-pki")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &conf.ClusterConfig{
+		DataDir: dir,
+		API:     conf.API{SANs: []string{"api.example.com"}},
+		Nodes: []conf.Node{
+			{Name: "node-a", Address: "192.168.0.10", Roles: []conf.Role{conf.RoleController}},
+			{Name: "node-b", Address: "192.168.0.11", Roles: []conf.Role{conf.RoleController}},
+		},
+	}
+	conf.SetDefaults(cfg)
+
+	p, err := pki.New(cfg, "node-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, cfg, func() { os.RemoveAll(dir) }
+}
+
+func TestEnsure(t *testing.T) {
+	p, _, clean := newPKI(t)
+	defer clean()
+
+	if err := p.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range append(pki.CANames(), pki.ServiceAccountKeyName) {
+		fi, err := os.Stat(p.KeyPath(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, os.FileMode(0600), fi.Mode().Perm(), "Private key should only be "+
+			"accessible by the owner.")
+	}
+
+	apiserver, err := p.LoadKeyPair(pki.APIServerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ips := []string{}
+	for _, ip := range apiserver.Cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	assert.Equal(t, []string{"127.0.0.1", "10.96.0.1", "192.168.0.10", "192.168.0.11"}, ips)
+	assert.Equal(t, []string{
+		"kubernetes",
+		"kubernetes.default",
+		"kubernetes.default.svc",
+		"kubernetes.default.svc.cluster.local",
+		"localhost",
+		"api.example.com",
+		"node-a",
+		"node-b",
+	}, apiserver.Cert.DNSNames)
+
+	ca, err := p.LoadKeyPair(pki.CAName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, apiserver.Cert.CheckSignatureFrom(ca.Cert), "Apiserver certificate should be "+
+		"signed by the cluster CA.")
+
+	etcdClient, err := p.LoadKeyPair(pki.APIServerEtcdClientName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(t, etcdClient.Cert.CheckSignatureFrom(ca.Cert), "Etcd client certificate should "+
+		"not be signed by the cluster CA.")
+}
+
+func TestEnsureIdempotent(t *testing.T) {
+	p, cfg, clean := newPKI(t)
+	defer clean()
+
+	if err := p.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	ca, err := p.LoadKeyPair(pki.CAName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := p.LoadKeyPair(pki.AdminName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiserver, err := p.LoadKeyPair(pki.APIServerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a new SAN makes the apiserver certificate invalid
+	cfg.API.SANs = append(cfg.API.SANs, "10.0.0.1")
+	p, err = pki.New(cfg, "node-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+
+	newCA, err := p.LoadKeyPair(pki.CAName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newAdmin, err := p.LoadKeyPair(pki.AdminName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newAPIServer, err := p.LoadKeyPair(pki.APIServerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, ca.Cert.SerialNumber, newCA.Cert.SerialNumber, "CA should not be changed.")
+	assert.Equal(t, admin.Cert.SerialNumber, newAdmin.Cert.SerialNumber, "Valid certificate "+
+		"should not be re-issued.")
+	assert.NotEqual(t, apiserver.Cert.SerialNumber, newAPIServer.Cert.SerialNumber, "Certificate "+
+		"missing SANs should be re-issued.")
+}
+
+func TestEnsureMismatchedKey(t *testing.T) {
+	p, _, clean := newPKI(t)
+	defer clean()
+
+	if err := p.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	admin, err := p.LoadKeyPair(pki.AdminName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a key replaced without its certificate, e.g. by an interrupted write
+	key, err := ioutil.ReadFile(p.KeyPath(pki.APIServerName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p.KeyPath(pki.AdminName), key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.LoadKeyPair(pki.AdminName)
+	assert.NotNil(t, err, "Key pair not matching should fail loading.")
+
+	if err := p.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	newAdmin, err := p.LoadKeyPair(pki.AdminName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, admin.Cert.SerialNumber, newAdmin.Cert.SerialNumber, "Certificate "+
+		"not matching its key should be re-issued.")
+}
+
+func TestRenew(t *testing.T) {
+	p, _, clean := newPKI(t)
+	defer clean()
+
+	if err := p.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+	ca, err := p.LoadKeyPair(pki.CAName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kubelet, err := p.LoadKeyPair(pki.KubeletName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pl := plan.New("certs renew", "node-a")
+	if err := p.PlanRenew(pki.KubeletName, pl); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{pki.KubeletName}, pl.Targets(plan.IssueCert))
+	assert.NotNil(t, p.PlanRenew(pki.CAName, pl), "CA should not be planned to renew.")
+
+	if err := p.Renew(pki.KubeletName); err != nil {
+		t.Fatal(err)
+	}
+	renewed, err := p.LoadKeyPair(pki.KubeletName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, kubelet.Cert.SerialNumber, renewed.Cert.SerialNumber)
+	assert.Nil(t, renewed.Cert.CheckSignatureFrom(ca.Cert), "Renewed certificate should be "+
+		"signed by the existing CA.")
+
+	assert.NotNil(t, p.Renew(pki.CAName), "CA should not be renewed.")
+}
+
+func TestInspect(t *testing.T) {
+	p, _, clean := newPKI(t)
+	defer clean()
+
+	if err := p.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := pki.Inspect(p.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, ci := range infos {
+		names = append(names, ci.Name)
+		assert.False(t, ci.ExpiresWithin(0), "Certificate %s should not be expired.", ci.Name)
+		assert.True(t, ci.ExpiresWithin(pki.CAValidity+time.Hour), "Certificate %s should "+
+			"not outlive the CA.", ci.Name)
+	}
+	assert.Equal(t, []string{
+		"admin",
+		"apiserver",
+		"apiserver-etcd-client",
+		"apiserver-kubelet-client",
+		"ca",
+		"etcd/ca",
+		"etcd/healthcheck-client",
+		"etcd/peer",
+		"etcd/server",
+		"front-proxy-ca",
+		"front-proxy-client",
+		"kubelet",
+	}, names)
+}
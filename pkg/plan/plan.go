@@ -0,0 +1,81 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package plan
+
+// Kind is the kind of an action
+type Kind string
+
+// kinds of actions
+const (
+	// WriteFile writes a file or populates a directory
+	WriteFile Kind = "write-file"
+	// IssueCert issues a certificate or generates a CA
+	IssueCert Kind = "issue-cert"
+	// StartProcess starts a supervised process
+	StartProcess Kind = "start-process"
+	// ApplyManifest applies a manifest to the cluster
+	ApplyManifest Kind = "apply-manifest"
+	// DeleteObject deletes an object from the cluster
+	DeleteObject Kind = "delete-object"
+	// Request sends a request changing the cluster to a remote server
+	Request Kind = "request"
+	// StopProcess stops a running process
+	StopProcess Kind = "stop-process"
+	// Unmount unmounts a mount point
+	Unmount Kind = "unmount"
+	// DeleteLink deletes a network interface
+	DeleteLink Kind = "delete-link"
+	// DeleteChain deletes an iptables chain with the rules jumping to it
+	DeleteChain Kind = "delete-chain"
+	// RemoveFile removes a file or a directory with all its content
+	RemoveFile Kind = "remove-file"
+)
+
+// Action is a single step a command would take
+type Action struct {
+	Kind   Kind   `json:"kind"`
+	Target string `json:"target"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Plan is the ordered actions an operation would take on a node,
+// which is built instead of taking the actions in dry runs
+type Plan struct {
+	Operation string   `json:"operation"`
+	Node      string   `json:"node"`
+	Actions   []Action `json:"actions"`
+}
+
+// New returns an empty plan of the operation on the node
+func New(operation, node string) *Plan {
+	return &Plan{Operation: operation, Node: node, Actions: []Action{}}
+}
+
+// Add appends an action to the plan
+func (p *Plan) Add(kind Kind, target, detail string) {
+	p.Actions = append(p.Actions, Action{Kind: kind, Target: target, Detail: detail})
+}
+
+// Targets returns targets of the actions of the kind in order
+func (p *Plan) Targets(kind Kind) []string {
+	targets := []string{}
+	for _, a := range p.Actions {
+		if a.Kind == kind {
+			targets = append(targets, a.Target)
+		}
+	}
+	return targets
+}
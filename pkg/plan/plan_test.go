@@ -0,0 +1,42 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package plan_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jiuchen1986/cks/pkg/plan"
+)
+
+func TestPlan(t *testing.T) {
+	pl := plan.New("controller", "node-a")
+	pl.Add(plan.IssueCert, "ca", "generate CA")
+	pl.Add(plan.WriteFile, "/var/lib/cks/pki/sa.key", "")
+	pl.Add(plan.IssueCert, "apiserver", "signed by ca")
+
+	assert.Equal(t, []string{"ca", "apiserver"}, pl.Targets(plan.IssueCert), "Targets should keep the order.")
+	assert.Empty(t, pl.Targets(plan.StartProcess))
+
+	out, err := json.Marshal(pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(out), `{"kind":"write-file","target":"/var/lib/cks/pki/sa.key"}`,
+		"Empty detail should be omitted.")
+}
@@ -0,0 +1,425 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package preflight
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// RequiredModules are the kernel modules workers need
+	RequiredModules = []string{"overlay", "br_netfilter"}
+	// RequiredSysctls are the sysctls workers need with their values
+	RequiredSysctls = map[string]string{
+		"net.ipv4.ip_forward":                 "1",
+		"net.bridge.bridge-nf-call-iptables":  "1",
+		"net.bridge.bridge-nf-call-ip6tables": "1",
+	}
+	// RequiredCgroupControllers are the cgroup controllers kubelet needs
+	RequiredCgroupControllers = []string{"cpu", "memory", "pids"}
+
+	// ControllerPorts are the ports controllers listen on
+	// except the API port, i.e. etcd client and peer, join server,
+	// controller-manager and scheduler
+	ControllerPorts = []int{2379, 2380, 9443, 10257, 10259}
+	// WorkerPorts are the ports workers listen on, i.e. kubelet and the apiserver load balancer
+	WorkerPorts = []int{10250, 6444}
+)
+
+const (
+	// MinDiskFree is the free space of the data directory below which nodes fail
+	MinDiskFree uint64 = 2 << 30
+	// RecommendedDiskFree is the free space of the data directory below which nodes warn
+	RecommendedDiskFree uint64 = 10 << 30
+
+	// MaxClockSkew is the clock skew beyond which certificates may be rejected
+	MaxClockSkew time.Duration = time.Minute
+	// WarnClockSkew is the clock skew beyond which nodes warn
+	WarnClockSkew time.Duration = 5 * time.Second
+)
+
+// KernelModulesCheck checks the kernel modules are loaded or built in
+type KernelModulesCheck struct {
+	Modules []string
+}
+
+// Name implements Check
+func (c *KernelModulesCheck) Name() string {
+	return "kernel-modules"
+}
+
+// Run implements Check
+func (c *KernelModulesCheck) Run(env *Env) Result {
+	loaded := map[string]bool{}
+	if data, err := readFile(env.FS, "/proc/modules"); err == nil {
+		for _, line := range lines(data) {
+			if fields := strings.Fields(line); len(fields) > 0 {
+				loaded[fields[0]] = true
+			}
+		}
+	}
+
+	missing := []string{}
+	for _, m := range c.Modules {
+		// built-in modules are absent in /proc/modules but present in /sys/module
+		if _, err := fs.Stat(env.FS, trimRoot("/sys/module/"+m)); loaded[m] || err == nil {
+			continue
+		}
+		missing = append(missing, m)
+	}
+	if len(missing) > 0 {
+		return Result{
+			Status:  StatusFail,
+			Message: fmt.Sprintf("kernel modules not loaded: %s", strings.Join(missing, ", ")),
+			Hint:    fmt.Sprintf("run modprobe %s and add them to /etc/modules-load.d", strings.Join(missing, " ")),
+		}
+	}
+	return Result{Status: StatusPass, Message: "kernel modules loaded: " + strings.Join(c.Modules, ", ")}
+}
+
+// SysctlCheck checks the sysctls have the expected values
+type SysctlCheck struct {
+	Sysctls map[string]string
+}
+
+// Name implements Check
+func (c *SysctlCheck) Name() string {
+	return "sysctl"
+}
+
+// Run implements Check
+func (c *SysctlCheck) Run(env *Env) Result {
+	wrong := []string{}
+	for _, key := range sortedKeys(c.Sysctls) {
+		data, err := readFile(env.FS, "/proc/sys/"+strings.ReplaceAll(key, ".", "/"))
+		if err != nil {
+			wrong = append(wrong, fmt.Sprintf("%s is unavailable", key))
+			continue
+		}
+		if v := strings.TrimSpace(string(data)); v != c.Sysctls[key] {
+			wrong = append(wrong, fmt.Sprintf("%s=%s", key, v))
+		}
+	}
+	if len(wrong) > 0 {
+		hints := []string{}
+		for _, key := range sortedKeys(c.Sysctls) {
+			hints = append(hints, fmt.Sprintf("%s=%s", key, c.Sysctls[key]))
+		}
+		return Result{
+			Status:  StatusFail,
+			Message: "unexpected sysctls: " + strings.Join(wrong, ", "),
+			Hint:    "run sysctl -w " + strings.Join(hints, " ") + " and persist them in /etc/sysctl.d",
+		}
+	}
+	return Result{Status: StatusPass, Message: "sysctls as expected"}
+}
+
+// SwapCheck checks swap is off as kubelet refuses to run with swap by default
+type SwapCheck struct{}
+
+// Name implements Check
+func (c *SwapCheck) Name() string {
+	return "swap"
+}
+
+// Run implements Check
+func (c *SwapCheck) Run(env *Env) Result {
+	data, err := readFile(env.FS, "/proc/swaps")
+	if err != nil {
+		return Result{Status: StatusWarn, Message: fmt.Sprintf("unable to detect swap: %v", err)}
+	}
+	// the first line is the header
+	if swaps := lines(data); len(swaps) > 1 {
+		devices := []string{}
+		for _, line := range swaps[1:] {
+			devices = append(devices, strings.Fields(line)[0])
+		}
+		return Result{
+			Status:  StatusFail,
+			Message: "swap is on: " + strings.Join(devices, ", "),
+			Hint:    "run swapoff -a and remove swap entries from /etc/fstab",
+		}
+	}
+	return Result{Status: StatusPass, Message: "swap is off"}
+}
+
+// CgroupVersion detects whether the host runs cgroup v1 or v2 (unified)
+func CgroupVersion(fsys fs.FS) (int, error) {
+	if _, err := fs.Stat(fsys, trimRoot("/sys/fs/cgroup/cgroup.controllers")); err == nil {
+		return 2, nil
+	}
+	if _, err := fs.Stat(fsys, trimRoot("/proc/cgroups")); err == nil {
+		return 1, nil
+	}
+	return 0, errors.New("neither cgroup v1 nor v2 is found")
+}
+
+// CgroupsCheck checks the required cgroup controllers are enabled
+type CgroupsCheck struct{}
+
+// Name implements Check
+func (c *CgroupsCheck) Name() string {
+	return "cgroups"
+}
+
+// Run implements Check
+func (c *CgroupsCheck) Run(env *Env) Result {
+	version, err := CgroupVersion(env.FS)
+	if err != nil {
+		return Result{Status: StatusFail, Message: err.Error(), Hint: "mount cgroup filesystems under /sys/fs/cgroup"}
+	}
+
+	enabled := map[string]bool{}
+	if version == 2 {
+		data, err := readFile(env.FS, "/sys/fs/cgroup/cgroup.controllers")
+		if err != nil {
+			return Result{Status: StatusFail, Message: err.Error()}
+		}
+		for _, ctrl := range strings.Fields(string(data)) {
+			enabled[ctrl] = true
+		}
+	} else {
+		data, err := readFile(env.FS, "/proc/cgroups")
+		if err != nil {
+			return Result{Status: StatusFail, Message: err.Error()}
+		}
+		// #subsys_name hierarchy num_cgroups enabled
+		for _, line := range lines(data) {
+			fields := strings.Fields(line)
+			if len(fields) == 4 && !strings.HasPrefix(fields[0], "#") && fields[3] == "1" {
+				enabled[fields[0]] = true
+			}
+		}
+	}
+
+	missing := []string{}
+	for _, ctrl := range RequiredCgroupControllers {
+		if !enabled[ctrl] {
+			missing = append(missing, ctrl)
+		}
+	}
+	if len(missing) > 0 {
+		return Result{
+			Status:  StatusFail,
+			Message: fmt.Sprintf("cgroup v%d controllers not enabled: %s", version, strings.Join(missing, ", ")),
+			Hint:    "enable the controllers on the kernel command line, e.g. cgroup_enable=memory",
+		}
+	}
+	return Result{Status: StatusPass, Message: fmt.Sprintf("cgroup v%d with required controllers", version)}
+}
+
+// PortsCheck checks the ports are free to listen on
+type PortsCheck struct {
+	Ports []int
+}
+
+// Name implements Check
+func (c *PortsCheck) Name() string {
+	return "ports"
+}
+
+// Run implements Check
+func (c *PortsCheck) Run(env *Env) Result {
+	used := []string{}
+	for _, p := range c.Ports {
+		ln, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(p)))
+		if err != nil {
+			used = append(used, strconv.Itoa(p))
+			continue
+		}
+		ln.Close()
+	}
+	if len(used) > 0 {
+		return Result{
+			Status:  StatusFail,
+			Message: "ports in use: " + strings.Join(used, ", "),
+			Hint:    "stop the processes listening on the ports, e.g. found by ss -ltnp",
+		}
+	}
+	return Result{Status: StatusPass, Message: "ports are free"}
+}
+
+// DiskSpaceCheck checks the free space of the data directory
+type DiskSpaceCheck struct{}
+
+// Name implements Check
+func (c *DiskSpaceCheck) Name() string {
+	return "disk-space"
+}
+
+// Run implements Check
+func (c *DiskSpaceCheck) Run(env *Env) Result {
+	// the data directory may not be created yet, so the free space
+	// of its nearest existing ancestor in env.FS is checked
+	dir, err := filepath.Abs(env.DataDir)
+	if err != nil {
+		return Result{Status: StatusWarn, Message: fmt.Sprintf("invalid data directory %s: %v", env.DataDir, err)}
+	}
+	for {
+		if _, err := fs.Stat(env.FS, fsPath(dir)); err == nil || dir == filepath.Dir(dir) {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+
+	free, err := env.DiskFree(dir)
+	if err != nil {
+		return Result{Status: StatusWarn, Message: fmt.Sprintf("unable to detect free space of %s: %v", dir, err)}
+	}
+
+	msg := fmt.Sprintf("%s free in %s", formatBytes(free), dir)
+	hint := fmt.Sprintf("free up space or move the data directory, at least %s is recommended", formatBytes(RecommendedDiskFree))
+	switch {
+	case free < MinDiskFree:
+		return Result{Status: StatusFail, Message: msg, Hint: hint}
+	case free < RecommendedDiskFree:
+		return Result{Status: StatusWarn, Message: msg, Hint: hint}
+	}
+	return Result{Status: StatusPass, Message: msg}
+}
+
+// ClockSkewCheck checks the local clock against the reference clock
+type ClockSkewCheck struct{}
+
+// Name implements Check
+func (c *ClockSkewCheck) Name() string {
+	return "clock-skew"
+}
+
+// Run implements Check
+func (c *ClockSkewCheck) Run(env *Env) Result {
+	if env.ReferenceTime == nil {
+		return Result{Status: StatusPass, Message: "no reference clock, skipped"}
+	}
+	ref, err := env.ReferenceTime()
+	if err != nil {
+		return Result{Status: StatusWarn, Message: fmt.Sprintf("unable to get reference time: %v", err)}
+	}
+
+	skew := env.Now().Sub(ref)
+	if skew < 0 {
+		skew = -skew
+	}
+	msg := fmt.Sprintf("clock skew is %s", skew.Round(time.Millisecond))
+	hint := "synchronize the clock with NTP, e.g. by chrony or systemd-timesyncd"
+	switch {
+	case skew > MaxClockSkew:
+		return Result{Status: StatusFail, Message: msg, Hint: hint}
+	case skew > WarnClockSkew:
+		return Result{Status: StatusWarn, Message: msg, Hint: hint}
+	}
+	return Result{Status: StatusPass, Message: msg}
+}
+
+// KubeletConflictCheck checks no other kubelet is installed or running
+type KubeletConflictCheck struct{}
+
+// kubeletInstallPaths are where kubelet of other installers lives
+var kubeletInstallPaths = []string{
+	"/usr/bin/kubelet",
+	"/usr/local/bin/kubelet",
+	"/etc/systemd/system/kubelet.service",
+	"/lib/systemd/system/kubelet.service",
+	"/usr/lib/systemd/system/kubelet.service",
+}
+
+// Name implements Check
+func (c *KubeletConflictCheck) Name() string {
+	return "kubelet-conflict"
+}
+
+// Run implements Check
+func (c *KubeletConflictCheck) Run(env *Env) Result {
+	procs, _ := fs.Glob(env.FS, trimRoot("/proc/*/comm"))
+	for _, p := range procs {
+		data, err := fs.ReadFile(env.FS, p)
+		if err == nil && strings.TrimSpace(string(data)) == "kubelet" {
+			return Result{
+				Status:  StatusFail,
+				Message: fmt.Sprintf("kubelet is running as pid %s", filepath.Base(filepath.Dir(p))),
+				Hint:    "stop the running kubelet, e.g. by systemctl disable --now kubelet",
+			}
+		}
+	}
+
+	found := []string{}
+	for _, p := range kubeletInstallPaths {
+		if _, err := fs.Stat(env.FS, trimRoot(p)); err == nil {
+			found = append(found, p)
+		}
+	}
+	if len(found) > 0 {
+		return Result{
+			Status:  StatusWarn,
+			Message: "another kubelet is installed: " + strings.Join(found, ", "),
+			Hint:    "remove the kubelet package to avoid it being started by accident",
+		}
+	}
+	return Result{Status: StatusPass, Message: "no other kubelet found"}
+}
+
+// trimRoot turns an absolute path into a path of fs.FS
+func trimRoot(path string) string {
+	return strings.TrimPrefix(path, "/")
+}
+
+// fsPath turns an absolute path into a path of fs.FS like trimRoot,
+// where the root is turned into "."
+func fsPath(path string) string {
+	if p := trimRoot(path); p != "" {
+		return p
+	}
+	return "."
+}
+
+func readFile(fsys fs.FS, path string) ([]byte, error) {
+	return fs.ReadFile(fsys, trimRoot(path))
+}
+
+func lines(data []byte) []string {
+	result := []string{}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatBytes(b uint64) string {
+	return fmt.Sprintf("%.1fGiB", float64(b)/float64(1<<30))
+}
@@ -0,0 +1,182 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package preflight
+
+import (
+	"crypto/tls"
+	"io/fs"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+)
+
+// Status is the outcome of a check
+type Status string
+
+const (
+	// StatusPass means nothing is wrong
+	StatusPass Status = "pass"
+	// StatusWarn means the node works but may misbehave
+	StatusWarn Status = "warn"
+	// StatusFail means the node is unable to work
+	StatusFail Status = "fail"
+)
+
+// IgnoreAll ignores failures of all the checks
+const IgnoreAll string = "all"
+
+// Result is the result of a check
+type Result struct {
+	Name    string `json:"name"`
+	Status  Status `json:"status"`
+	Message string `json:"message"`
+	// Hint tells how to fix a warning or a failure
+	Hint    string `json:"hint,omitempty"`
+	Ignored bool   `json:"ignored,omitempty"`
+}
+
+// Check inspects a single aspect of the node
+type Check interface {
+	Name() string
+	Run(env *Env) Result
+}
+
+// Env is what checks inspect, all of which are injectable for tests
+type Env struct {
+	// FS is the root filesystem where /proc and /sys are read from
+	FS fs.FS
+	// DataDir is the data directory of cks
+	DataDir string
+	// DiskFree returns the free bytes of the filesystem of the path
+	DiskFree func(path string) (uint64, error)
+	// Now returns the local time
+	Now func() time.Time
+	// ReferenceTime returns the time of a trusted clock, the clock skew
+	// check is skipped if it's nil
+	ReferenceTime func() (time.Time, error)
+}
+
+// NewEnv returns the env of the host
+func NewEnv(dataDir string) *Env {
+	return &Env{
+		FS:       os.DirFS("/"),
+		DataDir:  dataDir,
+		DiskFree: statfsFree,
+		Now:      time.Now,
+	}
+}
+
+// Report is the results of all the checks run
+type Report struct {
+	Results []Result `json:"results"`
+}
+
+// Failed returns the results failed and not ignored
+func (r *Report) Failed() []Result {
+	failed := []Result{}
+	for _, res := range r.Results {
+		if res.Status == StatusFail && !res.Ignored {
+			failed = append(failed, res)
+		}
+	}
+	return failed
+}
+
+// Run runs the checks in order, where failures of checks
+// named in ignore, or all if ignore includes IgnoreAll, are marked ignored
+func Run(env *Env, checks []Check, ignore []string) *Report {
+	ignored := map[string]bool{}
+	for _, name := range ignore {
+		ignored[name] = true
+	}
+
+	report := &Report{Results: []Result{}}
+	for _, c := range checks {
+		res := c.Run(env)
+		res.Name = c.Name()
+		if res.Status == StatusFail && (ignored[IgnoreAll] || ignored[res.Name]) {
+			res.Ignored = true
+		}
+		report.Results = append(report.Results, res)
+	}
+	return report
+}
+
+// For returns the checks for a node playing the roles in the cluster
+func For(cfg *conf.ClusterConfig, roles []conf.Role) []Check {
+	checks := []Check{&CgroupsCheck{}, &DiskSpaceCheck{}, &ClockSkewCheck{}}
+
+	ports := []int{}
+	for _, r := range roles {
+		switch r {
+		case conf.RoleController:
+			ports = append(ports, cfg.API.Port)
+			ports = append(ports, ControllerPorts...)
+		case conf.RoleWorker:
+			ports = append(ports, WorkerPorts...)
+			checks = append(checks,
+				&KernelModulesCheck{Modules: RequiredModules},
+				&SysctlCheck{Sysctls: RequiredSysctls},
+				&SwapCheck{},
+				&KubeletConflictCheck{},
+			)
+		}
+	}
+	if len(ports) > 0 {
+		checks = append(checks, &PortsCheck{Ports: ports})
+	}
+	return checks
+}
+
+// Names returns names of the checks
+func Names(checks []Check) []string {
+	names := []string{}
+	for _, c := range checks {
+		names = append(names, c.Name())
+	}
+	return names
+}
+
+// HTTPDate returns the time in the Date header of the server as the reference time,
+// the server is not verified as only the time is read
+func HTTPDate(url string) func() (time.Time, error) {
+	return func() (time.Time, error) {
+		hc := &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		}
+		resp, err := hc.Head(url)
+		if err != nil {
+			return time.Time{}, errors.Wrapf(err, "failed to reach %s", url)
+		}
+		resp.Body.Close()
+		t, err := http.ParseTime(resp.Header.Get("Date"))
+		return t, errors.Wrapf(err, "invalid Date header from %s", url)
+	}
+}
+
+func statfsFree(path string) (uint64, error) {
+	st := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
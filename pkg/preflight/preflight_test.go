@@ -0,0 +1,163 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package preflight_test
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/preflight"
+)
+
+func newEnv(root string, free uint64) *preflight.Env {
+	return &preflight.Env{
+		FS:       os.DirFS(root),
+		DataDir:  "/nonexistent/cks",
+		DiskFree: func(string) (uint64, error) { return free, nil },
+		Now:      time.Now,
+	}
+}
+
+func statuses(r *preflight.Report) map[string]preflight.Status {
+	m := map[string]preflight.Status{}
+	for _, res := range r.Results {
+		m[res.Name] = res.Status
+	}
+	return m
+}
+
+func TestGoodNode(t *testing.T) {
+	env := newEnv("testdata/good", 50<<30)
+	env.ReferenceTime = func() (time.Time, error) { return time.Now().Add(time.Second), nil }
+
+	checks := []preflight.Check{
+		&preflight.KernelModulesCheck{Modules: preflight.RequiredModules},
+		&preflight.SysctlCheck{Sysctls: preflight.RequiredSysctls},
+		&preflight.SwapCheck{},
+		&preflight.CgroupsCheck{},
+		&preflight.DiskSpaceCheck{},
+		&preflight.ClockSkewCheck{},
+		&preflight.KubeletConflictCheck{},
+	}
+	report := preflight.Run(env, checks, nil)
+	for _, res := range report.Results {
+		assert.Equal(t, preflight.StatusPass, res.Status, "%s: %s", res.Name, res.Message)
+	}
+	assert.Empty(t, report.Failed())
+
+	version, err := preflight.CgroupVersion(env.FS)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, version)
+}
+
+func TestBadNode(t *testing.T) {
+	env := newEnv("testdata/bad", 5<<30)
+	env.ReferenceTime = func() (time.Time, error) { return time.Now().Add(-10 * time.Minute), nil }
+
+	checks := []preflight.Check{
+		&preflight.KernelModulesCheck{Modules: preflight.RequiredModules},
+		&preflight.SysctlCheck{Sysctls: preflight.RequiredSysctls},
+		&preflight.SwapCheck{},
+		&preflight.CgroupsCheck{},
+		&preflight.DiskSpaceCheck{},
+		&preflight.ClockSkewCheck{},
+		&preflight.KubeletConflictCheck{},
+	}
+	report := preflight.Run(env, checks, []string{"swap"})
+	assert.Equal(t, map[string]preflight.Status{
+		"kernel-modules":   preflight.StatusFail,
+		"sysctl":           preflight.StatusFail,
+		"swap":             preflight.StatusFail,
+		"cgroups":          preflight.StatusFail,
+		"disk-space":       preflight.StatusWarn,
+		"clock-skew":       preflight.StatusFail,
+		"kubelet-conflict": preflight.StatusFail,
+	}, statuses(report))
+
+	for _, res := range report.Results {
+		if res.Status != preflight.StatusPass {
+			assert.NotEmpty(t, res.Hint, "%s should give a hint.", res.Name)
+		}
+	}
+	assert.Equal(t, 5, len(report.Failed()), "Ignored failure should not be counted.")
+	assert.Contains(t, report.Results[0].Message, "br_netfilter")
+	assert.Contains(t, report.Results[3].Message, "memory")
+
+	version, err := preflight.CgroupVersion(env.FS)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, version)
+
+	report = preflight.Run(env, checks, []string{preflight.IgnoreAll})
+	assert.Empty(t, report.Failed())
+}
+
+func TestPortsCheck(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	res := (&preflight.PortsCheck{Ports: []int{port}}).Run(newEnv("testdata/good", 0))
+	assert.Equal(t, preflight.StatusFail, res.Status)
+	assert.Contains(t, res.Message, strconv.Itoa(port))
+}
+
+func TestDiskAndClockErrors(t *testing.T) {
+	env := newEnv("testdata/good", 0)
+	env.DiskFree = func(string) (uint64, error) { return 0, errors.New("boom") }
+	env.ReferenceTime = func() (time.Time, error) { return time.Time{}, errors.New("boom") }
+
+	assert.Equal(t, preflight.StatusWarn, (&preflight.DiskSpaceCheck{}).Run(env).Status)
+	assert.Equal(t, preflight.StatusWarn, (&preflight.ClockSkewCheck{}).Run(env).Status)
+
+	env.DiskFree = func(string) (uint64, error) { return 1 << 30, nil }
+	assert.Equal(t, preflight.StatusFail, (&preflight.DiskSpaceCheck{}).Run(env).Status)
+}
+
+func TestDiskSpaceAncestor(t *testing.T) {
+	env := newEnv("testdata/good", 0)
+	checked := ""
+	env.DiskFree = func(path string) (uint64, error) {
+		checked = path
+		return 0, nil
+	}
+
+	// the ancestor is resolved in env.FS rather than the host
+	env.DataDir = "/proc/sys/net/bridge/cks"
+	(&preflight.DiskSpaceCheck{}).Run(env)
+	assert.Equal(t, "/proc/sys/net/bridge", checked)
+
+	env.DataDir = os.TempDir() + "/cks"
+	(&preflight.DiskSpaceCheck{}).Run(env)
+	assert.Equal(t, "/", checked)
+}
+
+func TestFor(t *testing.T) {
+	cfg := conf.NewDefault()
+	assert.Equal(t, []string{"cgroups", "disk-space", "clock-skew", "ports"},
+		preflight.Names(preflight.For(cfg, []conf.Role{conf.RoleController})))
+	assert.Equal(t, []string{"cgroups", "disk-space", "clock-skew", "kernel-modules", "sysctl", "swap", "kubelet-conflict", "ports"},
+		preflight.Names(preflight.For(cfg, []conf.Role{conf.RoleWorker})))
+}
@@ -0,0 +1,225 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package reset
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/plan"
+	"github.com/jiuchen1986/cks/pkg/state"
+)
+
+const (
+	// DefaultMountsPath is the mount table of the host
+	DefaultMountsPath string = "/proc/self/mounts"
+	// DefaultStopTimeout is how long to wait for a process to exit after SIGTERM
+	DefaultStopTimeout time.Duration = 2 * time.Minute
+)
+
+// Status is the status of a step
+type Status string
+
+// statuses of steps
+const (
+	StatusDone   Status = "done"
+	StatusFailed Status = "failed"
+	// StatusSkipped is a destructive step skipped as an earlier step failed
+	StatusSkipped Status = "skipped"
+)
+
+// Process is a running process on the host
+type Process struct {
+	PID  int
+	PPID int
+	// Name is the base name of the executable in the command line
+	Name    string
+	Cmdline []string
+}
+
+// Env is the host a reset acts on, which is replaceable in tests
+type Env struct {
+	DataDir    string
+	MountsPath string
+	// Exec runs a command and returns its combined output
+	Exec func(name string, args ...string) ([]byte, error)
+	// Kill sends the signal to the process
+	Kill func(pid int, sig syscall.Signal) error
+	// Unmount detaches the mount point
+	Unmount func(target string) error
+	// Processes lists the running processes
+	Processes func() ([]Process, error)
+	// Links lists names of the network interfaces
+	Links       func() ([]string, error)
+	StopTimeout time.Duration
+
+	// Lock is the lock of the data directory taken once the running cks stops
+	Lock *state.Lock
+}
+
+// NewEnv returns the env of the host with the data directory
+func NewEnv(dataDir string) *Env {
+	// component processes are matched by the absolute data directory in their arguments
+	if abs, err := filepath.Abs(dataDir); err == nil {
+		dataDir = abs
+	}
+	return &Env{
+		DataDir:    dataDir,
+		MountsPath: DefaultMountsPath,
+		Exec: func(name string, args ...string) ([]byte, error) {
+			return exec.Command(name, args...).CombinedOutput()
+		},
+		Kill: syscall.Kill,
+		Unmount: func(target string) error {
+			return syscall.Unmount(target, syscall.MNT_DETACH)
+		},
+		Processes:   procProcesses,
+		Links:       netLinks,
+		StopTimeout: DefaultStopTimeout,
+	}
+}
+
+// Step is a step of the reset, which tolerates what has been cleaned
+// up already so that a reset is able to be re-run after partial failures
+type Step interface {
+	Name() string
+	// Plan adds the actions the step would take to the plan
+	Plan(env *Env, pl *plan.Plan) error
+	Run(env *Env) error
+}
+
+// Destructive is implemented by steps destroying what the earlier steps release,
+// e.g. the data directory unmounted and unlocked, which are skipped once an earlier step failed
+type Destructive interface {
+	Destructive() bool
+}
+
+func isDestructive(s Step) bool {
+	d, ok := s.(Destructive)
+	return ok && d.Destructive()
+}
+
+// Result is the result of a step
+type Result struct {
+	Step   string `json:"step"`
+	Status Status `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Report holds results of all the steps in order
+type Report struct {
+	Results []Result `json:"results"`
+	errs    error
+}
+
+// Err returns errors of all the failed steps combined, or nil if all are done
+func (r *Report) Err() error {
+	return r.errs
+}
+
+// Run runs all the steps in order, where a failed step never stops the following ones
+// unless they're destructive, which are skipped to be re-run once the failure is fixed
+func Run(env *Env, steps []Step) *Report {
+	logger := lgr.GetGlobalLogger()
+	defer logger.Sync()
+
+	report := &Report{Results: []Result{}}
+	failed := ""
+	for _, s := range steps {
+		res := Result{Step: s.Name(), Status: StatusDone}
+		if failed != "" && isDestructive(s) {
+			logger.Warnf("reset step %s skipped as step %s failed", s.Name(), failed)
+			res.Status = StatusSkipped
+			res.Error = "skipped as step " + failed + " failed"
+			report.Results = append(report.Results, res)
+			continue
+		}
+
+		logger.Infof("reset step %s", s.Name())
+		if err := s.Run(env); err != nil {
+			logger.Errorf("reset step %s failed: %v", s.Name(), err)
+			res.Status = StatusFailed
+			res.Error = err.Error()
+			report.errs = multierr.Append(report.errs, errors.Wrapf(err, "step %s", s.Name()))
+			if failed == "" {
+				failed = s.Name()
+			}
+		}
+		report.Results = append(report.Results, res)
+	}
+	return report
+}
+
+// Plan adds the actions of all the steps to the plan in order
+func Plan(env *Env, steps []Step, pl *plan.Plan) error {
+	for _, s := range steps {
+		if err := s.Plan(env, pl); err != nil {
+			return errors.Wrapf(err, "failed to plan step %s", s.Name())
+		}
+	}
+	return nil
+}
+
+// procProcesses lists the running processes from /proc
+func procProcesses() ([]Process, error) {
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list processes")
+	}
+
+	procs := []Process{}
+	for _, d := range dirs {
+		pid, err := strconv.Atoi(d.Name())
+		if err != nil {
+			continue
+		}
+		// processes may exit meanwhile, and kernel threads have no command lines
+		data, err := ioutil.ReadFile(filepath.Join("/proc", d.Name(), "cmdline"))
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		cmdline := strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+		procs = append(procs, Process{PID: pid, PPID: procParent(d.Name()), Name: filepath.Base(cmdline[0]),
+			Cmdline: cmdline})
+	}
+	return procs, nil
+}
+
+// procParent returns the parent pid of the process from /proc, or 0 if it's unknown
+func procParent(pid string) int {
+	data, err := ioutil.ReadFile(filepath.Join("/proc", pid, "stat"))
+	if err != nil {
+		return 0
+	}
+	// the command name in parentheses may contain spaces, fields after it are
+	// the state and the parent pid
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) < 2 {
+		return 0
+	}
+	ppid, _ := strconv.Atoi(fields[1])
+	return ppid
+}
@@ -0,0 +1,255 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package reset_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jiuchen1986/cks/pkg/plan"
+	"github.com/jiuchen1986/cks/pkg/reset"
+	"github.com/jiuchen1986/cks/pkg/state"
+)
+
+const iptablesSave = `# Generated by iptables-save
+*nat
+:PREROUTING ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:DOCKER - [0:0]
+:KUBE-SERVICES - [0:0]
+:KUBE-SVC-NPX46M4PTMTKRN6Y - [0:0]
+-A PREROUTING -m comment --comment "kubernetes service portals" -j KUBE-SERVICES
+-A PREROUTING -m addrtype --dst-type LOCAL -j DOCKER
+-A KUBE-SERVICES -d 10.96.0.1/32 -p tcp -m comment --comment "default/kubernetes:https cluster IP" -j KUBE-SVC-NPX46M4PTMTKRN6Y
+COMMIT
+`
+
+type fakeStep struct {
+	name string
+	err  error
+	ran  *[]string
+}
+
+func (s *fakeStep) Name() string                             { return s.name }
+func (s *fakeStep) Plan(env *reset.Env, pl *plan.Plan) error { return nil }
+func (s *fakeStep) Run(env *reset.Env) error {
+	*s.ran = append(*s.ran, s.name)
+	return s.err
+}
+
+// destructiveStep is a fakeStep skipped once an earlier step failed
+type destructiveStep struct {
+	fakeStep
+}
+
+func (s *destructiveStep) Destructive() bool { return true }
+
+func TestRun(t *testing.T) {
+	ran := []string{}
+	report := reset.Run(&reset.Env{}, []reset.Step{
+		&fakeStep{name: "a", ran: &ran},
+		&fakeStep{name: "b", err: errors.New("boom"), ran: &ran},
+		&fakeStep{name: "c", err: errors.New("bang"), ran: &ran},
+		&fakeStep{name: "d", ran: &ran},
+	})
+
+	assert.Equal(t, []string{"a", "b", "c", "d"}, ran, "Failed steps should not stop the following ones.")
+	assert.Equal(t, reset.StatusDone, report.Results[0].Status)
+	assert.Equal(t, reset.StatusFailed, report.Results[1].Status)
+	assert.Equal(t, "boom", report.Results[1].Error)
+	if assert.NotNil(t, report.Err()) {
+		assert.Equal(t, "step b: boom; step c: bang", report.Err().Error(), "Errors should be aggregated.")
+	}
+
+	ran = []string{}
+	report = reset.Run(&reset.Env{}, []reset.Step{
+		&destructiveStep{fakeStep{name: "a", ran: &ran}},
+		&fakeStep{name: "b", err: errors.New("boom"), ran: &ran},
+		&destructiveStep{fakeStep{name: "c", ran: &ran}},
+		&fakeStep{name: "d", ran: &ran},
+	})
+	assert.Equal(t, []string{"a", "b", "d"}, ran, "Destructive steps should be skipped after a failure.")
+	assert.Equal(t, reset.StatusSkipped, report.Results[2].Status)
+	assert.Equal(t, "step b: boom", report.Err().Error())
+}
+
+func TestChainCommands(t *testing.T) {
+	cmds := reset.ChainCommands("nat", []byte(iptablesSave), reset.ChainPrefixes)
+	assert.Equal(t, [][]string{
+		{"-t", "nat", "-D", "PREROUTING", "-m", "comment", "--comment", "kubernetes service portals",
+			"-j", "KUBE-SERVICES"},
+		{"-t", "nat", "-F", "KUBE-SERVICES"},
+		{"-t", "nat", "-F", "KUBE-SVC-NPX46M4PTMTKRN6Y"},
+		{"-t", "nat", "-X", "KUBE-SERVICES"},
+		{"-t", "nat", "-X", "KUBE-SVC-NPX46M4PTMTKRN6Y"},
+	}, cmds, "Only jumps from chains of others should be deleted before the chains.")
+}
+
+func TestSteps(t *testing.T) {
+	root, err := ioutil.TempDir("", "cks-reset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	dataDir := filepath.Join(root, "data")
+	backupDir := filepath.Join(dataDir, "backups")
+	for _, d := range []string{filepath.Join(dataDir, "pki"), backupDir} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	volume := filepath.Join(dataDir, "kubelet", "pods", "a b", "volumes")
+	mounts := fmt.Sprintf("proc /proc proc rw 0 0\ntmpfs %s tmpfs rw 0 0\noverlay %s overlay rw 0 0\n",
+		strings.ReplaceAll(volume, " ", `\040`), filepath.Join(dataDir, "run", "containerd", "rootfs"))
+	mountsPath := filepath.Join(root, "mounts")
+	if err := ioutil.WriteFile(mountsPath, []byte(mounts), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	unmounted, execs, signals := []string{}, []string{}, []string{}
+	env := &reset.Env{
+		DataDir:    dataDir,
+		MountsPath: mountsPath,
+		Exec: func(name string, args ...string) ([]byte, error) {
+			if name == "iptables-save" {
+				return []byte(iptablesSave), nil
+			}
+			execs = append(execs, name+" "+strings.Join(args, " "))
+			return nil, nil
+		},
+		Kill: func(pid int, sig syscall.Signal) error {
+			if sig == 0 {
+				return syscall.ESRCH
+			}
+			signals = append(signals, fmt.Sprintf("%d %s", pid, sig))
+			return nil
+		},
+		Unmount: func(target string) error {
+			unmounted = append(unmounted, target)
+			data, err := ioutil.ReadFile(mountsPath)
+			if err != nil {
+				return err
+			}
+			lines := []string{}
+			for _, l := range strings.Split(string(data), "\n") {
+				if !strings.Contains(l, strings.ReplaceAll(target, " ", `\040`)+" ") {
+					lines = append(lines, l)
+				}
+			}
+			return ioutil.WriteFile(mountsPath, []byte(strings.Join(lines, "\n")), 0644)
+		},
+		Processes: func() ([]reset.Process, error) {
+			return []reset.Process{
+				{PID: 100, Name: "kubelet", Cmdline: []string{"/usr/bin/kubelet", "--root-dir=" + dataDir + "/kubelet"}},
+				{PID: 101, Name: "kubelet", Cmdline: []string{"/usr/bin/kubelet", "--root-dir=/var/lib/kubelet"}},
+				{PID: 102, Name: "bash", Cmdline: []string{"bash", dataDir}},
+				{PID: 111, PPID: 110, Name: "sh", Cmdline: []string{"sh", "-c", "sleep 1000"}},
+				{PID: 110, PPID: 1, Name: "containerd-shim-runc-v2", Cmdline: []string{"containerd-shim-runc-v2",
+					"-address", dataDir + "/run/containerd/containerd.sock"}},
+				{PID: 112, PPID: 111, Name: "sleep", Cmdline: []string{"sleep", "1000"}},
+			}, nil
+		},
+		Links: func() ([]string, error) {
+			return []string{"lo", "eth0", "cni0"}, nil
+		},
+		StopTimeout: time.Second,
+	}
+	steps := []reset.Step{
+		&reset.StopComponentsStep{},
+		&reset.UnmountStep{},
+		&reset.DeleteLinksStep{Links: reset.CNILinks},
+		&reset.DeleteChainsStep{Prefixes: reset.ChainPrefixes, Tables: []string{"nat"}},
+		&reset.RemoveDataDirStep{Keep: []string{backupDir}},
+	}
+
+	pl := plan.New("reset", "node-a")
+	if err := reset.Plan(env, steps, pl); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"sh (pid 111)", "sleep (pid 112)", "kubelet (pid 100)", "containerd-shim-runc-v2 (pid 110)"},
+		pl.Targets(plan.StopProcess), "Only containers, shims and components using the data directory should be stopped.")
+	assert.Equal(t, []string{"cni0"}, pl.Targets(plan.DeleteLink))
+	assert.Equal(t, []string{"nat/KUBE-SERVICES", "nat/KUBE-SVC-NPX46M4PTMTKRN6Y"}, pl.Targets(plan.DeleteChain))
+	assert.Equal(t, []string{filepath.Join(dataDir, "pki")}, pl.Targets(plan.RemoveFile),
+		"Backups should be kept.")
+	assert.Empty(t, unmounted, "Plan should not change anything.")
+	assert.Empty(t, execs, "Plan should not change anything.")
+
+	report := reset.Run(env, steps)
+	assert.Nil(t, report.Err())
+	if env.Lock != nil {
+		env.Lock.Unlock()
+	}
+
+	assert.Equal(t, []string{"111 terminated", "112 terminated", "100 terminated", "110 terminated"}, signals,
+		"Containers should be stopped before their shims.")
+	assert.Equal(t, []string{filepath.Join(dataDir, "run", "containerd", "rootfs"), volume}, unmounted,
+		"Mounts should be unmounted in the reverse order.")
+	assert.Contains(t, execs, "ip link delete cni0")
+	assert.Contains(t, execs, "iptables -t nat -X KUBE-SERVICES")
+	_, err = os.Stat(filepath.Join(dataDir, "pki"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(backupDir)
+	assert.Nil(t, err, "Backups should be kept.")
+}
+
+func TestRemoveDataDirRefused(t *testing.T) {
+	root, err := ioutil.TempDir("", "cks-reset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	dataDir := filepath.Join(root, "data")
+	if err := os.MkdirAll(filepath.Join(dataDir, "kubelet"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	mountsPath := filepath.Join(root, "mounts")
+	mounts := fmt.Sprintf("tmpfs %s tmpfs rw 0 0\n", filepath.Join(dataDir, "kubelet", "volume"))
+	if err := ioutil.WriteFile(mountsPath, []byte(mounts), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	env := &reset.Env{DataDir: dataDir, MountsPath: mountsPath}
+	step := &reset.RemoveDataDirStep{}
+	assert.NotNil(t, step.Run(env), "Data directory should not be removed without the lock.")
+
+	env.Lock, err = state.LockDataDir(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer env.Lock.Unlock()
+	assert.NotNil(t, step.Run(env), "Data directory should not be removed with mounts in it.")
+	_, err = os.Stat(filepath.Join(dataDir, "kubelet"))
+	assert.Nil(t, err)
+
+	if err := ioutil.WriteFile(mountsPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, step.Run(env))
+	_, err = os.Stat(dataDir)
+	assert.True(t, os.IsNotExist(err))
+}
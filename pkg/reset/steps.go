@@ -0,0 +1,663 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package reset
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+
+	"github.com/jiuchen1986/cks/pkg/controller"
+	"github.com/jiuchen1986/cks/pkg/etcd"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/plan"
+	"github.com/jiuchen1986/cks/pkg/state"
+	"github.com/jiuchen1986/cks/pkg/worker"
+)
+
+// Components are names of the processes cks supervises
+var Components = []string{
+	controller.EtcdName,
+	controller.APIServerName,
+	controller.ControllerManagerName,
+	controller.SchedulerName,
+	worker.ContainerdName,
+	worker.KubeletName,
+}
+
+// Shims are names of the containerd shims, which keep running the containers
+// after containerd stops
+var Shims = []string{"containerd-shim-runc-v2"}
+
+// CNILinks are the network interfaces created by the CNI plugins cks sets up
+var CNILinks = []string{"cni0", "flannel.1"}
+
+// ChainPrefixes are prefixes of the iptables chains created by kubelet,
+// kube-proxy and the CNI plugins cks sets up
+var ChainPrefixes = []string{"KUBE-", "FLANNEL-", "CNI-"}
+
+// ChainTables are the iptables tables holding the chains
+var ChainTables = []string{"filter", "nat", "mangle"}
+
+// etcdLeaveTimeout is how long to wait for the member to be removed
+const etcdLeaveTimeout time.Duration = time.Minute
+
+// StopComponentsStep stops the cks processes running against the data directory,
+// i.e. the controller and worker, which stop the components they supervise, then stops the containers,
+// the shims and the components left behind, and takes the lock of the data directory for the following steps
+type StopComponentsStep struct{}
+
+// Name returns the name of the step
+func (s *StopComponentsStep) Name() string {
+	return "stop-components"
+}
+
+// Plan adds the processes to stop to the plan
+func (s *StopComponentsStep) Plan(env *Env, pl *plan.Plan) error {
+	holders, err := state.LockHolders(env.DataDir)
+	if err != nil {
+		return err
+	}
+	for _, holder := range holders {
+		pl.Add(plan.StopProcess, fmt.Sprintf("cks (pid %d)", holder), "stop the components it supervises")
+	}
+
+	containers, procs, err := leftBehind(env)
+	if err != nil {
+		return err
+	}
+	for _, p := range containers {
+		pl.Add(plan.StopProcess, fmt.Sprintf("%s (pid %d)", p.Name, p.PID), "container")
+	}
+	for _, p := range procs {
+		pl.Add(plan.StopProcess, fmt.Sprintf("%s (pid %d)", p.Name, p.PID), "")
+	}
+	return nil
+}
+
+// Run stops the processes
+func (s *StopComponentsStep) Run(env *Env) error {
+	logger := lgr.GetGlobalLogger()
+
+	var errs error
+	holders, err := state.LockHolders(env.DataDir)
+	if err != nil {
+		errs = multierr.Append(errs, err)
+	}
+	for _, holder := range holders {
+		if holder == os.Getpid() {
+			continue
+		}
+		logger.Infof("stop cks (pid %d) running against %s", holder, env.DataDir)
+		errs = multierr.Append(errs, stopProcesses(env, []int{holder}))
+	}
+
+	if env.Lock == nil {
+		lock, err := state.LockDataDir(env.DataDir)
+		if err != nil {
+			errs = multierr.Append(errs, err)
+		}
+		env.Lock = lock
+	}
+
+	// containers are stopped before their shims, which would leave them running otherwise
+	containers, procs, err := leftBehind(env)
+	if err != nil {
+		return multierr.Append(errs, err)
+	}
+	for _, group := range [][]Process{containers, procs} {
+		pids := []int{}
+		for _, p := range group {
+			logger.Infof("stop %s (pid %d) left behind", p.Name, p.PID)
+			pids = append(pids, p.PID)
+		}
+		errs = multierr.Append(errs, stopProcesses(env, pids))
+	}
+	return errs
+}
+
+// leftBehind returns the running container processes, i.e. descendants of the shims,
+// and the component and shim processes using the data directory
+func leftBehind(env *Env) ([]Process, []Process, error) {
+	all, err := env.Processes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	procs := []Process{}
+	// parents tells whether the children of the process are containers
+	parents := map[int]bool{}
+	for _, p := range all {
+		if p.PID == os.Getpid() || !(contains(Components, p.Name) || contains(Shims, p.Name)) {
+			continue
+		}
+		if strings.Contains(strings.Join(p.Cmdline, " "), env.DataDir) {
+			procs = append(procs, p)
+			parents[p.PID] = contains(Shims, p.Name)
+		}
+	}
+
+	// descendants are found in rounds as parents may be listed after their children
+	containers := []Process{}
+	for found := true; found; {
+		found = false
+		for _, p := range all {
+			if _, seen := parents[p.PID]; !seen && parents[p.PPID] {
+				parents[p.PID] = true
+				containers = append(containers, p)
+				found = true
+			}
+		}
+	}
+	return containers, procs, nil
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// stopProcesses sends SIGTERM to the processes and waits for them to exit,
+// the processes are killed if they don't exit in time
+func stopProcesses(env *Env, pids []int) error {
+	var errs error
+	running := []int{}
+	for _, pid := range pids {
+		if err := env.Kill(pid, syscall.SIGTERM); err != nil {
+			if err != syscall.ESRCH {
+				errs = multierr.Append(errs, errors.Wrapf(err, "failed to stop process %d", pid))
+			}
+			continue
+		}
+		running = append(running, pid)
+	}
+
+	deadline := time.Now().Add(env.StopTimeout)
+	for len(running) > 0 && time.Now().Before(deadline) {
+		alive := []int{}
+		for _, pid := range running {
+			if env.Kill(pid, 0) != syscall.ESRCH {
+				alive = append(alive, pid)
+			}
+		}
+		running = alive
+		if len(running) > 0 {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	for _, pid := range running {
+		lgr.GetGlobalLogger().Warnf("process %d did not exit within %s, kill it", pid, env.StopTimeout)
+		if err := env.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+			errs = multierr.Append(errs, errors.Wrapf(err, "failed to kill process %d", pid))
+		}
+	}
+	return errs
+}
+
+// EtcdLeaveStep removes the etcd member of the node from the cluster
+// through the other members, so that the cluster keeps its quorum
+type EtcdLeaveStep struct {
+	NodeName string
+	// Client returns the client talking to the other members
+	Client func() (*etcd.Client, error)
+}
+
+// Name returns the name of the step
+func (s *EtcdLeaveStep) Name() string {
+	return "leave-etcd"
+}
+
+// Plan adds removing the member to the plan if the node has etcd data
+func (s *EtcdLeaveStep) Plan(env *Env, pl *plan.Plan) error {
+	if etcd.IsMember(env.DataDir) {
+		pl.Add(plan.Request, etcd.Name, "remove member "+s.NodeName)
+	}
+	return nil
+}
+
+// Destructive tells the step is destructive, as the member left is unable to run any more
+func (s *EtcdLeaveStep) Destructive() bool {
+	return true
+}
+
+// Run removes the member
+func (s *EtcdLeaveStep) Run(env *Env) error {
+	logger := lgr.GetGlobalLogger()
+
+	if !etcd.IsMember(env.DataDir) {
+		logger.Infof("node %s has no etcd data, skip leaving", s.NodeName)
+		return nil
+	}
+	c, err := s.Client()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdLeaveTimeout)
+	defer cancel()
+	m, err := etcd.Leave(ctx, c, s.NodeName)
+	if err != nil {
+		return err
+	}
+	logger.Infof("etcd member %s (%s) removed", m.Name, m.ID)
+	return nil
+}
+
+// UnmountStep unmounts everything mounted in the data directory,
+// i.e. volumes of pods in the kubelet root and rootfs of containers
+type UnmountStep struct{}
+
+// Name returns the name of the step
+func (s *UnmountStep) Name() string {
+	return "unmount"
+}
+
+// Plan adds the mount points to unmount to the plan
+func (s *UnmountStep) Plan(env *Env, pl *plan.Plan) error {
+	targets, err := mountsIn(env.MountsPath, env.DataDir)
+	if err != nil {
+		return err
+	}
+	for _, t := range targets {
+		pl.Add(plan.Unmount, t, "")
+	}
+	return nil
+}
+
+// Destructive tells the step is destructive, as volumes may be in use by containers left running
+func (s *UnmountStep) Destructive() bool {
+	return true
+}
+
+// Run unmounts the mount points
+func (s *UnmountStep) Run(env *Env) error {
+	logger := lgr.GetGlobalLogger()
+
+	targets, err := mountsIn(env.MountsPath, env.DataDir)
+	if err != nil {
+		return err
+	}
+	var errs error
+	for _, t := range targets {
+		if err := env.Unmount(t); err != nil {
+			errs = multierr.Append(errs, errors.Wrapf(err, "failed to unmount %s", t))
+			continue
+		}
+		logger.Infof("%s unmounted", t)
+	}
+	return errs
+}
+
+// mountsIn returns the mount points in the directory from the mount table,
+// in the reverse order of mounting so that nested ones are unmounted first
+func mountsIn(mountsPath, dir string) ([]string, error) {
+	data, err := ioutil.ReadFile(mountsPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read mount table %s", mountsPath)
+	}
+
+	prefix := filepath.Clean(dir) + string(filepath.Separator)
+	targets := []string{}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		target := unescapeMount(fields[1])
+		if strings.HasPrefix(target, prefix) {
+			targets = append([]string{target}, targets...)
+		}
+	}
+	return targets, nil
+}
+
+// unescapeMount decodes the octal escapes of spaces, tabs,
+// new lines and backslashes in the mount table
+func unescapeMount(s string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(s)
+}
+
+// DeleteLinksStep deletes the network interfaces
+type DeleteLinksStep struct {
+	Links []string
+}
+
+// Name returns the name of the step
+func (s *DeleteLinksStep) Name() string {
+	return "delete-links"
+}
+
+// Plan adds the existing interfaces to delete to the plan
+func (s *DeleteLinksStep) Plan(env *Env, pl *plan.Plan) error {
+	links, err := s.existing(env)
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		pl.Add(plan.DeleteLink, l, "")
+	}
+	return nil
+}
+
+// Run deletes the existing interfaces
+func (s *DeleteLinksStep) Run(env *Env) error {
+	logger := lgr.GetGlobalLogger()
+
+	links, err := s.existing(env)
+	if err != nil {
+		return err
+	}
+	var errs error
+	for _, l := range links {
+		if out, err := env.Exec("ip", "link", "delete", l); err != nil {
+			errs = multierr.Append(errs, errors.Wrapf(err, "failed to delete interface %s: %s", l, bytes.TrimSpace(out)))
+			continue
+		}
+		logger.Infof("interface %s deleted", l)
+	}
+	return errs
+}
+
+func (s *DeleteLinksStep) existing(env *Env) ([]string, error) {
+	all, err := env.Links()
+	if err != nil {
+		return nil, err
+	}
+	links := []string{}
+	for _, l := range s.Links {
+		for _, a := range all {
+			if a == l {
+				links = append(links, l)
+			}
+		}
+	}
+	return links, nil
+}
+
+// netLinks lists names of the network interfaces of the host
+func netLinks() ([]string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list network interfaces")
+	}
+	names := []string{}
+	for _, i := range ifaces {
+		names = append(names, i.Name)
+	}
+	return names, nil
+}
+
+// DeleteChainsStep deletes the iptables chains with the prefixes
+// in the tables, together with the rules jumping to them
+type DeleteChainsStep struct {
+	Prefixes []string
+	Tables   []string
+}
+
+// Name returns the name of the step
+func (s *DeleteChainsStep) Name() string {
+	return "delete-chains"
+}
+
+// Plan adds the chains to delete to the plan
+func (s *DeleteChainsStep) Plan(env *Env, pl *plan.Plan) error {
+	return s.each(env, func(table string, cmds [][]string) error {
+		for _, c := range cmds {
+			if c[2] == "-X" {
+				pl.Add(plan.DeleteChain, table+"/"+c[3], "")
+			}
+		}
+		return nil
+	})
+}
+
+// Run deletes the chains
+func (s *DeleteChainsStep) Run(env *Env) error {
+	logger := lgr.GetGlobalLogger()
+
+	return s.each(env, func(table string, cmds [][]string) error {
+		var errs error
+		for _, c := range cmds {
+			if out, err := env.Exec("iptables", c...); err != nil {
+				errs = multierr.Append(errs, errors.Wrapf(err, "failed to run iptables %s: %s",
+					strings.Join(c, " "), bytes.TrimSpace(out)))
+			}
+		}
+		if errs == nil && len(cmds) > 0 {
+			logger.Infof("iptables chains in table %s deleted", table)
+		}
+		return errs
+	})
+}
+
+// each calls fn with the iptables commands deleting the chains of each table,
+// nothing is done without iptables on the host
+func (s *DeleteChainsStep) each(env *Env, fn func(table string, cmds [][]string) error) error {
+	var errs error
+	for _, table := range s.Tables {
+		out, err := env.Exec("iptables-save", "-t", table)
+		if err != nil {
+			if errors.Is(err, exec.ErrNotFound) {
+				lgr.GetGlobalLogger().Infof("iptables not found, skip deleting chains")
+				return nil
+			}
+			errs = multierr.Append(errs, errors.Wrapf(err, "failed to save iptables table %s: %s",
+				table, bytes.TrimSpace(out)))
+			continue
+		}
+		errs = multierr.Append(errs, fn(table, ChainCommands(table, out, s.Prefixes)))
+	}
+	return errs
+}
+
+// ChainCommands returns arguments of iptables commands deleting the chains with the
+// prefixes in the table from the iptables-save output. Rules in other chains jumping
+// to the chains are deleted first, then the chains are flushed and deleted
+func ChainCommands(table string, save []byte, prefixes []string) [][]string {
+	owned := func(chain string) bool {
+		for _, p := range prefixes {
+			if strings.HasPrefix(chain, p) {
+				return true
+			}
+		}
+		return false
+	}
+
+	chains := []string{}
+	jumps := [][]string{}
+	sc := bufio.NewScanner(bytes.NewReader(save))
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, ":"):
+			if chain := strings.Fields(line[1:])[0]; owned(chain) {
+				chains = append(chains, chain)
+			}
+		case strings.HasPrefix(line, "-A "):
+			rule := splitRule(line[3:])
+			if len(rule) == 0 || owned(rule[0]) {
+				continue
+			}
+			for i := 1; i < len(rule)-1; i++ {
+				if (rule[i] == "-j" || rule[i] == "-g") && owned(rule[i+1]) {
+					jumps = append(jumps, append([]string{"-t", table, "-D"}, rule...))
+					break
+				}
+			}
+		}
+	}
+
+	cmds := jumps
+	for _, c := range chains {
+		cmds = append(cmds, []string{"-t", table, "-F", c})
+	}
+	for _, c := range chains {
+		cmds = append(cmds, []string{"-t", table, "-X", c})
+	}
+	return cmds
+}
+
+// splitRule splits a rule of iptables-save into arguments,
+// where double quoted arguments may contain spaces and escaped quotes
+func splitRule(s string) []string {
+	args := []string{}
+	var cur strings.Builder
+	inArg, quoted := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(s) && s[i+1] == '"':
+			cur.WriteByte('"')
+			i++
+		case c == '"':
+			quoted = !quoted
+			inArg = true
+		case c == ' ' && !quoted:
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args
+}
+
+// RemoveDataDirStep removes the data directory, where entries
+// of the data directory containing the kept paths are left
+type RemoveDataDirStep struct {
+	Keep []string
+}
+
+// Name returns the name of the step
+func (s *RemoveDataDirStep) Name() string {
+	return "remove-data-dir"
+}
+
+// Plan adds the paths to remove to the plan
+func (s *RemoveDataDirStep) Plan(env *Env, pl *plan.Plan) error {
+	paths, err := s.paths(env)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		pl.Add(plan.RemoveFile, p, "")
+	}
+	return nil
+}
+
+// Destructive tells the step is destructive
+func (s *RemoveDataDirStep) Destructive() bool {
+	return true
+}
+
+// Run removes the paths, which is refused unless the data directory is locked
+// and nothing is mounted in it, as removing would reach into the mounted volumes
+func (s *RemoveDataDirStep) Run(env *Env) error {
+	logger := lgr.GetGlobalLogger()
+
+	if env.Lock == nil {
+		return errors.Errorf("data directory %s is not locked, refuse to remove it", env.DataDir)
+	}
+	// mounts may be added meanwhile, e.g. by a kubelet started by others
+	mounts, err := mountsIn(env.MountsPath, env.DataDir)
+	if err != nil {
+		return err
+	}
+	if len(mounts) > 0 {
+		return errors.Errorf("%d mount(s) left in data directory %s, e.g. %s, refuse to remove it",
+			len(mounts), env.DataDir, mounts[0])
+	}
+
+	paths, err := s.paths(env)
+	if err != nil {
+		return err
+	}
+	var errs error
+	for _, p := range paths {
+		if err := os.RemoveAll(p); err != nil {
+			errs = multierr.Append(errs, errors.Wrapf(err, "failed to remove %s", p))
+		}
+	}
+	if errs == nil && len(paths) > 0 {
+		logger.Infof("data directory %s removed", env.DataDir)
+	}
+	return errs
+}
+
+// paths returns the data directory itself if nothing is kept in it,
+// otherwise its entries not containing the kept paths
+func (s *RemoveDataDirStep) paths(env *Env) ([]string, error) {
+	dir := filepath.Clean(env.DataDir)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	kept := []string{}
+	for _, k := range s.Keep {
+		if abs, err := filepath.Abs(k); err == nil {
+			k = abs
+		}
+		if _, err := os.Stat(k); err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(dir, k); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+			kept = append(kept, strings.SplitN(filepath.ToSlash(rel), "/", 2)[0])
+		}
+	}
+	if len(kept) == 0 {
+		return []string{dir}, nil
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read data directory %s", dir)
+	}
+	paths := []string{}
+	for _, e := range entries {
+		keep := false
+		for _, k := range kept {
+			keep = keep || e.Name() == k
+		}
+		if !keep {
+			paths = append(paths, filepath.Join(dir, e.Name()))
+		}
+	}
+	return paths, nil
+}
@@ -0,0 +1,179 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package state
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+)
+
+const (
+	// LockFileName is the name of the lock file in the data directory
+	LockFileName string = "cks.lock"
+
+	// holderWidth is the width of the pid recorded in lock files, which is fixed
+	// so that a pid overwrites the previous one in place without truncating
+	holderWidth int = 20
+	// holderRetries is how many times an empty lock file is read again,
+	// which is the holder not having recorded its pid yet
+	holderRetries int = 10
+	// holderRetryInterval is the interval reading an empty lock file again
+	holderRetryInterval time.Duration = 10 * time.Millisecond
+)
+
+// RoleLockFileName returns the name of the lock file in the data directory
+// held by the controller or worker of the role for its whole run
+func RoleLockFileName(role conf.Role) string {
+	return fmt.Sprintf("cks-%s.lock", role)
+}
+
+// Lock is an exclusive lock on a data directory held by this process
+type Lock struct {
+	f *os.File
+}
+
+// LockDataDir takes the exclusive lock on the data directory without blocking,
+// which fails if another cks process is changing it
+func LockDataDir(dataDir string) (*Lock, error) {
+	return lock(dataDir, LockFileName, "cks process")
+}
+
+// LockRole takes the exclusive lock of the role on the data directory without blocking,
+// which fails if another controller or worker of the role is running against it.
+// It's held for the whole run, while the lock of the data directory is only held
+// during provisioning, so that a controller and a worker run on the same node
+func LockRole(dataDir string, role conf.Role) (*Lock, error) {
+	return lock(dataDir, RoleLockFileName(role), "cks "+string(role))
+}
+
+func lock(dataDir, name, holderName string) (*Lock, error) {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create data directory")
+	}
+	p := filepath.Join(dataDir, name)
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open lock file %s", p)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		holder, _ := readHolder(f)
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errors.Errorf("another %s (pid %s) is running against %s", holderName, holder, dataDir)
+		}
+		return nil, errors.Wrapf(err, "failed to lock %s", p)
+	}
+
+	// record the holder for the error message of others in one write,
+	// so that they never read a partial pid
+	f.WriteAt([]byte(fmt.Sprintf("%-*d\n", holderWidth-1, os.Getpid())), 0)
+	return &Lock{f: f}, nil
+}
+
+// readHolder reads the pid recorded in the lock file, where a lock file just created
+// is read again for a while until its holder records the pid
+func readHolder(f *os.File) (string, error) {
+	buf := make([]byte, holderWidth)
+	for i := 0; ; i++ {
+		n, err := f.ReadAt(buf, 0)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		holder := strings.TrimSpace(string(buf[:n]))
+		if holder != "" || i == holderRetries {
+			return holder, nil
+		}
+		time.Sleep(holderRetryInterval)
+	}
+}
+
+// LockHolder returns pid of the process holding the lock on the data directory,
+// or 0 if no process holds it
+func LockHolder(dataDir string) (int, error) {
+	return lockHolder(filepath.Join(dataDir, LockFileName))
+}
+
+// LockHolders returns pids of the processes holding the lock on the data directory
+// or the lock of any role, i.e. the running controller and worker
+func LockHolders(dataDir string) ([]int, error) {
+	names := []string{LockFileName}
+	for _, r := range []conf.Role{conf.RoleController, conf.RoleWorker} {
+		names = append(names, RoleLockFileName(r))
+	}
+
+	seen := map[int]bool{}
+	holders := []int{}
+	for _, n := range names {
+		pid, err := lockHolder(filepath.Join(dataDir, n))
+		if err != nil {
+			return nil, err
+		}
+		if pid != 0 && !seen[pid] {
+			seen[pid] = true
+			holders = append(holders, pid)
+		}
+	}
+	sort.Ints(holders)
+	return holders, nil
+}
+
+func lockHolder(p string) (int, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, errors.Wrapf(err, "failed to open lock file %s", p)
+	}
+	defer f.Close()
+
+	// a shared lock is enough to probe the exclusive one
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == nil {
+		return 0, nil
+	}
+	if err != syscall.EWOULDBLOCK {
+		return 0, errors.Wrapf(err, "failed to probe lock %s", p)
+	}
+
+	holder, err := readHolder(f)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to read lock file %s", p)
+	}
+	pid, err := strconv.Atoi(holder)
+	if err != nil {
+		return 0, errors.Errorf("invalid holder %q in lock file %s", holder, p)
+	}
+	return pid, nil
+}
+
+// Unlock releases the lock
+func (l *Lock) Unlock() error {
+	defer l.f.Close()
+	return errors.Wrap(syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN), "failed to unlock data directory")
+}
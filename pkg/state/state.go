@@ -0,0 +1,231 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/pki"
+	"github.com/jiuchen1986/cks/pkg/utils"
+)
+
+const (
+	// FormatVersion is the version of the state document
+	FormatVersion int = 1
+	// FileName is the name of the state file in the data directory
+	FileName string = "cks.state"
+)
+
+// State records what has been provisioned on a node
+type State struct {
+	Version     int    `yaml:"version"`
+	ClusterName string `yaml:"clusterName"`
+	// ConfigHash is the hash of the cluster config last applied
+	ConfigHash    string        `yaml:"configHash"`
+	Nodes         []conf.Node   `yaml:"nodes"`
+	Versions      conf.Versions `yaml:"versions"`
+	Certificates  []Certificate `yaml:"certificates,omitempty"`
+	LastOperation *Operation    `yaml:"lastOperation,omitempty"`
+}
+
+// Certificate records a certificate generated on the node
+type Certificate struct {
+	Name     string    `yaml:"name"`
+	Subject  string    `yaml:"subject"`
+	IsCA     bool      `yaml:"isCA,omitempty"`
+	NotAfter time.Time `yaml:"notAfter"`
+}
+
+// Operation is the last successful operation on the node
+type Operation struct {
+	Name string    `yaml:"name"`
+	Node string    `yaml:"node"`
+	Time time.Time `yaml:"time"`
+}
+
+// Path returns path of the state file in the data directory
+func Path(dataDir string) string {
+	return filepath.Join(dataDir, FileName)
+}
+
+// Load reads the state in the data directory,
+// an empty state is returned if nothing has been provisioned
+func Load(dataDir string) (*State, error) {
+	data, err := ioutil.ReadFile(Path(dataDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &State{Version: FormatVersion}, nil
+		}
+		return nil, errors.Wrap(err, "failed to read state")
+	}
+
+	s := &State{}
+	if err := yaml.Unmarshal(data, s); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse state %s", Path(dataDir))
+	}
+	if s.Version != FormatVersion {
+		return nil, errors.Errorf("unsupported state version %d, only support %d", s.Version, FormatVersion)
+	}
+	return s, nil
+}
+
+// Save writes the state into the data directory atomically
+func Save(dataDir string, s *State) error {
+	s.Version = FormatVersion
+	data, err := yaml.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal state")
+	}
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return errors.Wrap(err, "failed to create data directory")
+	}
+	return utils.WriteFileAtomic(Path(dataDir), data, 0600)
+}
+
+// IsEmpty tells whether nothing has been provisioned
+func (s *State) IsEmpty() bool {
+	return s.LastOperation == nil
+}
+
+// Record updates the state with the applied config, certificates
+// in the PKI directory of the data directory and the operation succeeded
+func (s *State) Record(cfg *conf.ClusterConfig, operation, nodeName string, now time.Time) error {
+	hash, err := ConfigHash(cfg)
+	if err != nil {
+		return err
+	}
+
+	certs := []Certificate{}
+	if _, err := os.Stat(pki.Dir(cfg.DataDir)); err == nil {
+		infos, err := pki.Inspect(pki.Dir(cfg.DataDir))
+		if err != nil {
+			return err
+		}
+		for _, ci := range infos {
+			certs = append(certs, Certificate{Name: ci.Name, Subject: ci.Subject, IsCA: ci.IsCA, NotAfter: ci.NotAfter.UTC()})
+		}
+	}
+
+	s.ClusterName = cfg.ClusterName
+	s.ConfigHash = hash
+	s.Nodes = append([]conf.Node{}, cfg.Nodes...)
+	s.Versions = cfg.Versions
+	s.Certificates = certs
+	s.LastOperation = &Operation{Name: operation, Node: nodeName, Time: now.UTC()}
+	return nil
+}
+
+// ConfigHash returns the hash of the cluster config in form of sha256:<hex>
+func ConfigHash(cfg *conf.ClusterConfig) (string, error) {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal cluster config")
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// Change is a difference between the desired config and the state
+type Change struct {
+	// Path is the changed field, e.g. versions.kubernetes or nodes[node-a]
+	Path string `json:"path"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// String describes the change
+func (c Change) String() string {
+	switch {
+	case c.From == "":
+		return fmt.Sprintf("%s added: %s", c.Path, c.To)
+	case c.To == "":
+		return fmt.Sprintf("%s removed: %s", c.Path, c.From)
+	}
+	return fmt.Sprintf("%s changed: %s -> %s", c.Path, c.From, c.To)
+}
+
+// Diff returns the changes from the state to the desired config in a stable order,
+// which is empty if the config has been applied already
+func Diff(s *State, cfg *conf.ClusterConfig) ([]Change, error) {
+	hash, err := ConfigHash(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if s.IsEmpty() {
+		return []Change{{Path: "cluster", To: cfg.ClusterName}}, nil
+	}
+	if hash == s.ConfigHash {
+		return []Change{}, nil
+	}
+
+	changes := []Change{}
+	add := func(path, from, to string) {
+		if from != to {
+			changes = append(changes, Change{Path: path, From: from, To: to})
+		}
+	}
+	add("clusterName", s.ClusterName, cfg.ClusterName)
+	add("versions.kubernetes", s.Versions.Kubernetes, cfg.Versions.Kubernetes)
+	add("versions.etcd", s.Versions.Etcd, cfg.Versions.Etcd)
+	add("versions.containerd", s.Versions.Containerd, cfg.Versions.Containerd)
+
+	recorded := nodeSummaries(s.Nodes)
+	desired := nodeSummaries(cfg.Nodes)
+	names := []string{}
+	for name := range recorded {
+		names = append(names, name)
+	}
+	for name := range desired {
+		if _, ok := recorded[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(fmt.Sprintf("nodes[%s]", name), recorded[name], desired[name])
+	}
+
+	// any other change is only known by the hash
+	if len(changes) == 0 {
+		add("config", s.ConfigHash, hash)
+	}
+	return changes, nil
+}
+
+// nodeSummaries returns summaries of nodes by their names
+func nodeSummaries(nodes []conf.Node) map[string]string {
+	m := map[string]string{}
+	for _, n := range nodes {
+		roles := []string{}
+		for _, r := range n.Roles {
+			roles = append(roles, string(r))
+		}
+		m[n.Name] = n.Address + " " + strings.Join(roles, ",")
+	}
+	return m
+}
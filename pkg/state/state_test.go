@@ -0,0 +1,209 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package state_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/pki"
+	"github.com/jiuchen1986/cks/pkg/state"
+)
+
+func newConfig(dataDir string) *conf.ClusterConfig {
+	cfg := &conf.ClusterConfig{
+		DataDir: dataDir,
+		Nodes: []conf.Node{
+			{Name: "node-a", Address: "192.168.0.10", Roles: []conf.Role{conf.RoleController}},
+			{Name: "node-b", Address: "192.168.0.11", Roles: []conf.Role{conf.RoleWorker}},
+		},
+	}
+	conf.SetDefaults(cfg)
+	return cfg
+}
+
+func TestRecordAndDiff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := newConfig(dir)
+	p, err := pki.New(cfg, "node-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Ensure(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := state.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, s.IsEmpty())
+	changes, err := state.Diff(s, cfg)
+	assert.Nil(t, err)
+	assert.Equal(t, []state.Change{{Path: "cluster", To: "cks"}}, changes, "Everything should be "+
+		"provisioned on the first run.")
+
+	now := time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC)
+	if err := s.Record(cfg, "controller", "node-a", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Save(dir, s); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := state.Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, &state.Operation{Name: "controller", Node: "node-a", Time: now}, loaded.LastOperation)
+	assert.NotEmpty(t, loaded.Certificates)
+	assert.Equal(t, cfg.Versions, loaded.Versions)
+
+	changes, err = state.Diff(loaded, newConfig(dir))
+	assert.Nil(t, err)
+	assert.Empty(t, changes, "Nothing should change with the same config.")
+
+	desired := newConfig(dir)
+	desired.Versions.Kubernetes = "v1.20.0"
+	desired.Nodes = append(desired.Nodes[:1], conf.Node{Name: "node-c", Address: "192.168.0.12", Roles: []conf.Role{conf.RoleWorker}})
+	changes, err = state.Diff(loaded, desired)
+	assert.Nil(t, err)
+	assert.Equal(t, []state.Change{
+		{Path: "versions.kubernetes", From: "v1.19.4", To: "v1.20.0"},
+		{Path: "nodes[node-b]", From: "192.168.0.11 worker"},
+		{Path: "nodes[node-c]", To: "192.168.0.12 worker"},
+	}, changes)
+	assert.Equal(t, "nodes[node-b] removed: 192.168.0.11 worker", changes[1].String())
+
+	desired = newConfig(dir)
+	desired.Network.ClusterDomain = "example.com"
+	changes, err = state.Diff(loaded, desired)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(changes))
+	assert.Equal(t, "config", changes[0].Path, "Other changes should be detected by the config hash.")
+}
+
+func TestLockDataDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := state.LockDataDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = state.LockDataDir(dir)
+	if assert.NotNil(t, err, "Data directory should not be locked twice.") {
+		assert.Contains(t, err.Error(), "another cks process")
+	}
+
+	assert.Nil(t, l.Unlock())
+	l, err = state.LockDataDir(dir)
+	if assert.Nil(t, err, "Data directory should be locked again once unlocked.") {
+		l.Unlock()
+	}
+}
+
+func TestLockRole(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := state.LockRole(dir, conf.RoleController)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Unlock()
+	_, err = state.LockRole(dir, conf.RoleController)
+	if assert.NotNil(t, err, "Role should not be locked twice.") {
+		assert.Contains(t, err.Error(), "another cks controller")
+	}
+
+	// a worker on the same node and other commands are not blocked by a running controller
+	w, err := state.LockRole(dir, conf.RoleWorker)
+	if assert.Nil(t, err, "Other roles should be locked meanwhile.") {
+		defer w.Unlock()
+	}
+	l, err := state.LockDataDir(dir)
+	if assert.Nil(t, err, "Data directory should be locked meanwhile.") {
+		l.Unlock()
+	}
+
+	holder, err := state.LockHolder(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, holder, "Data directory should be unlocked.")
+	holders, err := state.LockHolders(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{os.Getpid()}, holders, "Holders of roles should be found once.")
+}
+
+func TestLockHolderRecording(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a holder which has locked the file just created but not recorded its pid yet
+	p := filepath.Join(dir, state.LockFileName)
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		f.WriteAt([]byte("42\n"), 0)
+	}()
+
+	holder, err := state.LockHolder(dir)
+	assert.Nil(t, err, "Empty lock file should be read again until the pid is recorded.")
+	assert.Equal(t, 42, holder)
+
+	// a longer pid left by a previous holder is overwritten in place
+	if err := ioutil.WriteFile(p, []byte(strconv.Itoa(1<<22)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	l, err := state.LockDataDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Unlock()
+	holder, err = state.LockHolder(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, os.Getpid(), holder)
+}
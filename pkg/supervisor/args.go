@@ -0,0 +1,75 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package supervisor
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// DeleteArg is the value of an extra arg deleting the flag instead of overriding it
+const DeleteArg string = "<delete>"
+
+// Args are command line flags keyed by flag names without leading dashes
+type Args map[string]string
+
+// Merge overrides args with the extra args, where
+// the ones with the value of DeleteArg are deleted
+func (a Args) Merge(extra map[string]string) Args {
+	for k, v := range extra {
+		if v == DeleteArg {
+			delete(a, k)
+			continue
+		}
+		a[k] = v
+	}
+	return a
+}
+
+// Render returns flags sorted by name in form of --name=value
+func (a Args) Render() []string {
+	keys := make([]string, 0, len(a))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	flags := make([]string, 0, len(a))
+	for _, k := range keys {
+		flags = append(flags, fmt.Sprintf("--%s=%s", k, a[k]))
+	}
+	return flags
+}
+
+// LookupBinary returns path of the binary in binDir if exists, otherwise in PATH
+func LookupBinary(binDir, name string) (string, error) {
+	if binDir != "" {
+		p := filepath.Join(binDir, name)
+		if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+			return p, nil
+		}
+	}
+	p, err := exec.LookPath(name)
+	if err != nil {
+		return "", errors.Wrapf(err, "binary %s not found in %s or PATH", name, binDir)
+	}
+	return p, nil
+}
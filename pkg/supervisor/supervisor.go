@@ -0,0 +1,468 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package supervisor
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+)
+
+const (
+	// DefaultInitialBackoff is the default delay before the first restart
+	DefaultInitialBackoff time.Duration = time.Second
+	// DefaultMaxBackoff is the default upper bound of the restart delay
+	DefaultMaxBackoff time.Duration = time.Minute
+	// DefaultStopTimeout is the default time waiting for a process
+	// to exit after SIGTERM before it's killed
+	DefaultStopTimeout time.Duration = 30 * time.Second
+	// DefaultReadyTimeout is the default time waiting for a process
+	// to be ready before starting its dependents anyway
+	DefaultReadyTimeout time.Duration = 5 * time.Minute
+	// DefaultOutputTimeout is the default time waiting for the output
+	// of an exited process to be closed before it's closed by the supervisor,
+	// since it's possibly held open by children of the process
+	DefaultOutputTimeout time.Duration = 5 * time.Second
+
+	// readyInterval is the interval to poll the readiness of a process
+	readyInterval time.Duration = 100 * time.Millisecond
+
+	// maxLineSize is the max size of a line read from a process output
+	maxLineSize int = 1024 * 1024
+)
+
+// Process is a child process run by the supervisor
+type Process struct {
+	// Name is the name of the component, e.g. etcd,
+	// which is also logged as the component field
+	Name string
+	Path string
+	Args []string
+	// Env is appended to the environment of cks
+	Env []string
+	Dir string
+	// DependsOn are names of processes which should be
+	// started before and stopped after this process
+	DependsOn []string
+	// Ready is polled after the process is started if not nil,
+	// dependents are not started until it returns nil
+	Ready func() error
+}
+
+// Status is the status of a supervised process
+type Status struct {
+	Name     string
+	PID      int
+	Running  bool
+	Restarts int
+}
+
+// Supervisor starts processes, restarts them with exponential backoff
+// when they exit, and stops them in dependency order
+type Supervisor struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	StopTimeout    time.Duration
+	ReadyTimeout   time.Duration
+	OutputTimeout  time.Duration
+
+	mu      sync.Mutex
+	runners []*runner
+	started bool
+	stopCh  chan struct{}
+}
+
+// New returns a supervisor with default settings
+func New() *Supervisor {
+	return &Supervisor{
+		InitialBackoff: DefaultInitialBackoff,
+		MaxBackoff:     DefaultMaxBackoff,
+		StopTimeout:    DefaultStopTimeout,
+		ReadyTimeout:   DefaultReadyTimeout,
+		OutputTimeout:  DefaultOutputTimeout,
+	}
+}
+
+// Add adds the process to be supervised, which must be done before Start
+func (s *Supervisor) Add(p Process) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.started {
+		return errors.Errorf("failed to add process %s: supervisor already started", p.Name)
+	}
+	for _, r := range s.runners {
+		if r.proc.Name == p.Name {
+			return errors.Errorf("process %s already added", p.Name)
+		}
+	}
+
+	s.runners = append(s.runners, &runner{
+		proc:   p,
+		s:      s,
+		logger: lgr.Named(p.Name),
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	})
+	return nil
+}
+
+// Start starts all the processes in dependency order
+// and keeps them running until Stop is called.
+// A supervisor is able to be started only once
+func (s *Supervisor) Start() error {
+	s.mu.Lock()
+	if s.stopCh != nil {
+		s.mu.Unlock()
+		return errors.New("supervisor already started")
+	}
+	sorted, err := sortByDependency(s.runners)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.runners = sorted
+	s.started = true
+	s.stopCh = make(chan struct{})
+	s.mu.Unlock()
+
+	for _, r := range sorted {
+		// never launch a process once stopping
+		s.mu.Lock()
+		select {
+		case <-s.stopCh:
+			s.mu.Unlock()
+			return errors.New("supervisor stopped before all processes started")
+		default:
+		}
+		started := make(chan struct{})
+		r.launched = true
+		go r.run(started)
+		s.mu.Unlock()
+
+		// wait for the first try before starting dependents
+		<-started
+		r.waitReady(s.stopCh)
+	}
+	return nil
+}
+
+// Stop stops all the processes in reverse dependency order
+// and waits until they all exit. It's safe to call Stop while starting
+func (s *Supervisor) Stop() {
+	s.mu.Lock()
+	if !s.started {
+		s.mu.Unlock()
+		return
+	}
+	close(s.stopCh)
+	s.started = false
+	runners := s.runners
+	s.mu.Unlock()
+
+	for i := len(runners) - 1; i >= 0; i-- {
+		r := runners[i]
+		if !r.launched {
+			continue
+		}
+		close(r.stopCh)
+		<-r.doneCh
+	}
+}
+
+// Statuses returns status of all the processes
+func (s *Supervisor) Statuses() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ss := []Status{}
+	for _, r := range s.runners {
+		ss = append(ss, r.status())
+	}
+	return ss
+}
+
+// sortByDependency sorts runners so that every runner comes after
+// the ones it depends on, keeping the order they were added otherwise
+func sortByDependency(runners []*runner) ([]*runner, error) {
+	byName := map[string]*runner{}
+	for _, r := range runners {
+		byName[r.proc.Name] = r
+	}
+
+	sorted := []*runner{}
+	// 1 means visiting and 2 means visited
+	state := map[string]int{}
+	var visit func(r *runner) error
+	visit = func(r *runner) error {
+		switch state[r.proc.Name] {
+		case 1:
+			return errors.Errorf("circular dependency found at process %s", r.proc.Name)
+		case 2:
+			return nil
+		}
+
+		state[r.proc.Name] = 1
+		for _, d := range r.proc.DependsOn {
+			dep, ok := byName[d]
+			if !ok {
+				return errors.Errorf("process %s depends on unknown process %s", r.proc.Name, d)
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		state[r.proc.Name] = 2
+		sorted = append(sorted, r)
+		return nil
+	}
+
+	for _, r := range runners {
+		if err := visit(r); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// runner keeps a single process running
+type runner struct {
+	proc   Process
+	s      *Supervisor
+	logger lgr.SugaredLogger
+	stopCh chan struct{}
+	doneCh chan struct{}
+	// launched is guarded by the mutex of the supervisor
+	launched bool
+
+	mu       sync.Mutex
+	pid      int
+	restarts int
+}
+
+func (r *runner) status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return Status{Name: r.proc.Name, PID: r.pid, Running: r.pid != 0, Restarts: r.restarts}
+}
+
+func (r *runner) run(started chan<- struct{}) {
+	defer close(r.doneCh)
+	defer r.logger.Sync()
+
+	delay := r.s.InitialBackoff
+	for first := true; ; first = false {
+		begin := time.Now()
+		stopped, err := r.runOnce(func() {
+			if first {
+				close(started)
+			}
+		})
+		if stopped {
+			r.logger.Infof("process %s stopped", r.proc.Name)
+			return
+		}
+		if err != nil {
+			r.logger.Errorf("process %s exited: %v", r.proc.Name, err)
+		} else {
+			r.logger.Warnf("process %s exited unexpectedly", r.proc.Name)
+		}
+
+		// a process running long enough is considered healthy,
+		// so the next restart is not delayed further
+		if time.Since(begin) > 2*r.s.MaxBackoff {
+			delay = r.s.InitialBackoff
+		}
+
+		r.logger.Infof("restart process %s in %s", r.proc.Name, delay)
+		select {
+		case <-r.stopCh:
+			r.logger.Infof("process %s stopped", r.proc.Name)
+			return
+		case <-time.After(delay):
+		}
+
+		r.mu.Lock()
+		r.restarts++
+		r.mu.Unlock()
+
+		if delay *= 2; delay > r.s.MaxBackoff {
+			delay = r.s.MaxBackoff
+		}
+	}
+}
+
+// runOnce runs the process until it exits or is stopped, and calls
+// onStart once it's tried to start. It returns true if stopped
+func (r *runner) runOnce(onStart func()) (bool, error) {
+	cmd := exec.Command(r.proc.Path, r.proc.Args...)
+	cmd.Env = append(os.Environ(), r.proc.Env...)
+	cmd.Dir = r.proc.Dir
+	// run in its own process group, so that signals sent to cks
+	// by terminal are not propagated and the whole group is able to be stopped
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	// pipes are made here rather than by cmd, so that waiting
+	// for the process doesn't depend on its output being closed
+	stdout, stdoutW, err := os.Pipe()
+	if err != nil {
+		onStart()
+		return false, errors.Wrap(err, "failed to pipe stdout")
+	}
+	stderr, stderrW, err := os.Pipe()
+	if err != nil {
+		stdout.Close()
+		stdoutW.Close()
+		onStart()
+		return false, errors.Wrap(err, "failed to pipe stderr")
+	}
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+
+	r.logger.Infof("start process %s: %s %v", r.proc.Name, r.proc.Path, r.proc.Args)
+	err = cmd.Start()
+	// the write ends are inherited by the process,
+	// reading gets EOF once the process and its children close them
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		stdout.Close()
+		stderr.Close()
+		onStart()
+		return false, errors.Wrapf(err, "failed to start %s", r.proc.Path)
+	}
+	r.setPID(cmd.Process.Pid)
+	defer r.setPID(0)
+	onStart()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go r.pipe(stdout, "stdout", &wg)
+	go r.pipe(stderr, "stderr", &wg)
+
+	// wait for the process independently of its output, which
+	// is possibly held open by its children after it exits
+	exitCh := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		r.closeOutput(&wg, stdout, stderr)
+		exitCh <- err
+	}()
+
+	select {
+	case err := <-exitCh:
+		return false, err
+	case <-r.stopCh:
+	}
+
+	pgid := -cmd.Process.Pid
+	r.logger.Infof("stop process %s with pid %d", r.proc.Name, cmd.Process.Pid)
+	if err := syscall.Kill(pgid, syscall.SIGTERM); err != nil {
+		r.logger.Warnf("failed to terminate process %s: %v", r.proc.Name, err)
+	}
+	select {
+	case <-exitCh:
+	case <-time.After(r.s.StopTimeout):
+		r.logger.Warnf("process %s not exited in %s, kill it", r.proc.Name, r.s.StopTimeout)
+		if err := syscall.Kill(pgid, syscall.SIGKILL); err != nil {
+			r.logger.Warnf("failed to kill process %s: %v", r.proc.Name, err)
+		}
+		<-exitCh
+	}
+	return true, nil
+}
+
+// waitReady polls the readiness of the process until it's ready,
+// timeout or the supervisor is stopping
+func (r *runner) waitReady(stopCh <-chan struct{}) {
+	if r.proc.Ready == nil {
+		return
+	}
+
+	timeout := time.After(r.s.ReadyTimeout)
+	for {
+		err := r.proc.Ready()
+		if err == nil {
+			r.logger.Infof("process %s is ready", r.proc.Name)
+			return
+		}
+
+		select {
+		case <-timeout:
+			r.logger.Warnf("process %s not ready in %s: %v", r.proc.Name, r.s.ReadyTimeout, err)
+			return
+		case <-stopCh:
+			return
+		case <-time.After(readyInterval):
+		}
+	}
+}
+
+func (r *runner) setPID(pid int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pid = pid
+}
+
+// closeOutput waits for the output of the exited process to be read till EOF,
+// and closes it if it's still open after the output timeout
+func (r *runner) closeOutput(wg *sync.WaitGroup, files ...*os.File) {
+	doneCh := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(doneCh)
+	}()
+
+	select {
+	case <-doneCh:
+	case <-time.After(r.s.OutputTimeout):
+		r.logger.Warnf("output of process %s still open %s after it exited, probably held by its "+
+			"children, close it", r.proc.Name, r.s.OutputTimeout)
+	}
+	for _, f := range files {
+		f.Close()
+	}
+	<-doneCh
+}
+
+// pipe logs each line read from the output of the process
+func (r *runner) pipe(rd io.Reader, stream string, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	logger := r.logger.With("stream", stream)
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		logger.Info(scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, os.ErrClosed) {
+			return
+		}
+		logger.Warnf("failed to read output of process %s: %v", r.proc.Name, err)
+		// drain the rest so that the process never blocks on writing
+		io.Copy(ioutil.Discard, rd)
+	}
+}
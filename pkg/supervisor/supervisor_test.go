@@ -0,0 +1,188 @@
+package supervisor_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/jiuchen1986/cks/pkg/supervisor"
+)
+
+// fakeProcess returns a process recording its start and stop into the file
+func fakeProcess(name, record string, deps ...string) supervisor.Process {
+	script := `echo start-$0 >> $1; trap "echo stop-$0 >> $1; exit 0" TERM; while true; do sleep 0.05; done`
+	return supervisor.Process{
+		Name:      name,
+		Path:      "sh",
+		Args:      []string{"-c", script, name, record},
+		DependsOn: deps,
+		Ready: func() error {
+			data, _ := ioutil.ReadFile(record)
+			if !strings.Contains(string(data), "start-"+name) {
+				return errors.New("not started")
+			}
+			return nil
+		},
+	}
+}
+
+func newSupervisor() *supervisor.Supervisor {
+	s := supervisor.New()
+	s.InitialBackoff = 50 * time.Millisecond
+	s.MaxBackoff = 200 * time.Millisecond
+	s.StopTimeout = 2 * time.Second
+	return s
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("timeout waiting for condition")
+}
+
+func TestDependencyOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-supervisor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	record := filepath.Join(dir, "record")
+
+	s := newSupervisor()
+	for _, p := range []supervisor.Process{
+		fakeProcess("scheduler", record, "apiserver"),
+		fakeProcess("apiserver", record, "etcd"),
+		fakeProcess("etcd", record),
+	} {
+		if err := s.Add(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		data, _ := ioutil.ReadFile(record)
+		return strings.Count(string(data), "start") == 3
+	})
+	s.Stop()
+
+	data, err := ioutil.ReadFile(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{
+		"start-etcd", "start-apiserver", "start-scheduler",
+		"stop-scheduler", "stop-apiserver", "stop-etcd",
+	}, strings.Fields(string(data)), "Processes should be started and stopped in dependency order.")
+}
+
+func TestCircularDependency(t *testing.T) {
+	s := newSupervisor()
+	for _, p := range []supervisor.Process{
+		fakeProcess("a", "/dev/null", "b"),
+		fakeProcess("b", "/dev/null", "a"),
+	} {
+		if err := s.Add(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.NotNil(t, s.Start(), "Circular dependency should be rejected.")
+}
+
+func TestRestartAndLog(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	undo := zap.ReplaceGlobals(zap.New(core))
+	defer undo()
+
+	s := newSupervisor()
+	if err := s.Add(supervisor.Process{
+		Name: "crasher",
+		Path: "sh",
+		Args: []string{"-c", "echo hello; echo oops >&2; exit 1"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return s.Statuses()[0].Restarts >= 3 })
+	s.Stop()
+
+	out := logs.FilterField(zap.String("stream", "stdout")).FilterMessage("hello")
+	assert.True(t, out.Len() >= 3, "Stdout of each run should be logged.")
+	for _, e := range out.All() {
+		assert.Equal(t, "crasher", e.ContextMap()["component"], "Output should be logged "+
+			"with the component field.")
+	}
+	assert.True(t, logs.FilterField(zap.String("stream", "stderr")).FilterMessage("oops").Len() >= 3,
+		"Stderr of each run should be logged.")
+}
+
+func TestStopTimeout(t *testing.T) {
+	s := newSupervisor()
+	s.StopTimeout = 100 * time.Millisecond
+	if err := s.Add(supervisor.Process{
+		Name: "stubborn",
+		Path: "sh",
+		Args: []string{"-c", `trap "" TERM; while true; do sleep 0.05; done`},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return s.Statuses()[0].Running })
+
+	begin := time.Now()
+	s.Stop()
+	assert.True(t, time.Since(begin) < 2*time.Second, "Process ignoring SIGTERM should be killed.")
+	assert.False(t, s.Statuses()[0].Running)
+}
+
+func TestOutputHeldByChildren(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-supervisor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	started := filepath.Join(dir, "started")
+
+	s := newSupervisor()
+	s.OutputTimeout = 100 * time.Millisecond
+	// the child in its own session survives stopping the process group
+	// and keeps the output of the process open
+	if err := s.Add(supervisor.Process{
+		Name: "leaky",
+		Path: "sh",
+		Args: []string{"-c", `setsid sleep 3 & touch $0; while true; do sleep 0.05; done`, started},
+		Ready: func() error {
+			_, err := os.Stat(started)
+			return err
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	begin := time.Now()
+	s.Stop()
+	assert.True(t, time.Since(begin) < 2*time.Second, "Stopping should not wait for the output "+
+		"held by children.")
+	assert.False(t, s.Statuses()[0].Running)
+}
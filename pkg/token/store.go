@@ -0,0 +1,210 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package token
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	"github.com/jiuchen1986/cks/pkg/utils"
+)
+
+// ErrNotFound is returned by a store if the token does not exist
+var ErrNotFound = errors.New("token not found")
+
+// Store keeps token records
+type Store interface {
+	Get(id string) (*Record, error)
+	Put(r *Record) error
+	Delete(id string) error
+	// List returns all the records sorted by creation time
+	List() ([]*Record, error)
+}
+
+// Dir returns the directory keeping tokens in the data directory
+func Dir(dataDir string) string {
+	return filepath.Join(dataDir, "tokens")
+}
+
+// FileStore keeps each token record in a yaml file in the directory
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore returns a store keeping records in the directory
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+// Get reads the record of the token
+func (s *FileStore) Get(id string) (*Record, error) {
+	if err := validateID(id); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(s.path(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrapf(err, "failed to read token %s", id)
+	}
+	r := &Record{}
+	if err := yaml.Unmarshal(data, r); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse token %s", id)
+	}
+	return r, nil
+}
+
+// Put writes the record of the token readable only by the owner
+func (s *FileStore) Put(r *Record) error {
+	if err := validateID(r.ID); err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(r)
+	if err != nil {
+		return errors.Wrapf(err, "failed to marshal token %s", r.ID)
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return errors.Wrap(err, "failed to create token directory")
+	}
+	return utils.WriteFileAtomic(s.path(r.ID), data, 0600)
+}
+
+// Delete removes the record of the token
+func (s *FileStore) Delete(id string) error {
+	if err := validateID(id); err != nil {
+		return err
+	}
+	if err := os.Remove(s.path(id)); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return errors.Wrapf(err, "failed to delete token %s", id)
+	}
+	return nil
+}
+
+// List reads all the records in the directory
+func (s *FileStore) List() ([]*Record, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*Record{}, nil
+		}
+		return nil, errors.Wrap(err, "failed to read token directory")
+	}
+
+	records := []*Record{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".yaml") {
+			continue
+		}
+		r, err := s.Get(strings.TrimSuffix(e.Name(), ".yaml"))
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	sortRecords(records)
+	return records, nil
+}
+
+func (s *FileStore) path(id string) string {
+	return RecordPath(s.dir, id)
+}
+
+// RecordPath returns path of the record of the token in the directory of a FileStore
+func RecordPath(dir, id string) string {
+	return filepath.Join(dir, id+".yaml")
+}
+
+// MemoryStore keeps token records in memory
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]Record
+}
+
+// NewMemoryStore returns an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: map[string]Record{}}
+}
+
+// Get returns a copy of the record of the token
+func (s *MemoryStore) Get(id string) (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &r, nil
+}
+
+// Put saves a copy of the record of the token
+func (s *MemoryStore) Put(r *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[r.ID] = *r
+	return nil
+}
+
+// Delete removes the record of the token
+func (s *MemoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.records[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.records, id)
+	return nil
+}
+
+// List returns copies of all the records
+func (s *MemoryStore) List() ([]*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := []*Record{}
+	for _, r := range s.records {
+		r := r
+		records = append(records, &r)
+	}
+	sortRecords(records)
+	return records, nil
+}
+
+func sortRecords(records []*Record) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Created.Equal(records[j].Created) {
+			return records[i].ID < records[j].ID
+		}
+		return records[i].Created.Before(records[j].Created)
+	})
+}
+
+// validateID rejects IDs escaping the token directory
+func validateID(id string) error {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return errors.Errorf("invalid token ID %q", id)
+	}
+	return nil
+}
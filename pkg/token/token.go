@@ -0,0 +1,252 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package token
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/utils"
+)
+
+const (
+	// DefaultTTL is how long a token is valid by default
+	DefaultTTL time.Duration = 24 * time.Hour
+
+	// prefix marks the format version of the encoded token
+	prefix string = "cks1."
+
+	idBytes     int = 3
+	secretBytes int = 16
+)
+
+// Token is a bootstrap token carrying everything a node needs to join,
+// i.e. where to reach the cluster and which CA to trust
+type Token struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+	// Server is the URL serving join requests on the API address
+	Server string `json:"server"`
+	// CAHash pins the cluster CA in form of sha256:<hex>
+	CAHash string `json:"caHash"`
+}
+
+// String encodes the token into one opaque string
+func (t *Token) String() string {
+	data, _ := json.Marshal(t)
+	return prefix + base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Parse decodes the token from its opaque string
+func Parse(s string) (*Token, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, prefix) {
+		return nil, errors.New("invalid token format")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, prefix))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid token encoding")
+	}
+	t := &Token{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, errors.Wrap(err, "invalid token payload")
+	}
+	if t.ID == "" || t.Secret == "" || t.Server == "" || t.CAHash == "" {
+		return nil, errors.New("incomplete token")
+	}
+	return t, nil
+}
+
+// Record is what is stored for a token, only the hash of the secret is kept
+type Record struct {
+	ID          string    `yaml:"id" json:"id"`
+	SecretHash  string    `yaml:"secretHash" json:"-"`
+	Role        conf.Role `yaml:"role" json:"role"`
+	Description string    `yaml:"description,omitempty" json:"description,omitempty"`
+	// NodeName is the only node allowed to join with the token if not empty
+	NodeName string    `yaml:"nodeName,omitempty" json:"nodeName,omitempty"`
+	Created  time.Time `yaml:"created" json:"created"`
+	// Expires is zero if the token never expires
+	Expires time.Time `yaml:"expires,omitempty" json:"expires,omitempty"`
+}
+
+// IsExpired tells whether the token has expired at the time
+func (r *Record) IsExpired(now time.Time) bool {
+	return !r.Expires.IsZero() && !now.Before(r.Expires)
+}
+
+// Manager creates, validates and revokes tokens kept in the store
+type Manager struct {
+	store Store
+	// Now returns the current time, replaceable for tests
+	Now func() time.Time
+}
+
+// NewManager returns a manager of tokens in the store
+func NewManager(store Store) *Manager {
+	return &Manager{store: store, Now: time.Now}
+}
+
+// CreateOptions describes a token to create
+type CreateOptions struct {
+	Role        conf.Role
+	Description string
+	// NodeName binds the token to the node, any node joins with it if empty
+	NodeName string
+	// TTL is how long the token is valid, never expires if zero
+	TTL    time.Duration
+	Server string
+	CAHash string
+}
+
+// Validate checks the options are valid to create a token
+func (opts *CreateOptions) Validate() error {
+	if opts.Role != conf.RoleController && opts.Role != conf.RoleWorker {
+		return errors.Errorf("invalid role %q, should be %s or %s", opts.Role, conf.RoleController, conf.RoleWorker)
+	}
+	if opts.NodeName != "" && !conf.IsNodeName(opts.NodeName) {
+		return errors.Errorf("invalid node name %q", opts.NodeName)
+	}
+	if opts.TTL < 0 {
+		return errors.Errorf("invalid TTL %s", opts.TTL)
+	}
+	return nil
+}
+
+// Create generates a token and stores its record
+func (m *Manager) Create(opts *CreateOptions) (*Token, *Record, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	id, err := randomHex(idBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret, err := randomHex(secretBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := m.Now()
+	r := &Record{
+		ID:          id,
+		SecretHash:  hashSecret(secret),
+		Role:        opts.Role,
+		Description: opts.Description,
+		NodeName:    opts.NodeName,
+		Created:     now,
+	}
+	if opts.TTL > 0 {
+		r.Expires = now.Add(opts.TTL)
+	}
+	if err := m.store.Put(r); err != nil {
+		return nil, nil, err
+	}
+
+	return &Token{ID: id, Secret: secret, Server: opts.Server, CAHash: opts.CAHash}, r, nil
+}
+
+// List returns records of all the tokens sorted by creation time
+func (m *Manager) List() ([]*Record, error) {
+	return m.store.List()
+}
+
+// Get returns the record of the token by its ID or its opaque string
+func (m *Manager) Get(idOrToken string) (*Record, error) {
+	return m.store.Get(tokenID(idOrToken))
+}
+
+// Revoke deletes the token by its ID or its opaque string,
+// and returns the ID of the revoked token
+func (m *Manager) Revoke(idOrToken string) (string, error) {
+	id := tokenID(idOrToken)
+	return id, m.store.Delete(id)
+}
+
+// tokenID returns the ID of the token given by its ID or its opaque string
+func tokenID(idOrToken string) string {
+	if t, err := Parse(idOrToken); err == nil {
+		return t.ID
+	}
+	return idOrToken
+}
+
+// Validate checks the token is known, not expired and plays the role
+func (m *Manager) Validate(s string, role conf.Role) (*Record, error) {
+	t, err := Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	r, err := m.store.Get(t.ID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, errors.Errorf("unknown token %s", t.ID)
+		}
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(r.SecretHash), []byte(hashSecret(t.Secret))) != 1 {
+		return nil, errors.Errorf("invalid secret of token %s", t.ID)
+	}
+	if r.IsExpired(m.Now()) {
+		return nil, errors.Errorf("token %s expired at %s", t.ID, r.Expires.Format(time.RFC3339))
+	}
+	if r.Role != role {
+		return nil, errors.Errorf("token %s is for role %s rather than %s", t.ID, r.Role, role)
+	}
+	return r, nil
+}
+
+// Validator returns a validator of the tokens, which satisfies join.TokenValidator
+func (m *Manager) Validator() *Validator {
+	return &Validator{m: m}
+}
+
+// Validator validates tokens for the roles nodes join in
+type Validator struct {
+	m *Manager
+}
+
+// Validate checks the token is valid for the role,
+// and returns the name of the node the token is bound to
+func (v *Validator) Validate(s string, role conf.Role) (string, error) {
+	r, err := v.m.Validate(s, role)
+	if err != nil {
+		return "", err
+	}
+	return r.NodeName, nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b, err := utils.RandomBytes(n)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
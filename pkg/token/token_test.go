@@ -0,0 +1,157 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package token_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/token"
+)
+
+func TestParse(t *testing.T) {
+	tk := &token.Token{ID: "abc123", Secret: "s3cr3t", Server: "https://10.0.0.1:9443", CAHash: "sha256:00ff"}
+
+	parsed, err := token.Parse(tk.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, tk, parsed)
+
+	for _, s := range []string{"", "abc123.s3cr3t", "cks1.!!!", "cks1.e30"} {
+		_, err := token.Parse(s)
+		assert.NotNil(t, err, "Token %q should be invalid.", s)
+	}
+}
+
+func TestManager(t *testing.T) {
+	now := time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC)
+	m := token.NewManager(token.NewMemoryStore())
+	m.Now = func() time.Time { return now }
+
+	tk, r, err := m.Create(&token.CreateOptions{
+		Role:   conf.RoleWorker,
+		TTL:    time.Hour,
+		Server: "https://10.0.0.1:9443",
+		CAHash: "sha256:00ff",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, now.Add(time.Hour), r.Expires)
+	assert.NotEqual(t, tk.Secret, r.SecretHash, "Secret should not be stored in plain text.")
+
+	_, err = m.Validate(tk.String(), conf.RoleWorker)
+	assert.Nil(t, err)
+	node, err := m.Validator().Validate(tk.String(), conf.RoleWorker)
+	assert.Nil(t, err)
+	assert.Empty(t, node, "Token should be bound to no node by default.")
+	_, err = m.Validator().Validate(tk.String(), conf.RoleController)
+	assert.NotNil(t, err, "Token should only be valid for its role.")
+
+	bound, r, err := m.Create(&token.CreateOptions{Role: conf.RoleWorker, NodeName: "node-b", Server: "https://10.0.0.1:9443",
+		CAHash: "sha256:00ff"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "node-b", r.NodeName)
+	node, err = m.Validator().Validate(bound.String(), conf.RoleWorker)
+	assert.Nil(t, err)
+	assert.Equal(t, "node-b", node, "Token should be bound to the node.")
+	_, _, err = m.Create(&token.CreateOptions{Role: conf.RoleWorker, NodeName: "../node"})
+	assert.NotNil(t, err, "Invalid node name should be rejected.")
+
+	forged := *tk
+	forged.Secret = "forged"
+	_, err = m.Validate(forged.String(), conf.RoleWorker)
+	assert.NotNil(t, err, "Token with a wrong secret should be invalid.")
+
+	now = now.Add(time.Hour)
+	_, err = m.Validate(tk.String(), conf.RoleWorker)
+	assert.NotNil(t, err, "Token should be invalid once expired.")
+
+	_, _, err = m.Create(&token.CreateOptions{Role: "admin"})
+	assert.NotNil(t, err, "Unknown role should be rejected.")
+	controller, _, err := m.Create(&token.CreateOptions{Role: conf.RoleController, Server: "https://10.0.0.1:9443",
+		CAHash: "sha256:00ff"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.Validate(controller.String(), conf.RoleController)
+	assert.Nil(t, err, "Controllers should join with tokens of their role.")
+	_, err = m.Validate(controller.String(), conf.RoleWorker)
+	assert.NotNil(t, err, "Token of controllers should not join workers.")
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := token.NewManager(token.NewFileStore(token.Dir(dir)))
+
+	records, err := m.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, records)
+
+	tk, _, err := m.Create(&token.CreateOptions{Role: conf.RoleWorker, Server: "https://10.0.0.1:9443", CAHash: "sha256:00ff"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = m.Create(&token.CreateOptions{Role: conf.RoleWorker, TTL: time.Hour, Server: "https://10.0.0.1:9443", CAHash: "sha256:00ff"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a new manager on the same directory sees the same tokens
+	m = token.NewManager(token.NewFileStore(token.Dir(dir)))
+	records, err = m.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(records))
+
+	r, err := m.Validate(tk.String(), conf.RoleWorker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, r.Expires.IsZero(), "Token without TTL should never expire.")
+
+	got, err := m.Get(tk.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, tk.ID, got.ID, "Token should be found by its opaque string.")
+
+	id, err := m.Revoke(tk.String())
+	assert.Nil(t, err)
+	assert.Equal(t, tk.ID, id)
+	_, err = m.Validate(tk.String(), conf.RoleWorker)
+	assert.NotNil(t, err, "Revoked token should be invalid.")
+	_, err = m.Revoke(tk.ID)
+	assert.Equal(t, token.ErrNotFound, err)
+	_, err = m.Revoke("../escape")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,93 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// WriteFileAtomic writes data to a temp file in the same directory
+// and renames it to path, so that a partially written file is never seen.
+// The parent directory must exist
+func WriteFileAtomic(path string, data []byte, mode os.FileMode) error {
+	return WriteFilesAtomic(File{Path: path, Data: data, Mode: mode})
+}
+
+// File is a file written by WriteFilesAtomic
+type File struct {
+	Path string
+	Data []byte
+	Mode os.FileMode
+}
+
+// WriteFilesAtomic writes all the files to temp files in their directories
+// before renaming any of them, so that a failure in writing leaves all of them unchanged,
+// and only renaming, which hardly fails, may leave some of them changed.
+// The parent directories must exist
+func WriteFilesAtomic(files ...File) error {
+	temps := make([]string, 0, len(files))
+	defer func() {
+		for _, t := range temps {
+			os.Remove(t)
+		}
+	}()
+
+	for _, file := range files {
+		t, err := writeTempFile(file)
+		if err != nil {
+			return err
+		}
+		temps = append(temps, t)
+	}
+	for i, file := range files {
+		if err := os.Rename(temps[i], file.Path); err != nil {
+			return errors.Wrapf(err, "failed to write %s", file.Path)
+		}
+	}
+	return nil
+}
+
+// writeTempFile writes the file to a temp file next to it and returns the temp file
+func writeTempFile(file File) (string, error) {
+	f, err := ioutil.TempFile(filepath.Dir(file.Path), "."+filepath.Base(file.Path))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create temp file for %s", file.Path)
+	}
+
+	if _, err := f.Write(file.Data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", errors.Wrapf(err, "failed to write %s", file.Path)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", errors.Wrapf(err, "failed to sync %s", file.Path)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", errors.Wrapf(err, "failed to write %s", file.Path)
+	}
+	if err := os.Chmod(f.Name(), file.Mode); err != nil {
+		os.Remove(f.Name())
+		return "", errors.Wrapf(err, "failed to change mode of %s", file.Path)
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,33 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package utils
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// OutboundIP returns the local IP address used to reach the target host:port,
+// no packets are sent as the UDP socket is only connected
+func OutboundIP(target string) (string, error) {
+	conn, err := net.Dial("udp", target)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to find outbound address to %s", target)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
@@ -17,6 +17,8 @@ package utils
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"time"
 )
 
@@ -24,11 +26,20 @@ const (
 	timeLayout string = "Mon Jan 2 15:04:05.0000 MST 2006"
 )
 
+// output is where Printf and Println print to, which is stdout by default
+var output io.Writer = os.Stdout
+
+// SetOutput changes where Printf and Println print to,
+// e.g. stderr for commands whose output on stdout is parsed
+func SetOutput(w io.Writer) {
+	output = w
+}
+
 // Printf is a wapper that prints msg with a prefix
 // which should be used in case log system isn't initiated completely
 func Printf(format string, a ...interface{}) (int, error) {
 	msg := fmt.Sprintf("%s * * * * * * %s\n", time.Now().Local().Format(timeLayout), format)
-	return fmt.Printf(msg, a...)
+	return fmt.Fprintf(output, msg, a...)
 }
 
 // Println is a wapper that prints msg with a prefix
@@ -37,5 +48,5 @@ func Println(a ...interface{}) (int, error) {
 	msg := fmt.Sprintf("%s * * * * * *", time.Now().Local().Format(timeLayout))
 	as := []interface{}{msg}
 	as = append(as, a...)
-	return fmt.Println(as...)
+	return fmt.Fprintln(output, as...)
 }
@@ -0,0 +1,171 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package worker
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	"github.com/jiuchen1986/cks/pkg/kubeconfig"
+	"github.com/jiuchen1986/cks/pkg/loadbalancer"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/utils"
+)
+
+// LoadBalancerAddress is where the apiserver load balancer of workers listens,
+// which kubelet talks to instead of a single apiserver
+var LoadBalancerAddress = net.JoinHostPort("127.0.0.1", strconv.Itoa(loadbalancer.DefaultPort))
+
+// endpointsInterval is how often the apiservers of the load balancer are refreshed
+const endpointsInterval time.Duration = 30 * time.Second
+
+// apiServers is the apiservers of the load balancer kept across restarts
+type apiServers struct {
+	Servers []string `yaml:"servers"`
+}
+
+// prepareLoadBalancer writes the kubeconfig kubelet talks to the load balancer with,
+// which is the kubelet kubeconfig pointed to the load balancer, and adds the apiserver
+// the kubelet kubeconfig points to to the apiservers of the load balancer.
+// The kubelet kubeconfig is left as is, as the controller on the same node keeps it as well.
+// Nothing is done before joining
+func (w *Worker) prepareLoadBalancer() error {
+	logger := lgr.GetGlobalStructuredLogger()
+
+	if _, err := os.Stat(w.kubeconfigPath()); os.IsNotExist(err) {
+		return nil
+	}
+	kc, err := kubeconfig.Load(w.kubeconfigPath())
+	if err != nil {
+		return err
+	}
+
+	// kubelet kubeconfigs pointed to the load balancer in place tell no apiserver
+	if kc.Server() != loadBalancerURL() {
+		u, err := url.Parse(kc.Server())
+		if err != nil || u.Hostname() == "" {
+			return errors.Errorf("invalid server %s in kubeconfig %s", kc.Server(), w.kubeconfigPath())
+		}
+		server := u.Host
+		if u.Port() == "" {
+			server = net.JoinHostPort(u.Hostname(), "443")
+		}
+		servers, err := w.loadAPIServers()
+		if err != nil {
+			return err
+		}
+		if err := w.saveAPIServers(append([]string{server}, servers...)); err != nil {
+			return err
+		}
+	}
+
+	kc.Clusters[0].Cluster.Server = loadBalancerURL()
+	if err := kc.Write(w.loadBalancerKubeconfigPath()); err != nil {
+		return err
+	}
+	logger.Info("kubelet kubeconfig of the apiserver load balancer written",
+		map[string]string{"path": w.loadBalancerKubeconfigPath()})
+	return nil
+}
+
+// StartLoadBalancer starts the apiserver load balancer in background until ctx is done,
+// which refreshes the apiservers from the kubernetes endpoints.
+// It should be started after Prepare and before Start
+func (w *Worker) StartLoadBalancer(ctx context.Context) error {
+	logger := lgr.GetGlobalLogger()
+
+	servers, err := w.loadAPIServers()
+	if err != nil {
+		return err
+	}
+	if len(servers) == 0 {
+		return errors.Errorf("no apiserver found in %s, join the cluster first", w.apiServersPath())
+	}
+	kc, err := kubeconfig.Load(w.loadBalancerKubeconfigPath())
+	if err != nil {
+		return err
+	}
+	fetch, err := loadbalancer.KubernetesEndpoints(kc, kc.Server())
+	if err != nil {
+		return err
+	}
+
+	lb := loadbalancer.New(LoadBalancerAddress, servers)
+	if err := lb.Start(ctx); err != nil {
+		return err
+	}
+	go lb.WatchEndpoints(ctx, fetch, endpointsInterval, func(servers []string) {
+		if err := w.saveAPIServers(servers); err != nil {
+			logger.Errorf("failed to save apiservers of the load balancer: %v", err)
+		}
+	})
+	return nil
+}
+
+func (w *Worker) loadAPIServers() ([]string, error) {
+	data, err := ioutil.ReadFile(w.apiServersPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, errors.Wrapf(err, "failed to read apiservers %s", w.apiServersPath())
+	}
+	s := &apiServers{}
+	if err := yaml.Unmarshal(data, s); err != nil {
+		return nil, errors.Wrapf(err, "invalid apiservers %s", w.apiServersPath())
+	}
+	return s.Servers, nil
+}
+
+// saveAPIServers saves the apiservers in order, where only the first of duplicates is kept
+func (w *Worker) saveAPIServers(servers []string) error {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, s := range servers {
+		if !seen[s] {
+			seen[s] = true
+			unique = append(unique, s)
+		}
+	}
+	out, err := yaml.Marshal(&apiServers{Servers: unique})
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal apiservers")
+	}
+	return utils.WriteFileAtomic(w.apiServersPath(), out, 0644)
+}
+
+// loadBalancerKubeconfigPath is kept apart from the kubelet kubeconfig,
+// which is also written by the controller on the same node
+func (w *Worker) loadBalancerKubeconfigPath() string {
+	return filepath.Join(w.configDir(), "kubelet-lb.conf")
+}
+
+func (w *Worker) apiServersPath() string {
+	return filepath.Join(w.configDir(), "apiservers.yaml")
+}
+
+func loadBalancerURL() string {
+	return "https://" + LoadBalancerAddress
+}
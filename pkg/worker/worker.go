@@ -0,0 +1,428 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package worker
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	"github.com/jiuchen1986/cks/pkg/assets"
+	"github.com/jiuchen1986/cks/pkg/components"
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/containerd"
+	"github.com/jiuchen1986/cks/pkg/join"
+	"github.com/jiuchen1986/cks/pkg/kubeconfig"
+	lgr "github.com/jiuchen1986/cks/pkg/logger"
+	"github.com/jiuchen1986/cks/pkg/pki"
+	"github.com/jiuchen1986/cks/pkg/plan"
+	"github.com/jiuchen1986/cks/pkg/supervisor"
+	"github.com/jiuchen1986/cks/pkg/utils"
+)
+
+// names of the worker components, which are also their binary names
+const (
+	ContainerdName string = "containerd"
+	KubeletName    string = components.KubeletName
+)
+
+// kubeletConfig is the subset of KubeletConfiguration cks sets
+type kubeletConfig struct {
+	APIVersion     string                `yaml:"apiVersion"`
+	Kind           string                `yaml:"kind"`
+	Authentication kubeletAuthentication `yaml:"authentication"`
+	Authorization  kubeletAuthorization  `yaml:"authorization"`
+	ClusterDNS     []string              `yaml:"clusterDNS"`
+	ClusterDomain  string                `yaml:"clusterDomain"`
+	CgroupDriver   string                `yaml:"cgroupDriver"`
+}
+
+type kubeletAuthentication struct {
+	Anonymous struct {
+		Enabled bool `yaml:"enabled"`
+	} `yaml:"anonymous"`
+	Webhook struct {
+		Enabled bool `yaml:"enabled"`
+	} `yaml:"webhook"`
+	X509 struct {
+		ClientCAFile string `yaml:"clientCAFile"`
+	} `yaml:"x509"`
+}
+
+type kubeletAuthorization struct {
+	Mode string `yaml:"mode"`
+}
+
+// KubeletRootDir returns the kubelet root directory in the data directory,
+// where volumes of pods are mounted
+func KubeletRootDir(dataDir string) string {
+	return filepath.Join(dataDir, "kubelet")
+}
+
+// CNIConfDir returns the directory of CNI configs in the data directory
+func CNIConfDir(dataDir string) string {
+	return filepath.Join(dataDir, "etc", "cni", "net.d")
+}
+
+// CNIBinDir returns the directory of CNI plugins in the data directory, which is
+// the current bin directory so that plugins installed by addons survive upgrades
+func CNIBinDir(dataDir string) string {
+	return assets.CurrentDir(assets.Dir(dataDir))
+}
+
+// cgroup drivers of containerd and kubelet
+const (
+	cgroupDriverCgroupfs string = "cgroupfs"
+	cgroupDriverSystemd  string = "systemd"
+)
+
+// cgroupDriver returns the cgroup driver of containerd and kubelet on this host,
+// which is systemd on cgroup v2, otherwise cgroupfs
+func cgroupDriver() (string, error) {
+	systemd, err := containerd.SystemdCgroup(os.DirFS("/"))
+	if err != nil {
+		return "", err
+	}
+	if systemd {
+		return cgroupDriverSystemd, nil
+	}
+	return cgroupDriverCgroupfs, nil
+}
+
+// Worker runs kubelet and the container runtime on a node
+type Worker struct {
+	cfg      *conf.ClusterConfig
+	dataDir  string
+	nodeName string
+	address  string
+	binDir   string
+	sup      *supervisor.Supervisor
+}
+
+// New returns a worker running on the node with the address,
+// where binaries are looked up in binDir first and then PATH.
+// The node is not required in the cluster config, which is only
+// read for the data directory, versions and component flags
+func New(cfg *conf.ClusterConfig, nodeName, address, binDir string) *Worker {
+	return &Worker{
+		cfg:      cfg,
+		dataDir:  cfg.DataDir,
+		nodeName: nodeName,
+		address:  address,
+		binDir:   binDir,
+		sup:      supervisor.New(),
+	}
+}
+
+// IsJoined tells whether the node has the bootstrap material already
+func (w *Worker) IsJoined() bool {
+	for _, p := range []string{w.caPath(), w.kubeconfigPath(), w.kubeletConfigPath()} {
+		if _, err := os.Stat(p); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Join fetches the cluster CA and bootstrap material through the client,
+// then writes the CA, kubelet kubeconfig and kubelet config
+func (w *Worker) Join(c *join.Client) error {
+	logger := lgr.GetGlobalStructuredLogger()
+	defer logger.Sync()
+
+	logger.Info("fetch cluster CA", map[string]string{"server": c.Server})
+	ca, err := c.FetchCA()
+	if err != nil {
+		return err
+	}
+	logger.Info("cluster CA verified", map[string]string{"hash": pki.CAHash(ca)})
+
+	logger.Info("request kubelet bootstrap material", map[string]string{"node": w.nodeName, "address": w.address})
+	kb, err := c.Kubelet(ca, &join.KubeletRequest{NodeName: w.nodeName, Address: w.address})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(pki.Dir(w.dataDir), 0700); err != nil {
+		return errors.Wrap(err, "failed to create PKI directory")
+	}
+	if err := utils.WriteFileAtomic(w.caPath(), pki.EncodeCertPEM(ca), 0644); err != nil {
+		return err
+	}
+	logger.Info("cluster CA written", map[string]string{"path": w.caPath()})
+
+	if err := os.MkdirAll(kubeconfig.Dir(w.dataDir), 0700); err != nil {
+		return errors.Wrap(err, "failed to create kubeconfig directory")
+	}
+	if err := utils.WriteFileAtomic(w.kubeconfigPath(), []byte(kb.Kubeconfig), 0600); err != nil {
+		return err
+	}
+	logger.Info("kubelet kubeconfig written", map[string]string{"path": w.kubeconfigPath()})
+
+	driver, err := cgroupDriver()
+	if err != nil {
+		return err
+	}
+	kc := &kubeletConfig{
+		APIVersion:    "kubelet.config.k8s.io/v1beta1",
+		Kind:          "KubeletConfiguration",
+		Authorization: kubeletAuthorization{Mode: "Webhook"},
+		ClusterDNS:    []string{kb.ClusterDNS},
+		ClusterDomain: kb.ClusterDomain,
+		CgroupDriver:  driver,
+	}
+	kc.Authentication.Webhook.Enabled = true
+	kc.Authentication.X509.ClientCAFile = w.caPath()
+	return w.writeKubeletConfig(kc)
+}
+
+// Prepare writes the containerd config, creates directories of components
+// and points kubelet to the apiserver load balancer
+func (w *Worker) Prepare() error {
+	logger := lgr.GetGlobalStructuredLogger()
+	defer logger.Sync()
+
+	for _, d := range []string{w.containerdRoot(), w.containerdState(), w.cniConfDir(), w.kubeletRoot(),
+		filepath.Dir(w.containerdConfigPath())} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return errors.Wrapf(err, "failed to create directory %s", d)
+		}
+	}
+
+	driver, err := cgroupDriver()
+	if err != nil {
+		return err
+	}
+	cfg, err := containerd.Config(w.cfg, &containerd.Options{
+		Root:          w.containerdRoot(),
+		State:         w.containerdState(),
+		Socket:        w.containerdSocket(),
+		CNIBinDir:     CNIBinDir(w.dataDir),
+		CNIConfDir:    w.cniConfDir(),
+		SystemdCgroup: driver == cgroupDriverSystemd,
+	})
+	if err != nil {
+		return err
+	}
+	// registry credentials may be in the config
+	if err := utils.WriteFileAtomic(w.containerdConfigPath(), cfg, 0600); err != nil {
+		return err
+	}
+	logger.Info("containerd config written", map[string]string{"path": w.containerdConfigPath(), "cgroupDriver": driver})
+
+	if err := w.syncKubeletCgroupDriver(driver); err != nil {
+		return err
+	}
+	return w.prepareLoadBalancer()
+}
+
+// Processes returns the worker processes to run
+func (w *Worker) Processes() ([]supervisor.Process, error) {
+	procs, err := w.processes()
+	if err != nil {
+		return nil, err
+	}
+	for i := range procs {
+		path, err := supervisor.LookupBinary(w.binDir, procs[i].Name)
+		if err != nil {
+			return nil, err
+		}
+		procs[i].Path = path
+	}
+	return procs, nil
+}
+
+// Plan adds what Join, Prepare and Start would do to the plan without changing anything,
+// where the node joins through the join server if it hasn't joined yet
+func (w *Worker) Plan(pl *plan.Plan, server string) error {
+	if !w.IsJoined() {
+		pl.Add(plan.Request, server, fmt.Sprintf("join as node %s with address %s", w.nodeName, w.address))
+		pl.Add(plan.WriteFile, w.caPath(), "cluster CA")
+		pl.Add(plan.WriteFile, w.kubeconfigPath(), "kubelet kubeconfig")
+		pl.Add(plan.WriteFile, w.kubeletConfigPath(), "kubelet config")
+	}
+	pl.Add(plan.WriteFile, w.containerdConfigPath(), "containerd config")
+	if kc, err := kubeconfig.Load(w.kubeconfigPath()); err != nil || kc.Server() != loadBalancerURL() {
+		pl.Add(plan.WriteFile, w.apiServersPath(), "apiservers of the load balancer on "+LoadBalancerAddress)
+	}
+	pl.Add(plan.WriteFile, w.loadBalancerKubeconfigPath(), "kubelet kubeconfig pointing to the load balancer")
+	procs, err := w.processes()
+	if err != nil {
+		return err
+	}
+	for _, p := range procs {
+		pl.Add(plan.StartProcess, p.Name, strings.Join(p.Args, " "))
+	}
+	return nil
+}
+
+// processes returns the worker processes whose paths are not looked up yet
+func (w *Worker) processes() ([]supervisor.Process, error) {
+	kubeletArgs, err := components.Kubelet(w.cfg, &components.KubeletOptions{
+		NodeName:        w.nodeName,
+		Address:         w.address,
+		ConfigPath:      w.kubeletConfigPath(),
+		KubeconfigPath:  w.loadBalancerKubeconfigPath(),
+		RuntimeEndpoint: "unix://" + w.containerdSocket(),
+		RootDir:         w.kubeletRoot(),
+		CertDir:         filepath.Join(w.kubeletRoot(), "pki"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return []supervisor.Process{
+		{
+			Name: ContainerdName,
+			Args: supervisor.Args{"config": w.containerdConfigPath()}.Render(),
+			Ready: func() error {
+				_, err := os.Stat(w.containerdSocket())
+				return err
+			},
+		},
+		{
+			Name:      KubeletName,
+			Args:      kubeletArgs,
+			DependsOn: []string{ContainerdName},
+		},
+	}, nil
+}
+
+// Start starts containerd and kubelet and waits for them ready,
+// which is given up with them stopped once ctx is done
+func (w *Worker) Start(ctx context.Context) error {
+	logger := lgr.GetGlobalStructuredLogger()
+	defer logger.Sync()
+
+	procs, err := w.Processes()
+	if err != nil {
+		return err
+	}
+	for _, p := range procs {
+		if err := w.sup.Add(p); err != nil {
+			return err
+		}
+	}
+
+	// waiting for readiness takes up to the ready timeout of containerd
+	started := make(chan struct{})
+	defer close(started)
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.sup.Stop()
+		case <-started:
+		}
+	}()
+
+	logger.Info("start worker components", map[string]string{"node": w.nodeName})
+	if err := w.sup.Start(); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return errors.Wrap(ctx.Err(), "worker stopped while starting")
+	}
+	return nil
+}
+
+// Stop stops containerd and kubelet gracefully
+func (w *Worker) Stop() {
+	w.sup.Stop()
+}
+
+// syncKubeletCgroupDriver updates the cgroup driver in the kubelet config
+// to the one of containerd, nothing is done before joining
+func (w *Worker) syncKubeletCgroupDriver(driver string) error {
+	data, err := ioutil.ReadFile(w.kubeletConfigPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "failed to read kubelet config")
+	}
+	kc := &kubeletConfig{}
+	if err := yaml.Unmarshal(data, kc); err != nil {
+		return errors.Wrapf(err, "invalid kubelet config %s", w.kubeletConfigPath())
+	}
+	if kc.CgroupDriver == driver {
+		return nil
+	}
+	kc.CgroupDriver = driver
+	return w.writeKubeletConfig(kc)
+}
+
+func (w *Worker) writeKubeletConfig(kc *kubeletConfig) error {
+	logger := lgr.GetGlobalStructuredLogger()
+
+	out, err := yaml.Marshal(kc)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal kubelet config")
+	}
+	if err := os.MkdirAll(filepath.Dir(w.kubeletConfigPath()), 0755); err != nil {
+		return errors.Wrap(err, "failed to create config directory")
+	}
+	if err := utils.WriteFileAtomic(w.kubeletConfigPath(), out, 0644); err != nil {
+		return err
+	}
+	logger.Info("kubelet config written", map[string]string{"path": w.kubeletConfigPath()})
+	return nil
+}
+
+func (w *Worker) caPath() string {
+	return pki.CertPath(pki.Dir(w.dataDir), pki.CAName)
+}
+
+func (w *Worker) kubeconfigPath() string {
+	return kubeconfig.Path(w.dataDir, kubeconfig.KubeletName)
+}
+
+func (w *Worker) configDir() string {
+	return filepath.Join(w.dataDir, "etc")
+}
+
+func (w *Worker) kubeletConfigPath() string {
+	return filepath.Join(w.configDir(), "kubelet.yaml")
+}
+
+func (w *Worker) kubeletRoot() string {
+	return KubeletRootDir(w.dataDir)
+}
+
+func (w *Worker) containerdConfigPath() string {
+	return filepath.Join(w.configDir(), "containerd", "config.toml")
+}
+
+func (w *Worker) containerdRoot() string {
+	return filepath.Join(w.dataDir, "containerd")
+}
+
+func (w *Worker) containerdState() string {
+	return filepath.Join(w.dataDir, "run", "containerd")
+}
+
+func (w *Worker) containerdSocket() string {
+	return filepath.Join(w.containerdState(), "containerd.sock")
+}
+
+func (w *Worker) cniConfDir() string {
+	return CNIConfDir(w.dataDir)
+}
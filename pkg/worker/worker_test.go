@@ -0,0 +1,169 @@
+/*
+Copyright © 2020 Xin Chen <devops.chen@gmail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package worker_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	conf "github.com/jiuchen1986/cks/pkg/config"
+	"github.com/jiuchen1986/cks/pkg/join"
+	"github.com/jiuchen1986/cks/pkg/kubeconfig"
+	"github.com/jiuchen1986/cks/pkg/pki"
+	"github.com/jiuchen1986/cks/pkg/plan"
+	"github.com/jiuchen1986/cks/pkg/worker"
+)
+
+func TestJoin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, err := pki.NewCA("test-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serving, err := ca.Issue(&pki.CertConfig{
+		CommonName: "join",
+		IPs:        []net.IP{net.ParseIP("127.0.0.1")},
+		Usages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(join.NewServer(conf.NewDefault(), ca, join.StaticToken("secret"),
+		join.NewRegistry(join.RegistryPath(filepath.Join(dir, "controller")))))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{serving.TLSCertificate()}}
+	ts.StartTLS()
+	defer ts.Close()
+
+	cfg := &conf.ClusterConfig{DataDir: dir}
+	conf.SetDefaults(cfg)
+	w := worker.New(cfg, "node-b", "192.168.0.11", filepath.Join(dir, "bin"))
+	assert.False(t, w.IsJoined())
+
+	pl := plan.New("worker", "node-b")
+	if err := w.Plan(pl, ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{ts.URL}, pl.Targets(plan.Request), "Worker should plan to join.")
+	assert.Equal(t, []string{worker.ContainerdName, worker.KubeletName}, pl.Targets(plan.StartProcess))
+	_, err = os.Stat(filepath.Join(dir, "etc"))
+	assert.True(t, os.IsNotExist(err), "Plan should not write anything.")
+
+	if err := w.Join(&join.Client{Server: ts.URL, Token: "secret", CAHash: pki.CAHash(ca.Cert)}); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, w.IsJoined())
+
+	pl = plan.New("worker", "node-b")
+	if err := w.Plan(pl, ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, pl.Targets(plan.Request), "Joined worker should not join again.")
+
+	kc, err := ioutil.ReadFile(filepath.Join(dir, "etc", "kubelet.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(kc), "clusterDomain: cluster.local")
+	assert.Contains(t, string(kc), "clientCAFile: "+filepath.Join(dir, "pki", "ca.crt"))
+
+	// prepared on every start
+	for i := 0; i < 2; i++ {
+		if err := w.Prepare(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kubelet, err := kubeconfig.Load(filepath.Join(dir, "etc", "kubelet-lb.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "https://"+worker.LoadBalancerAddress, kubelet.Server(), "Kubelet should talk to "+
+		"the apiserver load balancer.")
+	joined, err := kubeconfig.Load(kubeconfig.Path(dir, kubeconfig.KubeletName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "https://127.0.0.1:6443", joined.Server(), "The kubelet kubeconfig should be left as is, "+
+		"which a controller on the same node keeps as well.")
+	servers, err := ioutil.ReadFile(filepath.Join(dir, "etc", "apiservers.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "servers:\n- 127.0.0.1:6443\n", string(servers), "The apiserver joined should be "+
+		"saved for the load balancer once.")
+}
+
+func TestProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cks-worker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	binDir := filepath.Join(dir, "bin")
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{worker.ContainerdName, worker.KubeletName} {
+		if err := ioutil.WriteFile(filepath.Join(binDir, name), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := &conf.ClusterConfig{DataDir: dir}
+	conf.SetDefaults(cfg)
+	cfg.Components.Kubelet.ExtraArgs = map[string]string{"v": "2"}
+	w := worker.New(cfg, "node-b", "192.168.0.11", binDir)
+	if err := w.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	containerdConfig, err := ioutil.ReadFile(filepath.Join(dir, "etc", "containerd", "config.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(containerdConfig), fmt.Sprintf("bin_dir = %q", worker.CNIBinDir(dir)))
+	assert.Contains(t, string(containerdConfig), fmt.Sprintf("conf_dir = %q", worker.CNIConfDir(dir)),
+		"Containerd should look up CNI where the CNI addon installs.")
+
+	procs, err := w.Processes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, worker.ContainerdName, procs[0].Name)
+	assert.Equal(t, worker.KubeletName, procs[1].Name)
+	assert.Equal(t, []string{worker.ContainerdName}, procs[1].DependsOn)
+	assert.Equal(t, filepath.Join(binDir, worker.KubeletName), procs[1].Path)
+
+	args := strings.Join(procs[1].Args, " ")
+	assert.Contains(t, args, "--node-ip=192.168.0.11")
+	assert.Contains(t, args, "--hostname-override=node-b")
+	assert.Contains(t, args, "--kubeconfig="+filepath.Join(dir, "etc", "kubelet-lb.conf"))
+	assert.Contains(t, args, "--v=2")
+}